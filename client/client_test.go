@@ -543,6 +543,24 @@ func TestSignShellJWT(t *testing.T) {
 	})
 }
 
+func TestSignSignatureJWT(t *testing.T) {
+	tokenString, err := SignSignatureJWT("\n"+secret+"\n", 5*time.Minute, 1, 2, "sign-in@example.com", "abc123")
+	require.NoError(t, err)
+
+	claims := &SignatureClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(_ *jwt.Token) (interface{}, error) {
+		return []byte(secret), nil
+	})
+	require.NoError(t, err)
+	require.True(t, token.Valid)
+	require.Equal(t, "gitlab-shell", claims.Issuer)
+	require.Equal(t, int64(1), claims.UserID)
+	require.Equal(t, int64(2), claims.KeyID)
+	require.Equal(t, "sign-in@example.com", claims.Namespace)
+	require.Equal(t, "abc123", claims.Challenge)
+	require.WithinDuration(t, time.Now().Truncate(time.Second).Add(5*time.Minute), claims.ExpiresAt.Time, time.Second)
+}
+
 func TestRetryOnFailure(t *testing.T) {
 	reqAttempts := 0
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
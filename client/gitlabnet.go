@@ -273,6 +273,37 @@ func SignShellJWT(secret, glID string) (string, error) {
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretBytes)
 }
 
+// SignatureClaims extends RegisteredClaims with the fields stating that a
+// GitLab user proved possession of one of their SSH keys by signing a
+// challenge in a namespace.
+type SignatureClaims struct {
+	jwt.RegisteredClaims
+	UserID    int64  `json:"user_id"`
+	KeyID     int64  `json:"key_id"`
+	Namespace string `json:"namespace"`
+	Challenge string `json:"challenge"`
+}
+
+// SignSignatureJWT creates a JWT token with the given signature claims,
+// signed with the given secret and valid for ttl. It's issued to users once
+// a signature made with their SSH key is verified, for other services to trust.
+func SignSignatureJWT(secret string, ttl time.Duration, userID, keyID int64, namespace, challenge string) (string, error) {
+	now := time.Now()
+	claims := SignatureClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+		UserID:    userID,
+		KeyID:     keyID,
+		Namespace: namespace,
+		Challenge: challenge,
+	}
+	secretBytes := []byte(strings.TrimSpace(secret))
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secretBytes)
+}
+
 // WithHost returns a shallow copy of the client that sends requests to the
 // specified host instead of the default one. The returned client shares the
 // same HTTP transport, TLS settings, and authentication credentials.
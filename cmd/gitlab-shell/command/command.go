@@ -13,10 +13,13 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/receivepack"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/sshkeys"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/twofactorrecover"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/twofactorverify"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/uploadarchive"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/uploadpack"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/verifysignature"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
@@ -100,6 +103,15 @@ func Parse(arguments []string, env sshenv.Env) (*commandargs.Shell, error) {
 
 // Build constructs a command based on the provided arguments, config, and readWriter
 func Build(args *commandargs.Shell, config *config.Config, readWriter *readwriter.ReadWriter) command.Command {
+	cmd := build(args, config, readWriter)
+	if cmd != nil && args.JSONOutput {
+		return &jsonoutput.Command{Command: cmd, ReadWriter: readWriter}
+	}
+
+	return cmd
+}
+
+func build(args *commandargs.Shell, config *config.Config, readWriter *readwriter.ReadWriter) command.Command {
 	switch args.CommandType {
 	case commandargs.Discover:
 		return &discover.Command{Config: config, Args: args, ReadWriter: readWriter}
@@ -125,6 +137,12 @@ func Build(args *commandargs.Shell, config *config.Config, readWriter *readwrite
 		if config.PATConfig.Enabled {
 			return &personalaccesstoken.Command{Config: config, Args: args, ReadWriter: readWriter}
 		}
+	case commandargs.SSHKeys:
+		return &sshkeys.Command{Config: config, Args: args, ReadWriter: readWriter}
+	case commandargs.VerifySignature:
+		if config.SignatureVerification.Enabled {
+			return &verifysignature.Command{Config: config, Args: args, ReadWriter: readWriter}
+		}
 	}
 
 	return nil
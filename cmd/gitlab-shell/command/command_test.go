@@ -13,10 +13,13 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/personalaccesstoken"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/receivepack"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/sshkeys"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/twofactorrecover"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/twofactorverify"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/uploadarchive"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/uploadpack"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/verifysignature"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/executable"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
@@ -105,6 +108,13 @@ func TestNew(t *testing.T) {
 			config:       basicConfig,
 			expectedType: &personalaccesstoken.Command{},
 		},
+		{
+			desc:         "it returns an SSHKeys command",
+			executable:   gitlabShellExec,
+			env:          buildEnv("ssh_keys"),
+			config:       basicConfig,
+			expectedType: &sshkeys.Command{},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -217,6 +227,32 @@ func TestPATCommands(t *testing.T) {
 	}
 }
 
+func TestVerifySignatureCommands(t *testing.T) {
+	enabledConfig := &config.Config{
+		GitlabURL:             testGitlabURL,
+		SignatureVerification: config.SignatureVerificationConfig{Enabled: true},
+	}
+
+	command, err := cmd.New([]string{}, buildEnv("verify_signature"), enabledConfig, nil)
+	require.NoError(t, err)
+	require.IsType(t, &verifysignature.Command{}, command)
+
+	command, err = cmd.New([]string{}, buildEnv("verify_signature"), basicConfig, nil)
+	require.EqualError(t, err, "Disallowed command")
+	require.Nil(t, command)
+}
+
+func TestJSONOutputCommands(t *testing.T) {
+	command, err := cmd.New([]string{}, buildEnv("discover --format=json"), basicConfig, nil)
+	require.NoError(t, err)
+	require.IsType(t, &jsonoutput.Command{}, command)
+	require.IsType(t, &discover.Command{}, command.(*jsonoutput.Command).Command)
+
+	command, err = cmd.New([]string{}, buildEnv("discover"), basicConfig, nil)
+	require.NoError(t, err)
+	require.IsType(t, &discover.Command{}, command)
+}
+
 func TestFailingNew(t *testing.T) {
 	testCases := []struct {
 		desc          string
@@ -374,6 +410,41 @@ func TestParseSuccess(t *testing.T) {
 			arguments:    []string{},
 			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{"git-lfs-transfer", testRepo, "download"}, CommandType: commandargs.LfsTransfer, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: "git-lfs-transfer '" + testRepo + "' download"}},
 		},
+		{
+			desc:         "It parses the JSON output format of discover",
+			executable:   &executable.Executable{Name: executable.GitlabShell},
+			env:          sshenv.Env{IsSSHConnection: true, OriginalCommand: "--format=json"},
+			arguments:    []string{},
+			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{}, CommandType: commandargs.Discover, JSONOutput: true, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: "--format=json"}},
+		},
+		{
+			desc:         "It parses the JSON output format anywhere in the arguments",
+			executable:   &executable.Executable{Name: executable.GitlabShell},
+			env:          sshenv.Env{IsSSHConnection: true, OriginalCommand: "personal_access_token --format=json token api"},
+			arguments:    []string{},
+			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{"personal_access_token", "token", "api"}, CommandType: commandargs.PersonalAccessToken, JSONOutput: true, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: "personal_access_token --format=json token api"}},
+		},
+		{
+			desc:         "It parses the output format from the environment",
+			executable:   &executable.Executable{Name: executable.GitlabShell},
+			env:          sshenv.Env{IsSSHConnection: true, OriginalCommand: testTwoFARecoveryCodes, OutputFormat: "json"},
+			arguments:    []string{},
+			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{testTwoFARecoveryCodes}, CommandType: commandargs.TwoFactorRecover, JSONOutput: true, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: testTwoFARecoveryCodes, OutputFormat: "json"}},
+		},
+		{
+			desc:         "It lets the output format argument override the environment",
+			executable:   &executable.Executable{Name: executable.GitlabShell},
+			env:          sshenv.Env{IsSSHConnection: true, OriginalCommand: "ssh_keys --format=text", OutputFormat: "json"},
+			arguments:    []string{},
+			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{"ssh_keys"}, CommandType: commandargs.SSHKeys, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: "ssh_keys --format=text", OutputFormat: "json"}},
+		},
+		{
+			desc:         "It ignores the output format of Git commands",
+			executable:   &executable.Executable{Name: executable.GitlabShell},
+			env:          sshenv.Env{IsSSHConnection: true, OriginalCommand: testReceivePack + " --format=json", OutputFormat: "xml"},
+			arguments:    []string{},
+			expectedArgs: &commandargs.Shell{Arguments: []string{}, SSHArgs: []string{testReceivePack, "--format=json"}, CommandType: commandargs.ReceivePack, Env: sshenv.Env{IsSSHConnection: true, OriginalCommand: testReceivePack + " --format=json", OutputFormat: "xml"}},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -411,6 +482,34 @@ func TestParseFailure(t *testing.T) {
 			arguments:     []string{},
 			expectedError: "Invalid SSH command: invalid command line string",
 		},
+		{
+			desc:          "It fails if the output format is unsupported",
+			executable:    &executable.Executable{Name: executable.GitlabShell},
+			env:           sshenv.Env{IsSSHConnection: true, OriginalCommand: "discover --format=xml"},
+			arguments:     []string{},
+			expectedError: `Invalid SSH command: unsupported output format "xml"`,
+		},
+		{
+			desc:       "It fails if the command isn't allowed",
+			executable: &executable.Executable{Name: executable.GitlabShell},
+			env: sshenv.Env{
+				IsSSHConnection: true,
+				OriginalCommand: "git-receive-pack group/repo",
+				AllowedCommands: []string{"git-upload-pack"},
+			},
+			arguments:     []string{},
+			expectedError: "Command not allowed by the SSH certificate",
+		},
+		{
+			desc:       "It fails if discover isn't allowed",
+			executable: &executable.Executable{Name: executable.GitlabShell},
+			env: sshenv.Env{
+				IsSSHConnection: true,
+				AllowedCommands: []string{"git-upload-pack"},
+			},
+			arguments:     []string{},
+			expectedError: "Command not allowed by the SSH certificate",
+		},
 	}
 
 	for _, tc := range testCases {
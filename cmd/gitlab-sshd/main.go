@@ -7,6 +7,7 @@ import (
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
@@ -94,7 +95,16 @@ func main() {
 
 	// Startup monitoring endpoint.
 	if cfg.Server.WebListen != "" {
-		startupMonitoringEndpoint(ctx, cfg, server)
+		webListener, err := server.MonitoringListener(ctx)
+		if err != nil {
+			v2log.FromContext(ctx).ErrorContext(ctx, "Failed to start monitoring endpoint", v2log.ErrorMessage(err.Error()))
+			if logCloser != nil {
+				logCloser.Close() //nolint:errcheck
+			}
+			os.Exit(1)
+		}
+
+		startupMonitoringEndpoint(ctx, webListener, server)
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
@@ -105,6 +115,21 @@ func main() {
 
 	gracefulShutdown(ctx, done, cfg, server, cancel)
 
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	reloadKeysOnSignal(ctx, reload, server)
+
+	flushCache := make(chan os.Signal, 1)
+	signal.Notify(flushCache, syscall.SIGUSR1)
+
+	flushAuthorizedKeysCacheOnSignal(ctx, flushCache, server)
+
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+
+	upgradeOnSignal(ctx, upgrade, done, server)
+
 	if err := server.ListenAndServe(ctx); err != nil {
 		v2log.FromContext(ctx).ErrorContext(ctx, "GitLab built-in sshd failed to listen for new connections",
 			v2log.ErrorMessage(err.Error()))
@@ -131,18 +156,86 @@ func gracefulShutdown(
 		}
 		<-time.After(gracePeriod)
 
+		server.Disconnect(ctx)
 		cancel()
 	}()
 }
 
-func startupMonitoringEndpoint(ctx context.Context, cfg *config.Config, server *sshd.Server) {
+// reloadKeysOnSignal reloads the host keys, host certificates and trusted user
+// CA keys every time a signal is received. Failures are logged by ReloadKeys and
+// leave the current keys in place.
+func reloadKeysOnSignal(ctx context.Context, reload chan os.Signal, server *sshd.Server) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-reload:
+				v2log.FromContext(ctx).InfoContext(ctx, "Reloading keys", slog.String("signal", sig.String()))
+
+				_ = server.ReloadKeys(ctx)
+			}
+		}
+	}()
+}
+
+// flushAuthorizedKeysCacheOnSignal empties the authorized keys cache every time
+// a signal is received.
+func flushAuthorizedKeysCacheOnSignal(ctx context.Context, flush chan os.Signal, server *sshd.Server) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-flush:
+				v2log.FromContext(ctx).InfoContext(ctx, "Flushing authorized keys cache", slog.String("signal", sig.String()))
+
+				server.FlushAuthorizedKeysCache(ctx)
+			}
+		}
+	}()
+}
+
+// upgradeOnSignal hands the listening socket over to a new gitlab-sshd process
+// when a signal is received, for example after the binary has been replaced.
+// Once the new process is ready, this one shuts down gracefully as it would on
+// SIGTERM. If the new process fails to start, this one keeps serving.
+func upgradeOnSignal(ctx context.Context, upgrade chan os.Signal, done chan os.Signal, server *sshd.Server) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-upgrade:
+				v2log.FromContext(ctx).InfoContext(ctx, "Upgrading to a new process", slog.String("signal", sig.String()))
+
+				if err := server.Upgrade(ctx); err != nil {
+					v2log.FromContext(ctx).ErrorContext(ctx, "Failed to upgrade", v2log.ErrorMessage(err.Error()))
+					continue
+				}
+
+				signal.Stop(upgrade)
+				done <- sig
+
+				return
+			}
+		}
+	}()
+}
+
+func startupMonitoringEndpoint(ctx context.Context, listener net.Listener, server *sshd.Server) {
 	go func() {
 		err := monitoring.Start(
-			monitoring.WithListenerAddress(cfg.Server.WebListen),
+			monitoring.WithListener(listener),
 			monitoring.WithBuildInformation(Version, BuildTime),
 			monitoring.WithServeMux(server.MonitoringServeMux()),
 		)
 
+		// The listener is closed once it's handed over to a new process on upgrade
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+
 		v2log.FromContext(ctx).ErrorContext(ctx, "monitoring service raised an error", v2log.ErrorMessage(err.Error()))
 		panic(err)
 	}()
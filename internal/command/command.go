@@ -40,6 +40,10 @@ type LogData struct {
 	Username     string      `json:"username"`
 	WrittenBytes int64       `json:"written_bytes"`
 	Meta         LogMetadata `json:"meta"`
+
+	// ThrottledDuration is how long the output was held back by the
+	// gitlab-sshd bandwidth limits.
+	ThrottledDuration time.Duration `json:"throttled_duration"`
 }
 
 type contextKey string
@@ -47,6 +51,10 @@ type contextKey string
 // LogDataKey is the context key used to store log data in request contexts.
 const LogDataKey contextKey = "logData"
 
+// changedKeyKey is the context key used to store the fingerprint of the SSH key
+// changed by a command.
+const changedKeyKey contextKey = "changedKey"
+
 // featureFlagClientKey is the context key used to store the feature flag evaluator.
 const featureFlagClientKey contextKey = "featureFlagClient"
 
@@ -160,6 +168,25 @@ func ContextWithEvaluator(ctx context.Context, evaluator featureflag.Evaluator)
 	return context.WithValue(ctx, featureFlagClientKey, evaluator)
 }
 
+// WithChangedKey returns a copy of ctx recording that the command adds,
+// expires or deletes the SSH key with the given fingerprint, so that the
+// lookups of the key cached by the caller can be dropped.
+func WithChangedKey(ctx context.Context, fingerprint string) context.Context {
+	return context.WithValue(ctx, changedKeyKey, fingerprint)
+}
+
+// ChangedKey returns the fingerprint of the SSH key recorded in ctx by
+// WithChangedKey, or an empty string if there's none.
+func ChangedKey(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	fingerprint, _ := ctx.Value(changedKeyKey).(string)
+
+	return fingerprint
+}
+
 // NewLogData creates a new LogData instance with the given project, username, and IDs.
 // It extracts the root namespace from the project path.
 func NewLogData(project, username string, projectID, rootNamespaceID int) LogData {
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/mattn/go-shellwords"
@@ -24,6 +25,8 @@ const (
 	UploadPack          CommandType = "git-upload-pack"
 	UploadArchive       CommandType = "git-upload-archive"
 	PersonalAccessToken CommandType = "personal_access_token"
+	SSHKeys             CommandType = "ssh_keys"
+	VerifySignature     CommandType = "verify_signature"
 )
 
 // Regular expressions for parsing key IDs and usernames from arguments
@@ -33,12 +36,24 @@ var (
 
 	// List of Git commands that are handled in a special way
 	GitCommands = []CommandType{LfsAuthenticate, UploadPack, ReceivePack, UploadArchive}
+
+	// List of informational commands that can write their output as JSON
+	JSONCommands = []CommandType{Discover, PersonalAccessToken, TwoFactorRecover, SSHKeys, VerifySignature}
 )
 
+// outputFormatFlag is the argument selecting the output format of the
+// informational commands, which overrides GL_OUTPUT_FORMAT.
+const outputFormatFlag = "--format="
+
 var (
 	// ErrOnlySSHAllowed - represents the error returned when the
 	// a non ssh connection is passed.
 	ErrOnlySSHAllowed = errors.New("Only SSH allowed") //nolint:staticcheck // message is customer facing
+
+	// ErrCommandNotAllowed - represents the error returned when the SSH
+	// certificate the connection is authenticated with doesn't allow the
+	// command.
+	ErrCommandNotAllowed = errors.New("Command not allowed by the SSH certificate") //nolint:staticcheck // message is customer facing
 )
 
 // Shell represents a parsed shell command with its arguments and related information.
@@ -50,6 +65,9 @@ type Shell struct {
 	SSHArgs             []string
 	CommandType         CommandType
 	Env                 sshenv.Env
+	// JSONOutput is set when an informational command is asked to write its
+	// output as a JSON document.
+	JSONOutput bool
 }
 
 // Parse validates and parses the command-line arguments and SSH environment.
@@ -88,6 +106,10 @@ func (s *Shell) validate() error {
 		return fmt.Errorf("Invalid SSH command: %w", err) //nolint:staticcheck // message is customer facing
 	}
 
+	if !s.Env.AllowsCommand(string(s.CommandType)) {
+		return ErrCommandNotAllowed
+	}
+
 	return nil
 }
 
@@ -149,13 +171,46 @@ func (s *Shell) ParseCommand(commandString string) error {
 
 	s.defineCommandType()
 
-	return nil
+	return s.parseOutputFormat()
 }
 
 func (s *Shell) defineCommandType() {
-	if len(s.SSHArgs) == 0 {
+	if len(s.SSHArgs) == 0 || isOutputFormatFlag(s.SSHArgs[0]) {
 		s.CommandType = Discover
 	} else {
 		s.CommandType = CommandType(s.SSHArgs[0])
 	}
 }
+
+// parseOutputFormat selects the output format of the informational commands,
+// removing the --format arguments. The other commands ignore it.
+func (s *Shell) parseOutputFormat() error {
+	if !slices.Contains(JSONCommands, s.CommandType) {
+		return nil
+	}
+
+	format := s.Env.OutputFormat
+	if slices.ContainsFunc(s.SSHArgs, isOutputFormatFlag) {
+		for _, arg := range s.SSHArgs {
+			if isOutputFormatFlag(arg) {
+				format = strings.TrimPrefix(arg, outputFormatFlag)
+			}
+		}
+		s.SSHArgs = slices.DeleteFunc(s.SSHArgs, isOutputFormatFlag)
+	}
+
+	switch format {
+	case "", "text":
+		s.JSONOutput = false
+	case "json":
+		s.JSONOutput = true
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+
+	return nil
+}
+
+func isOutputFormatFlag(arg string) bool {
+	return strings.HasPrefix(arg, outputFormatFlag)
+}
@@ -8,6 +8,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
 )
@@ -33,9 +34,16 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	logData := command.LogData{}
 	if response.IsAnonymous() {
 		logData.Username = anonymousUsername
-		_, _ = fmt.Fprintf(c.ReadWriter.Out, "Welcome to GitLab, %s!\n", anonymousUsername)
 	} else {
 		logData.Username = response.Username
+	}
+
+	switch {
+	case c.Args.JSONOutput:
+		c.writeJSON(response)
+	case response.IsAnonymous():
+		_, _ = fmt.Fprintf(c.ReadWriter.Out, "Welcome to GitLab, %s!\n", anonymousUsername)
+	default:
 		_, _ = fmt.Fprintf(c.ReadWriter.Out, "Welcome to GitLab, @%s!\n", response.Username)
 	}
 
@@ -44,6 +52,27 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	return ctxWithLogData, nil
 }
 
+// jsonResponse is the JSON output of discover. User is null for anonymous
+// users.
+type jsonResponse struct {
+	User *jsonUser `json:"user"`
+}
+
+type jsonUser struct {
+	ID       int64  `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+func (c *Command) writeJSON(response *discover.Response) {
+	output := jsonResponse{}
+	if !response.IsAnonymous() {
+		output.User = &jsonUser{ID: response.UserID, Username: response.Username, Name: response.Name}
+	}
+
+	_ = jsonoutput.Write(c.ReadWriter.Out, output)
+}
+
 func (c *Command) getUserInfo(ctx context.Context) (*discover.Response, error) {
 	client, err := discover.NewClient(c.Config)
 	if err != nil {
@@ -116,6 +116,43 @@ func TestExecute(t *testing.T) {
 	}
 }
 
+func TestExecuteJSON(t *testing.T) {
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	testCases := []struct {
+		desc           string
+		arguments      *commandargs.Shell
+		expectedOutput string
+	}{
+		{
+			desc:           "With a known user",
+			arguments:      &commandargs.Shell{GitlabKeyID: "1", JSONOutput: true},
+			expectedOutput: `{"user":{"id":2,"username":"alex-doe","name":"Alex Doe"}}` + "\n",
+		},
+		{
+			desc:           "With an anonymous user",
+			arguments:      &commandargs.Shell{GitlabKeyID: "-1", JSONOutput: true},
+			expectedOutput: `{"user":null}` + "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			cmd := &Command{
+				Config:     &config.Config{GitlabURL: url},
+				Args:       tc.arguments,
+				ReadWriter: &readwriter.ReadWriter{Out: buffer},
+			}
+
+			_, err := cmd.Execute(context.Background())
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, buffer.String())
+		})
+	}
+}
+
 func TestFailingExecute(t *testing.T) {
 	url := testserver.StartSocketHTTPServer(t, requests)
 
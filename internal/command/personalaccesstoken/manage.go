@@ -0,0 +1,238 @@
+package personalaccesstoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/personalaccesstoken"
+)
+
+const (
+	listSubcommand   = "list"
+	revokeSubcommand = "revoke"
+	rotateSubcommand = "rotate"
+
+	listUsageText   = "Usage: personal_access_token list"
+	revokeUsageText = "Usage: personal_access_token revoke <id>"
+	rotateUsageText = "Usage: personal_access_token rotate <id> [ttl_days]"
+
+	dateFormat = "2006-01-02"
+)
+
+// listJSONResponse is the JSON output of personal_access_token list.
+// ExpiresAt and LastUsedAt are null for tokens that don't expire, or haven't
+// been used.
+type listJSONResponse struct {
+	Tokens []jsonToken `json:"tokens"`
+}
+
+type jsonToken struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  *string  `json:"expires_at"`
+	LastUsedAt *string  `json:"last_used_at"`
+}
+
+// revokeJSONResponse is the JSON output of personal_access_token revoke
+type revokeJSONResponse struct {
+	ID      int64 `json:"id"`
+	Revoked bool  `json:"revoked"`
+}
+
+// listTokens prints the tokens of the user that can be managed over SSH
+func (c *Command) listTokens(ctx context.Context) error {
+	if len(c.Args.SSHArgs) != 2 {
+		return errors.New(listUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+
+	slog.DebugContext(ctx, "personalaccesstoken: listTokens: listing tokens")
+
+	tokens, err := c.manageableTokens(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.Args.JSONOutput {
+		return c.writeTokensJSON(tokens)
+	}
+
+	c.printTokens(tokens)
+
+	return nil
+}
+
+// revokeToken revokes the token of the user with the given ID
+func (c *Command) revokeToken(ctx context.Context) error {
+	if len(c.Args.SSHArgs) != 3 {
+		return errors.New(revokeUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+
+	tokenID, err := c.findToken(ctx, c.Args.SSHArgs[2])
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "personalaccesstoken: revokeToken: revoking token", slog.Int64("token_id", tokenID))
+
+	client, err := personalaccesstoken.NewClient(c.Config)
+	if err != nil {
+		return err
+	}
+
+	if err := client.RevokeToken(ctx, c.Args, tokenID); err != nil {
+		return err
+	}
+
+	if c.Args.JSONOutput {
+		return jsonoutput.Write(c.ReadWriter.Out, revokeJSONResponse{ID: tokenID, Revoked: true})
+	}
+
+	_, _ = fmt.Fprintf(c.ReadWriter.Out, "Revoked personal access token %d.\n", tokenID)
+
+	return nil
+}
+
+// rotateToken revokes the token of the user with the given ID, and prints
+// the new token replacing it
+func (c *Command) rotateToken(ctx context.Context) error {
+	if len(c.Args.SSHArgs) < 3 || len(c.Args.SSHArgs) > 4 {
+		return errors.New(rotateUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+
+	expiresAt, err := expiresDate(c.Args.SSHArgs, 3)
+	if err != nil {
+		return err
+	}
+
+	tokenID, err := c.findToken(ctx, c.Args.SSHArgs[2])
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "personalaccesstoken: rotateToken: rotating token", slog.Int64("token_id", tokenID))
+
+	client, err := personalaccesstoken.NewClient(c.Config)
+	if err != nil {
+		return err
+	}
+
+	response, err := client.RotateToken(ctx, c.Args, tokenID, expiresAt)
+	if err != nil {
+		return err
+	}
+
+	c.printToken(response)
+
+	return nil
+}
+
+// findToken returns the ID of the token of the user with the given ID, which
+// must be manageable over SSH.
+func (c *Command) findToken(ctx context.Context, rawID string) (int64, error) {
+	tokenID, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || tokenID <= 0 {
+		return 0, fmt.Errorf("Invalid value for id: '%s'", rawID) //nolint:staticcheck // message is customer facing
+	}
+
+	tokens, err := c.manageableTokens(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	if !slices.ContainsFunc(tokens, func(token personalaccesstoken.Token) bool { return token.ID == tokenID }) {
+		return 0, fmt.Errorf("Personal access token %d not found", tokenID) //nolint:staticcheck // message is customer facing
+	}
+
+	return tokenID, nil
+}
+
+// manageableTokens returns the tokens of the user that can be managed over
+// SSH: those whose scopes are all allowed, when the allowed scopes are set.
+func (c *Command) manageableTokens(ctx context.Context) ([]personalaccesstoken.Token, error) {
+	client, err := personalaccesstoken.NewClient(c.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := client.ListTokens(ctx, c.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	allowedScopes := c.Config.PATConfig.AllowedScopes
+	if len(allowedScopes) == 0 {
+		return tokens, nil
+	}
+
+	return slices.DeleteFunc(tokens, func(token personalaccesstoken.Token) bool {
+		return slices.ContainsFunc(token.Scopes, func(scope string) bool {
+			return !slices.Contains(allowedScopes, scope)
+		})
+	}), nil
+}
+
+func (c *Command) writeTokensJSON(tokens []personalaccesstoken.Token) error {
+	response := listJSONResponse{Tokens: []jsonToken{}}
+	for _, token := range tokens {
+		t := jsonToken{ID: token.ID, Name: token.Name, Scopes: token.Scopes, CreatedAt: token.CreatedAt}
+		if t.Scopes == nil {
+			t.Scopes = []string{}
+		}
+		if token.ExpiresAt != "" {
+			t.ExpiresAt = &token.ExpiresAt
+		}
+		if token.LastUsedAt != "" {
+			t.LastUsedAt = &token.LastUsedAt
+		}
+
+		response.Tokens = append(response.Tokens, t)
+	}
+
+	return jsonoutput.Write(c.ReadWriter.Out, response)
+}
+
+func (c *Command) printTokens(tokens []personalaccesstoken.Token) {
+	if len(tokens) == 0 {
+		_, _ = fmt.Fprintln(c.ReadWriter.Out, "You have no personal access tokens.")
+		return
+	}
+
+	w := tabwriter.NewWriter(c.ReadWriter.Out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "ID\tNAME\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+	for _, token := range tokens {
+		expires := "never"
+		if token.ExpiresAt != "" {
+			expires = formatDate(token.ExpiresAt)
+		}
+
+		lastUsed := "never"
+		if token.LastUsedAt != "" {
+			lastUsed = formatDate(token.LastUsedAt)
+		}
+
+		_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Name, strings.Join(token.Scopes, ","),
+			formatDate(token.CreatedAt), expires, lastUsed)
+	}
+	_ = w.Flush()
+}
+
+// formatDate returns the date part of an RFC 3339 timestamp, or the timestamp
+// as is if it isn't one.
+func formatDate(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	return t.Format(dateFormat)
+}
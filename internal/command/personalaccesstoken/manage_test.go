@@ -0,0 +1,243 @@
+package personalaccesstoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/personalaccesstoken"
+)
+
+const (
+	testKeyEmpty     = "empty"
+	testKeyForbidden = "forbidden"
+)
+
+func manageRequests(t *testing.T) []testserver.TestRequestHandler {
+	readBody := func(r *http.Request) *personalaccesstoken.TokenRequestBody {
+		b, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		assert.NoError(t, err)
+
+		var requestBody *personalaccesstoken.TokenRequestBody
+		assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+		return requestBody
+	}
+
+	return []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/personal_access_token/list",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				switch readBody(r).KeyID {
+				case testKeyEmpty:
+					json.NewEncoder(w).Encode(map[string]interface{}{testSuccess: true, "tokens": nil})
+				case testKeyForbidden:
+					json.NewEncoder(w).Encode(map[string]interface{}{testSuccess: false, "message": "Forbidden!"})
+				default:
+					body := map[string]interface{}{
+						testSuccess: true,
+						"tokens": []map[string]interface{}{
+							{
+								"id":           7,
+								"name":         "ci",
+								"scopes":       []string{testScopeReadAPI},
+								"created_at":   "2024-01-02T03:04:05Z",
+								"expires_at":   "9001-11-17",
+								"last_used_at": "2024-02-03T04:05:06Z",
+							},
+							{
+								"id":         8,
+								"name":       "admin",
+								"scopes":     []string{testScopeAPI},
+								"created_at": "2024-01-02T03:04:05Z",
+							},
+						},
+					}
+					json.NewEncoder(w).Encode(body)
+				}
+			},
+		},
+		{
+			Path: "/api/v4/internal/personal_access_token/revoke",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, int64(7), readBody(r).TokenID)
+				json.NewEncoder(w).Encode(map[string]interface{}{testSuccess: true})
+			},
+		},
+		{
+			Path: "/api/v4/internal/personal_access_token/rotate",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readBody(r)
+				assert.Equal(t, int64(7), requestBody.TokenID)
+				assert.NotEmpty(t, requestBody.ExpiresAt)
+
+				body := map[string]interface{}{
+					testSuccess:  true,
+					"token":      "rotatedG3YPeemECgUvxu",
+					"scopes":     []string{testScopeReadAPI},
+					"expires_at": "9001-11-17",
+				}
+				json.NewEncoder(w).Encode(body)
+			},
+		},
+	}
+}
+
+func TestManageTokens(t *testing.T) {
+	url := testserver.StartSocketHTTPServer(t, manageRequests(t))
+
+	testCases := []struct {
+		desc           string
+		PATConfig      config.PATConfig
+		keyID          string
+		sshArgs        []string
+		jsonOutput     bool
+		expectedOutput string
+		expectedError  string
+	}{
+		{
+			desc:    "list",
+			sshArgs: []string{cmdname, listSubcommand},
+			expectedOutput: "ID  NAME   SCOPES    CREATED     EXPIRES     LAST USED\n" +
+				"7   ci     read_api  2024-01-02  9001-11-17  2024-02-03\n" +
+				"8   admin  api       2024-01-02  never       never\n",
+		},
+		{
+			desc:       "list with JSON output",
+			sshArgs:    []string{cmdname, listSubcommand},
+			jsonOutput: true,
+			expectedOutput: `{"tokens":[` +
+				`{"id":7,"name":"ci","scopes":["read_api"],"created_at":"2024-01-02T03:04:05Z","expires_at":"9001-11-17","last_used_at":"2024-02-03T04:05:06Z"},` +
+				`{"id":8,"name":"admin","scopes":["api"],"created_at":"2024-01-02T03:04:05Z","expires_at":null,"last_used_at":null}]}` + "\n",
+		},
+		{
+			desc:      "list with restricted scopes",
+			PATConfig: config.PATConfig{AllowedScopes: []string{testScopeReadAPI}},
+			sshArgs:   []string{cmdname, listSubcommand},
+			expectedOutput: "ID  NAME  SCOPES    CREATED     EXPIRES     LAST USED\n" +
+				"7   ci    read_api  2024-01-02  9001-11-17  2024-02-03\n",
+		},
+		{
+			desc:           "list without tokens",
+			keyID:          testKeyEmpty,
+			sshArgs:        []string{cmdname, listSubcommand},
+			expectedOutput: "You have no personal access tokens.\n",
+		},
+		{
+			desc:           "list without tokens with JSON output",
+			keyID:          testKeyEmpty,
+			sshArgs:        []string{cmdname, listSubcommand},
+			jsonOutput:     true,
+			expectedOutput: `{"tokens":[]}` + "\n",
+		},
+		{
+			desc:          "list with too many arguments",
+			sshArgs:       []string{cmdname, listSubcommand, "7"},
+			expectedError: listUsageText,
+		},
+		{
+			desc:          "list when API returns an error",
+			keyID:         testKeyForbidden,
+			sshArgs:       []string{cmdname, listSubcommand},
+			expectedError: "Forbidden!",
+		},
+		{
+			desc:           "revoke",
+			sshArgs:        []string{cmdname, revokeSubcommand, "7"},
+			expectedOutput: "Revoked personal access token 7.\n",
+		},
+		{
+			desc:           "revoke with JSON output",
+			sshArgs:        []string{cmdname, revokeSubcommand, "7"},
+			jsonOutput:     true,
+			expectedOutput: `{"id":7,"revoked":true}` + "\n",
+		},
+		{
+			desc:          "revoke an unknown token",
+			sshArgs:       []string{cmdname, revokeSubcommand, "9"},
+			expectedError: "Personal access token 9 not found",
+		},
+		{
+			desc:          "revoke a token with restricted scopes",
+			PATConfig:     config.PATConfig{AllowedScopes: []string{testScopeReadAPI}},
+			sshArgs:       []string{cmdname, revokeSubcommand, "8"},
+			expectedError: "Personal access token 8 not found",
+		},
+		{
+			desc:          "revoke with an invalid ID",
+			sshArgs:       []string{cmdname, revokeSubcommand, "ci"},
+			expectedError: "Invalid value for id: 'ci'",
+		},
+		{
+			desc:          "revoke without an ID",
+			sshArgs:       []string{cmdname, revokeSubcommand},
+			expectedError: revokeUsageText,
+		},
+		{
+			desc:    "rotate",
+			sshArgs: []string{cmdname, rotateSubcommand, "7", "30"},
+			expectedOutput: "Token:   rotatedG3YPeemECgUvxu\n" +
+				"Scopes:  read_api\n" +
+				"Expires: 9001-11-17\n",
+		},
+		{
+			desc:           "rotate with JSON output",
+			sshArgs:        []string{cmdname, rotateSubcommand, "7"},
+			jsonOutput:     true,
+			expectedOutput: `{"token":"rotatedG3YPeemECgUvxu","scopes":["read_api"],"expires_at":"9001-11-17"}` + "\n",
+		},
+		{
+			desc:          "rotate with a bad ttl_days argument",
+			sshArgs:       []string{cmdname, rotateSubcommand, "7", "bad_ttl"},
+			expectedError: "Invalid value for days_ttl: 'bad_ttl'",
+		},
+		{
+			desc:          "rotate a token with restricted scopes",
+			PATConfig:     config.PATConfig{AllowedScopes: []string{testScopeReadAPI}},
+			sshArgs:       []string{cmdname, rotateSubcommand, "8"},
+			expectedError: "Personal access token 8 not found",
+		},
+		{
+			desc:          "rotate with too many arguments",
+			sshArgs:       []string{cmdname, rotateSubcommand, "7", "30", "toomany"},
+			expectedError: rotateUsageText,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			keyID := tc.keyID
+			if keyID == "" {
+				keyID = testKeyDefault
+			}
+
+			output := &bytes.Buffer{}
+			cmd := &Command{
+				Config:     &config.Config{GitlabURL: url, PATConfig: tc.PATConfig},
+				Args:       &commandargs.Shell{GitlabKeyID: keyID, SSHArgs: tc.sshArgs, JSONOutput: tc.jsonOutput},
+				ReadWriter: &readwriter.ReadWriter{Out: output, In: &bytes.Buffer{}},
+			}
+
+			_, err := cmd.Execute(context.Background())
+
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+
+			require.Equal(t, tc.expectedOutput, output.String())
+		})
+	}
+}
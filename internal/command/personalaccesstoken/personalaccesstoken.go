@@ -14,6 +14,7 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/personalaccesstoken"
 )
@@ -38,7 +39,19 @@ type tokenArgs struct {
 }
 
 // Execute processes the command, requests a personal access token, and prints the result.
+// The list, revoke, and rotate subcommands manage the existing tokens instead.
 func (c *Command) Execute(ctx context.Context) (context.Context, error) {
+	if len(c.Args.SSHArgs) > 1 {
+		switch c.Args.SSHArgs[1] {
+		case listSubcommand:
+			return ctx, c.listTokens(ctx)
+		case revokeSubcommand:
+			return ctx, c.revokeToken(ctx)
+		case rotateSubcommand:
+			return ctx, c.rotateToken(ctx)
+		}
+	}
+
 	err := c.parseTokenArgs()
 	if err != nil {
 		return ctx, err
@@ -52,11 +65,36 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 		return ctx, err
 	}
 
+	c.printToken(response)
+
+	return ctx, nil
+}
+
+func (c *Command) printToken(response *personalaccesstoken.Response) {
+	if c.Args.JSONOutput {
+		_ = jsonoutput.Write(c.ReadWriter.Out, newJSONResponse(response))
+		return
+	}
+
 	_, _ = fmt.Fprint(c.ReadWriter.Out, "Token:   "+response.Token+"\n")
 	_, _ = fmt.Fprint(c.ReadWriter.Out, "Scopes:  "+strings.Join(response.Scopes, ",")+"\n")
 	_, _ = fmt.Fprint(c.ReadWriter.Out, "Expires: "+response.ExpiresAt+"\n")
+}
 
-	return ctx, nil
+// jsonResponse is the JSON output of personal_access_token
+type jsonResponse struct {
+	Token     string   `json:"token"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt string   `json:"expires_at"`
+}
+
+func newJSONResponse(response *personalaccesstoken.Response) jsonResponse {
+	scopes := response.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return jsonResponse{Token: response.Token, Scopes: scopes, ExpiresAt: response.ExpiresAt}
 }
 
 func (c *Command) parseTokenArgs() error {
@@ -80,20 +118,26 @@ func (c *Command) parseTokenArgs() error {
 		Scopes: rectfiedScopes,
 	}
 
-	if len(c.Args.SSHArgs) < 4 {
-		c.TokenArgs.ExpiresDate = time.Now().AddDate(0, 0, 30).Format(expiresDateFormat)
-		return nil
+	var err error
+	c.TokenArgs.ExpiresDate, err = expiresDate(c.Args.SSHArgs, 3)
+
+	return err
+}
+
+// expiresDate returns the expiry date of a token, given its TTL in days as
+// args[i]. Tokens expire in 30 days when it's omitted.
+func expiresDate(args []string, i int) (string, error) {
+	if len(args) <= i {
+		return time.Now().AddDate(0, 0, 30).Format(expiresDateFormat), nil
 	}
-	rawTTL := c.Args.SSHArgs[3]
+	rawTTL := args[i]
 
 	TTL, err := strconv.Atoi(rawTTL)
 	if err != nil || TTL < 0 {
-		return fmt.Errorf("Invalid value for days_ttl: '%s'", rawTTL) //nolint:staticcheck // message is customer facing
+		return "", fmt.Errorf("Invalid value for days_ttl: '%s'", rawTTL) //nolint:staticcheck // message is customer facing
 	}
 
-	c.TokenArgs.ExpiresDate = time.Now().AddDate(0, 0, TTL+1).Format(expiresDateFormat)
-
-	return nil
+	return time.Now().AddDate(0, 0, TTL+1).Format(expiresDateFormat), nil
 }
 
 func (c *Command) getPersonalAccessToken(ctx context.Context) (*personalaccesstoken.Response, error) {
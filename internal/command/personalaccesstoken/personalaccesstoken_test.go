@@ -141,6 +141,15 @@ func TestExecute(t *testing.T) {
 				"Scopes:  api\n" +
 				"Expires: 9001-11-17\n",
 		},
+		{
+			desc: "With JSON output",
+			arguments: &commandargs.Shell{
+				GitlabKeyID: testKeyDefault,
+				SSHArgs:     []string{cmdname, testNewtoken, testScopesReadAll},
+				JSONOutput:  true,
+			},
+			expectedOutput: `{"token":"YXuxvUgCEmeePY3G1YAa","scopes":["read_api","read_repository"],"expires_at":"9001-11-17"}` + "\n",
+		},
 		{
 			desc: "With bad response",
 			arguments: &commandargs.Shell{
@@ -0,0 +1,50 @@
+// Package jsonoutput writes the output of the informational commands as JSON
+// documents, for the clients asking for it with --format=json or
+// GL_OUTPUT_FORMAT=json
+package jsonoutput
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	grpcstatus "google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+)
+
+// ErrorResponse is the document written when a command fails
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+// ErrorDetails describes the error a command failed with
+type ErrorDetails struct {
+	Message string `json:"message"`
+}
+
+// Write writes v to w as a single-line JSON document
+func Write(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Command wraps a command writing its output as JSON, so that an
+// ErrorResponse is written when it fails
+type Command struct {
+	command.Command
+	ReadWriter *readwriter.ReadWriter
+}
+
+// Execute runs the wrapped command, and writes an ErrorResponse if it fails.
+// The error is still returned, for the command to exit with a non-zero status.
+func (c *Command) Execute(ctx context.Context) (context.Context, error) {
+	ctx, err := c.Command.Execute(ctx)
+	if err != nil {
+		_ = Write(c.ReadWriter.Out, ErrorResponse{
+			Error: ErrorDetails{Message: grpcstatus.Convert(err).Message()},
+		})
+	}
+
+	return ctx, err
+}
@@ -0,0 +1,62 @@
+package jsonoutput
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+)
+
+type fakeCommand struct {
+	err error
+}
+
+func (f *fakeCommand) Execute(ctx context.Context) (context.Context, error) {
+	return ctx, f.err
+}
+
+func TestWrite(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	require.NoError(t, Write(out, map[string]string{"token": "secret"}))
+	require.Equal(t, `{"token":"secret"}`+"\n", out.String())
+}
+
+func TestCommand(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		err            error
+		expectedOutput string
+	}{
+		{
+			desc: "success",
+		},
+		{
+			desc:           "error",
+			err:            errors.New("Forbidden!"),
+			expectedOutput: `{"error":{"message":"Forbidden!"}}` + "\n",
+		},
+		{
+			desc:           "gRPC error",
+			err:            grpcstatus.Error(codes.PermissionDenied, "access denied"),
+			expectedOutput: `{"error":{"message":"access denied"}}` + "\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			cmd := &Command{Command: &fakeCommand{err: tc.err}, ReadWriter: &readwriter.ReadWriter{Out: out}}
+
+			_, err := cmd.Execute(context.Background())
+			require.Equal(t, tc.err, err)
+			require.Equal(t, tc.expectedOutput, out.String())
+		})
+	}
+}
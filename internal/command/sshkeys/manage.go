@@ -0,0 +1,219 @@
+package sshkeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+const (
+	addUsageText    = "Usage: ssh_keys add <title> [ttl_days] < key.pub"
+	expireUsageText = "Usage: ssh_keys expire <fingerprint> <ttl_days>"
+	deleteUsageText = "Usage: ssh_keys delete <fingerprint> [--force]"
+
+	forceFlag = "--force"
+
+	// maxKeySize caps how much of stdin is read. Public keys of the largest
+	// RSA keys take a few kilobytes.
+	maxKeySize = 16 * 1024
+)
+
+var (
+	errInvalidKey     = errors.New("expected one SSH public key, in the authorized keys format, on stdin")
+	errCertificateKey = errors.New("SSH certificates can't be added as SSH keys")
+	errCurrentKey     = errors.New("refusing to delete the SSH key this session is authenticated with, use --force to delete it anyway")
+)
+
+// keyJSONResponse is the JSON output of ssh_keys add and expire
+type keyJSONResponse struct {
+	Key jsonKey `json:"key"`
+}
+
+// deleteJSONResponse is the JSON output of ssh_keys delete
+type deleteJSONResponse struct {
+	Fingerprint string `json:"fingerprint"`
+	Deleted     bool   `json:"deleted"`
+}
+
+// addKey adds the public key read from stdin to the user
+func (c *Command) addKey(ctx context.Context) (context.Context, error) {
+	if len(c.Args.SSHArgs) < 3 || len(c.Args.SSHArgs) > 4 {
+		return ctx, errors.New(addUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+	title := c.Args.SSHArgs[2]
+
+	var expiresAt string
+	if len(c.Args.SSHArgs) == 4 {
+		var err error
+		if expiresAt, err = parseExpiresAt(c.Args.SSHArgs[3]); err != nil {
+			return ctx, err
+		}
+	}
+
+	publicKey, err := c.readPublicKey()
+	if err != nil {
+		return ctx, err
+	}
+
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+	ctx = command.WithChangedKey(ctx, fingerprint)
+
+	slog.InfoContext(ctx, "sshkeys: addKey: adding key", slog.String("fingerprint", fingerprint))
+
+	client, err := sshkeys.NewClient(c.Config)
+	if err != nil {
+		return ctx, err
+	}
+
+	key, err := client.AddKey(ctx, c.Args, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), title, expiresAt)
+	if err != nil {
+		return ctx, err
+	}
+
+	if c.Args.JSONOutput {
+		return ctx, jsonoutput.Write(c.ReadWriter.Out, keyJSONResponse{Key: newJSONKey(key)})
+	}
+
+	_, _ = fmt.Fprintf(c.ReadWriter.Out, "Added SSH key %s.\n", key.Fingerprint)
+
+	return ctx, nil
+}
+
+// expireKey sets the expiry of the key of the user with the given fingerprint
+func (c *Command) expireKey(ctx context.Context) (context.Context, error) {
+	if len(c.Args.SSHArgs) != 4 {
+		return ctx, errors.New(expireUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+	fingerprint := c.Args.SSHArgs[2]
+
+	expiresAt, err := parseExpiresAt(c.Args.SSHArgs[3])
+	if err != nil {
+		return ctx, err
+	}
+
+	ctx = command.WithChangedKey(ctx, fingerprint)
+
+	slog.InfoContext(ctx, "sshkeys: expireKey: setting key expiry",
+		slog.String("fingerprint", fingerprint),
+		slog.String("expires_at", expiresAt),
+	)
+
+	client, err := sshkeys.NewClient(c.Config)
+	if err != nil {
+		return ctx, err
+	}
+
+	key, err := client.ExpireKey(ctx, c.Args, fingerprint, expiresAt)
+	if err != nil {
+		return ctx, err
+	}
+
+	if c.Args.JSONOutput {
+		return ctx, jsonoutput.Write(c.ReadWriter.Out, keyJSONResponse{Key: newJSONKey(key)})
+	}
+
+	_, _ = fmt.Fprintf(c.ReadWriter.Out, "SSH key %s expires on %s.\n", key.Fingerprint, formatDate(key.ExpiresAt))
+
+	return ctx, nil
+}
+
+// deleteKey deletes the key of the user with the given fingerprint. The key
+// the session is authenticated with is only deleted when forced.
+func (c *Command) deleteKey(ctx context.Context) (context.Context, error) {
+	args := c.Args.SSHArgs
+	if len(args) < 3 || len(args) > 4 || (len(args) == 4 && args[3] != forceFlag) {
+		return ctx, errors.New(deleteUsageText) //nolint:staticcheck // usageText is customer facing
+	}
+	fingerprint := args[2]
+	force := len(args) == 4
+
+	client, err := sshkeys.NewClient(c.Config)
+	if err != nil {
+		return ctx, err
+	}
+
+	keys, err := client.ListKeys(ctx, c.Args)
+	if err != nil {
+		return ctx, err
+	}
+
+	key := findKey(keys, fingerprint)
+	if key == nil {
+		return ctx, fmt.Errorf("SSH key %s not found", fingerprint)
+	}
+
+	current := c.Args.GitlabKeyID != "" && strconv.FormatInt(key.ID, 10) == c.Args.GitlabKeyID
+	if current && !force {
+		return ctx, errCurrentKey
+	}
+
+	ctx = command.WithChangedKey(ctx, fingerprint)
+
+	slog.InfoContext(ctx, "sshkeys: deleteKey: deleting key",
+		slog.String("fingerprint", fingerprint),
+		slog.Bool("current", current),
+	)
+
+	if err := client.DeleteKey(ctx, c.Args, fingerprint); err != nil {
+		return ctx, err
+	}
+
+	if c.Args.JSONOutput {
+		return ctx, jsonoutput.Write(c.ReadWriter.Out, deleteJSONResponse{Fingerprint: fingerprint, Deleted: true})
+	}
+
+	_, _ = fmt.Fprintf(c.ReadWriter.Out, "Deleted SSH key %s.\n", fingerprint)
+
+	return ctx, nil
+}
+
+// readPublicKey reads a single public key, in the authorized keys format,
+// from stdin.
+func (c *Command) readPublicKey() (ssh.PublicKey, error) {
+	input, err := io.ReadAll(io.LimitReader(c.ReadWriter.In, maxKeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, _, rest, err := ssh.ParseAuthorizedKey(input)
+	if err != nil || strings.TrimSpace(string(rest)) != "" {
+		return nil, errInvalidKey
+	}
+
+	if _, ok := publicKey.(*ssh.Certificate); ok {
+		return nil, errCertificateKey
+	}
+
+	return publicKey, nil
+}
+
+// parseExpiresAt returns the time a key expires at, given its TTL in days.
+func parseExpiresAt(rawTTL string) (string, error) {
+	ttl, err := strconv.Atoi(rawTTL)
+	if err != nil || ttl < 0 {
+		return "", fmt.Errorf("Invalid value for ttl_days: '%s'", rawTTL) //nolint:staticcheck // message is customer facing
+	}
+
+	return time.Now().UTC().AddDate(0, 0, ttl).Format(time.RFC3339), nil
+}
+
+func findKey(keys []sshkeys.Key, fingerprint string) *sshkeys.Key {
+	for i := range keys {
+		if keys[i].Fingerprint == fingerprint {
+			return &keys[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+var (
+	laptopKey = sshkeys.Key{ID: 1, Title: "Laptop", Fingerprint: "SHA256:laptop", CreatedAt: "2026-01-01T10:00:00Z"}
+	ciKey     = sshkeys.Key{ID: 2, Title: "CI runner", Fingerprint: "SHA256:ci", CreatedAt: "2026-02-01T10:00:00Z"}
+)
+
+func setupManage(t *testing.T, publicKey ssh.PublicKey) string {
+	readBody := func(r *http.Request) *sshkeys.RequestBody {
+		b, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		assert.NoError(t, err)
+
+		var requestBody *sshkeys.RequestBody
+		assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+		return requestBody
+	}
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/ssh_keys/list",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				readBody(r)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "keys": []sshkeys.Key{laptopKey, ciKey}})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/add",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readBody(r)
+				assert.Equal(t, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), requestBody.Key)
+
+				key := sshkeys.Key{
+					ID:          3,
+					Title:       requestBody.Title,
+					Fingerprint: ssh.FingerprintSHA256(publicKey),
+					CreatedAt:   "2026-03-01T10:00:00Z",
+					ExpiresAt:   requestBody.ExpiresAt,
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/expire",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readBody(r)
+				if requestBody.Fingerprint != ciKey.Fingerprint {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Key not found"})
+					return
+				}
+
+				key := ciKey
+				key.ExpiresAt = "2026-12-01T10:00:00Z"
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/delete",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				readBody(r)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			},
+		},
+		{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				json.NewEncoder(w).Encode(&discover.Response{UserID: 1, Username: "jane-doe", Name: "Jane Doe"})
+			},
+		},
+	}
+
+	return testserver.StartSocketHTTPServer(t, requests)
+}
+
+func TestManageKeys(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	url := setupManage(t, publicKey)
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))) + " jane@laptop\n"
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+
+	testCases := []struct {
+		desc           string
+		arguments      []string
+		input          string
+		json           bool
+		expectedOutput string
+		expectedError  string
+		expectedKey    string
+	}{
+		{
+			desc:           "add",
+			arguments:      []string{"ssh_keys", "add", "Desktop"},
+			input:          authorizedKey,
+			expectedOutput: "Added SSH key " + fingerprint + ".\n",
+			expectedKey:    fingerprint,
+		},
+		{
+			desc:      "add with JSON output",
+			arguments: []string{"ssh_keys", "add", "Desktop"},
+			input:     authorizedKey,
+			json:      true,
+			expectedOutput: `{"key":{"id":3,"title":"Desktop","fingerprint":"` + fingerprint + `",` +
+				`"created_at":"2026-03-01T10:00:00Z","expires_at":null}}` + "\n",
+			expectedKey: fingerprint,
+		},
+		{
+			desc:           "add with a ttl_days argument",
+			arguments:      []string{"ssh_keys", "add", "Desktop", "30"},
+			input:          authorizedKey,
+			expectedOutput: "Added SSH key " + fingerprint + ".\n",
+			expectedKey:    fingerprint,
+		},
+		{
+			desc:          "add with a bad ttl_days argument",
+			arguments:     []string{"ssh_keys", "add", "Desktop", "never"},
+			input:         authorizedKey,
+			expectedError: "Invalid value for ttl_days: 'never'",
+		},
+		{
+			desc:          "add without a title",
+			arguments:     []string{"ssh_keys", "add"},
+			input:         authorizedKey,
+			expectedError: addUsageText,
+		},
+		{
+			desc:          "add an invalid key",
+			arguments:     []string{"ssh_keys", "add", "Desktop"},
+			input:         "ssh-ed25519 invalid\n",
+			expectedError: errInvalidKey.Error(),
+		},
+		{
+			desc:          "add several keys",
+			arguments:     []string{"ssh_keys", "add", "Desktop"},
+			input:         authorizedKey + authorizedKey,
+			expectedError: errInvalidKey.Error(),
+		},
+		{
+			desc:           "expire",
+			arguments:      []string{"ssh_keys", "expire", "SHA256:ci", "7"},
+			expectedOutput: "SSH key SHA256:ci expires on 2026-12-01.\n",
+			expectedKey:    "SHA256:ci",
+		},
+		{
+			desc:      "expire with JSON output",
+			arguments: []string{"ssh_keys", "expire", "SHA256:ci", "7"},
+			json:      true,
+			expectedOutput: `{"key":{"id":2,"title":"CI runner","fingerprint":"SHA256:ci",` +
+				`"created_at":"2026-02-01T10:00:00Z","expires_at":"2026-12-01T10:00:00Z"}}` + "\n",
+			expectedKey: "SHA256:ci",
+		},
+		{
+			desc:          "expire an unknown key",
+			arguments:     []string{"ssh_keys", "expire", "SHA256:unknown", "7"},
+			expectedError: "Key not found",
+			expectedKey:   "SHA256:unknown",
+		},
+		{
+			desc:          "expire without a ttl_days argument",
+			arguments:     []string{"ssh_keys", "expire", "SHA256:ci"},
+			expectedError: expireUsageText,
+		},
+		{
+			desc:           "delete",
+			arguments:      []string{"ssh_keys", "delete", "SHA256:ci"},
+			expectedOutput: "Deleted SSH key SHA256:ci.\n",
+			expectedKey:    "SHA256:ci",
+		},
+		{
+			desc:           "delete with JSON output",
+			arguments:      []string{"ssh_keys", "delete", "SHA256:ci"},
+			json:           true,
+			expectedOutput: `{"fingerprint":"SHA256:ci","deleted":true}` + "\n",
+			expectedKey:    "SHA256:ci",
+		},
+		{
+			desc:          "delete the key of the session",
+			arguments:     []string{"ssh_keys", "delete", "SHA256:laptop"},
+			expectedError: errCurrentKey.Error(),
+		},
+		{
+			desc:           "delete the key of the session when forced",
+			arguments:      []string{"ssh_keys", "delete", "SHA256:laptop", "--force"},
+			expectedOutput: "Deleted SSH key SHA256:laptop.\n",
+			expectedKey:    "SHA256:laptop",
+		},
+		{
+			desc:          "delete an unknown key",
+			arguments:     []string{"ssh_keys", "delete", "SHA256:unknown"},
+			expectedError: "SSH key SHA256:unknown not found",
+		},
+		{
+			desc:          "delete with an unknown flag",
+			arguments:     []string{"ssh_keys", "delete", "SHA256:ci", "--now"},
+			expectedError: deleteUsageText,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			cmd := &Command{
+				Config:     &config.Config{GitlabURL: url},
+				Args:       &commandargs.Shell{GitlabKeyID: "1", SSHArgs: tc.arguments, JSONOutput: tc.json},
+				ReadWriter: &readwriter.ReadWriter{Out: output, In: strings.NewReader(tc.input)},
+			}
+
+			ctxWithLogData, err := cmd.Execute(context.Background())
+
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedOutput, output.String())
+			require.Equal(t, tc.expectedKey, command.ChangedKey(ctxWithLogData))
+		})
+	}
+}
+
+// Without a key, as with certificates, no key is the key of the session
+func TestDeleteKeyWithoutKeyID(t *testing.T) {
+	url := setupManage(t, nil)
+
+	output := &bytes.Buffer{}
+	cmd := &Command{
+		Config:     &config.Config{GitlabURL: url},
+		Args:       &commandargs.Shell{GitlabUsername: "jane-doe", SSHArgs: []string{"ssh_keys", "delete", "SHA256:laptop"}},
+		ReadWriter: &readwriter.ReadWriter{Out: output},
+	}
+
+	_, err := cmd.Execute(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "Deleted SSH key SHA256:laptop.\n", output.String())
+}
+
+func TestReadPublicKeyCertificate(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	publicKey, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	cert := &ssh.Certificate{Key: publicKey, CertType: ssh.UserCert}
+	require.NoError(t, cert.SignCert(rand.Reader, signer))
+
+	cmd := &Command{ReadWriter: &readwriter.ReadWriter{In: bytes.NewReader(ssh.MarshalAuthorizedKey(cert))}}
+
+	_, err = cmd.readPublicKey()
+	require.Equal(t, errCertificateKey, err)
+}
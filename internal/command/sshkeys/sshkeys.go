@@ -0,0 +1,145 @@
+// Package sshkeys defines logic for managing the SSH keys of the user
+package sshkeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+const (
+	usageText  = "Usage: ssh_keys [list | add <title> [ttl_days] | expire <fingerprint> <ttl_days> | delete <fingerprint> [--force]]"
+	dateFormat = "2006-01-02"
+
+	listSubcommand   = "list"
+	addSubcommand    = "add"
+	expireSubcommand = "expire"
+	deleteSubcommand = "delete"
+)
+
+// Command manages the SSH keys of the user
+type Command struct {
+	Config     *config.Config
+	Args       *commandargs.Shell
+	ReadWriter *readwriter.ReadWriter
+}
+
+// Execute runs the subcommand given as argument: it lists the SSH keys of the
+// user by default
+func (c *Command) Execute(ctx context.Context) (context.Context, error) {
+	subcommand := listSubcommand
+	if len(c.Args.SSHArgs) > 1 {
+		subcommand = c.Args.SSHArgs[1]
+	}
+
+	switch subcommand {
+	case listSubcommand:
+		return ctx, c.listKeys(ctx)
+	case addSubcommand:
+		return c.addKey(ctx)
+	case expireSubcommand:
+		return c.expireKey(ctx)
+	case deleteSubcommand:
+		return c.deleteKey(ctx)
+	default:
+		return ctx, errors.New(usageText) //nolint:staticcheck // usageText is customer facing
+	}
+}
+
+// listKeys lists the SSH keys of the user, with their fingerprints and expiry
+func (c *Command) listKeys(ctx context.Context) error {
+	if len(c.Args.SSHArgs) > 2 {
+		return errors.New(usageText) //nolint:staticcheck // usageText is customer facing
+	}
+
+	slog.DebugContext(ctx, "sshkeys: listKeys: listing keys")
+
+	client, err := sshkeys.NewClient(c.Config)
+	if err != nil {
+		return err
+	}
+
+	keys, err := client.ListKeys(ctx, c.Args)
+	if err != nil {
+		return err
+	}
+
+	if c.Args.JSONOutput {
+		return c.writeJSON(keys)
+	}
+
+	c.printKeys(keys)
+
+	return nil
+}
+
+// jsonResponse is the JSON output of ssh_keys. ExpiresAt is null for keys
+// that don't expire.
+type jsonResponse struct {
+	Keys []jsonKey `json:"keys"`
+}
+
+type jsonKey struct {
+	ID          int64   `json:"id"`
+	Title       string  `json:"title"`
+	Fingerprint string  `json:"fingerprint"`
+	CreatedAt   string  `json:"created_at"`
+	ExpiresAt   *string `json:"expires_at"`
+}
+
+func newJSONKey(key *sshkeys.Key) jsonKey {
+	k := jsonKey{ID: key.ID, Title: key.Title, Fingerprint: key.Fingerprint, CreatedAt: key.CreatedAt}
+	if key.ExpiresAt != "" {
+		k.ExpiresAt = &key.ExpiresAt
+	}
+
+	return k
+}
+
+func (c *Command) writeJSON(keys []sshkeys.Key) error {
+	response := jsonResponse{Keys: []jsonKey{}}
+	for i := range keys {
+		response.Keys = append(response.Keys, newJSONKey(&keys[i]))
+	}
+
+	return jsonoutput.Write(c.ReadWriter.Out, response)
+}
+
+func (c *Command) printKeys(keys []sshkeys.Key) {
+	if len(keys) == 0 {
+		_, _ = fmt.Fprintln(c.ReadWriter.Out, "You have no SSH keys.")
+		return
+	}
+
+	w := tabwriter.NewWriter(c.ReadWriter.Out, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "FINGERPRINT\tTITLE\tCREATED\tEXPIRES")
+	for _, key := range keys {
+		expires := "never"
+		if key.ExpiresAt != "" {
+			expires = formatDate(key.ExpiresAt)
+		}
+
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.Fingerprint, key.Title, formatDate(key.CreatedAt), expires)
+	}
+	_ = w.Flush()
+}
+
+// formatDate returns the date part of an RFC 3339 timestamp, or the timestamp
+// as is if it isn't one.
+func formatDate(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+
+	return t.Format(dateFormat)
+}
@@ -0,0 +1,135 @@
+package sshkeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+func setup(t *testing.T) string {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/ssh_keys/list",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				defer r.Body.Close()
+
+				assert.NoError(t, err)
+
+				var requestBody *sshkeys.RequestBody
+				assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+				switch requestBody.KeyID {
+				case "1":
+					json.NewEncoder(w).Encode(map[string]interface{}{
+						"success": true,
+						"keys": []sshkeys.Key{
+							{ID: 1, Title: "Laptop", Fingerprint: "SHA256:laptop", CreatedAt: "2026-01-01T10:00:00Z", ExpiresAt: "2027-01-01T00:00:00Z"},
+							{ID: 2, Title: "CI runner", Fingerprint: "SHA256:ci", CreatedAt: "2026-02-01T10:00:00Z"},
+						},
+					})
+				case "2":
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "keys": []sshkeys.Key{}})
+				case "forbidden":
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Forbidden!"})
+				}
+			},
+		},
+	}
+
+	return testserver.StartSocketHTTPServer(t, requests)
+}
+
+func TestExecute(t *testing.T) {
+	url := setup(t)
+
+	testCases := []struct {
+		desc           string
+		keyID          string
+		arguments      []string
+		json           bool
+		expectedOutput string
+		expectedError  string
+	}{
+		{
+			desc:      "With keys",
+			keyID:     "1",
+			arguments: []string{"ssh_keys"},
+			expectedOutput: "FINGERPRINT    TITLE      CREATED     EXPIRES\n" +
+				"SHA256:laptop  Laptop     2026-01-01  2027-01-01\n" +
+				"SHA256:ci      CI runner  2026-02-01  never\n",
+		},
+		{
+			desc:           "With the list subcommand and no keys",
+			keyID:          "2",
+			arguments:      []string{"ssh_keys", "list"},
+			expectedOutput: "You have no SSH keys.\n",
+		},
+		{
+			desc:      "With JSON output",
+			keyID:     "1",
+			arguments: []string{"ssh_keys"},
+			json:      true,
+			expectedOutput: `{"keys":[` +
+				`{"id":1,"title":"Laptop","fingerprint":"SHA256:laptop","created_at":"2026-01-01T10:00:00Z","expires_at":"2027-01-01T00:00:00Z"},` +
+				`{"id":2,"title":"CI runner","fingerprint":"SHA256:ci","created_at":"2026-02-01T10:00:00Z","expires_at":null}]}` + "\n",
+		},
+		{
+			desc:           "With JSON output and no keys",
+			keyID:          "2",
+			arguments:      []string{"ssh_keys"},
+			json:           true,
+			expectedOutput: `{"keys":[]}` + "\n",
+		},
+		{
+			desc:          "With an unknown subcommand",
+			keyID:         "1",
+			arguments:     []string{"ssh_keys", "purge"},
+			expectedError: usageText,
+		},
+		{
+			desc:          "With too many arguments",
+			keyID:         "1",
+			arguments:     []string{"ssh_keys", "list", "SHA256:laptop"},
+			expectedError: usageText,
+		},
+		{
+			desc:          "With an error",
+			keyID:         "forbidden",
+			arguments:     []string{"ssh_keys"},
+			expectedError: "Forbidden!",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			cmd := &Command{
+				Config:     &config.Config{GitlabURL: url},
+				Args:       &commandargs.Shell{GitlabKeyID: tc.keyID, SSHArgs: tc.arguments, JSONOutput: tc.json},
+				ReadWriter: &readwriter.ReadWriter{Out: output},
+			}
+
+			_, err := cmd.Execute(context.Background())
+
+			if tc.expectedError != "" {
+				require.EqualError(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tc.expectedOutput, output.String())
+		})
+	}
+}
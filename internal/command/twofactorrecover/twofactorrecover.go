@@ -12,6 +12,7 @@ import (
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/twofactorrecover"
 )
@@ -29,7 +30,11 @@ type Command struct {
 func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	slog.DebugContext(ctx, "twofactorrecover: execute: Waiting for user input")
 
-	if c.getUserAnswer(ctx) == "yes" {
+	if c.Args.JSONOutput {
+		return ctx, c.executeJSON(ctx)
+	}
+
+	if c.getUserAnswer(ctx, c.ReadWriter.Out) == "yes" {
 		slog.DebugContext(ctx, "twofactorrecover: execute: User chose to continue")
 		c.displayRecoveryCodes(ctx)
 	} else {
@@ -40,11 +45,35 @@ func (c *Command) Execute(ctx context.Context) (context.Context, error) {
 	return ctx, nil
 }
 
-func (c *Command) getUserAnswer(ctx context.Context) string {
+// jsonResponse is the JSON output of 2fa_recovery_codes
+type jsonResponse struct {
+	Generated     bool     `json:"generated"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// executeJSON generates new recovery codes, writing them as JSON. The question
+// is asked on stderr, and errors are returned rather than printed.
+func (c *Command) executeJSON(ctx context.Context) error {
+	response := jsonResponse{RecoveryCodes: []string{}}
+
+	if c.getUserAnswer(ctx, c.ReadWriter.ErrOut) == "yes" {
+		codes, err := c.getRecoveryCodes(ctx)
+		if err != nil {
+			return err
+		}
+
+		response.Generated = true
+		response.RecoveryCodes = codes
+	}
+
+	return jsonoutput.Write(c.ReadWriter.Out, response)
+}
+
+func (c *Command) getUserAnswer(ctx context.Context, out io.Writer) string {
 	question :=
 		"Are you sure you want to generate new two-factor recovery codes?\n" +
 			"Any existing recovery codes you saved will be invalidated. (yes/no)"
-	_, _ = fmt.Fprintln(c.ReadWriter.Out, question)
+	_, _ = fmt.Fprintln(out, question)
 
 	var answer string
 	if _, err := fmt.Fscanln(io.LimitReader(c.ReadWriter.In, readerLimit), &answer); err != nil {
@@ -141,3 +141,60 @@ func TestExecute(t *testing.T) {
 		})
 	}
 }
+
+func TestExecuteJSON(t *testing.T) {
+	setup(t)
+
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	testCases := []struct {
+		desc           string
+		arguments      *commandargs.Shell
+		answer         string
+		expectedOutput string
+		expectedError  string
+	}{
+		{
+			desc:           "With a known key id",
+			arguments:      &commandargs.Shell{GitlabKeyID: "1", JSONOutput: true},
+			answer:         answerYes,
+			expectedOutput: `{"generated":true,"recovery_codes":["recovery","codes"]}` + "\n",
+		},
+		{
+			desc:           "With negative answer",
+			arguments:      &commandargs.Shell{GitlabKeyID: "1", JSONOutput: true},
+			answer:         "no\n",
+			expectedOutput: `{"generated":false,"recovery_codes":[]}` + "\n",
+		},
+		{
+			desc:          "With API returns an error",
+			arguments:     &commandargs.Shell{GitlabKeyID: "forbidden", JSONOutput: true},
+			answer:        answerYes,
+			expectedError: "Forbidden!",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			errOutput := &bytes.Buffer{}
+			input := bytes.NewBufferString(tc.answer)
+
+			cmd := &Command{
+				Config:     &config.Config{GitlabURL: url},
+				Args:       tc.arguments,
+				ReadWriter: &readwriter.ReadWriter{Out: output, In: input, ErrOut: errOutput},
+			}
+
+			_, err := cmd.Execute(context.Background())
+
+			if tc.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tc.expectedError)
+			}
+			require.Equal(t, tc.expectedOutput, output.String())
+			require.Equal(t, question[:len(question)-1], errOutput.String())
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package verifysignature
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSHSIG format, as made by `ssh-keygen -Y sign`, is described in
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+const (
+	sigMagic      = "SSHSIG"
+	sigVersion    = 1
+	sigArmorBegin = "-----BEGIN SSH SIGNATURE-----"
+	sigArmorEnd   = "-----END SSH SIGNATURE-----"
+)
+
+var (
+	errInvalidSignature       = errors.New("invalid SSH signature")
+	errUnsupportedHash        = errors.New("unsupported SSH signature hash algorithm")
+	errSignatureVerification  = errors.New("SSH signature verification failed")
+	errUnsupportedRSASignFunc = errors.New("RSA SSH signatures must use SHA-2")
+)
+
+// sigBlob is the binary form of a signature, following the magic preamble.
+type sigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// signedData is what's signed, following the magic preamble.
+type signedData struct {
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// signature is a parsed SSHSIG signature.
+type signature struct {
+	publicKey     ssh.PublicKey
+	namespace     string
+	hashAlgorithm string
+	signature     *ssh.Signature
+}
+
+// parseSignature parses an armored SSHSIG signature.
+func parseSignature(armored []byte) (*signature, error) {
+	body, ok := strings.CutPrefix(strings.TrimSpace(string(armored)), sigArmorBegin)
+	if !ok {
+		return nil, errInvalidSignature
+	}
+
+	body, ok = strings.CutSuffix(body, sigArmorEnd)
+	if !ok {
+		return nil, errInvalidSignature
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	raw, ok = bytes.CutPrefix(raw, []byte(sigMagic))
+	if !ok {
+		return nil, errInvalidSignature
+	}
+
+	var blob sigBlob
+	if err := ssh.Unmarshal(raw, &blob); err != nil || blob.Version != sigVersion {
+		return nil, errInvalidSignature
+	}
+
+	publicKey, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(blob.Signature, sig); err != nil {
+		return nil, errInvalidSignature
+	}
+
+	return &signature{
+		publicKey:     publicKey,
+		namespace:     blob.Namespace,
+		hashAlgorithm: blob.HashAlgorithm,
+		signature:     sig,
+	}, nil
+}
+
+// verify checks that the signature was made over message.
+func (s *signature) verify(message []byte) error {
+	var h hash.Hash
+	switch s.hashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return errUnsupportedHash
+	}
+	h.Write(message)
+
+	if s.signature.Format == ssh.KeyAlgoRSA {
+		return errUnsupportedRSASignFunc
+	}
+
+	data := append([]byte(sigMagic), ssh.Marshal(signedData{
+		Namespace:     s.namespace,
+		HashAlgorithm: s.hashAlgorithm,
+		Hash:          h.Sum(nil),
+	})...)
+
+	if err := s.publicKey.Verify(data, s.signature); err != nil {
+		return errSignatureVerification
+	}
+
+	return nil
+}
+
+// fingerprint returns the SHA256 fingerprint of the key that made the
+// signature. The key of a certificate is used when signed with one.
+func (s *signature) fingerprint() string {
+	if cert, ok := s.publicKey.(*ssh.Certificate); ok {
+		return ssh.FingerprintSHA256(cert.Key)
+	}
+
+	return ssh.FingerprintSHA256(s.publicKey)
+}
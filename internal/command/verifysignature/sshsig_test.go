@@ -0,0 +1,162 @@
+package verifysignature
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// Signatures of "abc123" in the sign-in@example.com namespace, made with
+// `ssh-keygen -Y sign`
+const (
+	ed25519Fingerprint = "SHA256:pvacySr7Cb3Mtf3SztfiDhTb3jmOYRIvlDPNom1E3eU"
+	ed25519Signature   = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgqQw4M/3SKkwiMY8sUkFm806fVV
+PWqh/5C9Y3SvzNE08AAAATc2lnbi1pbkBleGFtcGxlLmNvbQAAAAAAAAAGc2hhNTEyAAAA
+UwAAAAtzc2gtZWQyNTUxOQAAAEBW94AA2IQZaAyZ2K53O4tcTki11RjM9B6KlSVBzYA3Tm
+PtCASweu84c5TjmZa3KJXqwUEtyRTom2AftuVlKTwP
+-----END SSH SIGNATURE-----
+`
+	rsaFingerprint = "SHA256:rrg58S1HiTJkaNch69f/nRLEJ+RbySCmf/bKWc6V+Z8"
+	rsaSignature   = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAARcAAAAHc3NoLXJzYQAAAAMBAAEAAAEBALRPWfkjwaPsSKqLI0NLyB
+NCg8/BJAF6k27kTax0KQX2gn969/znjEU3arCtQBHDQhjbCpsi+ZFLeR1JjidFmol9lGzo
+IA1ECsIxr3hYVyyKDq2y4tHqbHD/xkQkKPHku+ieKBx0VmNlOQ6HYYsLFtlMvRYNo+i7/m
+G9ocQE3k2YjVMAEwie1O7jlzGhMUFOKk7mzFuutuYYE/ULfy+SUtyUIkK3adl4Z3bd/wxg
+wZq+WgN98eC9KxbFY1Jqwb5MgAjYgEahr+oxdL7qNqB5eURy0EQpoUdZMUSRNcOcl7oo4p
+OcztoOac0K2f4chvRwzzlUXuKxc/E/u/uigIVEk+8AAAATc2lnbi1pbkBleGFtcGxlLmNv
+bQAAAAAAAAAGc2hhNTEyAAABFAAAAAxyc2Etc2hhMi01MTIAAAEAgGC6Nt6kjx8wFNXZ7q
+tZ7vn9RuaTQ9AWEeWx8vzPRllFY2HP3+rc39edZHLU35VzF65na0YYBZKqkMPGOiqWIlfy
+tvkBprPbyMe8tWB0vGKzu9afwqHlHZXlqRDF5pvZajivRxkUoLLx2Rp2WwDpWxjBbSDgBQ
+Y0PhhVrPVH+nH8KVw0whk5MXOqq6A3ruMZ/SSKFsE7khlt5u5nGdfhuNEf+xCKPjx+WQ+Y
+AYFHX9LkyS0I5hBQN7guk/FLpORsgnkWMF+x1hujS7tYgrdCuOItqiC9qfk9NMOcAO5xkk
+J1ZBYx9GJqeroDlrqxZbs5fU2kwUOqSn+yaoHryJpq3A==
+-----END SSH SIGNATURE-----
+`
+)
+
+func TestParseSignature(t *testing.T) {
+	testCases := []struct {
+		desc                string
+		armored             string
+		expectedFingerprint string
+	}{
+		{desc: "Ed25519", armored: ed25519Signature, expectedFingerprint: ed25519Fingerprint},
+		{desc: "RSA", armored: rsaSignature, expectedFingerprint: rsaFingerprint},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sig, err := parseSignature([]byte(tc.armored))
+			require.NoError(t, err)
+			require.Equal(t, "sign-in@example.com", sig.namespace)
+			require.Equal(t, tc.expectedFingerprint, sig.fingerprint())
+
+			require.NoError(t, sig.verify([]byte("abc123")))
+			require.ErrorIs(t, sig.verify([]byte("abc124")), errSignatureVerification)
+		})
+	}
+}
+
+func TestParseInvalidSignature(t *testing.T) {
+	testCases := []struct {
+		desc    string
+		armored string
+	}{
+		{desc: "empty", armored: ""},
+		{desc: "no armor", armored: "U1NIU0lHAAAAAQ=="},
+		{desc: "no end", armored: "-----BEGIN SSH SIGNATURE-----\nU1NIU0lHAAAAAQ==\n"},
+		{desc: "invalid base64", armored: armor([]byte("SSHSIG"))[:40] + "!!\n-----END SSH SIGNATURE-----"},
+		{desc: "no magic", armored: armor([]byte("SSHSIH"))},
+		{desc: "truncated", armored: armor([]byte("SSHSIG\x00\x00\x00\x01"))},
+		{desc: "unknown version", armored: armor(append([]byte(sigMagic), ssh.Marshal(sigBlob{Version: 2})...))},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := parseSignature([]byte(tc.armored))
+			require.ErrorIs(t, err, errInvalidSignature)
+		})
+	}
+}
+
+func TestVerifySignatureAlgorithms(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edSigner, err := ssh.NewSignerFromKey(edKey)
+	require.NoError(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	rsaSigner, err := ssh.NewSignerFromKey(rsaKey)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc          string
+		signer        ssh.Signer
+		algorithm     string
+		hashAlgorithm string
+		expectedErr   error
+	}{
+		{desc: "SHA-256", signer: edSigner, hashAlgorithm: "sha256"},
+		{desc: "SHA-512", signer: edSigner, hashAlgorithm: "sha512"},
+		{desc: "SHA-1", signer: edSigner, hashAlgorithm: "sha1", expectedErr: errUnsupportedHash},
+		{desc: "RSA with SHA-2", signer: rsaSigner, algorithm: ssh.KeyAlgoRSASHA256, hashAlgorithm: "sha512"},
+		{desc: "RSA with SHA-1", signer: rsaSigner, algorithm: ssh.KeyAlgoRSA, hashAlgorithm: "sha512", expectedErr: errUnsupportedRSASignFunc},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			armored := sign(t, tc.signer, tc.algorithm, "file", tc.hashAlgorithm, "message")
+
+			sig, err := parseSignature([]byte(armored))
+			require.NoError(t, err)
+			require.Equal(t, ssh.FingerprintSHA256(tc.signer.PublicKey()), sig.fingerprint())
+			require.ErrorIs(t, sig.verify([]byte("message")), tc.expectedErr)
+		})
+	}
+}
+
+// sign signs message like `ssh-keygen -Y sign` does, with the hash algorithm
+// and, if set, the signature algorithm given.
+func sign(t *testing.T, signer ssh.Signer, algorithm, namespace, hashAlgorithm, message string) string {
+	t.Helper()
+
+	var hash []byte
+	if hashAlgorithm == "sha256" {
+		sum := sha256.Sum256([]byte(message))
+		hash = sum[:]
+	} else {
+		sum := sha512.Sum512([]byte(message))
+		hash = sum[:]
+	}
+	data := append([]byte(sigMagic), ssh.Marshal(signedData{Namespace: namespace, HashAlgorithm: hashAlgorithm, Hash: hash})...)
+
+	var sig *ssh.Signature
+	var err error
+	if algorithm != "" {
+		sig, err = signer.(ssh.AlgorithmSigner).SignWithAlgorithm(rand.Reader, data, algorithm)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	require.NoError(t, err)
+
+	return armor(append([]byte(sigMagic), ssh.Marshal(sigBlob{
+		Version:       sigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: hashAlgorithm,
+		Signature:     ssh.Marshal(sig),
+	})...))
+}
+
+func armor(raw []byte) string {
+	return sigArmorBegin + "\n" + base64.StdEncoding.EncodeToString(raw) + "\n" + sigArmorEnd + "\n"
+}
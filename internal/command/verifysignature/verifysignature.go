@@ -0,0 +1,190 @@
+// Package verifysignature verifies SSH signatures made with the SSH key of the
+// user, and issues JWTs stating it for other services to trust
+package verifysignature
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/jsonoutput"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+const (
+	usageText       = "Usage: verify_signature <namespace> <challenge>"
+	defaultTokenTTL = 5 * time.Minute
+
+	// maxSignatureSize caps how much of stdin is read. Armored signatures
+	// of the largest RSA keys take a few kilobytes.
+	maxSignatureSize = 64 * 1024
+)
+
+var (
+	errKeyRequired       = errors.New("verify_signature requires authenticating with an SSH key")
+	errPersonalKey       = errors.New("verify_signature requires a personal SSH key")
+	errNamespaceMismatch = errors.New("the namespace of the SSH signature doesn't match")
+	errKeyMismatch       = errors.New("the SSH signature wasn't made with the key you're authenticated with")
+	errNotConfigured     = errors.New("signature verification isn't available")
+)
+
+// Command verifies an SSH signature read from stdin
+type Command struct {
+	Config     *config.Config
+	Args       *commandargs.Shell
+	ReadWriter *readwriter.ReadWriter
+}
+
+// Execute verifies that the SSH signature read from stdin was made over the
+// challenge in the namespace with the key the user is authenticated with, and
+// prints a JWT stating it
+func (c *Command) Execute(ctx context.Context) (context.Context, error) {
+	if len(c.Args.SSHArgs) != 3 {
+		return ctx, errors.New(usageText) //nolint:staticcheck // usageText is customer facing
+	}
+	namespace, challenge := c.Args.SSHArgs[1], c.Args.SSHArgs[2]
+
+	if c.Args.GitlabKeyID == "" {
+		return ctx, errKeyRequired
+	}
+
+	sig, err := c.readSignature(namespace, challenge)
+	if err != nil {
+		return ctx, err
+	}
+
+	userID, keyID, err := c.authenticatedKey(ctx, sig.fingerprint())
+	if err != nil {
+		return ctx, err
+	}
+
+	secret, err := c.readSecret(ctx)
+	if err != nil {
+		return ctx, err
+	}
+
+	ttl := time.Duration(c.Config.SignatureVerification.TokenTTL)
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+
+	token, err := client.SignSignatureJWT(secret, ttl, userID, keyID, namespace, challenge)
+	if err != nil {
+		return ctx, err
+	}
+
+	slog.InfoContext(ctx, "verifysignature: execute: signature verified",
+		slog.String("namespace", namespace),
+		slog.Int64("key_id", keyID),
+	)
+
+	if c.Args.JSONOutput {
+		return ctx, jsonoutput.Write(c.ReadWriter.Out, jsonResponse{Token: token})
+	}
+
+	_, _ = fmt.Fprintln(c.ReadWriter.Out, token)
+
+	return ctx, nil
+}
+
+// jsonResponse is the JSON output of verify_signature
+type jsonResponse struct {
+	Token string `json:"token"`
+}
+
+// readSignature reads the signature from stdin, and verifies it was made over
+// challenge in namespace.
+func (c *Command) readSignature(namespace, challenge string) (*signature, error) {
+	armored, err := io.ReadAll(io.LimitReader(c.ReadWriter.In, maxSignatureSize))
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := parseSignature(armored)
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.namespace != namespace {
+		return nil, errNamespaceMismatch
+	}
+
+	if err := sig.verify([]byte(challenge)); err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+// authenticatedKey returns the IDs of the user and of the key they're
+// authenticated with, which must have the given fingerprint.
+func (c *Command) authenticatedKey(ctx context.Context, fingerprint string) (int64, int64, error) {
+	discoverClient, err := discover.NewClient(c.Config)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	user, err := discoverClient.GetByCommandArgs(ctx, c.Args)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if user.IsAnonymous() {
+		return 0, 0, errPersonalKey
+	}
+
+	keysClient, err := sshkeys.NewClient(c.Config)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	keys, err := keysClient.ListKeys(ctx, c.Args)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, key := range keys {
+		if strconv.FormatInt(key.ID, 10) == c.Args.GitlabKeyID && key.Fingerprint == fingerprint {
+			return user.UserID, key.ID, nil
+		}
+	}
+
+	return 0, 0, errKeyMismatch
+}
+
+// readSecret reads the secret the JWTs are signed with. The secret shared
+// with GitLab is never used, as it authenticates gitlab-shell itself.
+func (c *Command) readSecret(ctx context.Context) (string, error) {
+	path := c.Config.SignatureVerification.SecretFile
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(c.Config.RootDir, path)
+	}
+
+	content, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		slog.ErrorContext(ctx, "verifysignature: readSecret: failed to read the secret", log.ErrorMessage(err.Error()))
+		return "", errNotConfigured
+	}
+
+	secret := strings.TrimSpace(string(content))
+	if secret == "" || secret == strings.TrimSpace(c.Config.Secret) {
+		slog.ErrorContext(ctx, "verifysignature: readSecret: the secret must be set, and differ from the GitLab secret")
+		return "", errNotConfigured
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,217 @@
+package verifysignature
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/sshkeys"
+)
+
+const signatureSecret = "signature-secret"
+
+func setup(t *testing.T) string {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Query().Get("key_id") == "3" {
+					json.NewEncoder(w).Encode(map[string]interface{}{})
+					return
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{"id": 7, "username": "alex"})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/list",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"success": true,
+					"keys": []sshkeys.Key{
+						{ID: 1, Title: "Laptop", Fingerprint: ed25519Fingerprint},
+						{ID: 2, Title: "Desktop", Fingerprint: rsaFingerprint},
+					},
+				})
+			},
+		},
+	}
+
+	return testserver.StartSocketHTTPServer(t, requests)
+}
+
+func TestExecute(t *testing.T) {
+	url := setup(t)
+
+	secretFile := filepath.Join(t.TempDir(), "signature_secret")
+	require.NoError(t, os.WriteFile(secretFile, []byte(signatureSecret+"\n"), 0o600))
+
+	cmd := &Command{
+		Config: &config.Config{
+			GitlabURL: url,
+			Secret:    "gitlab-secret",
+			SignatureVerification: config.SignatureVerificationConfig{
+				Enabled:    true,
+				SecretFile: secretFile,
+				TokenTTL:   config.YamlDuration(time.Minute),
+			},
+		},
+		Args: &commandargs.Shell{
+			GitlabKeyID: "2",
+			SSHArgs:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+		},
+		ReadWriter: &readwriter.ReadWriter{Out: &bytes.Buffer{}, In: strings.NewReader(rsaSignature)},
+	}
+
+	_, err := cmd.Execute(context.Background())
+	require.NoError(t, err)
+
+	claims := &client.SignatureClaims{}
+	token, err := jwt.ParseWithClaims(strings.TrimSpace(cmd.ReadWriter.Out.(*bytes.Buffer).String()), claims,
+		func(_ *jwt.Token) (interface{}, error) { return []byte(signatureSecret), nil })
+	require.NoError(t, err)
+	require.True(t, token.Valid)
+	require.Equal(t, int64(7), claims.UserID)
+	require.Equal(t, int64(2), claims.KeyID)
+	require.Equal(t, "sign-in@example.com", claims.Namespace)
+	require.Equal(t, "abc123", claims.Challenge)
+	require.WithinDuration(t, time.Now().Add(time.Minute), claims.ExpiresAt.Time, 2*time.Second)
+
+	// With JSON output
+	cmd.Args.JSONOutput = true
+	cmd.ReadWriter = &readwriter.ReadWriter{Out: &bytes.Buffer{}, In: strings.NewReader(rsaSignature)}
+
+	_, err = cmd.Execute(context.Background())
+	require.NoError(t, err)
+
+	var response map[string]string
+	require.NoError(t, json.Unmarshal(cmd.ReadWriter.Out.(*bytes.Buffer).Bytes(), &response))
+	require.Len(t, response, 1)
+	require.NotEmpty(t, response["token"])
+}
+
+func TestExecuteFailures(t *testing.T) {
+	url := setup(t)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "signature_secret"), []byte(signatureSecret), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "gitlab_secret"), []byte("gitlab-secret"), 0o600))
+
+	testCases := []struct {
+		desc          string
+		keyID         string
+		username      string
+		arguments     []string
+		signature     string
+		secretFile    string
+		expectedError string
+	}{
+		{
+			desc:          "With missing arguments",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com"},
+			signature:     ed25519Signature,
+			expectedError: usageText,
+		},
+		{
+			desc:          "With a username",
+			username:      "alex",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     ed25519Signature,
+			expectedError: errKeyRequired.Error(),
+		},
+		{
+			desc:          "With an invalid signature",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     "signature",
+			expectedError: errInvalidSignature.Error(),
+		},
+		{
+			desc:          "With another namespace",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "file", "abc123"},
+			signature:     ed25519Signature,
+			expectedError: errNamespaceMismatch.Error(),
+		},
+		{
+			desc:          "With another challenge",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc124"},
+			signature:     ed25519Signature,
+			expectedError: errSignatureVerification.Error(),
+		},
+		{
+			desc:          "With another key of the user",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     rsaSignature,
+			expectedError: errKeyMismatch.Error(),
+		},
+		{
+			desc:          "With a deploy key",
+			keyID:         "3",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     ed25519Signature,
+			expectedError: errPersonalKey.Error(),
+		},
+		{
+			desc:          "Without a secret",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     ed25519Signature,
+			secretFile:    "missing",
+			expectedError: errNotConfigured.Error(),
+		},
+		{
+			desc:          "With the GitLab secret",
+			keyID:         "1",
+			arguments:     []string{"verify_signature", "sign-in@example.com", "abc123"},
+			signature:     ed25519Signature,
+			secretFile:    "gitlab_secret",
+			expectedError: errNotConfigured.Error(),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			secretFile := tc.secretFile
+			if secretFile == "" {
+				secretFile = "signature_secret"
+			}
+
+			output := &bytes.Buffer{}
+			cmd := &Command{
+				Config: &config.Config{
+					GitlabURL: url,
+					RootDir:   dir,
+					Secret:    "gitlab-secret",
+					SignatureVerification: config.SignatureVerificationConfig{
+						Enabled:    true,
+						SecretFile: secretFile,
+					},
+				},
+				Args:       &commandargs.Shell{GitlabKeyID: tc.keyID, GitlabUsername: tc.username, SSHArgs: tc.arguments},
+				ReadWriter: &readwriter.ReadWriter{Out: output, In: strings.NewReader(tc.signature)},
+			}
+
+			_, err := cmd.Execute(context.Background())
+			require.EqualError(t, err, tc.expectedError)
+			require.Empty(t, output.String())
+		})
+	}
+}
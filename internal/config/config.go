@@ -4,6 +4,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -37,28 +38,220 @@ type GSSAPIConfig struct {
 	LibPath              string
 }
 
+// GitChannelConfig contains settings for the gitlab-git@gitlab.com SSH channel type.
+type GitChannelConfig struct {
+	Enabled                 bool  `yaml:"enabled,omitempty"`
+	ConcurrentChannelsLimit int64 `yaml:"concurrent_channels_limit,omitempty"`
+}
+
+// RateLimitConfig configures a token bucket. Rate is the number of tokens added
+// per second and Burst the size of the bucket. A zero Rate disables the limit.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate,omitempty"`
+	Burst int     `yaml:"burst,omitempty"`
+}
+
+// RateLimitsConfig contains the rate limits applied by gitlab-sshd.
+type RateLimitsConfig struct {
+	PerIP       RateLimitConfig `yaml:"per_ip,omitempty"`
+	PerIdentity RateLimitConfig `yaml:"per_identity,omitempty"`
+}
+
+// AuthorizedKeysCacheConfig configures the cache of authorized key lookups.
+// A zero Size disables the cache.
+type AuthorizedKeysCacheConfig struct {
+	Size        int          `yaml:"size,omitempty"`
+	TTL         YamlDuration `yaml:"ttl,omitempty"`
+	NegativeTTL YamlDuration `yaml:"negative_ttl,omitempty"`
+}
+
+// TwoFactorConfig configures the second factor asked at login, with
+// keyboard-interactive authentication, of the users GitLab requires SSH
+// two-factor authentication of. Timeout bounds how long the user has to answer
+// or approve the push notification.
+type TwoFactorConfig struct {
+	Enabled bool         `yaml:"enabled,omitempty"`
+	Timeout YamlDuration `yaml:"timeout,omitempty"`
+}
+
+// SecurityKeysConfig configures the policy on security keys, the FIDO/U2F
+// sk-ecdsa-sha2-nistp256@openssh.com and sk-ssh-ed25519@openssh.com keys.
+// RequireUserPresenceForPush refuses pushes over connections that aren't
+// authenticated with a security key the user touched.
+// RequireUserVerificationForPush would also require the user to have entered
+// their PIN, but the user verification flag of the signatures isn't exposed by
+// crypto/ssh, so it's rejected by Validate rather than silently ignored.
+type SecurityKeysConfig struct {
+	RequireUserPresenceForPush     bool `yaml:"require_user_presence_for_push,omitempty"`
+	RequireUserVerificationForPush bool `yaml:"require_user_verification_for_push,omitempty"`
+}
+
+// Validate checks that the security key policy can be enforced.
+func (c *SecurityKeysConfig) Validate() error {
+	if c.RequireUserVerificationForPush {
+		return errors.New("require_user_verification_for_push is not supported: the user verification flag of security key signatures isn't available")
+	}
+
+	return nil
+}
+
+// IPFilterConfig lists the networks, in CIDR notation or as single addresses,
+// that gitlab-sshd accepts connections from. Deny entries take precedence. When
+// there are allow entries, any other address is rejected. The files hold one
+// entry per line and are reloaded along with the keys.
+type IPFilterConfig struct {
+	Allow      []string `yaml:"allow,omitempty"`
+	Deny       []string `yaml:"deny,omitempty"`
+	AllowFiles []string `yaml:"allow_files,omitempty"`
+	DenyFiles  []string `yaml:"deny_files,omitempty"`
+}
+
+// BandwidthLimitConfig limits the rate data is sent to clients, in bytes per
+// second. Burst is how many bytes can be sent at once, and defaults to one
+// second worth. A zero Rate disables the limit.
+type BandwidthLimitConfig struct {
+	Rate  int64 `yaml:"rate,omitempty"`
+	Burst int64 `yaml:"burst,omitempty"`
+}
+
+// BandwidthLimitsConfig contains the limits gitlab-sshd applies to the output
+// of commands, per session and per user. Commands overrides them per command
+// type, such as git-upload-pack.
+type BandwidthLimitsConfig struct {
+	PerSession BandwidthLimitConfig                    `yaml:"per_session,omitempty"`
+	PerUser    BandwidthLimitConfig                    `yaml:"per_user,omitempty"`
+	Commands   map[string]CommandBandwidthLimitsConfig `yaml:"commands,omitempty"`
+}
+
+// CommandBandwidthLimitsConfig overrides the bandwidth limits of a command
+// type. A limit that isn't set is inherited.
+type CommandBandwidthLimitsConfig struct {
+	PerSession *BandwidthLimitConfig `yaml:"per_session,omitempty"`
+	PerUser    *BandwidthLimitConfig `yaml:"per_user,omitempty"`
+}
+
+// ForCommand returns the per-session and per-user limits of commandType, and
+// whether its per-user limit is its own rather than the one shared by all
+// command types.
+func (c *BandwidthLimitsConfig) ForCommand(commandType string) (perSession, perUser BandwidthLimitConfig, ownPerUser bool) {
+	perSession, perUser = c.PerSession, c.PerUser
+
+	override, ok := c.Commands[commandType]
+	if !ok {
+		return perSession, perUser, false
+	}
+
+	if override.PerSession != nil {
+		perSession = *override.PerSession
+	}
+	if override.PerUser != nil {
+		perUser = *override.PerUser
+	}
+
+	return perSession, perUser, override.PerUser != nil
+}
+
+// AcceptEnvConfig is an environment variable that gitlab-sshd accepts from
+// clients, besides GIT_PROTOCOL. Name is either a variable name or a pattern,
+// such as GL_OPTION_*. Gitaly and API pass accepted values on as Gitaly metadata
+// and to the internal API. Longer values than MaxLength, 256 bytes by default,
+// are refused.
+type AcceptEnvConfig struct {
+	Name      string `yaml:"name"`
+	Gitaly    bool   `yaml:"gitaly,omitempty"`
+	API       bool   `yaml:"api,omitempty"`
+	MaxLength int    `yaml:"max_length,omitempty"`
+}
+
+// AuthBansConfig configures the temporary bans of client IP addresses that
+// fail to authenticate repeatedly. An address is banned for BanTime once it has
+// failed MaxFailures times within FindTime, and each further ban lasts twice as
+// long as the previous one, up to MaxBanTime. A zero MaxFailures disables bans.
+type AuthBansConfig struct {
+	MaxFailures int          `yaml:"max_failures,omitempty"`
+	FindTime    YamlDuration `yaml:"find_time,omitempty"`
+	BanTime     YamlDuration `yaml:"ban_time,omitempty"`
+	MaxBanTime  YamlDuration `yaml:"max_ban_time,omitempty"`
+}
+
+// TrustedUserCAKeyConfig is a file of trusted user CA keys, along with how the
+// certificates they sign are mapped to GitLab users. In the config file, an
+// entry is either the path of the file, which maps the KeyId to the username,
+// or a map of the settings below.
+type TrustedUserCAKeyConfig struct {
+	File string `yaml:"file"`
+	// UsernameFrom is key_id, first_principal or principal. With principal,
+	// the username is taken from the first principal matching
+	// PrincipalTemplate, in which {username} stands for the username.
+	UsernameFrom      string `yaml:"username_from,omitempty"`
+	PrincipalTemplate string `yaml:"principal_template,omitempty"`
+	// Rewrite, when set, rewrites the username before it's looked up.
+	Rewrite *UsernameRewriteConfig `yaml:"rewrite,omitempty"`
+	// Namespaces pins the certificates to the namespaces at these full paths,
+	// as with group-level certificates. Without namespaces, the certificates
+	// give instance-wide access.
+	Namespaces []string `yaml:"namespaces,omitempty"`
+}
+
+// UsernameRewriteConfig rewrites usernames matching Pattern, a regular
+// expression, to Replacement, in which $1 stands for the first submatch.
+// Usernames that don't match Pattern are rejected.
+type UsernameRewriteConfig struct {
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// ListenerConfig is an address gitlab-sshd listens on, along with the settings
+// that apply to the connections accepted there. Listen is either a TCP address
+// or a Unix socket path prefixed with "unix:".
+type ListenerConfig struct {
+	Listen             string            `yaml:"listen"`
+	ProxyProtocol      bool              `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy        string            `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed       []string          `yaml:"proxy_allowed,omitempty"`
+	ProxyHeaderTimeout YamlDuration      `yaml:"proxy_header_timeout,omitempty"`
+	LoginGraceTime     YamlDuration      `yaml:"login_grace_time,omitempty"`
+	RateLimits         *RateLimitsConfig `yaml:"rate_limits,omitempty"`
+}
+
 // ServerConfig contains SSH server configuration options.
 type ServerConfig struct {
-	Listen                  string       `yaml:"listen,omitempty"`
-	ProxyProtocol           bool         `yaml:"proxy_protocol,omitempty"`
-	ProxyPolicy             string       `yaml:"proxy_policy,omitempty"`
-	ProxyAllowed            []string     `yaml:"proxy_allowed,omitempty"`
-	WebListen               string       `yaml:"web_listen,omitempty"`
-	ConcurrentSessionsLimit int64        `yaml:"concurrent_sessions_limit,omitempty"`
-	ClientAliveInterval     YamlDuration `yaml:"client_alive_interval,omitempty"`
-	GracePeriod             YamlDuration `yaml:"grace_period"`
-	ProxyHeaderTimeout      YamlDuration `yaml:"proxy_header_timeout"`
-	LoginGraceTime          YamlDuration `yaml:"login_grace_time"`
-	ReadinessProbe          string       `yaml:"readiness_probe"`
-	LivenessProbe           string       `yaml:"liveness_probe"`
-	HostKeyFiles            []string     `yaml:"host_key_files,omitempty"`
-	HostCertFiles           []string     `yaml:"host_cert_files,omitempty"`
-	TrustedUserCAKeys       []string     `yaml:"trusted_user_ca_keys,omitempty"`
-	MACs                    []string     `yaml:"macs"`
-	KexAlgorithms           []string     `yaml:"kex_algorithms"`
-	PublicKeyAlgorithms     []string     `yaml:"public_key_algorithms"`
-	Ciphers                 []string     `yaml:"ciphers"`
-	GSSAPI                  GSSAPIConfig `yaml:"gssapi,omitempty"`
+	Listen                  string                    `yaml:"listen,omitempty"`
+	ProxyProtocol           bool                      `yaml:"proxy_protocol,omitempty"`
+	ProxyPolicy             string                    `yaml:"proxy_policy,omitempty"`
+	ProxyAllowed            []string                  `yaml:"proxy_allowed,omitempty"`
+	Listeners               []ListenerConfig          `yaml:"listeners,omitempty"`
+	WebListen               string                    `yaml:"web_listen,omitempty"`
+	ConcurrentSessionsLimit int64                     `yaml:"concurrent_sessions_limit,omitempty"`
+	ClientAliveInterval     YamlDuration              `yaml:"client_alive_interval,omitempty"`
+	GracePeriod             YamlDuration              `yaml:"grace_period"`
+	ProxyHeaderTimeout      YamlDuration              `yaml:"proxy_header_timeout"`
+	LoginGraceTime          YamlDuration              `yaml:"login_grace_time"`
+	SessionIdleTimeout      YamlDuration              `yaml:"session_idle_timeout,omitempty"`
+	MaxSessionDuration      YamlDuration              `yaml:"max_session_duration,omitempty"`
+	ReadinessProbe          string                    `yaml:"readiness_probe"`
+	LivenessProbe           string                    `yaml:"liveness_probe"`
+	HostKeyFiles            []string                  `yaml:"host_key_files,omitempty"`
+	HostCertFiles           []string                  `yaml:"host_cert_files,omitempty"`
+	TrustedUserCAKeys       []TrustedUserCAKeyConfig  `yaml:"trusted_user_ca_keys,omitempty"`
+	RevokedKeys             []string                  `yaml:"revoked_keys,omitempty"`
+	KeyReloadInterval       YamlDuration              `yaml:"key_reload_interval,omitempty"`
+	MACs                    []string                  `yaml:"macs"`
+	KexAlgorithms           []string                  `yaml:"kex_algorithms"`
+	PublicKeyAlgorithms     []string                  `yaml:"public_key_algorithms"`
+	Ciphers                 []string                  `yaml:"ciphers"`
+	GSSAPI                  GSSAPIConfig              `yaml:"gssapi,omitempty"`
+	GitChannel              GitChannelConfig          `yaml:"git_channel,omitempty"`
+	RateLimits              RateLimitsConfig          `yaml:"rate_limits,omitempty"`
+	AuthorizedKeysCache     AuthorizedKeysCacheConfig `yaml:"authorized_keys_cache,omitempty"`
+	IPFilter                IPFilterConfig            `yaml:"ip_filter,omitempty"`
+	AuthBans                AuthBansConfig            `yaml:"auth_bans,omitempty"`
+	TwoFactor               TwoFactorConfig           `yaml:"two_factor,omitempty"`
+	SecurityKeys            SecurityKeysConfig        `yaml:"security_keys,omitempty"`
+	AdminTokenFile          string                    `yaml:"admin_token_file,omitempty"`
+	BandwidthLimits         BandwidthLimitsConfig     `yaml:"bandwidth_limits,omitempty"`
+	AcceptEnv               []AcceptEnvConfig         `yaml:"accept_env,omitempty"`
+	InteractiveShell        bool                      `yaml:"interactive_shell,omitempty"`
 }
 
 // HTTPSettingsConfig are HTTP related settings
@@ -81,6 +274,16 @@ type PATConfig struct {
 	AllowedScopes []string `yaml:"allowed_scopes,omitempty"`
 }
 
+// SignatureVerificationConfig contains the settings of the verify_signature
+// command, which issues JWTs to users who prove possession of their SSH keys.
+type SignatureVerificationConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// SecretFile holds the secret the JWTs are signed with, which must differ
+	// from the secret shared with GitLab.
+	SecretFile string       `yaml:"secret_file,omitempty"`
+	TokenTTL   YamlDuration `yaml:"token_ttl,omitempty"`
+}
+
 // Config represents the main gitlab-shell configuration.
 type Config struct {
 	User                  string `yaml:"user,omitempty"`
@@ -100,6 +303,8 @@ type Config struct {
 	LFSConfig      LFSConfig          `yaml:"lfs"`
 	PATConfig      PATConfig          `yaml:"pat"`
 
+	SignatureVerification SignatureVerificationConfig `yaml:"signature_verification,omitempty"`
+
 	// TopologyService contains Topology Service client configuration for Cells routing.
 	TopologyService topology.Config `yaml:"topology_service"`
 
@@ -129,12 +334,23 @@ var (
 		Listen:                  "[::]:22",
 		WebListen:               "localhost:9122",
 		ConcurrentSessionsLimit: 10,
-		GracePeriod:             YamlDuration(10 * time.Second),
-		ClientAliveInterval:     YamlDuration(15 * time.Second),
-		ProxyHeaderTimeout:      YamlDuration(500 * time.Millisecond),
-		LoginGraceTime:          YamlDuration(60 * time.Second),
-		ReadinessProbe:          "/start",
-		LivenessProbe:           "/health",
+		GitChannel:              GitChannelConfig{ConcurrentChannelsLimit: 100},
+		AuthorizedKeysCache: AuthorizedKeysCacheConfig{
+			TTL:         YamlDuration(time.Minute),
+			NegativeTTL: YamlDuration(10 * time.Second),
+		},
+		AuthBans: AuthBansConfig{
+			FindTime:   YamlDuration(10 * time.Minute),
+			BanTime:    YamlDuration(10 * time.Minute),
+			MaxBanTime: YamlDuration(24 * time.Hour),
+		},
+		TwoFactor:           TwoFactorConfig{Timeout: YamlDuration(30 * time.Second)},
+		GracePeriod:         YamlDuration(10 * time.Second),
+		ClientAliveInterval: YamlDuration(15 * time.Second),
+		ProxyHeaderTimeout:  YamlDuration(500 * time.Millisecond),
+		LoginGraceTime:      YamlDuration(60 * time.Second),
+		ReadinessProbe:      "/start",
+		LivenessProbe:       "/health",
 		HostKeyFiles: []string{
 			"/run/secrets/ssh-hostkeys/ssh_host_rsa_key",
 			"/run/secrets/ssh-hostkeys/ssh_host_ecdsa_key",
@@ -160,6 +376,65 @@ func (d *YamlDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// UnmarshalYAML implements custom YAML unmarshaling for TrustedUserCAKeyConfig,
+// accepting both the path of the file and a map of settings.
+func (c *TrustedUserCAKeyConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var file string
+	if err := unmarshal(&file); err == nil {
+		*c = TrustedUserCAKeyConfig{File: file}
+		return nil
+	}
+
+	type plain TrustedUserCAKeyConfig
+	return unmarshal((*plain)(c))
+}
+
+// TrustedUserCAKeyFiles returns the files of the trusted user CA keys.
+func (c *ServerConfig) TrustedUserCAKeyFiles() []string {
+	files := make([]string, 0, len(c.TrustedUserCAKeys))
+	for _, caKey := range c.TrustedUserCAKeys {
+		files = append(files, caKey.File)
+	}
+
+	return files
+}
+
+// ListenerConfigs returns the listeners gitlab-sshd serves. When no listeners
+// are configured, there's a single one built from the top-level settings.
+// Otherwise, the proxy_header_timeout, login_grace_time and rate_limits of a
+// listener default to the top-level ones, while its PROXY protocol settings
+// are its own.
+func (c *ServerConfig) ListenerConfigs() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{
+			Listen:             c.Listen,
+			ProxyProtocol:      c.ProxyProtocol,
+			ProxyPolicy:        c.ProxyPolicy,
+			ProxyAllowed:       c.ProxyAllowed,
+			ProxyHeaderTimeout: c.ProxyHeaderTimeout,
+			LoginGraceTime:     c.LoginGraceTime,
+			RateLimits:         &c.RateLimits,
+		}}
+	}
+
+	listeners := make([]ListenerConfig, 0, len(c.Listeners))
+	for _, listener := range c.Listeners {
+		if listener.ProxyHeaderTimeout == 0 {
+			listener.ProxyHeaderTimeout = c.ProxyHeaderTimeout
+		}
+		if listener.LoginGraceTime == 0 {
+			listener.LoginGraceTime = c.LoginGraceTime
+		}
+		if listener.RateLimits == nil {
+			listener.RateLimits = &c.RateLimits
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	return listeners
+}
+
 // ApplyGlobalState applies configuration settings that affect global process state,
 // such as environment variables.
 func (c *Config) ApplyGlobalState() {
@@ -277,6 +552,10 @@ func newFromFile(path string) (*Config, error) {
 		cfg.TopologyClient = topology.NewClient(&cfg.TopologyService)
 	}
 
+	if err := cfg.Server.SecurityKeys.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid security_keys config: %w", err)
+	}
+
 	return cfg, nil
 }
 
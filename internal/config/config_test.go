@@ -49,7 +49,7 @@ func TestCustomPrometheusMetrics(t *testing.T) {
 	require.NoError(t, err)
 
 	var actualNames []string
-	for _, m := range ms[0:12] {
+	for _, m := range ms[0:17] {
 		actualNames = append(actualNames, m.GetName())
 	}
 
@@ -57,7 +57,12 @@ func TestCustomPrometheusMetrics(t *testing.T) {
 		"gitlab_shell_http_in_flight_requests",
 		"gitlab_shell_http_request_duration_seconds",
 		"gitlab_shell_http_requests_total",
+		"gitlab_shell_sshd_auth_ban_rejected_connections_total",
+		"gitlab_shell_sshd_auth_bans_total",
+		"gitlab_shell_sshd_concurrent_limited_git_channels_total",
 		"gitlab_shell_sshd_concurrent_limited_sessions_total",
+		"gitlab_shell_sshd_git_channel_duration_seconds",
+		"gitlab_shell_sshd_git_channels_in_flight",
 		"gitlab_shell_sshd_in_flight_connections",
 		"gitlab_shell_sshd_session_duration_seconds",
 		"gitlab_shell_sshd_session_established_duration_seconds",
@@ -108,6 +113,93 @@ func TestYAMLDuration(t *testing.T) {
 	}
 }
 
+func TestTrustedUserCAKeyConfig(t *testing.T) {
+	yamlData := `
+sshd:
+  trusted_user_ca_keys:
+    - /etc/gitlab/ssh_user_ca.pub
+    - file: /etc/gitlab/corp_ca.pub
+      username_from: principal
+      principal_template: "{username}@corp.example.com"
+      rewrite:
+        pattern: "^(.+)-admin$"
+        replacement: "$1"
+    - file: /etc/gitlab/payments_ca.pub
+      namespaces: [payments, shared/tools]
+`
+	var cfg Config
+	require.NoError(t, yaml.Unmarshal([]byte(yamlData), &cfg))
+
+	require.Equal(t, []TrustedUserCAKeyConfig{
+		{File: "/etc/gitlab/ssh_user_ca.pub"},
+		{
+			File:              "/etc/gitlab/corp_ca.pub",
+			UsernameFrom:      "principal",
+			PrincipalTemplate: "{username}@corp.example.com",
+			Rewrite:           &UsernameRewriteConfig{Pattern: "^(.+)-admin$", Replacement: "$1"},
+		},
+		{File: "/etc/gitlab/payments_ca.pub", Namespaces: []string{"payments", "shared/tools"}},
+	}, cfg.Server.TrustedUserCAKeys)
+	require.Equal(t, []string{"/etc/gitlab/ssh_user_ca.pub", "/etc/gitlab/corp_ca.pub", "/etc/gitlab/payments_ca.pub"}, cfg.Server.TrustedUserCAKeyFiles())
+}
+
+func TestListenerConfigs(t *testing.T) {
+	t.Run("single listener from the top-level settings", func(t *testing.T) {
+		cfg := DefaultServerConfig
+		cfg.ProxyProtocol = true
+		cfg.ProxyPolicy = "require"
+		cfg.RateLimits.PerIP = RateLimitConfig{Rate: 1}
+
+		listeners := cfg.ListenerConfigs()
+		require.Len(t, listeners, 1)
+		require.Equal(t, "[::]:22", listeners[0].Listen)
+		require.True(t, listeners[0].ProxyProtocol)
+		require.Equal(t, "require", listeners[0].ProxyPolicy)
+		require.Equal(t, 500*time.Millisecond, time.Duration(listeners[0].ProxyHeaderTimeout))
+		require.Equal(t, 60*time.Second, time.Duration(listeners[0].LoginGraceTime))
+		require.Equal(t, RateLimitConfig{Rate: 1}, listeners[0].RateLimits.PerIP)
+	})
+
+	t.Run("listeners default to the top-level settings", func(t *testing.T) {
+		yamlData := `
+sshd:
+  proxy_protocol: true
+  login_grace_time: 30s
+  rate_limits:
+    per_ip:
+      rate: 1
+  listeners:
+    - listen: "[::]:2222"
+    - listen: "[::]:22"
+      proxy_protocol: true
+      proxy_policy: require
+      login_grace_time: 10s
+      rate_limits:
+        per_identity:
+          rate: 2
+    - listen: "unix:/run/gitlab-sshd.sock"
+`
+		cfg := Config{Server: DefaultServerConfig}
+		require.NoError(t, yaml.Unmarshal([]byte(yamlData), &cfg))
+
+		listeners := cfg.Server.ListenerConfigs()
+		require.Len(t, listeners, 3)
+
+		require.Equal(t, "[::]:2222", listeners[0].Listen)
+		require.False(t, listeners[0].ProxyProtocol)
+		require.Equal(t, 30*time.Second, time.Duration(listeners[0].LoginGraceTime))
+		require.Equal(t, 500*time.Millisecond, time.Duration(listeners[0].ProxyHeaderTimeout))
+		require.Equal(t, RateLimitConfig{Rate: 1}, listeners[0].RateLimits.PerIP)
+
+		require.True(t, listeners[1].ProxyProtocol)
+		require.Equal(t, "require", listeners[1].ProxyPolicy)
+		require.Equal(t, 10*time.Second, time.Duration(listeners[1].LoginGraceTime))
+		require.Equal(t, RateLimitsConfig{PerIdentity: RateLimitConfig{Rate: 2}}, *listeners[1].RateLimits)
+
+		require.Equal(t, "unix:/run/gitlab-sshd.sock", listeners[2].Listen)
+	})
+}
+
 func TestTopologyServiceConfig(t *testing.T) {
 	t.Run("default test config has topology_service disabled", func(t *testing.T) {
 		testRoot := testhelper.PrepareTestRootDir(t)
@@ -223,3 +315,53 @@ topology_service:
 		require.Contains(t, err.Error(), "address is required")
 	})
 }
+
+func TestSecurityKeysConfigValidation(t *testing.T) {
+	require.NoError(t, (&SecurityKeysConfig{RequireUserPresenceForPush: true}).Validate())
+
+	tmpDir := t.TempDir()
+	require.NoError(t, os.WriteFile(tmpDir+"/.gitlab_shell_secret", []byte("test-secret"), 0o600))
+	require.NoError(t, os.WriteFile(tmpDir+"/config.yml", []byte(`
+sshd:
+  security_keys:
+    require_user_presence_for_push: true
+    require_user_verification_for_push: true
+`), 0o600))
+
+	_, err := NewFromDir(tmpDir)
+	require.ErrorContains(t, err, "invalid security_keys config: require_user_verification_for_push is not supported")
+}
+
+func TestBandwidthLimitsForCommand(t *testing.T) {
+	unlimited := BandwidthLimitConfig{}
+	archive := BandwidthLimitConfig{Rate: 100}
+
+	cfg := BandwidthLimitsConfig{
+		PerSession: BandwidthLimitConfig{Rate: 1000, Burst: 2000},
+		PerUser:    BandwidthLimitConfig{Rate: 5000},
+		Commands: map[string]CommandBandwidthLimitsConfig{
+			"git-receive-pack":   {PerSession: &unlimited},
+			"git-upload-archive": {PerUser: &archive},
+		},
+	}
+
+	testCases := []struct {
+		commandType string
+		perSession  BandwidthLimitConfig
+		perUser     BandwidthLimitConfig
+		ownPerUser  bool
+	}{
+		{commandType: "git-upload-pack", perSession: cfg.PerSession, perUser: cfg.PerUser},
+		{commandType: "git-receive-pack", perSession: unlimited, perUser: cfg.PerUser},
+		{commandType: "git-upload-archive", perSession: cfg.PerSession, perUser: archive, ownPerUser: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.commandType, func(t *testing.T) {
+			perSession, perUser, ownPerUser := cfg.ForCommand(tc.commandType)
+			require.Equal(t, tc.perSession, perSession)
+			require.Equal(t, tc.perUser, perUser)
+			require.Equal(t, tc.ownPerUser, ownPerUser)
+		})
+	}
+}
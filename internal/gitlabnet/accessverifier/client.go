@@ -4,14 +4,17 @@ package accessverifier
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 
 	pb "gitlab.com/gitlab-org/gitaly/v18/proto/go/gitalypb"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/topology"
 )
 
@@ -20,6 +23,24 @@ const (
 	anyChanges  = "_any"
 )
 
+var (
+	// ErrReadOnlyCertificate is returned when a write action is attempted with
+	// an SSH certificate allowing read access only.
+	ErrReadOnlyCertificate = errors.New("Your SSH certificate only allows read access") //nolint:staticcheck // message is customer facing
+
+	// ErrProjectNotAllowed is returned when a project the SSH certificate
+	// doesn't list is accessed.
+	ErrProjectNotAllowed = errors.New("Your SSH certificate doesn't allow access to this project") //nolint:staticcheck // message is customer facing
+
+	// ErrUserPresenceRequired is returned when pushing over a connection that
+	// isn't authenticated with a security key the user touched.
+	ErrUserPresenceRequired = errors.New("Pushing requires authenticating with a security key you touch") //nolint:staticcheck // message is customer facing
+)
+
+// readActions are the actions an SSH certificate allowing read access only
+// narrows the actions to.
+var readActions = []commandargs.CommandType{commandargs.UploadPack, commandargs.UploadArchive}
+
 // Client is a client for accessing resources
 type Client struct {
 	client   *client.GitlabNetClient
@@ -39,6 +60,12 @@ type Request struct {
 	// NamespacePath is the full path of the namespace in which the authenticated
 	// user is allowed to perform operation.
 	NamespacePath string `json:"namespace_path,omitempty"`
+	// SecurityKeyUserPresence tells that the connection is authenticated with
+	// a security key the user touched.
+	SecurityKeyUserPresence bool `json:"security_key_user_presence,omitempty"`
+	// Env holds the environment variables sent by the client that are
+	// forwarded to the internal API.
+	Env map[string]string `json:"env,omitempty"`
 }
 
 // Gitaly represents Gitaly server information
@@ -111,12 +138,22 @@ func NewClient(config *config.Config) (*Client, error) {
 
 // Verify verifies access to a GitLab resource
 func (c *Client) Verify(ctx context.Context, args *commandargs.Shell, action commandargs.CommandType, repo string) (*Response, error) {
+	if err := checkCertificatePolicy(args.Env, action, repo); err != nil {
+		return nil, err
+	}
+
+	if action == commandargs.ReceivePack && args.Env.PushRequiresUserPresence && !args.Env.SecurityKeyUserPresence {
+		return nil, ErrUserPresenceRequired
+	}
+
 	request := &Request{
-		Action:        action,
-		Repo:          repo,
-		Changes:       anyChanges,
-		Protocol:      sshProtocol,
-		NamespacePath: args.Env.NamespacePath,
+		Action:                  action,
+		Repo:                    repo,
+		Changes:                 anyChanges,
+		Protocol:                sshProtocol,
+		NamespacePath:           args.Env.NamespacePath,
+		SecurityKeyUserPresence: args.Env.SecurityKeyUserPresence,
+		Env:                     args.Env.APIVariables(),
 	}
 
 	switch {
@@ -146,6 +183,20 @@ func (c *Client) Verify(ctx context.Context, args *commandargs.Shell, action com
 	return resp, nil
 }
 
+// checkCertificatePolicy narrows the actions to the ones allowed by the SSH
+// certificate the connection is authenticated with, before asking GitLab.
+func checkCertificatePolicy(env sshenv.Env, action commandargs.CommandType, repo string) error {
+	if env.ReadOnly && !slices.Contains(readActions, action) {
+		return ErrReadOnlyCertificate
+	}
+
+	if !env.AllowsProject(repo) {
+		return ErrProjectNotAllowed
+	}
+
+	return nil
+}
+
 func parse(hr *http.Response, args *commandargs.Shell) (*Response, error) {
 	response := &Response{}
 	if err := gitlabnet.ParseJSON(hr, response); err != nil {
@@ -253,6 +253,105 @@ func TestCheckIP(t *testing.T) {
 	}
 }
 
+func TestForwardedEnv(t *testing.T) {
+	client := setupWithAPIInspector(t,
+		func(r *Request) {
+			require.Equal(t, map[string]string{"GL_OPTION_CI_SKIP": "true"}, r.Env)
+		})
+
+	sshEnv := sshenv.Env{
+		Variables: []sshenv.Variable{
+			{Name: "GL_OPTION_CI_SKIP", Value: "true", API: true},
+			{Name: "GIT_TRACE2_PARENT_SID", Value: "sid", Gitaly: true},
+		},
+	}
+	client.Verify(context.Background(), &commandargs.Shell{Env: sshEnv}, uploadPackAction, repo)
+}
+
+func TestForwardedSecurityKeyUserPresence(t *testing.T) {
+	client := setupWithAPIInspector(t,
+		func(r *Request) {
+			require.True(t, r.SecurityKeyUserPresence)
+		})
+
+	sshEnv := sshenv.Env{SecurityKeyUserPresence: true}
+	client.Verify(context.Background(), &commandargs.Shell{Env: sshEnv}, uploadPackAction, repo)
+}
+
+func TestCertificatePolicy(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+	okResponse := testResponse{body: responseBody(t, testRoot, "allowed.json"), status: http.StatusOK}
+	client := setup(t, map[string]testResponse{"first": okResponse}, nil)
+
+	testCases := []struct {
+		desc        string
+		env         sshenv.Env
+		action      commandargs.CommandType
+		repo        string
+		expectedErr error
+	}{
+		{
+			desc:   "read-only certificate fetching",
+			env:    sshenv.Env{NamespacePath: namespace, ReadOnly: true},
+			action: uploadPackAction,
+			repo:   repo,
+		},
+		{
+			desc:        "read-only certificate pushing",
+			env:         sshenv.Env{NamespacePath: namespace, ReadOnly: true},
+			action:      receivePackAction,
+			repo:        repo,
+			expectedErr: ErrReadOnlyCertificate,
+		},
+		{
+			desc:   "certificate listing the project",
+			env:    sshenv.Env{NamespacePath: namespace, AllowedProjects: []string{"group/other", repo}},
+			action: receivePackAction,
+			repo:   "/" + repo + ".git",
+		},
+		{
+			desc:        "certificate not listing the project",
+			env:         sshenv.Env{NamespacePath: namespace, AllowedProjects: []string{"group/other"}},
+			action:      uploadPackAction,
+			repo:        repo,
+			expectedErr: ErrProjectNotAllowed,
+		},
+		{
+			desc:        "push without touching a security key",
+			env:         sshenv.Env{NamespacePath: namespace, PushRequiresUserPresence: true},
+			action:      receivePackAction,
+			repo:        repo,
+			expectedErr: ErrUserPresenceRequired,
+		},
+		{
+			desc:   "push touching a security key",
+			env:    sshenv.Env{NamespacePath: namespace, PushRequiresUserPresence: true, SecurityKeyUserPresence: true},
+			action: receivePackAction,
+			repo:   repo,
+		},
+		{
+			desc:   "fetch without touching a security key",
+			env:    sshenv.Env{NamespacePath: namespace, PushRequiresUserPresence: true},
+			action: uploadPackAction,
+			repo:   repo,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			result, err := client.Verify(context.Background(), &commandargs.Shell{GitlabUsername: "first", Env: tc.env}, tc.action, tc.repo)
+
+			if tc.expectedErr != nil {
+				require.Equal(t, tc.expectedErr, err)
+				require.Nil(t, result)
+			} else {
+				require.NoError(t, err)
+				require.True(t, result.Success)
+			}
+		})
+	}
+}
+
 type testResponse struct {
 	body   []byte
 	status int
@@ -33,6 +33,9 @@ type Client struct {
 type Response struct {
 	ID  int64  `json:"id"`
 	Key string `json:"key"`
+	// TwoFactorRequired is set when the owner of the key must pass SSH
+	// two-factor authentication.
+	TwoFactorRequired bool `json:"two_factor_required,omitempty"`
 }
 
 // NewClient creates a new instance of the authorized keys client
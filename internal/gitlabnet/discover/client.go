@@ -26,6 +26,9 @@ type Response struct {
 	UserID   int64  `json:"id"`
 	Name     string `json:"name"`
 	Username string `json:"username"`
+	// TwoFactorRequired is set when the user must pass SSH two-factor
+	// authentication.
+	TwoFactorRequired bool `json:"two_factor_required,omitempty"`
 }
 
 // NewClient creates a new instance of the user discovery client
@@ -40,6 +40,32 @@ type RequestBody struct {
 	ExpiresAt string   `json:"expires_at,omitempty"`
 }
 
+// Token represents a personal access token of a user, without its value
+type Token struct {
+	ID         int64    `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at"`
+	LastUsedAt string   `json:"last_used_at"`
+}
+
+// ListResponse represents the response from listing personal access tokens
+type ListResponse struct {
+	Success bool    `json:"success"`
+	Tokens  []Token `json:"tokens"`
+	Message string  `json:"message"`
+}
+
+// TokenRequestBody represents the request body for managing an existing
+// personal access token
+type TokenRequestBody struct {
+	KeyID     string `json:"key_id,omitempty"`
+	UserID    int64  `json:"user_id,omitempty"`
+	TokenID   int64  `json:"token_id,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
 // NewClient creates a new instance of Client
 func NewClient(config *config.Config) (*Client, error) {
 	client, err := gitlabnet.GetClient(config)
@@ -71,6 +97,72 @@ func (c *Client) GetPersonalAccessToken(ctx context.Context, args *commandargs.S
 	return parse(response)
 }
 
+// ListTokens retrieves the personal access tokens of the user
+func (c *Client) ListTokens(ctx context.Context, args *commandargs.Shell) ([]Token, error) {
+	requestBody, err := c.getTokenRequestBody(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	routed := c.resolver.ClientForUserArgs(ctx, c.client, args.UserArgs())
+	response, err := routed.Client.Post(ctx, "/personal_access_token/list", requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	listResponse := &ListResponse{}
+	if err := gitlabnet.ParseJSON(response, listResponse); err != nil {
+		return nil, err
+	}
+
+	if !listResponse.Success {
+		return nil, errors.New(listResponse.Message)
+	}
+
+	return listResponse.Tokens, nil
+}
+
+// RevokeToken revokes a personal access token of the user
+func (c *Client) RevokeToken(ctx context.Context, args *commandargs.Shell, tokenID int64) error {
+	requestBody, err := c.getTokenRequestBody(ctx, args)
+	if err != nil {
+		return err
+	}
+	requestBody.TokenID = tokenID
+
+	routed := c.resolver.ClientForUserArgs(ctx, c.client, args.UserArgs())
+	response, err := routed.Client.Post(ctx, "/personal_access_token/revoke", requestBody)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	_, err = parse(response)
+
+	return err
+}
+
+// RotateToken revokes a personal access token of the user, and creates a new
+// one with the same name and scopes expiring at expiresAt
+func (c *Client) RotateToken(ctx context.Context, args *commandargs.Shell, tokenID int64, expiresAt string) (*Response, error) {
+	requestBody, err := c.getTokenRequestBody(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	requestBody.TokenID = tokenID
+	requestBody.ExpiresAt = expiresAt
+
+	routed := c.resolver.ClientForUserArgs(ctx, c.client, args.UserArgs())
+	response, err := routed.Client.Post(ctx, "/personal_access_token/rotate", requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	return parse(response)
+}
+
 func parse(hr *http.Response) (*Response, error) {
 	response := &Response{}
 	if err := gitlabnet.ParseJSON(hr, response); err != nil {
@@ -105,3 +197,21 @@ func (c *Client) getRequestBody(ctx context.Context, args *commandargs.Shell, na
 
 	return requestBody, nil
 }
+
+func (c *Client) getTokenRequestBody(ctx context.Context, args *commandargs.Shell) (*TokenRequestBody, error) {
+	if args.GitlabKeyID != "" {
+		return &TokenRequestBody{KeyID: args.GitlabKeyID}, nil
+	}
+
+	client, err := discover.NewClient(c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo, err := client.GetByCommandArgs(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenRequestBody{UserID: userInfo.UserID}, nil
+}
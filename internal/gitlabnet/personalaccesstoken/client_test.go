@@ -78,6 +78,66 @@ func initialize(t *testing.T) {
 				}
 			},
 		},
+		{
+			Path: "/api/v4/internal/personal_access_token/list",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readTokenRequestBody(t, r)
+
+				switch {
+				case requestBody.KeyID == "0" || requestBody.UserID == 1:
+					body := map[string]interface{}{
+						successResponse: true,
+						"tokens": []map[string]interface{}{
+							{
+								"id":           7,
+								"name":         "ci",
+								"scopes":       []string{readAPIScope},
+								"created_at":   "2024-01-02T03:04:05Z",
+								"expires_at":   "9001-11-17",
+								"last_used_at": nil,
+							},
+						},
+					}
+					json.NewEncoder(w).Encode(body)
+				case requestBody.KeyID == "1":
+					json.NewEncoder(w).Encode(map[string]interface{}{successResponse: false, "message": "missing user"})
+				case requestBody.KeyID == "2":
+					w.WriteHeader(http.StatusForbidden)
+				}
+			},
+		},
+		{
+			Path: "/api/v4/internal/personal_access_token/revoke",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readTokenRequestBody(t, r)
+
+				if requestBody.TokenID != 7 {
+					json.NewEncoder(w).Encode(map[string]interface{}{successResponse: false, "message": "Token not found"})
+					return
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{successResponse: true})
+			},
+		},
+		{
+			Path: "/api/v4/internal/personal_access_token/rotate",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readTokenRequestBody(t, r)
+
+				if requestBody.TokenID != 7 {
+					json.NewEncoder(w).Encode(map[string]interface{}{successResponse: false, "message": "Token not found"})
+					return
+				}
+
+				body := map[string]interface{}{
+					successResponse: true,
+					"token":         "rotatedG3YPeemECgUvxu",
+					"scopes":        []string{readAPIScope},
+					"expires_at":    requestBody.ExpiresAt,
+				}
+				json.NewEncoder(w).Encode(body)
+			},
+		},
 		{
 			Path: "/api/v4/internal/discover",
 			Handler: func(w http.ResponseWriter, _ *http.Request) {
@@ -170,6 +230,67 @@ func TestErrorResponses(t *testing.T) {
 	}
 }
 
+func TestListTokens(t *testing.T) {
+	client := setup(t)
+
+	expected := []Token{
+		{
+			ID:        7,
+			Name:      "ci",
+			Scopes:    []string{readAPIScope},
+			CreatedAt: "2024-01-02T03:04:05Z",
+			ExpiresAt: "9001-11-17",
+		},
+	}
+
+	for _, args := range []*commandargs.Shell{{GitlabKeyID: "0"}, {GitlabUsername: "jane-doe"}} {
+		result, err := client.ListTokens(context.Background(), args)
+		require.NoError(t, err)
+		require.Equal(t, expected, result)
+	}
+}
+
+func TestListTokensErrors(t *testing.T) {
+	client := setup(t)
+
+	_, err := client.ListTokens(context.Background(), &commandargs.Shell{GitlabKeyID: "1"})
+	require.EqualError(t, err, "missing user")
+
+	_, err = client.ListTokens(context.Background(), &commandargs.Shell{GitlabKeyID: "2"})
+	require.EqualError(t, err, "Internal API error (403)")
+}
+
+func TestRevokeToken(t *testing.T) {
+	client := setup(t)
+	args := &commandargs.Shell{GitlabKeyID: "0"}
+
+	require.NoError(t, client.RevokeToken(context.Background(), args, 7))
+	require.EqualError(t, client.RevokeToken(context.Background(), args, 8), "Token not found")
+}
+
+func TestRotateToken(t *testing.T) {
+	client := setup(t)
+	args := &commandargs.Shell{GitlabKeyID: "0"}
+
+	result, err := client.RotateToken(context.Background(), args, 7, "9001-11-17")
+	require.NoError(t, err)
+	require.Equal(t, &Response{true, "rotatedG3YPeemECgUvxu", []string{readAPIScope}, "9001-11-17", ""}, result)
+
+	_, err = client.RotateToken(context.Background(), args, 8, "9001-11-17")
+	require.EqualError(t, err, "Token not found")
+}
+
+func readTokenRequestBody(t *testing.T, r *http.Request) *TokenRequestBody {
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	assert.NoError(t, err)
+
+	var requestBody *TokenRequestBody
+	assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+	return requestBody
+}
+
 func setup(t *testing.T) *Client {
 	initialize(t)
 	url := testserver.StartSocketHTTPServer(t, requests)
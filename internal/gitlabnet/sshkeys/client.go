@@ -0,0 +1,172 @@
+// Package sshkeys provides functionality for managing the SSH keys of a GitLab user
+package sshkeys
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/topology"
+)
+
+// Client represents a client for managing the SSH keys of a user
+type Client struct {
+	config   *config.Config
+	client   *client.GitlabNetClient
+	resolver *topology.Resolver
+}
+
+// Key represents an SSH key of a user
+type Key struct {
+	ID          int64  `json:"id"`
+	Title       string `json:"title"`
+	Fingerprint string `json:"fingerprint"`
+	CreatedAt   string `json:"created_at"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+// Response represents the response from the SSH keys endpoints
+type Response struct {
+	Success bool   `json:"success"`
+	Keys    []Key  `json:"keys"`
+	Key     *Key   `json:"key"`
+	Message string `json:"message"`
+}
+
+// RequestBody represents the request body identifying the user whose SSH keys
+// are managed, and the key managed
+type RequestBody struct {
+	KeyID       string `json:"key_id,omitempty"`
+	UserID      int64  `json:"user_id,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Key         string `json:"key,omitempty"`
+	Title       string `json:"title,omitempty"`
+	ExpiresAt   string `json:"expires_at,omitempty"`
+}
+
+// NewClient creates a new instance of Client
+func NewClient(config *config.Config) (*Client, error) {
+	client, err := gitlabnet.GetClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("error creating http client: %v", err)
+	}
+
+	return &Client{
+		config:   config,
+		client:   client,
+		resolver: config.NewTopologyResolver(),
+	}, nil
+}
+
+// ListKeys retrieves the SSH keys of the user
+func (c *Client) ListKeys(ctx context.Context, args *commandargs.Shell) ([]Key, error) {
+	requestBody, err := c.getRequestBody(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := c.post(ctx, args, "/ssh_keys/list", requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Keys, nil
+}
+
+// AddKey adds an SSH key, in the authorized keys format, to the user. The key
+// doesn't expire when expiresAt is empty.
+func (c *Client) AddKey(ctx context.Context, args *commandargs.Shell, key, title, expiresAt string) (*Key, error) {
+	requestBody, err := c.getRequestBody(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	requestBody.Key = key
+	requestBody.Title = title
+	requestBody.ExpiresAt = expiresAt
+
+	response, err := c.post(ctx, args, "/ssh_keys/add", requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Key, nil
+}
+
+// ExpireKey sets the expiry of the SSH key of the user with the given
+// fingerprint
+func (c *Client) ExpireKey(ctx context.Context, args *commandargs.Shell, fingerprint, expiresAt string) (*Key, error) {
+	requestBody, err := c.getRequestBody(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	requestBody.Fingerprint = fingerprint
+	requestBody.ExpiresAt = expiresAt
+
+	response, err := c.post(ctx, args, "/ssh_keys/expire", requestBody)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Key, nil
+}
+
+// DeleteKey deletes the SSH key of the user with the given fingerprint
+func (c *Client) DeleteKey(ctx context.Context, args *commandargs.Shell, fingerprint string) error {
+	requestBody, err := c.getRequestBody(ctx, args)
+	if err != nil {
+		return err
+	}
+	requestBody.Fingerprint = fingerprint
+
+	_, err = c.post(ctx, args, "/ssh_keys/delete", requestBody)
+
+	return err
+}
+
+func (c *Client) post(ctx context.Context, args *commandargs.Shell, path string, requestBody *RequestBody) (*Response, error) {
+	routed := c.resolver.ClientForUserArgs(ctx, c.client, args.UserArgs())
+	response, err := routed.Client.Post(ctx, path, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	return parse(response)
+}
+
+func parse(hr *http.Response) (*Response, error) {
+	response := &Response{}
+	if err := gitlabnet.ParseJSON(hr, response); err != nil {
+		return nil, err
+	}
+
+	if !response.Success {
+		return nil, errors.New(response.Message)
+	}
+
+	return response, nil
+}
+
+func (c *Client) getRequestBody(ctx context.Context, args *commandargs.Shell) (*RequestBody, error) {
+	if args.GitlabKeyID != "" {
+		return &RequestBody{KeyID: args.GitlabKeyID}, nil
+	}
+
+	client, err := discover.NewClient(c.config)
+	if err != nil {
+		return nil, err
+	}
+
+	userInfo, err := client.GetByCommandArgs(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RequestBody{UserID: userInfo.UserID}, nil
+}
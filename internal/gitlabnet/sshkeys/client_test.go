@@ -0,0 +1,212 @@
+package sshkeys
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
+)
+
+var (
+	laptopKey = Key{ID: 1, Title: "Laptop", Fingerprint: "SHA256:laptop", CreatedAt: "2026-01-01T00:00:00Z", ExpiresAt: "2027-01-01T00:00:00Z"}
+	ciKey     = Key{ID: 2, Title: "CI", Fingerprint: "SHA256:ci", CreatedAt: "2026-02-01T00:00:00Z"}
+)
+
+func setup(t *testing.T) *Client {
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/ssh_keys/list",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				b, err := io.ReadAll(r.Body)
+				defer r.Body.Close()
+
+				assert.NoError(t, err)
+
+				var requestBody *RequestBody
+				assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+				switch requestBody.KeyID {
+				case "0":
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "keys": []Key{laptopKey, ciKey}})
+				case "1":
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "missing user"})
+				case "2":
+					w.WriteHeader(http.StatusForbidden)
+					json.NewEncoder(w).Encode(&client.ErrorResponse{Message: "Not allowed!"})
+				case "3":
+					w.Write([]byte("{ \"message\": \"broken json!\""))
+				case "4":
+					w.WriteHeader(http.StatusForbidden)
+				}
+
+				if requestBody.UserID == 1 {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "keys": []Key{ciKey}})
+				}
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/add",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readRequestBody(t, r)
+
+				if requestBody.Key != "ssh-ed25519 AAAA" {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Key is invalid"})
+					return
+				}
+
+				key := Key{ID: 3, Title: requestBody.Title, Fingerprint: "SHA256:new", CreatedAt: "2026-03-01T00:00:00Z", ExpiresAt: requestBody.ExpiresAt}
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/expire",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readRequestBody(t, r)
+
+				if requestBody.Fingerprint != ciKey.Fingerprint {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Key not found"})
+					return
+				}
+
+				key := ciKey
+				key.ExpiresAt = requestBody.ExpiresAt
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key": key})
+			},
+		},
+		{
+			Path: "/api/v4/internal/ssh_keys/delete",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestBody := readRequestBody(t, r)
+
+				if requestBody.Fingerprint != ciKey.Fingerprint || requestBody.UserID != 1 {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Key not found"})
+					return
+				}
+
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			},
+		},
+		{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				json.NewEncoder(w).Encode(&discover.Response{UserID: 1, Username: "jane-doe", Name: "Jane Doe"})
+			},
+		},
+	}
+
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	client, err := NewClient(&config.Config{GitlabURL: url})
+	require.NoError(t, err)
+
+	return client
+}
+
+func TestListKeysByKeyID(t *testing.T) {
+	client := setup(t)
+
+	keys, err := client.ListKeys(context.Background(), &commandargs.Shell{GitlabKeyID: "0"})
+	require.NoError(t, err)
+	require.Equal(t, []Key{laptopKey, ciKey}, keys)
+}
+
+func TestListKeysByUsername(t *testing.T) {
+	client := setup(t)
+
+	keys, err := client.ListKeys(context.Background(), &commandargs.Shell{GitlabUsername: "jane-doe"})
+	require.NoError(t, err)
+	require.Equal(t, []Key{ciKey}, keys)
+}
+
+func TestListKeysErrorResponses(t *testing.T) {
+	client := setup(t)
+
+	testCases := []struct {
+		desc          string
+		fakeID        string
+		expectedError string
+	}{
+		{
+			desc:          "An unsuccessful response",
+			fakeID:        "1",
+			expectedError: "missing user",
+		},
+		{
+			desc:          "A response with an error message",
+			fakeID:        "2",
+			expectedError: "Not allowed!",
+		},
+		{
+			desc:          "A response with bad JSON",
+			fakeID:        "3",
+			expectedError: "parsing failed",
+		},
+		{
+			desc:          "An error response without message",
+			fakeID:        "4",
+			expectedError: "Internal API error (403)",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			keys, err := client.ListKeys(context.Background(), &commandargs.Shell{GitlabKeyID: tc.fakeID})
+
+			require.EqualError(t, err, tc.expectedError)
+			require.Nil(t, keys)
+		})
+	}
+}
+
+func TestAddKey(t *testing.T) {
+	client := setup(t)
+	args := &commandargs.Shell{GitlabKeyID: "0"}
+
+	key, err := client.AddKey(context.Background(), args, "ssh-ed25519 AAAA", "Desktop", "2027-03-01T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, &Key{ID: 3, Title: "Desktop", Fingerprint: "SHA256:new", CreatedAt: "2026-03-01T00:00:00Z", ExpiresAt: "2027-03-01T00:00:00Z"}, key)
+
+	_, err = client.AddKey(context.Background(), args, "ssh-ed25519 BBBB", "Desktop", "")
+	require.EqualError(t, err, "Key is invalid")
+}
+
+func TestExpireKey(t *testing.T) {
+	client := setup(t)
+	args := &commandargs.Shell{GitlabKeyID: "0"}
+
+	key, err := client.ExpireKey(context.Background(), args, ciKey.Fingerprint, "2026-12-01T00:00:00Z")
+	require.NoError(t, err)
+	require.Equal(t, "2026-12-01T00:00:00Z", key.ExpiresAt)
+	require.Equal(t, ciKey.ID, key.ID)
+
+	_, err = client.ExpireKey(context.Background(), args, "SHA256:unknown", "2026-12-01T00:00:00Z")
+	require.EqualError(t, err, "Key not found")
+}
+
+func TestDeleteKeyByKrb5Principal(t *testing.T) {
+	client := setup(t)
+
+	args := &commandargs.Shell{GitlabKrb5Principal: "jane-doe@EXAMPLE.COM"}
+	require.NoError(t, client.DeleteKey(context.Background(), args, ciKey.Fingerprint))
+	require.EqualError(t, client.DeleteKey(context.Background(), args, laptopKey.Fingerprint), "Key not found")
+}
+
+func readRequestBody(t *testing.T, r *http.Request) *RequestBody {
+	b, err := io.ReadAll(r.Body)
+	defer r.Body.Close()
+	assert.NoError(t, err)
+
+	var requestBody *RequestBody
+	assert.NoError(t, json.Unmarshal(b, &requestBody))
+
+	return requestBody
+}
@@ -122,6 +122,9 @@ func (gc *GitalyCommand) PrepareContext(ctx context.Context, repository *pb.Repo
 	md.Append("user_id", gc.Response.UserID)
 	md.Append("username", gc.Response.Username)
 	md.Append("remote_ip", env.RemoteAddr)
+	for key, value := range env.GitalyMetadata() {
+		md.Append(key, value)
+	}
 	ctx = metadata.NewOutgoingContext(ctx, md)
 
 	return ctx, cancel
@@ -209,6 +209,39 @@ func TestPrepareContext(t *testing.T) {
 				"remote_ip": "10.0.0.1",
 			},
 		},
+		{
+			name: "client_env",
+			gc: NewGitalyCommand(
+				&config.Config{},
+				string(commandargs.UploadPack),
+				&accessverifier.Response{
+					KeyID:    1,
+					KeyType:  "key",
+					UserID:   "user-6",
+					Username: "jane.doe",
+					Gitaly: accessverifier.Gitaly{
+						Address: testListenAddr,
+					},
+				},
+			),
+			env: sshenv.Env{
+				IsSSHConnection: true,
+				RemoteAddr:      "10.0.0.1",
+				Variables: []sshenv.Variable{
+					{Name: "GIT_TRACE2_PARENT_SID", Value: "sid", Gitaly: true},
+					{Name: "GL_OPTION_CI_SKIP", Value: "true", API: true},
+				},
+			},
+			repo: &pb.Repository{GlRepository: "project-26", GlProjectPath: "group/private"},
+			want: map[string]string{
+				"key_id":                        "1",
+				"key_type":                      "key",
+				"user_id":                       "user-6",
+				"username":                      "jane.doe",
+				"remote_ip":                     "10.0.0.1",
+				"ssh-env-git_trace2_parent_sid": "sid",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -24,6 +24,18 @@ const (
 	sshdHitMaxSessionsName                    = "concurrent_limited_sessions_total"
 	sshdSessionDurationSecondsName            = "session_duration_seconds"
 	sshdSessionEstablishedDurationSecondsName = "session_established_duration_seconds"
+	sshdKeyReloadsTotalName                   = "key_reloads_total"
+	sshdGitChannelsInFlightName               = "git_channels_in_flight"
+	sshdHitMaxGitChannelsName                 = "concurrent_limited_git_channels_total"
+	sshdGitChannelDurationSecondsName         = "git_channel_duration_seconds"
+	sshdRateLimitedTotalName                  = "rate_limited_total"
+	sshdAuthorizedKeysCacheRequestsTotalName  = "authorized_keys_cache_requests_total"
+	sshdIPFilterMatchesTotalName              = "ip_filter_matches_total"
+	sshdAuthBansTotalName                     = "auth_bans_total"
+	sshdAuthBanRejectedTotalName              = "auth_ban_rejected_connections_total"
+	sshdBandwidthThrottledSessionsTotalName   = "bandwidth_throttled_sessions_total"
+	sshdBandwidthThrottledSecondsTotalName    = "bandwidth_throttled_seconds_total"
+	sshdSessionTimeoutsTotalName              = "session_timeouts_total"
 
 	sliSshdSessionsTotalName       = "gitlab_sli:shell_sshd_sessions:total"
 	sliSshdSessionsErrorsTotalName = "gitlab_sli:shell_sshd_sessions:errors_total"
@@ -36,7 +48,11 @@ const (
 
 	connectionsTotalName = "connections_total"
 
-	statusLabel = "status"
+	statusLabel  = "status"
+	limitLabel   = "limit"
+	resultLabel  = "result"
+	commandLabel = "command"
+	timeoutLabel = "timeout"
 )
 
 var (
@@ -90,6 +106,147 @@ var (
 		},
 	)
 
+	// SshdGitChannelsInFlight is a gauge of gitlab-git@gitlab.com channels currently being served by gitlab-shell sshd.
+	SshdGitChannelsInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdGitChannelsInFlightName,
+			Help:      "A gauge of git channels currently being served by gitlab-shell sshd.",
+		},
+	)
+
+	// SshdHitMaxGitChannels is the number of times the concurrent git channels limit was hit in gitlab-shell sshd.
+	SshdHitMaxGitChannels = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdHitMaxGitChannelsName,
+			Help:      "The number of times the concurrent git channels limit was hit in gitlab-shell sshd.",
+		},
+	)
+
+	// SshdGitChannelDuration is a histogram of latencies for git channels served by gitlab-shell sshd.
+	SshdGitChannelDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdGitChannelDurationSecondsName,
+			Help:      "A histogram of latencies for git channels served by gitlab-shell sshd.",
+			Buckets: []float64{
+				5.0,  /* 5s */
+				30.0, /* 30s */
+				60.0, /* 1m */
+			},
+		},
+	)
+
+	// SshdKeyReloadsTotal is the number of times gitlab-shell sshd reloaded its host keys,
+	// host certificates and trusted user CA keys, labelled by outcome.
+	SshdKeyReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdKeyReloadsTotalName,
+			Help:      "The number of times gitlab-shell sshd reloaded its keys.",
+		},
+		[]string{statusLabel},
+	)
+
+	// SshdRateLimitedTotal is the number of connections and authentication attempts rejected by
+	// the gitlab-shell sshd rate limits, labelled by the limit that was hit.
+	SshdRateLimitedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdRateLimitedTotalName,
+			Help:      "The number of connections and authentication attempts rejected by the gitlab-shell sshd rate limits.",
+		},
+		[]string{limitLabel},
+	)
+
+	// SshdAuthorizedKeysCacheRequestsTotal is the number of authorized key lookups served by
+	// the gitlab-shell sshd cache, labelled by whether they were a hit or a miss.
+	SshdAuthorizedKeysCacheRequestsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdAuthorizedKeysCacheRequestsTotalName,
+			Help:      "The number of authorized key lookups in the gitlab-shell sshd cache.",
+		},
+		[]string{resultLabel},
+	)
+
+	// SshdIPFilterMatchesTotal is the number of connections matched by the gitlab-shell sshd
+	// IP allow and deny lists, labelled by whether they were allowed, denied or not allowed.
+	SshdIPFilterMatchesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdIPFilterMatchesTotalName,
+			Help:      "The number of connections matched by the gitlab-shell sshd IP allow and deny lists.",
+		},
+		[]string{resultLabel},
+	)
+
+	// SshdAuthBansTotal is the number of times a client IP address was banned by gitlab-shell
+	// sshd after repeated authentication failures.
+	SshdAuthBansTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdAuthBansTotalName,
+			Help:      "The number of client IP addresses banned by gitlab-shell sshd after repeated authentication failures.",
+		},
+	)
+
+	// SshdAuthBanRejectedTotal is the number of connections from banned IP addresses rejected by
+	// gitlab-shell sshd.
+	SshdAuthBanRejectedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdAuthBanRejectedTotalName,
+			Help:      "The number of connections from banned IP addresses rejected by gitlab-shell sshd.",
+		},
+	)
+
+	// SshdBandwidthThrottledSessionsTotal is the number of gitlab-shell sshd sessions whose output
+	// was held back by the bandwidth limits, labelled by command type.
+	SshdBandwidthThrottledSessionsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdBandwidthThrottledSessionsTotalName,
+			Help:      "The number of gitlab-shell sshd sessions whose output was held back by the bandwidth limits.",
+		},
+		[]string{commandLabel},
+	)
+
+	// SshdBandwidthThrottledSecondsTotal is the time gitlab-shell sshd sessions spent held back by
+	// the bandwidth limits, labelled by command type.
+	SshdBandwidthThrottledSecondsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdBandwidthThrottledSecondsTotalName,
+			Help:      "The time gitlab-shell sshd sessions spent held back by the bandwidth limits.",
+		},
+		[]string{commandLabel},
+	)
+
+	// SshdSessionTimeoutsTotal is the number of gitlab-shell sshd sessions stopped by a session
+	// timeout, labelled by whether they were idle or exceeded the maximum duration.
+	SshdSessionTimeoutsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: sshdSubsystem,
+			Name:      sshdSessionTimeoutsTotalName,
+			Help:      "The number of gitlab-shell sshd sessions stopped by a session timeout.",
+		},
+		[]string{timeoutLabel},
+	)
+
 	// SliSshdSessionsTotal is the number of SSH sessions that have been established.
 	SliSshdSessionsTotal = promauto.NewCounter(
 		prometheus.CounterOpts{
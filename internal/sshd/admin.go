@@ -0,0 +1,270 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	// adminConnectionsPath is the admin endpoint that lists the open
+	// connections, and adminTerminatePath the one that closes them.
+	adminConnectionsPath = "/admin/connections"
+	adminTerminatePath   = "/admin/connections/terminate"
+
+	terminatedMessage = "Your SSH connection to GitLab was terminated by an administrator."
+)
+
+// adminConnection is an open connection, as listed on the admin endpoint.
+type adminConnection struct {
+	ID            uint64         `json:"id"`
+	RemoteAddr    string         `json:"remote_addr"`
+	LocalAddr     string         `json:"local_addr"`
+	Authenticated bool           `json:"authenticated"`
+	KeyID         string         `json:"key_id,omitempty"`
+	Username      string         `json:"username,omitempty"`
+	Krb5Principal string         `json:"krb5_principal,omitempty"`
+	StartedAt     time.Time      `json:"started_at"`
+	DurationS     float64        `json:"duration_s"`
+	Sessions      int            `json:"sessions"`
+	Commands      []adminCommand `json:"commands"`
+}
+
+// adminCommand is a command running on an open connection.
+type adminCommand struct {
+	Command      string  `json:"command"`
+	Repository   string  `json:"repository,omitempty"`
+	WrittenBytes int64   `json:"written_bytes"`
+	DurationS    float64 `json:"duration_s"`
+}
+
+// readAdminToken reads the token that authenticates requests to the admin
+// endpoints. They're disabled when no token file is configured.
+func readAdminToken(filename string) ([]byte, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	token, err := os.ReadFile(filepath.Clean(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	token = bytes.TrimSpace(token)
+	if len(token) == 0 {
+		return nil, fmt.Errorf("admin token file %q is empty", filename)
+	}
+
+	return token, nil
+}
+
+// requireAdminToken only lets through the requests that carry the admin token
+// as a bearer token.
+func (s *Server) requireAdminToken(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var token []byte
+		if srvCfg := s.serverConfig.Load(); srvCfg != nil {
+			token = srvCfg.adminToken
+		}
+
+		if len(token) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		bearer, ok := bytes.CutPrefix([]byte(r.Header.Get("Authorization")), []byte("Bearer "))
+		if !ok || subtle.ConstantTimeCompare(bearer, token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+func (s *Server) serveAdminConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	conns := []adminConnection{}
+	for _, conn := range s.connections() {
+		conns = append(conns, conn.adminInfo(now))
+	}
+
+	writeJSON(r.Context(), w, conns)
+}
+
+// serveAdminTerminate closes the connection with the given id, or every
+// connection of the user with the given username or key ID.
+func (s *Server) serveAdminTerminate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	match, err := terminateMatcher(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	terminated := s.TerminateConnections(r.Context(), match)
+
+	writeJSON(r.Context(), w, map[string]int{"terminated": terminated})
+}
+
+func terminateMatcher(r *http.Request) (func(adminConnection) bool, error) {
+	query := r.URL.Query()
+	if len(query) != 1 {
+		return nil, errors.New("exactly one of id, username or key_id is required")
+	}
+
+	switch {
+	case query.Has("id"):
+		id, err := strconv.ParseUint(query.Get("id"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id %q", query.Get("id"))
+		}
+
+		return func(c adminConnection) bool { return c.ID == id }, nil
+	case query.Get("username") != "":
+		username := query.Get("username")
+
+		return func(c adminConnection) bool { return c.Username == username }, nil
+	case query.Get("key_id") != "":
+		keyID := query.Get("key_id")
+
+		return func(c adminConnection) bool { return c.KeyID == keyID }, nil
+	default:
+		return nil, errors.New("exactly one of id, username or key_id is required")
+	}
+}
+
+// TerminateConnections closes the open connections that match, telling their
+// clients why, and returns how many there were.
+func (s *Server) TerminateConnections(ctx context.Context, match func(adminConnection) bool) int {
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var terminated int
+	for _, conn := range s.connections() {
+		info := conn.adminInfo(now)
+		if !match(info) {
+			continue
+		}
+
+		log.FromContext(ctx).InfoContext(ctx, "Terminating connection",
+			slog.Uint64("connection_id", info.ID),
+			slog.String("remote_addr", info.RemoteAddr),
+			slog.String("username", info.Username),
+			slog.String("key_id", info.KeyID),
+		)
+
+		terminated++
+		wg.Go(func() { conn.disconnect(ctx, terminatedMessage) })
+	}
+	wg.Wait()
+
+	return terminated
+}
+
+// adminInfo describes the connection and the commands running on it.
+func (c *connection) adminInfo(now time.Time) adminConnection {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := adminConnection{
+		ID:         c.id,
+		RemoteAddr: c.remoteAddr,
+		LocalAddr:  c.nconn.LocalAddr().String(),
+		StartedAt:  c.started,
+		DurationS:  now.Sub(c.started).Seconds(),
+		Sessions:   len(c.channels),
+		Commands:   []adminCommand{},
+		Username:   c.username,
+	}
+
+	if c.sconn != nil {
+		info.Authenticated = true
+		info.KeyID = c.sconn.Permissions.Extensions["key-id"]
+		info.Krb5Principal = c.sconn.Permissions.Extensions["krb5principal"]
+		if username := c.sconn.Permissions.Extensions[certPermUsername]; username != "" {
+			info.Username = username
+		}
+	}
+
+	for sess := range c.sessions {
+		info.Commands = append(info.Commands, adminCommand{
+			Command:      string(sess.commandType),
+			Repository:   sess.repository,
+			WrittenBytes: sess.writtenBytes.Load(),
+			DurationS:    now.Sub(sess.commandStarted).Seconds(),
+		})
+	}
+
+	return info
+}
+
+// trackSession registers a session whose command is running. A session that
+// doesn't belong to a connection isn't tracked.
+func (c *connection) trackSession(sess *session) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessions == nil {
+		c.sessions = make(map[*session]struct{})
+	}
+	c.sessions[sess] = struct{}{}
+}
+
+func (c *connection) untrackSession(sess *session) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.sessions, sess)
+}
+
+// setUsername records the GitLab username a command ran as. Connections
+// authenticated with a key only learn it once GitLab has been asked about a
+// command.
+func (c *connection) setUsername(username string) {
+	if c == nil || username == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.username = username
+}
+
+func writeJSON(ctx context.Context, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.FromContext(ctx).WarnContext(ctx, "Failed to write response", log.ErrorMessage(err.Error()))
+	}
+}
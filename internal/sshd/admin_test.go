@@ -0,0 +1,243 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+const testAdminToken = "admin-token"
+
+func adminRequest(t *testing.T, s *Server, method, target, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	r := httptest.NewRecorder()
+	s.MonitoringServeMux().ServeHTTP(r, req)
+
+	return r
+}
+
+func TestReadAdminToken(t *testing.T) {
+	token, err := readAdminToken("")
+	require.NoError(t, err)
+	require.Nil(t, token)
+
+	filename := path.Join(t.TempDir(), "admin_token")
+	require.NoError(t, os.WriteFile(filename, []byte(testAdminToken+"\n"), 0600))
+
+	token, err = readAdminToken(filename)
+	require.NoError(t, err)
+	require.Equal(t, testAdminToken, string(token))
+
+	require.NoError(t, os.WriteFile(filename, []byte(" \n"), 0600))
+	_, err = readAdminToken(filename)
+	require.EqualError(t, err, `admin token file "`+filename+`" is empty`)
+
+	_, err = readAdminToken("/nonexistent/admin_token")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestAdminEndpointsAuthentication(t *testing.T) {
+	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
+
+	// Without a token, the admin endpoints are disabled
+	r := adminRequest(t, s, http.MethodGet, adminConnectionsPath, testAdminToken)
+	require.Equal(t, http.StatusNotFound, r.Code)
+	r = adminRequest(t, s, http.MethodPost, flushAuthorizedKeysCachePath, testAdminToken)
+	require.Equal(t, http.StatusNotFound, r.Code)
+	r = adminRequest(t, s, http.MethodGet, authBansPath, testAdminToken)
+	require.Equal(t, http.StatusNotFound, r.Code)
+
+	s.serverConfig.Store(&serverConfig{adminToken: []byte(testAdminToken)})
+
+	testCases := []struct {
+		desc     string
+		method   string
+		target   string
+		token    string
+		expected int
+	}{
+		{desc: "no token", method: http.MethodGet, target: adminConnectionsPath, expected: http.StatusUnauthorized},
+		{desc: "wrong token", method: http.MethodGet, target: adminConnectionsPath, token: "wrong", expected: http.StatusUnauthorized},
+		{desc: "list", method: http.MethodGet, target: adminConnectionsPath, token: testAdminToken, expected: http.StatusOK},
+		{desc: "list with the wrong method", method: http.MethodPost, target: adminConnectionsPath, token: testAdminToken, expected: http.StatusMethodNotAllowed},
+		{desc: "terminate with the wrong method", method: http.MethodGet, target: adminTerminatePath + "?id=1", token: testAdminToken, expected: http.StatusMethodNotAllowed},
+		{desc: "terminate without a filter", method: http.MethodPost, target: adminTerminatePath, token: testAdminToken, expected: http.StatusBadRequest},
+		{desc: "terminate with two filters", method: http.MethodPost, target: adminTerminatePath + "?id=1&key_id=1", token: testAdminToken, expected: http.StatusBadRequest},
+		{desc: "terminate with an invalid id", method: http.MethodPost, target: adminTerminatePath + "?id=one", token: testAdminToken, expected: http.StatusBadRequest},
+		{desc: "terminate with an empty username", method: http.MethodPost, target: adminTerminatePath + "?username=", token: testAdminToken, expected: http.StatusBadRequest},
+		{desc: "terminate", method: http.MethodPost, target: adminTerminatePath + "?username=alice", token: testAdminToken, expected: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := adminRequest(t, s, tc.method, tc.target, tc.token)
+			require.Equal(t, tc.expected, r.Code)
+
+			if tc.expected == http.StatusUnauthorized {
+				require.Equal(t, "Bearer", r.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestConnectionAdminInfo(t *testing.T) {
+	nconn, peer := net.Pipe()
+	defer nconn.Close()
+	defer peer.Close()
+
+	conn := newConnection(&config.Config{}, nconn)
+	conn.id = 7
+
+	info := conn.adminInfo(conn.started.Add(time.Second))
+	require.Equal(t, adminConnection{
+		ID:         7,
+		RemoteAddr: "pipe",
+		LocalAddr:  "pipe",
+		StartedAt:  conn.started,
+		DurationS:  1,
+		Commands:   []adminCommand{},
+	}, info)
+
+	sess := &session{conn: conn, execCmd: "git upload-pack 'group/project.git'"}
+	sess.setCommand()
+	sess.writtenBytes.Store(42)
+	conn.trackSession(sess)
+	conn.setUsername("alice")
+
+	info = conn.adminInfo(sess.commandStarted.Add(2 * time.Second))
+	require.Equal(t, "alice", info.Username)
+	require.Equal(t, []adminCommand{
+		{Command: "git-upload-pack", Repository: "group/project.git", WrittenBytes: 42, DurationS: 2},
+	}, info.Commands)
+
+	conn.untrackSession(sess)
+	require.Empty(t, conn.adminInfo(time.Now()).Commands)
+}
+
+func TestSessionSetCommand(t *testing.T) {
+	testCases := []struct {
+		execCmd     string
+		commandType string
+		repository  string
+	}{
+		{execCmd: "", commandType: "discover"},
+		{execCmd: "git-receive-pack group/project.git", commandType: "git-receive-pack", repository: "group/project.git"},
+		{execCmd: "git-lfs-transfer group/project.git download", commandType: "git-lfs-transfer", repository: "group/project.git"},
+		{execCmd: "personal_access_token token api 30", commandType: "personal_access_token"},
+		{execCmd: "git-upload-pack 'unterminated", commandType: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.execCmd, func(t *testing.T) {
+			sess := &session{execCmd: tc.execCmd}
+			sess.setCommand()
+
+			require.Equal(t, tc.commandType, string(sess.commandType))
+			require.Equal(t, tc.repository, sess.repository)
+			require.False(t, sess.commandStarted.IsZero())
+		})
+	}
+}
+
+func TestAdminListAndTerminateConnections(t *testing.T) {
+	defer func(timeout time.Duration) { DisconnectTimeout = timeout }(DisconnectTimeout)
+	DisconnectTimeout = 100 * time.Millisecond
+
+	tokenFile := path.Join(t.TempDir(), "admin_token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(testAdminToken), 0600))
+
+	cfg := &config.Config{Server: config.DefaultServerConfig}
+	cfg.Server.AdminTokenFile = tokenFile
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	channel, requests, err := client.OpenChannel(sessionChannelType, nil)
+	require.NoError(t, err)
+	defer channel.Close()
+
+	otherClient, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer otherClient.Close()
+
+	var conns []adminConnection
+	require.Eventually(t, func() bool {
+		r := adminRequest(t, s, http.MethodGet, adminConnectionsPath, testAdminToken)
+		require.Equal(t, http.StatusOK, r.Code)
+		require.Equal(t, "application/json", r.Header().Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&conns))
+
+		return len(conns) == 2 && conns[0].Sessions == 1
+	}, 2*time.Second, time.Millisecond)
+
+	require.True(t, conns[0].Authenticated)
+	require.Equal(t, "1000", conns[0].KeyID)
+	require.Equal(t, s.Addr(), conns[0].LocalAddr)
+	require.Equal(t, client.LocalAddr().String(), conns[0].RemoteAddr)
+	require.Less(t, conns[0].ID, conns[1].ID)
+
+	r := adminRequest(t, s, http.MethodPost, adminTerminatePath+"?id="+strconv.FormatUint(conns[0].ID, 10), testAdminToken)
+	require.Equal(t, http.StatusOK, r.Code)
+	require.JSONEq(t, `{"terminated": 1}`, r.Body.String())
+
+	notice, err := io.ReadAll(channel.Stderr())
+	require.NoError(t, err)
+	require.Contains(t, string(notice), "remote: "+terminatedMessage+"\n")
+
+	req := <-requests
+	require.Equal(t, "exit-signal", req.Type)
+	require.Error(t, client.Wait())
+
+	// The other connection is left alone until it's terminated by key ID
+	holdSession(t, otherClient)
+
+	r = adminRequest(t, s, http.MethodPost, adminTerminatePath+"?key_id=1000", testAdminToken)
+	require.Equal(t, http.StatusOK, r.Code)
+	require.JSONEq(t, `{"terminated": 1}`, r.Body.String())
+	require.Error(t, otherClient.Wait())
+
+	require.Eventually(t, func() bool {
+		r := adminRequest(t, s, http.MethodGet, adminConnectionsPath, testAdminToken)
+
+		return strings.TrimSpace(r.Body.String()) == "[]"
+	}, 2*time.Second, time.Millisecond)
+}
+
+func TestTerminateConnectionsBeforeHandshake(t *testing.T) {
+	s, _ := setupServer(t)
+
+	nconn, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	require.Eventually(t, func() bool { return len(s.connections()) == 1 }, 2*time.Second, time.Millisecond)
+
+	terminated := s.TerminateConnections(context.Background(), func(c adminConnection) bool { return !c.Authenticated })
+	require.Equal(t, 1, terminated)
+
+	// The server closes the connection without waiting for the handshake
+	_, err = io.ReadAll(nconn)
+	require.NoError(t, err)
+}
@@ -0,0 +1,231 @@
+package sshd
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/fields"
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	// authBansPath is the admin endpoint that lists the banned IP
+	// addresses.
+	authBansPath = "/auth_bans"
+
+	// authBanPruneInterval is how often the addresses that are neither banned
+	// nor failing are dropped.
+	authBanPruneInterval = time.Minute
+)
+
+// authBanList bans the client IP addresses that fail to authenticate too many
+// times within a sliding window, in the manner of fail2ban. Bans are enforced
+// when connections are accepted and after each failed authentication attempt,
+// and get longer each time an address is banned again. A nil *authBanList
+// bans nothing.
+type authBanList struct {
+	maxFailures int
+	findTime    time.Duration
+	banTime     time.Duration
+	maxBanTime  time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	clients   map[string]*authBanState
+	lastPrune time.Time
+}
+
+type authBanState struct {
+	// failures holds the times of the most recent failures within findTime,
+	// oldest first.
+	failures    []time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+// authBan is an entry of the ban list served on the monitoring endpoint.
+type authBan struct {
+	IP          string    `json:"ip"`
+	BannedUntil time.Time `json:"banned_until"`
+	Bans        int       `json:"bans"`
+}
+
+// newAuthBanList returns a ban list for cfg, or nil if cfg doesn't set a
+// number of failures.
+func newAuthBanList(cfg config.AuthBansConfig) *authBanList {
+	if cfg.MaxFailures <= 0 {
+		return nil
+	}
+
+	return &authBanList{
+		maxFailures: cfg.MaxFailures,
+		findTime:    time.Duration(cfg.FindTime),
+		banTime:     time.Duration(cfg.BanTime),
+		maxBanTime:  max(time.Duration(cfg.MaxBanTime), time.Duration(cfg.BanTime)),
+		now:         time.Now,
+		clients:     make(map[string]*authBanState),
+		lastPrune:   time.Now(),
+	}
+}
+
+// observe records the authentication failures of a connection from ip, and
+// bans ip if it's now over the limit.
+func (b *authBanList) observe(ctx context.Context, ip string, failures int) {
+	if b == nil || ip == "" || failures <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.prune(now)
+
+	state, ok := b.clients[ip]
+	if !ok {
+		state = &authBanState{}
+		b.clients[ip] = state
+	}
+
+	state.failures = b.recentFailures(state, now)
+	for range min(failures, b.maxFailures) {
+		state.failures = append(state.failures, now)
+	}
+	if len(state.failures) > b.maxFailures {
+		state.failures = state.failures[len(state.failures)-b.maxFailures:]
+	}
+
+	if len(state.failures) < b.maxFailures || now.Before(state.bannedUntil) {
+		return
+	}
+
+	state.failures = nil
+	state.bans++
+	state.bannedUntil = now.Add(b.banDuration(state.bans))
+
+	metrics.SshdAuthBansTotal.Inc()
+	log.FromContext(ctx).WarnContext(ctx, "client banned: too many authentication failures",
+		slog.String(fields.RemoteIP, ip),
+		slog.Int("auth_bans", state.bans),
+		slog.Time("banned_until", state.bannedUntil),
+	)
+}
+
+// forgive drops the last failures recorded for ip, made by a connection that
+// went on to authenticate. Failures that got ip banned aren't forgiven.
+func (b *authBanList) forgive(ip string, failures int) {
+	if b == nil || ip == "" || failures <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if state, ok := b.clients[ip]; ok {
+		state.failures = state.failures[:max(len(state.failures)-failures, 0)]
+	}
+}
+
+// banDuration returns how long the nth ban of an address lasts: banTime
+// doubled for every earlier ban, up to maxBanTime.
+func (b *authBanList) banDuration(n int) time.Duration {
+	duration := b.banTime
+	for i := 1; i < n && duration < b.maxBanTime; i++ {
+		duration *= 2
+	}
+
+	return min(duration, b.maxBanTime)
+}
+
+func (b *authBanList) recentFailures(state *authBanState, now time.Time) []time.Time {
+	cutoff := now.Add(-b.findTime)
+	i, _ := slices.BinarySearchFunc(state.failures, cutoff, func(t, cutoff time.Time) int { return t.Compare(cutoff) })
+
+	return state.failures[i:]
+}
+
+// prune drops the addresses that have no recent failures, and whose last ban
+// is long enough ago that their next one starts from banTime again.
+func (b *authBanList) prune(now time.Time) {
+	if now.Sub(b.lastPrune) < authBanPruneInterval {
+		return
+	}
+
+	for ip, state := range b.clients {
+		if len(b.recentFailures(state, now)) == 0 && now.Sub(state.bannedUntil) >= b.maxBanTime {
+			delete(b.clients, ip)
+		}
+	}
+
+	b.lastPrune = now
+}
+
+// banned reports whether ip is currently banned.
+func (b *authBanList) banned(ip string) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.clients[ip]
+
+	return ok && b.now().Before(state.bannedUntil)
+}
+
+// acceptsConn reports whether a connection from remoteAddr is accepted, that
+// is whether its IP address isn't banned. With PROXY protocol, remoteAddr is
+// the client address from the header.
+func (b *authBanList) acceptsConn(ctx context.Context, remoteAddr string) bool {
+	ip := gitlabnet.ParseIP(remoteAddr)
+	if !b.banned(ip) {
+		return true
+	}
+
+	metrics.SshdAuthBanRejectedTotal.Inc()
+	log.FromContext(ctx).InfoContext(ctx, "connection rejected: IP address banned", slog.String(fields.RemoteIP, ip))
+
+	return false
+}
+
+// list returns the current bans, sorted by IP address.
+func (b *authBanList) list() []authBan {
+	bans := []authBan{}
+	if b == nil {
+		return bans
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for ip, state := range b.clients {
+		if now.Before(state.bannedUntil) {
+			bans = append(bans, authBan{IP: ip, BannedUntil: state.bannedUntil, Bans: state.bans})
+		}
+	}
+
+	slices.SortFunc(bans, func(a, b authBan) int { return strings.Compare(a.IP, b.IP) })
+
+	return bans
+}
+
+// serveAuthBans writes the current bans as JSON.
+func (s *Server) serveAuthBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(r.Context(), w, s.authBans.list())
+}
@@ -0,0 +1,186 @@
+package sshd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func newTestAuthBanList(t *testing.T) (*authBanList, *time.Time) {
+	t.Helper()
+
+	b := newAuthBanList(config.AuthBansConfig{
+		MaxFailures: 3,
+		FindTime:    config.YamlDuration(time.Minute),
+		BanTime:     config.YamlDuration(10 * time.Minute),
+		MaxBanTime:  config.YamlDuration(30 * time.Minute),
+	})
+	require.NotNil(t, b)
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+	b.lastPrune = now
+
+	return b, &now
+}
+
+func TestAuthBanListDisabled(t *testing.T) {
+	b := newAuthBanList(config.AuthBansConfig{})
+	require.Nil(t, b)
+
+	b.observe(context.Background(), "127.0.0.1", 100)
+	require.False(t, b.banned("127.0.0.1"))
+	require.Empty(t, b.list())
+}
+
+func TestAuthBanListSlidingWindow(t *testing.T) {
+	b, now := newTestAuthBanList(t)
+	ctx := context.Background()
+
+	b.observe(ctx, "10.0.0.1", 2)
+	require.False(t, b.banned("10.0.0.1"))
+
+	// The earlier failures fall out of the window
+	*now = now.Add(time.Minute + time.Second)
+	b.observe(ctx, "10.0.0.1", 1)
+	require.False(t, b.banned("10.0.0.1"))
+
+	*now = now.Add(30 * time.Second)
+	b.observe(ctx, "10.0.0.1", 1)
+	require.False(t, b.banned("10.0.0.1"))
+
+	initialBans := testutil.ToFloat64(metrics.SshdAuthBansTotal)
+
+	b.observe(ctx, "10.0.0.1", 1)
+	require.True(t, b.banned("10.0.0.1"))
+	require.False(t, b.banned("10.0.0.2"))
+	require.InDelta(t, initialBans+1, testutil.ToFloat64(metrics.SshdAuthBansTotal), 0.1)
+
+	*now = now.Add(10 * time.Minute)
+	require.False(t, b.banned("10.0.0.1"))
+}
+
+func TestAuthBanListBackoff(t *testing.T) {
+	b, now := newTestAuthBanList(t)
+	ctx := context.Background()
+
+	for _, expected := range []time.Duration{10 * time.Minute, 20 * time.Minute, 30 * time.Minute, 30 * time.Minute} {
+		b.observe(ctx, "10.0.0.1", 3)
+
+		bans := b.list()
+		require.Len(t, bans, 1)
+		require.Equal(t, now.Add(expected), bans[0].BannedUntil)
+
+		*now = bans[0].BannedUntil
+		require.False(t, b.banned("10.0.0.1"))
+	}
+
+	// An address that stays out of trouble long enough starts over
+	*now = now.Add(30*time.Minute + authBanPruneInterval)
+	b.observe(ctx, "10.0.0.2", 1)
+	require.NotContains(t, b.clients, "10.0.0.1")
+
+	b.observe(ctx, "10.0.0.1", 3)
+	require.Equal(t, []authBan{{IP: "10.0.0.1", BannedUntil: now.Add(10 * time.Minute), Bans: 1}}, b.list())
+}
+
+func TestAuthBanListForgive(t *testing.T) {
+	b, _ := newTestAuthBanList(t)
+	ctx := context.Background()
+
+	b.forgive("10.0.0.1", 1)
+	require.Empty(t, b.clients)
+
+	b.observe(ctx, "10.0.0.1", 2)
+	b.forgive("10.0.0.1", 1)
+	require.Len(t, b.clients["10.0.0.1"].failures, 1)
+
+	b.forgive("10.0.0.1", 5)
+	require.Empty(t, b.clients["10.0.0.1"].failures)
+
+	// Failures that got an address banned aren't forgiven
+	b.observe(ctx, "10.0.0.1", 3)
+	b.forgive("10.0.0.1", 3)
+	require.True(t, b.banned("10.0.0.1"))
+}
+
+func TestAuthBanListIgnoresUnixSockets(t *testing.T) {
+	b, _ := newTestAuthBanList(t)
+
+	b.observe(context.Background(), "", 3)
+	require.Empty(t, b.clients)
+	require.True(t, b.acceptsConn(context.Background(), ""))
+}
+
+func TestAuthBansEndpoint(t *testing.T) {
+	b, now := newTestAuthBanList(t)
+	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}, authBans: b}
+	s.serverConfig.Store(&serverConfig{adminToken: []byte(testAdminToken)})
+
+	b.observe(context.Background(), "10.0.0.2", 3)
+	b.observe(context.Background(), "10.0.0.1", 3)
+	b.observe(context.Background(), "10.0.0.3", 1)
+
+	r := adminRequest(t, s, http.MethodGet, authBansPath, "")
+	require.Equal(t, http.StatusUnauthorized, r.Result().StatusCode)
+
+	r = adminRequest(t, s, http.MethodPost, authBansPath, testAdminToken)
+	require.Equal(t, http.StatusMethodNotAllowed, r.Result().StatusCode)
+
+	r = adminRequest(t, s, http.MethodGet, authBansPath, testAdminToken)
+	require.Equal(t, http.StatusOK, r.Result().StatusCode)
+	require.Equal(t, "application/json", r.Result().Header.Get("Content-Type"))
+
+	var bans []authBan
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&bans))
+	require.Len(t, bans, 2)
+	require.Equal(t, "10.0.0.1", bans[0].IP)
+	require.Equal(t, "10.0.0.2", bans[1].IP)
+	require.True(t, now.Add(10*time.Minute).Equal(bans[0].BannedUntil))
+
+	// Without bans configured, the list is empty rather than null
+	s = &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
+	s.serverConfig.Store(&serverConfig{adminToken: []byte(testAdminToken)})
+	r = adminRequest(t, s, http.MethodGet, authBansPath, testAdminToken)
+	require.JSONEq(t, "[]", r.Body.String())
+}
+
+func TestAuthBansRejectConnections(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{
+		AuthBans: config.AuthBansConfig{
+			MaxFailures: 1,
+			FindTime:    config.YamlDuration(time.Minute),
+			BanTime:     config.YamlDuration(time.Minute),
+		},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	initialRejected := testutil.ToFloat64(metrics.SshdAuthBanRejectedTotal)
+
+	// The failing connection is closed as soon as it gets its address banned
+	unknownUser := clientConfig(t, testRoot)
+	unknownUser.User = "unknown"
+	_, err = ssh.Dial("tcp", s.Addr(), unknownUser)
+	require.ErrorContains(t, err, "ssh: handshake failed")
+	require.True(t, s.authBans.banned("127.0.0.1"))
+
+	_, err = ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.ErrorContains(t, err, "ssh: handshake failed")
+	require.InDelta(t, initialRejected+2, testutil.ToFloat64(metrics.SshdAuthBanRejectedTotal), 0.1)
+
+	// The connection established before the ban is unaffected
+	holdSession(t, client)
+}
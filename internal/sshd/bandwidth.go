@@ -0,0 +1,203 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+// bandwidthChunkSize caps how much is written to a throttled channel at once,
+// so that the sessions sharing a per-user limit take turns.
+const bandwidthChunkSize = 32 * 1024
+
+// byteLimiter is a token bucket of bytes. Unlike rateLimiter, it's waited on
+// rather than checked: writers take the bytes they send up front, possibly
+// going into debt, and wait until the debt is paid back. A nil *byteLimiter
+// doesn't limit anything.
+type byteLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+// newByteLimiter returns a limiter for cfg, or nil if cfg doesn't set a rate.
+// When no burst is configured, one second worth of bytes is allowed.
+func newByteLimiter(cfg config.BandwidthLimitConfig) *byteLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+
+	burst := cfg.Burst
+	if burst <= 0 {
+		burst = cfg.Rate
+	}
+
+	return &byteLimiter{
+		rate:    float64(cfg.Rate),
+		burst:   float64(burst),
+		now:     time.Now,
+		tokens:  float64(burst),
+		updated: time.Now(),
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before
+// sending them.
+func (l *byteLimiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.updated).Seconds()*l.rate)
+	l.updated = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// userBandwidthLimiters holds the per-user limiters, shared by all the
+// sessions of a user. A limiter is dropped once its last session is done. A
+// nil *userBandwidthLimiters doesn't limit anything.
+type userBandwidthLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*sharedByteLimiter
+}
+
+type sharedByteLimiter struct {
+	*byteLimiter
+	sessions int
+}
+
+// acquire returns the limiter of the user identified by key, creating it from
+// cfg if the user has no other session. It must be released once the session
+// is done.
+func (u *userBandwidthLimiters) acquire(key string, cfg config.BandwidthLimitConfig) *byteLimiter {
+	if u == nil || cfg.Rate <= 0 {
+		return nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.limiters == nil {
+		u.limiters = make(map[string]*sharedByteLimiter)
+	}
+
+	limiter, ok := u.limiters[key]
+	if !ok {
+		limiter = &sharedByteLimiter{byteLimiter: newByteLimiter(cfg)}
+		u.limiters[key] = limiter
+	}
+	limiter.sessions++
+
+	return limiter.byteLimiter
+}
+
+func (u *userBandwidthLimiters) release(key string) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	limiter, ok := u.limiters[key]
+	if !ok {
+		return
+	}
+
+	limiter.sessions--
+	if limiter.sessions == 0 {
+		delete(u.limiters, key)
+	}
+}
+
+// throttledWriter writes to w no faster than its limiters allow, and records
+// how long it was held back. It's used by a single command, so it isn't safe
+// for concurrent use.
+type throttledWriter struct {
+	ctx       context.Context
+	w         io.Writer
+	limiters  []*byteLimiter
+	chunkSize int
+	throttled time.Duration
+}
+
+func newThrottledWriter(ctx context.Context, w io.Writer, limiters ...*byteLimiter) *throttledWriter {
+	tw := &throttledWriter{ctx: ctx, w: w, chunkSize: bandwidthChunkSize}
+
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+
+		tw.limiters = append(tw.limiters, limiter)
+		tw.chunkSize = min(tw.chunkSize, max(1, int(limiter.burst)))
+	}
+
+	return tw
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	if len(tw.limiters) == 0 {
+		return tw.w.Write(p)
+	}
+
+	var written int
+	for len(p) > 0 {
+		chunk := p[:min(len(p), tw.chunkSize)]
+
+		if err := tw.wait(len(chunk)); err != nil {
+			return written, err
+		}
+
+		n, err := tw.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+func (tw *throttledWriter) wait(n int) error {
+	var delay time.Duration
+	for _, limiter := range tw.limiters {
+		delay = max(delay, limiter.reserve(n))
+	}
+
+	if delay <= 0 {
+		return nil
+	}
+
+	tw.throttled += delay
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-tw.ctx.Done():
+		return tw.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,116 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestByteLimiter(t *testing.T) {
+	require.Nil(t, newByteLimiter(config.BandwidthLimitConfig{}))
+	require.Zero(t, (*byteLimiter)(nil).reserve(1<<20))
+
+	l := newByteLimiter(config.BandwidthLimitConfig{Rate: 1000, Burst: 500})
+	now := time.Now()
+	l.now = func() time.Time { return now }
+	l.updated = now
+
+	require.Zero(t, l.reserve(500))
+	require.Equal(t, 100*time.Millisecond, l.reserve(100))
+
+	// Writers that share the limiter queue up behind each other
+	require.Equal(t, 300*time.Millisecond, l.reserve(200))
+
+	now = now.Add(300 * time.Millisecond)
+	require.Equal(t, 100*time.Millisecond, l.reserve(100))
+
+	// The bucket doesn't refill past the burst
+	now = now.Add(time.Hour)
+	require.Zero(t, l.reserve(500))
+	require.Equal(t, time.Millisecond, l.reserve(1))
+}
+
+func TestByteLimiterDefaultBurst(t *testing.T) {
+	l := newByteLimiter(config.BandwidthLimitConfig{Rate: 1000})
+	require.InDelta(t, 1000, l.burst, 0.1)
+}
+
+func TestUserBandwidthLimiters(t *testing.T) {
+	cfg := config.BandwidthLimitConfig{Rate: 1000}
+
+	var nilLimiters *userBandwidthLimiters
+	require.Nil(t, nilLimiters.acquire("key:1", cfg))
+	nilLimiters.release("key:1")
+
+	u := &userBandwidthLimiters{}
+	require.Nil(t, u.acquire("key:1", config.BandwidthLimitConfig{}))
+
+	first := u.acquire("key:1", cfg)
+	require.NotNil(t, first)
+	require.Same(t, first, u.acquire("key:1", cfg))
+	require.NotSame(t, first, u.acquire("key:2", cfg))
+
+	u.release("key:1")
+	u.release("key:2")
+	require.Same(t, first, u.acquire("key:1", cfg))
+
+	u.release("key:1")
+	u.release("key:1")
+	require.Empty(t, u.limiters)
+
+	// Releasing a limiter that's already gone is harmless
+	u.release("key:1")
+}
+
+func TestThrottledWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+
+	t.Run("without limits", func(t *testing.T) {
+		var out bytes.Buffer
+		tw := newThrottledWriter(context.Background(), &out, nil, nil)
+
+		n, err := tw.Write(data)
+		require.NoError(t, err)
+		require.Equal(t, len(data), n)
+		require.Equal(t, data, out.Bytes())
+		require.Zero(t, tw.throttled)
+	})
+
+	t.Run("with limits", func(t *testing.T) {
+		var out bytes.Buffer
+		fast := newByteLimiter(config.BandwidthLimitConfig{Rate: 1 << 20})
+		slow := newByteLimiter(config.BandwidthLimitConfig{Rate: 10000, Burst: 40})
+		tw := newThrottledWriter(context.Background(), &out, fast, slow)
+		require.Equal(t, 40, tw.chunkSize)
+
+		started := time.Now()
+		n, err := tw.Write(data)
+		require.NoError(t, err)
+		require.Equal(t, len(data), n)
+		require.Equal(t, data, out.Bytes())
+
+		// 60 bytes over the burst, at 10000 bytes per second
+		require.Positive(t, tw.throttled)
+		require.LessOrEqual(t, tw.throttled, 6*time.Millisecond)
+		require.GreaterOrEqual(t, time.Since(started), tw.throttled)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		var out bytes.Buffer
+		slow := newByteLimiter(config.BandwidthLimitConfig{Rate: 1, Burst: 40})
+		tw := newThrottledWriter(ctx, &out, slow)
+
+		n, err := tw.Write(data)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, 40, n)
+		require.Equal(t, data[:40], out.Bytes())
+	})
+}
@@ -0,0 +1,140 @@
+package sshd
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+const (
+	usernameFromKeyID          = "key_id"
+	usernameFromFirstPrincipal = "first_principal"
+	usernameFromPrincipal      = "principal"
+
+	// usernamePlaceholder stands for the username in principal templates.
+	usernamePlaceholder = "{username}"
+)
+
+// certIdentityMapping maps the certificates signed by a trusted user CA to
+// GitLab usernames and, when the CA is pinned to namespaces, to these
+// namespaces. The zero value takes the username from the KeyId and gives
+// instance-wide access.
+type certIdentityMapping struct {
+	fromPrincipals     bool
+	principalTemplate  string
+	principalPattern   *regexp.Regexp
+	rewritePattern     *regexp.Regexp
+	rewriteReplacement string
+	namespaces         []string
+}
+
+// newCertIdentityMapping builds the mapping of the trusted user CA keys
+// configured by caKey.
+func newCertIdentityMapping(caKey config.TrustedUserCAKeyConfig) (certIdentityMapping, error) {
+	var mapping certIdentityMapping
+
+	switch caKey.UsernameFrom {
+	case "", usernameFromKeyID:
+	case usernameFromFirstPrincipal:
+		mapping.fromPrincipals = true
+	case usernameFromPrincipal:
+		if strings.Count(caKey.PrincipalTemplate, usernamePlaceholder) != 1 {
+			return certIdentityMapping{}, fmt.Errorf("principal_template %q must contain %s once", caKey.PrincipalTemplate, usernamePlaceholder)
+		}
+
+		prefix, suffix, _ := strings.Cut(caKey.PrincipalTemplate, usernamePlaceholder)
+		mapping.fromPrincipals = true
+		mapping.principalTemplate = caKey.PrincipalTemplate
+		mapping.principalPattern = regexp.MustCompile("^" + regexp.QuoteMeta(prefix) + "(.+)" + regexp.QuoteMeta(suffix) + "$")
+	default:
+		return certIdentityMapping{}, fmt.Errorf("unknown username_from %q", caKey.UsernameFrom)
+	}
+
+	if caKey.PrincipalTemplate != "" && mapping.principalPattern == nil {
+		return certIdentityMapping{}, fmt.Errorf("principal_template requires username_from: %s", usernameFromPrincipal)
+	}
+
+	if caKey.Rewrite != nil {
+		pattern, err := regexp.Compile(caKey.Rewrite.Pattern)
+		if err != nil {
+			return certIdentityMapping{}, fmt.Errorf("invalid rewrite pattern %q: %w", caKey.Rewrite.Pattern, err)
+		}
+
+		mapping.rewritePattern = pattern
+		mapping.rewriteReplacement = caKey.Rewrite.Replacement
+	}
+
+	for _, namespace := range caKey.Namespaces {
+		namespace = strings.Trim(namespace, "/")
+		if namespace == "" || strings.ContainsAny(namespace, ", ") {
+			return certIdentityMapping{}, fmt.Errorf("invalid namespace %q", namespace)
+		}
+
+		mapping.namespaces = append(mapping.namespaces, namespace)
+	}
+
+	return mapping, nil
+}
+
+// equal reports whether m and other map certificates the same way.
+func (m certIdentityMapping) equal(other certIdentityMapping) bool {
+	return m.fromPrincipals == other.fromPrincipals &&
+		m.principalTemplate == other.principalTemplate &&
+		(m.rewritePattern == nil) == (other.rewritePattern == nil) &&
+		(m.rewritePattern == nil || m.rewritePattern.String() == other.rewritePattern.String()) &&
+		m.rewriteReplacement == other.rewriteReplacement &&
+		slices.Equal(m.namespaces, other.namespaces)
+}
+
+// principal returns the principal of cert the username is taken from, when the
+// mapping takes it from the principals.
+func (m certIdentityMapping) principal(cert *ssh.Certificate) (string, error) {
+	if m.principalPattern == nil {
+		if len(cert.ValidPrincipals) == 0 {
+			return "", fmt.Errorf("certificate has no principals")
+		}
+
+		return cert.ValidPrincipals[0], nil
+	}
+
+	for _, principal := range cert.ValidPrincipals {
+		if m.principalPattern.MatchString(principal) {
+			return principal, nil
+		}
+	}
+
+	return "", fmt.Errorf("certificate has no principal matching %q", m.principalTemplate)
+}
+
+// username returns the GitLab username cert maps to. It's validated by the
+// caller.
+func (m certIdentityMapping) username(cert *ssh.Certificate) (string, error) {
+	username := cert.KeyId
+
+	if m.fromPrincipals {
+		principal, err := m.principal(cert)
+		if err != nil {
+			return "", err
+		}
+
+		username = principal
+		if m.principalPattern != nil {
+			username = m.principalPattern.FindStringSubmatch(principal)[1]
+		}
+	}
+
+	if m.rewritePattern != nil {
+		if !m.rewritePattern.MatchString(username) {
+			return "", fmt.Errorf("certificate username %q doesn't match the rewrite pattern", username)
+		}
+
+		username = m.rewritePattern.ReplaceAllString(username, m.rewriteReplacement)
+	}
+
+	return username, nil
+}
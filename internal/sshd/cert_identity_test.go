@@ -0,0 +1,172 @@
+package sshd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestNewCertIdentityMappingErrors(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		caKey       config.TrustedUserCAKeyConfig
+		expectedErr string
+	}{
+		{
+			desc:        "unknown username_from",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: "email"},
+			expectedErr: `unknown username_from "email"`,
+		},
+		{
+			desc:        "principal without a template",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromPrincipal},
+			expectedErr: `principal_template "" must contain {username} once`,
+		},
+		{
+			desc:        "template with the placeholder twice",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromPrincipal, PrincipalTemplate: "{username}@{username}"},
+			expectedErr: `principal_template "{username}@{username}" must contain {username} once`,
+		},
+		{
+			desc:        "template without principal",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromFirstPrincipal, PrincipalTemplate: "{username}@example.com"},
+			expectedErr: "principal_template requires username_from: principal",
+		},
+		{
+			desc:        "invalid rewrite pattern",
+			caKey:       config.TrustedUserCAKeyConfig{Rewrite: &config.UsernameRewriteConfig{Pattern: "(", Replacement: "$1"}},
+			expectedErr: "invalid rewrite pattern \"(\": error parsing regexp: missing closing ): `(`",
+		},
+		{
+			desc:        "empty namespace",
+			caKey:       config.TrustedUserCAKeyConfig{Namespaces: []string{"group", "/"}},
+			expectedErr: `invalid namespace ""`,
+		},
+		{
+			desc:        "namespaces in one entry",
+			caKey:       config.TrustedUserCAKeyConfig{Namespaces: []string{"group,other"}},
+			expectedErr: `invalid namespace "group,other"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := newCertIdentityMapping(tc.caKey)
+			require.EqualError(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func TestCertIdentityMappingUsername(t *testing.T) {
+	cert := &ssh.Certificate{
+		KeyId:           "ticket-1234",
+		ValidPrincipals: []string{"deploy", "jane.doe@corp.example.com", "git"},
+	}
+
+	testCases := []struct {
+		desc             string
+		caKey            config.TrustedUserCAKeyConfig
+		cert             *ssh.Certificate
+		expectedUsername string
+		expectedErr      string
+	}{
+		{
+			desc:             "default",
+			caKey:            config.TrustedUserCAKeyConfig{},
+			expectedUsername: "ticket-1234",
+		},
+		{
+			desc:             "key_id",
+			caKey:            config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromKeyID},
+			expectedUsername: "ticket-1234",
+		},
+		{
+			desc:             "first_principal",
+			caKey:            config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromFirstPrincipal},
+			expectedUsername: "deploy",
+		},
+		{
+			desc:        "first_principal without principals",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromFirstPrincipal},
+			cert:        &ssh.Certificate{KeyId: "jane"},
+			expectedErr: "certificate has no principals",
+		},
+		{
+			desc:             "principal matching a template",
+			caKey:            config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromPrincipal, PrincipalTemplate: "{username}@corp.example.com"},
+			expectedUsername: "jane.doe",
+		},
+		{
+			desc:        "no principal matching a template",
+			caKey:       config.TrustedUserCAKeyConfig{UsernameFrom: usernameFromPrincipal, PrincipalTemplate: "gitlab:{username}"},
+			expectedErr: `certificate has no principal matching "gitlab:{username}"`,
+		},
+		{
+			desc: "rewrite",
+			caKey: config.TrustedUserCAKeyConfig{
+				UsernameFrom:      usernameFromPrincipal,
+				PrincipalTemplate: "{username}@corp.example.com",
+				Rewrite:           &config.UsernameRewriteConfig{Pattern: `^(\w+)\.(\w+)$`, Replacement: "$1-$2"},
+			},
+			expectedUsername: "jane-doe",
+		},
+		{
+			desc: "rewrite not matching",
+			caKey: config.TrustedUserCAKeyConfig{
+				Rewrite: &config.UsernameRewriteConfig{Pattern: `^user-(.+)$`, Replacement: "$1"},
+			},
+			expectedErr: `certificate username "ticket-1234" doesn't match the rewrite pattern`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			mapping, err := newCertIdentityMapping(tc.caKey)
+			require.NoError(t, err)
+
+			c := cert
+			if tc.cert != nil {
+				c = tc.cert
+			}
+
+			username, err := mapping.username(c)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedUsername, username)
+		})
+	}
+}
+
+func TestCertIdentityMappingEqual(t *testing.T) {
+	byKeyID, err := newCertIdentityMapping(config.TrustedUserCAKeyConfig{File: "a.pub"})
+	require.NoError(t, err)
+	byKeyIDToo, err := newCertIdentityMapping(config.TrustedUserCAKeyConfig{File: "b.pub", UsernameFrom: usernameFromKeyID})
+	require.NoError(t, err)
+	byPrincipal, err := newCertIdentityMapping(config.TrustedUserCAKeyConfig{File: "a.pub", UsernameFrom: usernameFromFirstPrincipal})
+	require.NoError(t, err)
+	rewritten, err := newCertIdentityMapping(config.TrustedUserCAKeyConfig{
+		File:    "a.pub",
+		Rewrite: &config.UsernameRewriteConfig{Pattern: "^(.+)-admin$", Replacement: "$1"},
+	})
+	require.NoError(t, err)
+
+	require.True(t, byKeyID.equal(certIdentityMapping{}))
+	require.True(t, byKeyID.equal(byKeyIDToo))
+	require.False(t, byKeyID.equal(byPrincipal))
+	require.False(t, byKeyID.equal(rewritten))
+	require.False(t, rewritten.equal(byKeyID))
+	require.True(t, rewritten.equal(rewritten))
+
+	pinned, err := newCertIdentityMapping(config.TrustedUserCAKeyConfig{File: "a.pub", Namespaces: []string{"/group/", "other/sub"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"group", "other/sub"}, pinned.namespaces)
+	require.False(t, byKeyID.equal(pinned))
+	require.True(t, pinned.equal(certIdentityMapping{namespaces: []string{"group", "other/sub"}}))
+}
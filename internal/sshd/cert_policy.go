@@ -0,0 +1,157 @@
+package sshd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+)
+
+const (
+	// forceCommandOption restricts the commands a certificate allows to the
+	// ones it lists, separated by commas or spaces.
+	forceCommandOption = "force-command"
+
+	permitPTYExtension = "permit-pty"
+	// readOnlyExtension restricts a certificate to read access.
+	readOnlyExtension = "gitlab-read-only@gitlab.com"
+	// projectsExtension restricts a certificate to the projects it lists, by
+	// full path, separated by commas.
+	projectsExtension = "gitlab-projects@gitlab.com"
+
+	// The permissions extensions recording the policy of a certificate.
+	certPermCommands = "commands"
+	certPermReadOnly = "read-only"
+	certPermProjects = "projects"
+	certPermNoPTY    = "no-pty"
+)
+
+// supportedCriticalOptions are the critical options of the certificates
+// accepted besides source-address, which crypto/ssh enforces. Certificates
+// with other critical options are rejected.
+var supportedCriticalOptions = []string{forceCommandOption}
+
+// readOnlyCommands are the commands a read-only certificate allows at most.
+// The Git commands are narrowed to reading when verifying access.
+var readOnlyCommands = []string{
+	string(commandargs.Discover),
+	string(commandargs.UploadPack),
+	string(commandargs.UploadArchive),
+	string(commandargs.LfsAuthenticate),
+	string(commandargs.LfsTransfer),
+}
+
+// projectCommands are the commands a certificate restricted to projects allows
+// at most: the ones bound to a repository, whose project is checked. The
+// account commands, such as personal_access_token and ssh_keys, aren't.
+var projectCommands = []string{
+	string(commandargs.Discover),
+	string(commandargs.UploadPack),
+	string(commandargs.ReceivePack),
+	string(commandargs.UploadArchive),
+	string(commandargs.LfsAuthenticate),
+	string(commandargs.LfsTransfer),
+}
+
+// certPolicy narrows what the sessions of a connection authenticated with a
+// certificate allow. The zero value allows everything.
+type certPolicy struct {
+	commands []string
+	readOnly bool
+	projects []string
+	noPTY    bool
+}
+
+// parseCertPolicy returns the policy set by the critical options and
+// extensions of cert. Without the permit-pty extension, PTY requests are
+// refused, as with OpenSSH.
+func parseCertPolicy(cert *ssh.Certificate) (certPolicy, error) {
+	var policy certPolicy
+
+	if forceCommand, ok := cert.CriticalOptions[forceCommandOption]; ok {
+		policy.commands = strings.FieldsFunc(forceCommand, func(r rune) bool {
+			return r == ',' || r == ' '
+		})
+		if len(policy.commands) == 0 {
+			return certPolicy{}, fmt.Errorf("certificate has an empty %s", forceCommandOption)
+		}
+	}
+
+	if _, ok := cert.Extensions[readOnlyExtension]; ok {
+		policy.readOnly = true
+
+		policy.commands = narrowCommands(policy.commands, readOnlyCommands)
+		if len(policy.commands) == 0 {
+			return certPolicy{}, fmt.Errorf("certificate %s doesn't list any read-only command", forceCommandOption)
+		}
+	}
+
+	if projects, ok := cert.Extensions[projectsExtension]; ok {
+		for _, project := range strings.Split(projects, ",") {
+			if project = strings.TrimSpace(project); project != "" {
+				policy.projects = append(policy.projects, project)
+			}
+		}
+		if len(policy.projects) == 0 {
+			return certPolicy{}, fmt.Errorf("certificate has an empty %s extension", projectsExtension)
+		}
+
+		policy.commands = narrowCommands(policy.commands, projectCommands)
+		if len(policy.commands) == 0 {
+			return certPolicy{}, fmt.Errorf("certificate %s doesn't list any project command", forceCommandOption)
+		}
+	}
+
+	_, permitPTY := cert.Extensions[permitPTYExtension]
+	policy.noPTY = !permitPTY
+
+	return policy, nil
+}
+
+// narrowCommands returns the commands that are both in commands and allowed,
+// or allowed if commands is empty, that is when every command is allowed.
+func narrowCommands(commands, allowed []string) []string {
+	if len(commands) == 0 {
+		return slices.Clone(allowed)
+	}
+
+	return slices.DeleteFunc(commands, func(command string) bool {
+		return !slices.Contains(allowed, command)
+	})
+}
+
+// addTo records the policy in the permissions extensions.
+func (p certPolicy) addTo(extensions map[string]string) {
+	if len(p.commands) > 0 {
+		extensions[certPermCommands] = strings.Join(p.commands, ",")
+	}
+	if p.readOnly {
+		extensions[certPermReadOnly] = ""
+	}
+	if len(p.projects) > 0 {
+		extensions[certPermProjects] = strings.Join(p.projects, ",")
+	}
+	if p.noPTY {
+		extensions[certPermNoPTY] = ""
+	}
+}
+
+// certPolicyFromExtensions returns the policy recorded in the permissions
+// extensions by addTo.
+func certPolicyFromExtensions(extensions map[string]string) certPolicy {
+	var policy certPolicy
+
+	if commands := extensions[certPermCommands]; commands != "" {
+		policy.commands = strings.Split(commands, ",")
+	}
+	_, policy.readOnly = extensions[certPermReadOnly]
+	if projects := extensions[certPermProjects]; projects != "" {
+		policy.projects = strings.Split(projects, ",")
+	}
+	_, policy.noPTY = extensions[certPermNoPTY]
+
+	return policy
+}
@@ -0,0 +1,164 @@
+package sshd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+)
+
+func TestParseCertPolicy(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		criticalOptions map[string]string
+		extensions      map[string]string
+		expectedPolicy  certPolicy
+		expectedErr     string
+	}{
+		{
+			desc:           "no policy",
+			extensions:     map[string]string{permitPTYExtension: ""},
+			expectedPolicy: certPolicy{},
+		},
+		{
+			desc:           "without permit-pty",
+			expectedPolicy: certPolicy{noPTY: true},
+		},
+		{
+			desc:            "force-command",
+			criticalOptions: map[string]string{forceCommandOption: "git-upload-pack, git-receive-pack git-upload-archive"},
+			extensions:      map[string]string{permitPTYExtension: ""},
+			expectedPolicy:  certPolicy{commands: []string{"git-upload-pack", "git-receive-pack", "git-upload-archive"}},
+		},
+		{
+			desc:            "empty force-command",
+			criticalOptions: map[string]string{forceCommandOption: " , "},
+			expectedErr:     "certificate has an empty force-command",
+		},
+		{
+			desc:       "read-only",
+			extensions: map[string]string{readOnlyExtension: ""},
+			expectedPolicy: certPolicy{
+				commands: readOnlyCommands,
+				readOnly: true,
+				noPTY:    true,
+			},
+		},
+		{
+			desc:            "read-only with force-command",
+			criticalOptions: map[string]string{forceCommandOption: "git-upload-pack,git-receive-pack,personal_access_token"},
+			extensions:      map[string]string{readOnlyExtension: ""},
+			expectedPolicy: certPolicy{
+				commands: []string{"git-upload-pack"},
+				readOnly: true,
+				noPTY:    true,
+			},
+		},
+		{
+			desc:            "read-only with force-command writing",
+			criticalOptions: map[string]string{forceCommandOption: "git-receive-pack"},
+			extensions:      map[string]string{readOnlyExtension: ""},
+			expectedErr:     "certificate force-command doesn't list any read-only command",
+		},
+		{
+			desc:       "projects",
+			extensions: map[string]string{projectsExtension: "group/project, group/sub/other,"},
+			expectedPolicy: certPolicy{
+				commands: projectCommands,
+				projects: []string{"group/project", "group/sub/other"},
+				noPTY:    true,
+			},
+		},
+		{
+			desc:            "projects with force-command",
+			criticalOptions: map[string]string{forceCommandOption: "git-receive-pack,ssh_keys"},
+			extensions:      map[string]string{projectsExtension: "group/project"},
+			expectedPolicy: certPolicy{
+				commands: []string{"git-receive-pack"},
+				projects: []string{"group/project"},
+				noPTY:    true,
+			},
+		},
+		{
+			desc:            "projects with force-command of account commands",
+			criticalOptions: map[string]string{forceCommandOption: "personal_access_token"},
+			extensions:      map[string]string{projectsExtension: "group/project"},
+			expectedErr:     "certificate force-command doesn't list any project command",
+		},
+		{
+			desc:       "read-only projects",
+			extensions: map[string]string{readOnlyExtension: "", projectsExtension: "group/project"},
+			expectedPolicy: certPolicy{
+				commands: readOnlyCommands,
+				readOnly: true,
+				projects: []string{"group/project"},
+				noPTY:    true,
+			},
+		},
+		{
+			desc:        "empty projects",
+			extensions:  map[string]string{projectsExtension: ""},
+			expectedErr: "certificate has an empty gitlab-projects@gitlab.com extension",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cert := &ssh.Certificate{
+				Permissions: ssh.Permissions{CriticalOptions: tc.criticalOptions, Extensions: tc.extensions},
+			}
+
+			policy, err := parseCertPolicy(cert)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedPolicy, policy)
+		})
+	}
+}
+
+func TestProjectsCertPolicyRefusesAccountCommands(t *testing.T) {
+	cert := &ssh.Certificate{
+		Permissions: ssh.Permissions{Extensions: map[string]string{projectsExtension: "group/project"}},
+	}
+
+	policy, err := parseCertPolicy(cert)
+	require.NoError(t, err)
+
+	env := (&session{certPolicy: policy}).commandEnv()
+	require.True(t, env.AllowsCommand(string(commandargs.UploadPack)))
+	require.True(t, env.AllowsCommand(string(commandargs.ReceivePack)))
+
+	for _, command := range []commandargs.CommandType{
+		commandargs.PersonalAccessToken,
+		commandargs.SSHKeys,
+		commandargs.TwoFactorRecover,
+		commandargs.TwoFactorVerify,
+		commandargs.VerifySignature,
+	} {
+		require.False(t, env.AllowsCommand(string(command)), command)
+	}
+}
+
+func TestCertPolicyExtensions(t *testing.T) {
+	policies := []certPolicy{
+		{},
+		{noPTY: true},
+		{commands: []string{"git-upload-pack", "discover"}, readOnly: true},
+		{projects: []string{"group/project", "group/other"}},
+	}
+
+	for _, policy := range policies {
+		extensions := map[string]string{certPermUsername: "jane"}
+		policy.addTo(extensions)
+
+		require.Equal(t, policy, certPolicyFromExtensions(extensions))
+	}
+
+	require.Equal(t, certPolicy{}, certPolicyFromExtensions(map[string]string{"key-id": "1"}))
+}
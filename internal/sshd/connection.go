@@ -8,9 +8,11 @@ import (
 	"log/slog"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/sync/semaphore"
 	grpccodes "google.golang.org/grpc/codes"
@@ -21,6 +23,7 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 
+	"gitlab.com/gitlab-org/labkit/v2/fields"
 	"gitlab.com/gitlab-org/labkit/v2/log"
 )
 
@@ -31,6 +34,10 @@ const (
 	// sessionChannelType is the SSH channel type for interactive sessions.
 	sessionChannelType = "session"
 
+	// gitChannelType is the opt-in SSH channel type that runs a single Git
+	// command without the env/exec request round trips of a session.
+	gitChannelType = "gitlab-git@gitlab.com"
+
 	// NotOurRefError represents the error message indicating that the git upload-pack is not our reference
 	NotOurRefError = `exit status 128, stderr: "fatal: git upload-pack: not our ref `
 
@@ -59,24 +66,59 @@ const (
 var EOFTimeout = 10 * time.Second
 
 type connection struct {
-	cfg                *config.Config
-	concurrentSessions *semaphore.Weighted
-	nconn              net.Conn
-	maxSessions        int64
-	remoteAddr         string
-	outcome            connOutcome
+	cfg                   *config.Config
+	concurrentSessions    *semaphore.Weighted
+	concurrentGitChannels *semaphore.Weighted
+	nconn                 net.Conn
+	maxSessions           int64
+	maxGitChannels        int64
+	loginGraceTime        time.Duration
+	remoteAddr            string
+	outcome               connOutcome
+
+	// gitChannelHandler serves gitlab-git@gitlab.com channels. When it's nil the
+	// channel type is rejected like any other unknown type.
+	gitChannelHandler gitChannelHandler
+
+	// draining reports whether the server is shutting down, in which case new
+	// channels are turned away with a notice. It's nil when the connection isn't
+	// owned by a Server.
+	draining func() bool
+
+	// id identifies the connection on the admin endpoints, and started is when
+	// it was accepted.
+	id      uint64
+	started time.Time
+
+	// State used to disconnect the client once the shutdown grace period is
+	// over, and to report on the connection on the admin endpoints
+	mu       sync.Mutex
+	sconn    *ssh.ServerConn
+	channels map[ssh.Channel]struct{}
+	closed   chan struct{}
+	sessions map[*session]struct{}
+	username string
 }
 
 // connOutcome records, for a single connection, whether authentication was
 // attempted and whether any server-side error occurred (at the auth or session
 // phase). It feeds the connection-level SLI emitted once in handle().
 //
-// authAttempted is written only from the auth callback, which ssh.NewServerConn
-// invokes inline on handle()'s goroutine, so it needs no synchronization.
-// serverError may also be written from per-session goroutines, so it is atomic.
+// It also records the client-side authentication failures in authBans as they
+// happen, and disconnects the client once its address ip is banned.
+//
+// authAttempted and authFailures are written only from the auth callback, which
+// ssh.NewServerConn invokes inline on handle()'s goroutine, so they need no
+// synchronization. serverError may also be written from per-session goroutines,
+// so it is atomic.
 type connOutcome struct {
 	authAttempted bool
+	authFailures  int
 	serverError   atomic.Bool
+
+	authBans   *authBanList
+	ip         string
+	disconnect func()
 }
 
 // observeAuth records the result of a public-key (or certificate) auth attempt.
@@ -85,7 +127,11 @@ type connOutcome struct {
 // transport handshake earlier and never get here. Only a server-side failure (a
 // System *client.APIError, e.g. the internal API was unreachable or redirected)
 // marks the connection as an error; client-side failures (unknown key) do not.
-func (o *connOutcome) observeAuth(err error) {
+//
+// Client-side failures are recorded in the ban list right away, and the
+// connection is closed as soon as its address is banned, whether by this
+// failure or by another connection's, rather than left to try more keys.
+func (o *connOutcome) observeAuth(ctx context.Context, err error) {
 	o.authAttempted = true
 
 	// SSH clients may try several keys in sequence, and the final attempt decides
@@ -95,28 +141,57 @@ func (o *connOutcome) observeAuth(err error) {
 	// from): the connection ultimately succeeded and must not count as an error.
 	// Auth always completes before any session runs, so this never clears a
 	// session-phase error.
+	// For the same reason, the keys that failed before one that's accepted
+	// aren't held against the client, unless they already got it banned.
 	if err == nil {
 		o.serverError.Store(false)
+		o.authBans.forgive(o.ip, o.authFailures)
+		o.authFailures = 0
 		return
 	}
 
 	var apiErr *client.APIError
-	if errors.As(err, &apiErr) && apiErr.System {
+	switch {
+	case errors.As(err, &apiErr) && apiErr.System:
 		o.serverError.Store(true)
+	case !errors.Is(err, errRateLimited):
+		o.authFailures++
+		o.authBans.observe(ctx, o.ip, 1)
+	}
+
+	if o.disconnect != nil && o.authBans.banned(o.ip) {
+		metrics.SshdAuthBanRejectedTotal.Inc()
+		log.FromContext(ctx).InfoContext(ctx, "connection closed: IP address banned", slog.String(fields.RemoteIP, o.ip))
+
+		o.disconnect()
 	}
 }
 
 type channelHandler func(context.Context, *ssh.ServerConn, ssh.Channel, <-chan *ssh.Request) error
 
+// gitChannelRequest is the extra data sent by the client when opening a
+// gitlab-git@gitlab.com channel.
+type gitChannelRequest struct {
+	Command            string
+	GitProtocolVersion string
+}
+
+type gitChannelHandler func(context.Context, *ssh.ServerConn, ssh.Channel, gitChannelRequest) error
+
 func newConnection(cfg *config.Config, nconn net.Conn) *connection {
 	maxSessions := cfg.Server.ConcurrentSessionsLimit
+	maxGitChannels := cfg.Server.GitChannel.ConcurrentChannelsLimit
 
 	return &connection{
-		cfg:                cfg,
-		maxSessions:        maxSessions,
-		concurrentSessions: semaphore.NewWeighted(maxSessions),
-		nconn:              nconn,
-		remoteAddr:         nconn.RemoteAddr().String(),
+		cfg:                   cfg,
+		maxSessions:           maxSessions,
+		concurrentSessions:    semaphore.NewWeighted(maxSessions),
+		maxGitChannels:        maxGitChannels,
+		concurrentGitChannels: semaphore.NewWeighted(maxGitChannels),
+		nconn:                 nconn,
+		loginGraceTime:        time.Duration(cfg.Server.LoginGraceTime),
+		remoteAddr:            nconn.RemoteAddr().String(),
+		started:               time.Now(),
 	}
 }
 
@@ -137,6 +212,9 @@ func (c *connection) handle(ctx context.Context, srvCfg *ssh.ServerConfig, handl
 		return
 	}
 
+	closed := c.setServerConn(sconn)
+	defer close(closed)
+
 	if c.cfg.Server.ClientAliveInterval > 0 {
 		ticker := time.NewTicker(time.Duration(c.cfg.Server.ClientAliveInterval))
 		defer ticker.Stop()
@@ -152,8 +230,8 @@ func (c *connection) handle(ctx context.Context, srvCfg *ssh.ServerConfig, handl
 }
 
 func (c *connection) initServerConn(ctx context.Context, srvCfg *ssh.ServerConfig) (*ssh.ServerConn, <-chan ssh.NewChannel, error) {
-	if c.cfg.Server.LoginGraceTime > 0 {
-		_ = c.nconn.SetDeadline(time.Now().Add(time.Duration(c.cfg.Server.LoginGraceTime)))
+	if c.loginGraceTime > 0 {
+		_ = c.nconn.SetDeadline(time.Now().Add(c.loginGraceTime))
 		defer func() { _ = c.nconn.SetDeadline(time.Time{}) }()
 	}
 
@@ -180,48 +258,15 @@ func (c *connection) handleRequests(ctx context.Context, sconn *ssh.ServerConn,
 	for newChannel := range chans {
 		log.FromContext(requestCtx).InfoContext(requestCtx, "connection: handle: new channel requested", slog.String("channel_type", newChannel.ChannelType()))
 
-		if newChannel.ChannelType() != sessionChannelType {
+		switch {
+		case newChannel.ChannelType() == sessionChannelType:
+			c.handleSessionChannel(requestCtx, sconn, newChannel, handler)
+		case newChannel.ChannelType() == gitChannelType && c.gitChannelHandler != nil:
+			c.handleGitChannel(requestCtx, sconn, newChannel)
+		default:
 			log.FromContext(requestCtx).InfoContext(requestCtx, "connection: handleRequests: unknown channel type")
 			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
-		}
-
-		if !c.concurrentSessions.TryAcquire(1) {
-			log.FromContext(requestCtx).InfoContext(requestCtx, "connection: handleRequests: too many concurrent sessions")
-			_ = newChannel.Reject(ssh.ResourceShortage, "too many concurrent sessions")
-			metrics.SshdHitMaxSessions.Inc()
-			continue
-		}
-
-		channel, requests, err := newChannel.Accept()
-		if err != nil {
-			log.FromContext(requestCtx).ErrorContext(requestCtx, "connection: handleRequests: accepting channel failed", log.ErrorMessage(err.Error()))
-			c.concurrentSessions.Release(1)
-			continue
 		}
-
-		go func() {
-			defer func(started time.Time) {
-				dur := time.Since(started)
-				metrics.SshdSessionDuration.Observe(dur.Seconds())
-				log.FromContext(requestCtx).InfoContext(requestCtx, "connection: handleRequests: done", log.DurationS(dur))
-			}(time.Now())
-
-			defer c.concurrentSessions.Release(1)
-
-			// Prevent a panic in a single session from taking out the whole server
-			defer func() {
-				if err := recover(); err != nil {
-					log.FromContext(requestCtx).ErrorContext(requestCtx, "panic handling session", slog.Any("recovered_error", err))
-				}
-			}()
-
-			metrics.SliSshdSessionsTotal.Inc()
-			err := handler(requestCtx, sconn, channel, requests)
-			if err != nil {
-				c.trackError(requestCtx, err)
-			}
-		}()
 	}
 
 	// When a connection has been prematurely closed we block execution until all concurrent sessions are released
@@ -231,6 +276,127 @@ func (c *connection) handleRequests(ctx context.Context, sconn *ssh.ServerConn,
 	ctx, cancel := context.WithTimeout(ctx, EOFTimeout)
 	defer cancel()
 	_ = c.concurrentSessions.Acquire(ctx, c.maxSessions)
+	if c.concurrentGitChannels != nil {
+		_ = c.concurrentGitChannels.Acquire(ctx, c.maxGitChannels)
+	}
+}
+
+func (c *connection) handleSessionChannel(ctx context.Context, sconn *ssh.ServerConn, newChannel ssh.NewChannel, handler channelHandler) {
+	if c.isDraining() {
+		c.handleDrainingChannel(ctx, newChannel)
+		return
+	}
+
+	if !c.concurrentSessions.TryAcquire(1) {
+		log.FromContext(ctx).InfoContext(ctx, "connection: handleRequests: too many concurrent sessions")
+		_ = newChannel.Reject(ssh.ResourceShortage, "too many concurrent sessions")
+		metrics.SshdHitMaxSessions.Inc()
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.FromContext(ctx).ErrorContext(ctx, "connection: handleRequests: accepting channel failed", log.ErrorMessage(err.Error()))
+		c.concurrentSessions.Release(1)
+		return
+	}
+
+	go c.serveChannel(ctx, channel, c.concurrentSessions, metrics.SshdSessionDuration, func(ctx context.Context, channel ssh.Channel) error {
+		return handler(ctx, sconn, channel, requests)
+	})
+}
+
+// handleGitChannel accepts a gitlab-git@gitlab.com channel. The command is
+// carried in the channel open request, so the channel is rejected up front if
+// it's malformed or over the limit, before any round trip is spent on it.
+// Git channels are accounted separately from sessions: they are meant for
+// clients that multiplex many fetches over one connection.
+func (c *connection) handleGitChannel(ctx context.Context, sconn *ssh.ServerConn, newChannel ssh.NewChannel) {
+	var req gitChannelRequest
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &req); err != nil {
+		log.FromContext(ctx).InfoContext(ctx, "connection: handleGitChannel: invalid channel request", log.ErrorMessage(err.Error()))
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid git channel request")
+		return
+	}
+
+	if c.isDraining() {
+		c.handleDrainingChannel(ctx, newChannel)
+		return
+	}
+
+	if !c.concurrentGitChannels.TryAcquire(1) {
+		log.FromContext(ctx).InfoContext(ctx, "connection: handleGitChannel: too many concurrent git channels")
+		_ = newChannel.Reject(ssh.ResourceShortage, "too many concurrent git channels")
+		metrics.SshdHitMaxGitChannels.Inc()
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.FromContext(ctx).ErrorContext(ctx, "connection: handleGitChannel: accepting channel failed", log.ErrorMessage(err.Error()))
+		c.concurrentGitChannels.Release(1)
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	metrics.SshdGitChannelsInFlight.Inc()
+	go c.serveChannel(ctx, channel, c.concurrentGitChannels, metrics.SshdGitChannelDuration, func(ctx context.Context, channel ssh.Channel) error {
+		defer metrics.SshdGitChannelsInFlight.Dec()
+
+		return c.gitChannelHandler(ctx, sconn, channel, req)
+	})
+}
+
+// serveChannel runs serve for an accepted channel and releases its slot in
+// limit once it's done. When session timeouts are configured, serve is given a
+// channel that enforces them, and a context that's canceled on timeout.
+func (c *connection) serveChannel(
+	ctx context.Context,
+	channel ssh.Channel,
+	limit *semaphore.Weighted,
+	duration prometheus.Observer,
+	serve func(context.Context, ssh.Channel) error,
+) {
+	c.trackChannel(channel)
+	defer c.untrackChannel(channel)
+
+	defer func(started time.Time) {
+		dur := time.Since(started)
+		duration.Observe(dur.Seconds())
+		log.FromContext(ctx).InfoContext(ctx, "connection: handleRequests: done", log.DurationS(dur))
+	}(time.Now())
+
+	defer limit.Release(1)
+
+	// Prevent a panic in a single session from taking out the whole server
+	defer func() {
+		if err := recover(); err != nil {
+			log.FromContext(ctx).ErrorContext(ctx, "panic handling session", slog.Any("recovered_error", err))
+		}
+	}()
+
+	metrics.SliSshdSessionsTotal.Inc()
+
+	idleTimeout := time.Duration(c.cfg.Server.SessionIdleTimeout)
+	maxDuration := time.Duration(c.cfg.Server.MaxSessionDuration)
+	if idleTimeout <= 0 && maxDuration <= 0 {
+		if err := serve(ctx, channel); err != nil {
+			c.trackError(ctx, err)
+		}
+
+		return
+	}
+
+	timed := newTimedChannel(channel, idleTimeout, maxDuration)
+	serveCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go timed.watch(serveCtx, cancel)
+
+	// A command stopped by a timeout fails, but that's the client's doing: it's
+	// counted by its own metric rather than as an error.
+	if err := serve(serveCtx, timed); err != nil && !timed.timedOut.Load() {
+		c.trackError(ctx, err)
+	}
 }
 
 func (c *connection) sendKeepAliveMsg(ctx context.Context, sconn *ssh.ServerConn, ticker *time.Ticker) {
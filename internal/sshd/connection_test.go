@@ -126,6 +126,76 @@ func TestUnknownChannelType(t *testing.T) {
 	require.Equal(t, expectedRejection, rejectionData)
 }
 
+func TestGitChannelHandler(t *testing.T) {
+	extraData := ssh.Marshal(gitChannelRequest{Command: "git-upload-pack group/project.git", GitProtocolVersion: "version=2"})
+	newChannel := &fakeNewChannel{channelType: gitChannelType, extraData: extraData}
+	conn, chans := setup(newChannel)
+	conn.maxGitChannels = 1
+	conn.concurrentGitChannels = semaphore.NewWeighted(1)
+
+	var received gitChannelRequest
+	conn.gitChannelHandler = func(_ context.Context, _ *ssh.ServerConn, _ ssh.Channel, req gitChannelRequest) error {
+		received = req
+		close(chans)
+		return nil
+	}
+
+	conn.handleRequests(context.Background(), nil, chans, nil)
+
+	require.Equal(t, gitChannelRequest{Command: "git-upload-pack group/project.git", GitProtocolVersion: "version=2"}, received)
+}
+
+func TestGitChannelRejections(t *testing.T) {
+	validData := ssh.Marshal(gitChannelRequest{Command: "git-upload-pack group/project.git"})
+
+	testCases := []struct {
+		desc              string
+		extraData         []byte
+		maxGitChannels    int64
+		expectedRejection rejectCall
+	}{
+		{
+			desc:              "invalid request",
+			extraData:         []byte("invalid"),
+			maxGitChannels:    1,
+			expectedRejection: rejectCall{reason: ssh.ConnectionFailed, message: "invalid git channel request"},
+		},
+		{
+			desc:              "too many git channels",
+			extraData:         validData,
+			maxGitChannels:    0,
+			expectedRejection: rejectCall{reason: ssh.ResourceShortage, message: "too many concurrent git channels"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rejectCh := make(chan rejectCall)
+			defer close(rejectCh)
+
+			newChannel := &fakeNewChannel{channelType: gitChannelType, extraData: tc.extraData, rejectCh: rejectCh}
+			conn, chans := setup(newChannel)
+			conn.maxGitChannels = tc.maxGitChannels
+			conn.concurrentGitChannels = semaphore.NewWeighted(tc.maxGitChannels)
+			conn.gitChannelHandler = func(context.Context, *ssh.ServerConn, ssh.Channel, gitChannelRequest) error {
+				return nil
+			}
+
+			initialLimited := testutil.ToFloat64(metrics.SshdHitMaxGitChannels)
+
+			go func() {
+				conn.handleRequests(context.Background(), nil, chans, nil)
+			}()
+
+			require.Equal(t, tc.expectedRejection, <-rejectCh)
+
+			if tc.expectedRejection.reason == ssh.ResourceShortage {
+				require.InDelta(t, initialLimited+1, testutil.ToFloat64(metrics.SshdHitMaxGitChannels), 0.1)
+			}
+		})
+	}
+}
+
 func TestTooManySessions(t *testing.T) {
 	rejectCh := make(chan rejectCall)
 	defer close(rejectCh)
@@ -285,42 +355,90 @@ func TestSessionErrorMetricDistinguishesAPIErrors(t *testing.T) {
 func TestConnOutcomeObserveAuth(t *testing.T) {
 	t.Run("nil error marks attempted without a server error", func(t *testing.T) {
 		var o connOutcome
-		o.observeAuth(nil)
+		o.observeAuth(context.Background(), nil)
 		require.True(t, o.authAttempted)
 		require.False(t, o.serverError.Load())
 	})
 
 	t.Run("system APIError marks a server error", func(t *testing.T) {
 		var o connOutcome
-		o.observeAuth(&client.APIError{Msg: "redirect", StatusCode: 301, System: true})
+		o.observeAuth(context.Background(), &client.APIError{Msg: "redirect", StatusCode: 301, System: true})
 		require.True(t, o.authAttempted)
 		require.True(t, o.serverError.Load())
 	})
 
 	t.Run("policy APIError does not mark a server error", func(t *testing.T) {
 		var o connOutcome
-		o.observeAuth(&client.APIError{Msg: "You are not allowed", StatusCode: 403})
+		o.observeAuth(context.Background(), &client.APIError{Msg: "You are not allowed", StatusCode: 403})
 		require.True(t, o.authAttempted)
 		require.False(t, o.serverError.Load())
 	})
 
 	t.Run("plain error does not mark a server error", func(t *testing.T) {
 		var o connOutcome
-		o.observeAuth(errors.New("unknown user"))
+		o.observeAuth(context.Background(), errors.New("unknown user"))
 		require.True(t, o.authAttempted)
 		require.False(t, o.serverError.Load())
 	})
 
 	t.Run("a later successful attempt clears an earlier server error", func(t *testing.T) {
 		var o connOutcome
-		o.observeAuth(&client.APIError{Msg: "redirect", StatusCode: 301, System: true})
+		o.observeAuth(context.Background(), &client.APIError{Msg: "redirect", StatusCode: 301, System: true})
 		require.True(t, o.serverError.Load())
 
 		// The next key the client offers authenticates successfully.
-		o.observeAuth(nil)
+		o.observeAuth(context.Background(), nil)
 		require.True(t, o.authAttempted)
 		require.False(t, o.serverError.Load(), "ultimate success must not count as an error")
 	})
+
+	t.Run("client-side failures are counted until an attempt succeeds", func(t *testing.T) {
+		var o connOutcome
+		o.observeAuth(context.Background(), errors.New("unknown user"))
+		o.observeAuth(context.Background(), &client.APIError{Msg: "Not found", StatusCode: 404})
+		require.Equal(t, 2, o.authFailures)
+
+		// Neither server-side errors nor rate limits are the client's fault.
+		o.observeAuth(context.Background(), &client.APIError{Msg: "redirect", StatusCode: 301, System: true})
+		o.observeAuth(context.Background(), &ssh.BannerError{Err: errRateLimited, Message: rateLimitedMessage})
+		require.Equal(t, 2, o.authFailures)
+
+		o.observeAuth(context.Background(), nil)
+		require.Zero(t, o.authFailures)
+	})
+
+	t.Run("client-side failures are recorded in the ban list as they happen", func(t *testing.T) {
+		b, _ := newTestAuthBanList(t)
+		disconnected := 0
+		o := connOutcome{authBans: b, ip: "10.0.0.1", disconnect: func() { disconnected++ }}
+
+		o.observeAuth(context.Background(), errors.New("unknown user"))
+		o.observeAuth(context.Background(), errors.New("unknown user"))
+		require.Len(t, b.clients["10.0.0.1"].failures, 2)
+
+		// Failures followed by a successful attempt are forgiven
+		o.observeAuth(context.Background(), nil)
+		require.Empty(t, b.clients["10.0.0.1"].failures)
+		require.Zero(t, disconnected)
+
+		initialRejected := testutil.ToFloat64(metrics.SshdAuthBanRejectedTotal)
+
+		// The connection is closed as soon as its address is banned
+		for range 3 {
+			o.observeAuth(context.Background(), errors.New("unknown user"))
+		}
+		require.True(t, b.banned("10.0.0.1"))
+		require.Equal(t, 1, disconnected)
+		require.InDelta(t, initialRejected+1, testutil.ToFloat64(metrics.SshdAuthBanRejectedTotal), 0.1)
+
+		// A ban isn't forgiven, and is enforced on other connections
+		o.observeAuth(context.Background(), nil)
+		require.True(t, b.banned("10.0.0.1"))
+
+		other := connOutcome{authBans: b, ip: "10.0.0.1", disconnect: func() { disconnected++ }}
+		other.observeAuth(context.Background(), &client.APIError{Msg: "redirect", StatusCode: 301, System: true})
+		require.Equal(t, 2, disconnected)
+	})
 }
 
 func TestTrackErrorFeedsConnectionOutcome(t *testing.T) {
@@ -0,0 +1,193 @@
+package sshd
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	drainingMessage     = "GitLab SSH server is shutting down, please try again."
+	disconnectedMessage = "GitLab SSH server shut down before the command completed, please try again."
+)
+
+// DisconnectTimeout is how long a client is given to close the connection
+// itself once its channels have been closed, before the connection is closed
+// by the server.
+var DisconnectTimeout = 2 * time.Second
+
+// exitSignalReq is the payload of an exit-signal request, see RFC 4254
+// section 6.10.
+type exitSignalReq struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+func (c *connection) isDraining() bool {
+	return c.draining != nil && c.draining()
+}
+
+// handleDrainingChannel accepts a channel opened while the server is shutting
+// down and tells the client to try again, instead of starting a command that
+// the end of the grace period could cut short. The channel is accepted rather
+// than rejected so that the message reaches the user through Git.
+func (c *connection) handleDrainingChannel(ctx context.Context, newChannel ssh.NewChannel) {
+	log.FromContext(ctx).InfoContext(ctx, "connection: handleDrainingChannel: server is shutting down")
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		log.FromContext(ctx).ErrorContext(ctx, "connection: handleDrainingChannel: accepting channel failed", log.ErrorMessage(err.Error()))
+		return
+	}
+
+	go func() {
+		defer func() { _ = channel.Close() }()
+
+		// A session only runs a command once it has been requested: answering
+		// before then would be taken as the session failing to start.
+		if newChannel.ChannelType() == sessionChannelType {
+			waitForCommandRequest(requests)
+		}
+		go ssh.DiscardRequests(requests)
+
+		console.DisplayWarningMessage(drainingMessage, channel.Stderr())
+
+		_ = channel.CloseWrite()
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{ExitStatus: 1}))
+	}()
+}
+
+// waitForCommandRequest consumes session requests until the client asks for a
+// command or a shell, which is accepted.
+func waitForCommandRequest(requests <-chan *ssh.Request) {
+	for req := range requests {
+		accepted := req.Type == "exec" || req.Type == "shell"
+		if req.WantReply {
+			_ = req.Reply(accepted, nil)
+		}
+
+		if accepted {
+			return
+		}
+	}
+}
+
+// setServerConn records the SSH connection once the handshake has succeeded,
+// so that it can be disconnected. The returned channel must be closed when the
+// connection is done.
+func (c *connection) setServerConn(sconn *ssh.ServerConn) chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sconn = sconn
+	c.closed = make(chan struct{})
+
+	return c.closed
+}
+
+func (c *connection) trackChannel(channel ssh.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channels == nil {
+		c.channels = make(map[ssh.Channel]struct{})
+	}
+	c.channels[channel] = struct{}{}
+}
+
+func (c *connection) untrackChannel(channel ssh.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.channels, channel)
+}
+
+// disconnect ends the commands still running on the connection. The SSH
+// library can't send a disconnect message once the handshake is over, so each
+// channel is closed the way the SSH protocol expects instead: the client is
+// told why with message on stderr and the command is reported as terminated by
+// a signal. The client is then given DisconnectTimeout to hang up before the
+// connection is closed, so that it doesn't see a reset connection.
+func (c *connection) disconnect(ctx context.Context, message string) {
+	c.mu.Lock()
+	sconn, closed := c.sconn, c.closed
+	channels := slices.Collect(maps.Keys(c.channels))
+	c.mu.Unlock()
+
+	// The handshake hasn't completed yet: there's nobody to notify.
+	if sconn == nil {
+		_ = c.nconn.Close()
+		return
+	}
+
+	log.FromContext(ctx).InfoContext(ctx, "connection: disconnect: closing connection",
+		slog.String("remote_addr", c.remoteAddr),
+		slog.Int("channels", len(channels)),
+	)
+
+	for _, channel := range channels {
+		console.DisplayWarningMessage(message, channel.Stderr())
+
+		_ = channel.CloseWrite()
+		_, _ = channel.SendRequest("exit-signal", false, ssh.Marshal(exitSignalReq{Signal: "TERM", Error: message}))
+		_ = channel.Close()
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(DisconnectTimeout):
+		_ = sconn.Close()
+	}
+}
+
+func (s *Server) trackConn(conn *connection) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*connection]struct{})
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Server) untrackConn(conn *connection) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, conn)
+}
+
+// connections returns the open connections, oldest first.
+func (s *Server) connections() []*connection {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	return slices.SortedFunc(maps.Keys(s.conns), func(a, b *connection) int { return cmp.Compare(a.id, b.id) })
+}
+
+// Disconnect closes the connections that are still open, typically once the
+// shutdown grace period is over. Clients whose command was cut short are told
+// why, rather than seeing the connection drop.
+func (s *Server) Disconnect(ctx context.Context) {
+	conns := s.connections()
+
+	log.FromContext(ctx).InfoContext(ctx, "Disconnecting remaining connections", slog.Int("connections", len(conns)))
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Go(func() { conn.disconnect(ctx, disconnectedMessage) })
+	}
+	wg.Wait()
+}
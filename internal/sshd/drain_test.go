@@ -0,0 +1,130 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func requireDrainingNotice(t *testing.T, c *ssh.Client) {
+	t.Helper()
+
+	session, err := c.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	stderr, err := session.StderrPipe()
+	require.NoError(t, err)
+
+	output, err := session.Output("discover")
+
+	var exitErr *ssh.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 1, exitErr.ExitStatus())
+	require.Empty(t, output)
+
+	notice, err := io.ReadAll(stderr)
+	require.NoError(t, err)
+	require.Contains(t, string(notice), "remote: "+drainingMessage+"\n")
+}
+
+func TestDrainingSession(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+
+	require.NoError(t, s.Shutdown())
+	verifyStatus(t, s, StatusOnShutdown)
+
+	requireDrainingNotice(t, client)
+}
+
+func TestDrainingGitChannel(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{
+		GitChannel: config.GitChannelConfig{Enabled: true, ConcurrentChannelsLimit: 1},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, s.Shutdown())
+	verifyStatus(t, s, StatusOnShutdown)
+
+	channel, requests, err := client.OpenChannel(gitChannelType, ssh.Marshal(gitChannelRequest{Command: "git-upload-pack group/project.git"}))
+	require.NoError(t, err)
+	defer channel.Close()
+
+	output, err := io.ReadAll(channel)
+	require.NoError(t, err)
+	require.Empty(t, output)
+
+	notice, err := io.ReadAll(channel.Stderr())
+	require.NoError(t, err)
+	require.Contains(t, string(notice), "remote: "+drainingMessage+"\n")
+
+	req := <-requests
+	require.Equal(t, "exit-status", req.Type)
+	require.Equal(t, ssh.Marshal(exitStatusReq{ExitStatus: 1}), req.Payload)
+}
+
+func TestDisconnect(t *testing.T) {
+	defer func(timeout time.Duration) { DisconnectTimeout = timeout }(DisconnectTimeout)
+	DisconnectTimeout = 100 * time.Millisecond
+
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The session waits for a command that never comes, like a long-running one
+	channel, requests, err := client.OpenChannel(sessionChannelType, nil)
+	require.NoError(t, err)
+	defer channel.Close()
+
+	require.NoError(t, s.Shutdown())
+	require.Eventually(t, func() bool {
+		s.connsMu.Lock()
+		defer s.connsMu.Unlock()
+
+		for conn := range s.conns {
+			conn.mu.Lock()
+			channels := len(conn.channels)
+			conn.mu.Unlock()
+
+			return channels == 1
+		}
+
+		return false
+	}, 2*time.Second, time.Millisecond)
+
+	s.Disconnect(context.Background())
+
+	notice, err := io.ReadAll(channel.Stderr())
+	require.NoError(t, err)
+	require.Contains(t, string(notice), "remote: "+disconnectedMessage+"\n")
+
+	req := <-requests
+	require.Equal(t, "exit-signal", req.Type)
+
+	var signal exitSignalReq
+	require.NoError(t, ssh.Unmarshal(req.Payload, &signal))
+	require.Equal(t, "TERM", signal.Signal)
+	require.Equal(t, disconnectedMessage, signal.Error)
+
+	// The client didn't hang up by itself, so the server closed the connection
+	require.Error(t, client.Wait())
+	verifyStatus(t, s, StatusClosed)
+}
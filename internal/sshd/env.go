@@ -0,0 +1,125 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	// defaultEnvMaxLength is the default limit on the length of the values of
+	// accepted environment variables.
+	defaultEnvMaxLength = 256
+
+	// maxEnvVariables is how many environment variables a session accepts,
+	// besides GIT_PROTOCOL and GL_OUTPUT_FORMAT.
+	maxEnvVariables = 32
+)
+
+var (
+	envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,127}$`)
+
+	errEnvNotAllowed   = errors.New("not allowed")
+	errEnvTooLong      = errors.New("value too long")
+	errEnvInvalidValue = errors.New("value has invalid characters")
+	errEnvTooMany      = errors.New("too many variables")
+)
+
+// envAllowlist holds the environment variables that clients may send. A nil
+// *envAllowlist allows none.
+type envAllowlist struct {
+	entries []config.AcceptEnvConfig
+}
+
+// newEnvAllowlist returns the allowlist of cfgs, or nil if it's empty.
+func newEnvAllowlist(cfgs []config.AcceptEnvConfig) (*envAllowlist, error) {
+	if len(cfgs) == 0 {
+		return nil, nil
+	}
+
+	a := &envAllowlist{}
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || cfg.Name == sshenv.GitProtocolEnv || cfg.Name == sshenv.OutputFormatEnv {
+			return nil, fmt.Errorf("invalid accept_env name %q", cfg.Name)
+		}
+
+		if _, err := path.Match(cfg.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid accept_env name %q: %w", cfg.Name, err)
+		}
+
+		if cfg.MaxLength <= 0 {
+			cfg.MaxLength = defaultEnvMaxLength
+		}
+
+		a.entries = append(a.entries, cfg)
+	}
+
+	return a, nil
+}
+
+// accept returns the variable for name and value, or why it's refused. The
+// first entry that matches name applies.
+func (a *envAllowlist) accept(name, value string) (sshenv.Variable, error) {
+	if a == nil || !envNameRegexp.MatchString(name) {
+		return sshenv.Variable{}, errEnvNotAllowed
+	}
+
+	i := slices.IndexFunc(a.entries, func(cfg config.AcceptEnvConfig) bool {
+		matched, _ := path.Match(cfg.Name, name)
+		return matched
+	})
+	if i < 0 {
+		return sshenv.Variable{}, errEnvNotAllowed
+	}
+
+	entry := a.entries[i]
+	if len(value) > entry.MaxLength {
+		return sshenv.Variable{}, errEnvTooLong
+	}
+
+	// Values are passed on as Gitaly metadata, which must be printable ASCII
+	for i := range len(value) {
+		if value[i] < 0x20 || value[i] > 0x7e {
+			return sshenv.Variable{}, errEnvInvalidValue
+		}
+	}
+
+	return sshenv.Variable{Name: name, Value: value, Gitaly: entry.Gitaly, API: entry.API}, nil
+}
+
+// acceptEnv records the variable of an env request if the allowlist allows
+// it, replacing an earlier value of the same variable.
+func (s *session) acceptEnv(ctx context.Context, envReq envRequest) bool {
+	variable, err := s.envAllowlist.accept(envReq.Name, envReq.Value)
+
+	i := slices.IndexFunc(s.envVariables, func(v sshenv.Variable) bool { return v.Name == envReq.Name })
+	if err == nil && i < 0 && len(s.envVariables) >= maxEnvVariables {
+		err = errEnvTooMany
+	}
+
+	if err != nil {
+		log.FromContext(ctx).DebugContext(ctx, "session: handleEnv: variable refused",
+			slog.String("name", envReq.Name),
+			log.ErrorMessage(err.Error()),
+		)
+
+		return false
+	}
+
+	if i >= 0 {
+		s.envVariables[i] = variable
+	} else {
+		s.envVariables = append(s.envVariables, variable)
+	}
+
+	return true
+}
@@ -0,0 +1,160 @@
+package sshd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/sshenv"
+)
+
+func TestNewEnvAllowlist(t *testing.T) {
+	allowlist, err := newEnvAllowlist(nil)
+	require.NoError(t, err)
+	require.Nil(t, allowlist)
+
+	allowlist, err = newEnvAllowlist([]config.AcceptEnvConfig{{Name: "GL_OPTION_*"}, {Name: "DEBUG", MaxLength: 1}})
+	require.NoError(t, err)
+	require.Equal(t, []config.AcceptEnvConfig{
+		{Name: "GL_OPTION_*", MaxLength: defaultEnvMaxLength},
+		{Name: "DEBUG", MaxLength: 1},
+	}, allowlist.entries)
+
+	for _, name := range []string{"", "GIT_PROTOCOL", "GL_OUTPUT_FORMAT", "GL_OPTION_["} {
+		_, err := newEnvAllowlist([]config.AcceptEnvConfig{{Name: name}})
+		require.ErrorContains(t, err, "invalid accept_env name "+strconv.Quote(name))
+	}
+}
+
+func TestEnvAllowlistAccept(t *testing.T) {
+	allowlist, err := newEnvAllowlist([]config.AcceptEnvConfig{
+		{Name: "GIT_TRACE2_PARENT_SID", Gitaly: true},
+		{Name: "GL_OPTION_*", API: true, MaxLength: 8},
+		{Name: "*_ID", Gitaly: true, API: true},
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		desc             string
+		name             string
+		value            string
+		expectedVariable sshenv.Variable
+		expectedErr      error
+	}{
+		{
+			desc:             "name",
+			name:             "GIT_TRACE2_PARENT_SID",
+			value:            "20260101T000000.000000Z-H1234",
+			expectedVariable: sshenv.Variable{Name: "GIT_TRACE2_PARENT_SID", Value: "20260101T000000.000000Z-H1234", Gitaly: true},
+		},
+		{
+			desc:             "pattern",
+			name:             "GL_OPTION_CI_SKIP",
+			value:            "true",
+			expectedVariable: sshenv.Variable{Name: "GL_OPTION_CI_SKIP", Value: "true", API: true},
+		},
+		{
+			desc:             "first matching entry",
+			name:             "GL_OPTION_ID",
+			value:            "1",
+			expectedVariable: sshenv.Variable{Name: "GL_OPTION_ID", Value: "1", API: true},
+		},
+		{
+			desc:             "empty value",
+			name:             "CORRELATION_ID",
+			expectedVariable: sshenv.Variable{Name: "CORRELATION_ID", Gitaly: true, API: true},
+		},
+		{desc: "not allowed", name: "LANG", value: "C", expectedErr: errEnvNotAllowed},
+		{desc: "names are case sensitive", name: "gl_option_ci_skip", value: "true", expectedErr: errEnvNotAllowed},
+		{desc: "invalid name", name: "BAD-NAME_ID", value: "1", expectedErr: errEnvNotAllowed},
+		{desc: "too long", name: "GL_OPTION_CI_SKIP", value: "123456789", expectedErr: errEnvTooLong},
+		{desc: "default max length", name: "CORRELATION_ID", value: strings.Repeat("a", defaultEnvMaxLength+1), expectedErr: errEnvTooLong},
+		{desc: "control character", name: "CORRELATION_ID", value: "a\nb", expectedErr: errEnvInvalidValue},
+		{desc: "non-ASCII", name: "CORRELATION_ID", value: "é", expectedErr: errEnvInvalidValue},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			variable, err := allowlist.accept(tc.name, tc.value)
+			require.Equal(t, tc.expectedErr, err)
+			require.Equal(t, tc.expectedVariable, variable)
+		})
+	}
+
+	_, err = (*envAllowlist)(nil).accept("GIT_TRACE2_PARENT_SID", "sid")
+	require.Equal(t, errEnvNotAllowed, err)
+}
+
+func TestHandleEnvAllowlist(t *testing.T) {
+	allowlist, err := newEnvAllowlist([]config.AcceptEnvConfig{{Name: "GL_OPTION_*", API: true}})
+	require.NoError(t, err)
+
+	s := &session{envAllowlist: allowlist}
+
+	handleEnv := func(name, value string) {
+		shouldContinue, err := s.handleEnv(context.Background(), &ssh.Request{Payload: ssh.Marshal(envRequest{Name: name, Value: value})})
+		require.NoError(t, err)
+		require.True(t, shouldContinue)
+	}
+
+	handleEnv("GL_OPTION_CI_SKIP", "false")
+	handleEnv("LANG", "C")
+	handleEnv("GL_OPTION_CI_SKIP", "true")
+	handleEnv(sshenv.GitProtocolEnv, "version=2")
+
+	require.Equal(t, []sshenv.Variable{{Name: "GL_OPTION_CI_SKIP", Value: "true", API: true}}, s.envVariables)
+	require.Equal(t, "version=2", s.gitProtocolVersion)
+}
+
+func TestSessionAcceptEnvLimit(t *testing.T) {
+	allowlist, err := newEnvAllowlist([]config.AcceptEnvConfig{{Name: "GL_OPTION_*"}})
+	require.NoError(t, err)
+
+	s := &session{envAllowlist: allowlist}
+	for i := range maxEnvVariables {
+		require.True(t, s.acceptEnv(context.Background(), envRequest{Name: "GL_OPTION_" + strconv.Itoa(i), Value: "1"}))
+	}
+
+	require.False(t, s.acceptEnv(context.Background(), envRequest{Name: "GL_OPTION_EXTRA", Value: "1"}))
+
+	// Variables that were already accepted can still be replaced
+	require.True(t, s.acceptEnv(context.Background(), envRequest{Name: "GL_OPTION_0", Value: "2"}))
+	require.Len(t, s.envVariables, maxEnvVariables)
+	require.Equal(t, "2", s.envVariables[0].Value)
+}
+
+func TestNewServerWithInvalidAcceptEnv(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.AcceptEnv = []config.AcceptEnvConfig{{Name: "GL_OPTION_["}}
+
+	_, err := NewServer(cfg)
+	require.ErrorContains(t, err, `invalid accept_env name "GL_OPTION_["`)
+}
+
+func TestSessionEnv(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.AcceptEnv = []config.AcceptEnvConfig{{Name: "GL_OPTION_*", API: true, MaxLength: 8}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.NoError(t, session.Setenv("GL_OPTION_CI_SKIP", "true"))
+	require.NoError(t, session.Setenv(sshenv.GitProtocolEnv, "version=2"))
+	require.Error(t, session.Setenv("GL_OPTION_CI_SKIP", "too long a value"))
+	require.Error(t, session.Setenv("LANG", "C"))
+
+	output, err := session.Output(discoverCmd)
+	require.NoError(t, err)
+	require.Equal(t, "Welcome to GitLab, @test-user!\n", string(output))
+}
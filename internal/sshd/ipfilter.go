@@ -0,0 +1,172 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/fields"
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+// Results of matching a client address against the IP filter.
+const (
+	ipFilterAllowed    = "allowed"
+	ipFilterDenied     = "denied"
+	ipFilterNotAllowed = "not_allowed"
+)
+
+// ipFilter holds the allow and deny lists from ip_filter. A nil *ipFilter
+// accepts every address.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// parseIPFilter loads the allow and deny lists, or returns nil if none are
+// configured. Any unparsable entry is an error, since a partially loaded deny
+// list would let blocked networks back in.
+func parseIPFilter(cfg config.IPFilterConfig) (*ipFilter, error) {
+	if len(cfg.Allow)+len(cfg.Deny)+len(cfg.AllowFiles)+len(cfg.DenyFiles) == 0 {
+		return nil, nil
+	}
+
+	allow, err := parsePrefixes(cfg.Allow, cfg.AllowFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := parsePrefixes(cfg.Deny, cfg.DenyFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipFilter{allow: allow, deny: deny}, nil
+}
+
+func parsePrefixes(entries []string, files []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		prefix, err := parsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	for _, filename := range files {
+		data, err := os.ReadFile(filepath.Clean(filename))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read IP filter file %q: %w", filename, err)
+		}
+
+		for lineNumber, line := range bytes.Split(data, []byte("\n")) {
+			entry, _, _ := strings.Cut(string(line), "#")
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse IP filter file %q, line %d: %w", filename, lineNumber+1, err)
+			}
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return prefixes, nil
+}
+
+// parsePrefix parses a network in CIDR notation, or a single address.
+func parsePrefix(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q: %w", entry, err)
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// match returns whether addr is allowed, denied or not allowed, or an empty
+// string if the filter doesn't apply to it.
+func (f *ipFilter) match(addr netip.Addr) string {
+	if f == nil {
+		return ""
+	}
+
+	addr = addr.Unmap().WithZone("")
+
+	if containsAddr(f.deny, addr) {
+		return ipFilterDenied
+	}
+
+	if len(f.allow) == 0 {
+		return ""
+	}
+
+	if containsAddr(f.allow, addr) {
+		return ipFilterAllowed
+	}
+
+	return ipFilterNotAllowed
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptsConn reports whether a connection from remoteAddr passes the IP
+// filter. With PROXY protocol, remoteAddr is the client address from the
+// header. Connections without an IP address, accepted on a Unix socket, are
+// not filtered.
+func (f *ipFilter) acceptsConn(ctx context.Context, remoteAddr string) bool {
+	ip := gitlabnet.ParseIP(remoteAddr)
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true
+	}
+
+	result := f.match(addr)
+	if result == "" {
+		return true
+	}
+
+	metrics.SshdIPFilterMatchesTotal.WithLabelValues(result).Inc()
+
+	if result == ipFilterAllowed {
+		return true
+	}
+
+	log.FromContext(ctx).InfoContext(ctx, "connection rejected: IP address filtered",
+		slog.String(fields.RemoteIP, ip),
+		slog.String("ip_filter_result", result),
+	)
+
+	return false
+}
@@ -0,0 +1,186 @@
+package sshd
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func writeIPFilterFile(t *testing.T, data string) string {
+	t.Helper()
+
+	filename := path.Join(t.TempDir(), "ip_filter")
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0600))
+
+	return filename
+}
+
+func TestIPFilterMatch(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		cfg      config.IPFilterConfig
+		addr     string
+		expected string
+	}{
+		{
+			desc:     "denied network",
+			cfg:      config.IPFilterConfig{Deny: []string{"10.0.0.0/8"}},
+			addr:     "10.1.2.3",
+			expected: ipFilterDenied,
+		},
+		{
+			desc: "address outside of the denied network",
+			cfg:  config.IPFilterConfig{Deny: []string{"10.0.0.0/8"}},
+			addr: "192.168.1.1",
+		},
+		{
+			desc:     "allowed network",
+			cfg:      config.IPFilterConfig{Allow: []string{"192.168.0.0/16"}},
+			addr:     "192.168.1.1",
+			expected: ipFilterAllowed,
+		},
+		{
+			desc:     "address outside of the allowed networks",
+			cfg:      config.IPFilterConfig{Allow: []string{"192.168.0.0/16", "2001:db8::/32"}},
+			addr:     "10.1.2.3",
+			expected: ipFilterNotAllowed,
+		},
+		{
+			desc:     "deny takes precedence over allow",
+			cfg:      config.IPFilterConfig{Allow: []string{"192.168.0.0/16"}, Deny: []string{"192.168.1.1"}},
+			addr:     "192.168.1.1",
+			expected: ipFilterDenied,
+		},
+		{
+			desc:     "single address",
+			cfg:      config.IPFilterConfig{Deny: []string{"2001:db8::1"}},
+			addr:     "2001:db8::1",
+			expected: ipFilterDenied,
+		},
+		{
+			desc:     "IPv4-mapped IPv6 address",
+			cfg:      config.IPFilterConfig{Deny: []string{"10.0.0.0/8"}},
+			addr:     "::ffff:10.1.2.3",
+			expected: ipFilterDenied,
+		},
+		{
+			desc:     "network with host bits set",
+			cfg:      config.IPFilterConfig{Allow: []string{"192.168.1.1/24"}},
+			addr:     "192.168.1.200",
+			expected: ipFilterAllowed,
+		},
+		{
+			desc: "files",
+			cfg: config.IPFilterConfig{
+				DenyFiles: []string{writeIPFilterFile(t, "# blocked networks\n\n172.16.0.0/12 # abuse\n")},
+			},
+			addr:     "172.16.5.4",
+			expected: ipFilterDenied,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			filter, err := parseIPFilter(tc.cfg)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.expected, filter.match(netip.MustParseAddr(tc.addr)))
+		})
+	}
+}
+
+func TestParseIPFilterNone(t *testing.T) {
+	filter, err := parseIPFilter(config.IPFilterConfig{})
+	require.NoError(t, err)
+	require.Nil(t, filter)
+	require.Empty(t, filter.match(netip.MustParseAddr("10.1.2.3")))
+}
+
+func TestParseIPFilterErrors(t *testing.T) {
+	testCases := []struct {
+		desc        string
+		cfg         config.IPFilterConfig
+		errContains string
+	}{
+		{
+			desc:        "invalid network",
+			cfg:         config.IPFilterConfig{Allow: []string{"10.0.0.0/33"}},
+			errContains: `invalid network "10.0.0.0/33"`,
+		},
+		{
+			desc:        "invalid address",
+			cfg:         config.IPFilterConfig{Deny: []string{"example.com"}},
+			errContains: `invalid address "example.com"`,
+		},
+		{
+			desc:        "missing file",
+			cfg:         config.IPFilterConfig{DenyFiles: []string{"/nonexistent/deny"}},
+			errContains: `failed to read IP filter file "/nonexistent/deny"`,
+		},
+		{
+			desc:        "invalid line in file",
+			cfg:         config.IPFilterConfig{AllowFiles: []string{writeIPFilterFile(t, "10.0.0.0/8\nnot an address\n")}},
+			errContains: "line 2: invalid address",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, err := parseIPFilter(tc.cfg)
+			require.ErrorContains(t, err, tc.errContains)
+		})
+	}
+}
+
+func TestIPFilterAcceptsConn(t *testing.T) {
+	filter, err := parseIPFilter(config.IPFilterConfig{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	initial := map[string]float64{}
+	for _, result := range []string{ipFilterAllowed, ipFilterDenied, ipFilterNotAllowed} {
+		initial[result] = testutil.ToFloat64(metrics.SshdIPFilterMatchesTotal.WithLabelValues(result))
+	}
+
+	require.True(t, filter.acceptsConn(ctx, "10.1.2.3:22"))
+	require.False(t, filter.acceptsConn(ctx, "10.0.0.1:22"))
+	require.False(t, filter.acceptsConn(ctx, "[2001:db8::1]:22"))
+
+	// Connections on a Unix socket have no address to filter
+	require.True(t, filter.acceptsConn(ctx, ""))
+
+	for _, result := range []string{ipFilterAllowed, ipFilterDenied, ipFilterNotAllowed} {
+		require.InDelta(t, initial[result]+1, testutil.ToFloat64(metrics.SshdIPFilterMatchesTotal.WithLabelValues(result)), 0.1)
+	}
+}
+
+func TestIPFilterRejectsConnections(t *testing.T) {
+	denyFile := writeIPFilterFile(t, "")
+
+	cfg := &config.Config{Server: config.ServerConfig{
+		IPFilter: config.IPFilterConfig{DenyFiles: []string{denyFile}},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, os.WriteFile(denyFile, []byte("127.0.0.0/8\n"), 0600))
+	require.NoError(t, s.ReloadKeys(context.Background()))
+
+	_, err = ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.ErrorContains(t, err, "ssh: handshake failed")
+
+	// The connection established before the reload is unaffected
+	holdSession(t, client)
+}
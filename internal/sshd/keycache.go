@@ -0,0 +1,202 @@
+package sshd
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	keyCacheHit  = "hit"
+	keyCacheMiss = "miss"
+
+	// flushAuthorizedKeysCachePath is the admin endpoint that empties the
+	// authorized keys cache.
+	flushAuthorizedKeysCachePath = "/authorized_keys_cache/flush"
+
+	sha256FingerprintPrefix = "SHA256:"
+)
+
+// authorizedKeysCache is an LRU cache of authorized key lookups keyed by key
+// fingerprint. Keys unknown to GitLab are cached too, for a separate and
+// usually shorter TTL, because SSH clients typically offer several keys that
+// fail before the one that succeeds. A nil *authorizedKeysCache caches nothing.
+type authorizedKeysCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type keyCacheEntry struct {
+	fingerprint string
+	response    *authorizedkeys.Response
+	err         error
+	expires     time.Time
+}
+
+// newAuthorizedKeysCache returns a cache for cfg, or nil if cfg doesn't set a
+// size.
+func newAuthorizedKeysCache(cfg config.AuthorizedKeysCacheConfig) *authorizedKeysCache {
+	if cfg.Size <= 0 {
+		return nil
+	}
+
+	return &authorizedKeysCache{
+		size:        cfg.Size,
+		ttl:         time.Duration(cfg.TTL),
+		negativeTTL: time.Duration(cfg.NegativeTTL),
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// get returns the cached lookup for fingerprint, if there is one that hasn't
+// expired.
+func (c *authorizedKeysCache) get(fingerprint string) (*keyCacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[fingerprint]
+	if ok && !c.now().Before(elem.Value.(*keyCacheEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+
+	if !ok {
+		metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheMiss).Inc()
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheHit).Inc()
+
+	return elem.Value.(*keyCacheEntry), true
+}
+
+// add caches the result of a lookup. Only successful lookups and keys that
+// GitLab doesn't know are cached: any other error may be transient.
+func (c *authorizedKeysCache) add(fingerprint string, response *authorizedkeys.Response, err error) {
+	if c == nil {
+		return
+	}
+
+	ttl := c.ttl
+	if err != nil {
+		if !isKeyNotFound(err) {
+			return
+		}
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[fingerprint]; ok {
+		c.remove(elem)
+	}
+
+	entry := &keyCacheEntry{fingerprint: fingerprint, response: response, err: err, expires: c.now().Add(ttl)}
+	c.entries[fingerprint] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// flush empties the cache, for when keys have been removed from GitLab.
+func (c *authorizedKeysCache) flush() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// evict drops the cached lookup of the key with the given SHA256 fingerprint,
+// with or without its SHA256: prefix.
+func (c *authorizedKeysCache) evict(fingerprint string) {
+	if c == nil {
+		return
+	}
+
+	if !strings.HasPrefix(fingerprint, sha256FingerprintPrefix) {
+		fingerprint = sha256FingerprintPrefix + fingerprint
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[fingerprint]; ok {
+		c.remove(elem)
+	}
+}
+
+// evictChangedKey drops the cached lookup of the key that the command run with
+// ctxWithLogData reported adding, expiring or deleting. An expired or deleted
+// key stops being accepted right away, and an added key that was offered
+// before is accepted right away, rather than once its cache entry expires.
+// It's evicted even if the command failed, since it may have failed after the
+// key was changed.
+func (s *session) evictChangedKey(ctxWithLogData context.Context) {
+	if fingerprint := command.ChangedKey(ctxWithLogData); fingerprint != "" {
+		s.authorizedKeysCache.evict(fingerprint)
+	}
+}
+
+// FlushAuthorizedKeysCache empties the authorized keys cache, so that keys
+// deleted in GitLab stop being accepted before their cache entry expires.
+func (s *Server) FlushAuthorizedKeysCache(ctx context.Context) {
+	s.serverConfig.Load().authorizedKeysCache.flush()
+
+	log.FromContext(ctx).InfoContext(ctx, "Flushed authorized keys cache")
+}
+
+func (s *Server) serveFlushAuthorizedKeysCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.FlushAuthorizedKeysCache(r.Context())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *authorizedKeysCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*keyCacheEntry).fingerprint)
+}
+
+func isKeyNotFound(err error) bool {
+	var apiErr *client.APIError
+
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
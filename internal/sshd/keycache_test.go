@@ -0,0 +1,176 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func newTestAuthorizedKeysCache(size int) (*authorizedKeysCache, *time.Time) {
+	now := time.Now()
+	cache := newAuthorizedKeysCache(config.AuthorizedKeysCacheConfig{
+		Size:        size,
+		TTL:         config.YamlDuration(time.Minute),
+		NegativeTTL: config.YamlDuration(10 * time.Second),
+	})
+	cache.now = func() time.Time { return now }
+
+	return cache, &now
+}
+
+func TestAuthorizedKeysCacheDisabled(t *testing.T) {
+	cache := newAuthorizedKeysCache(config.AuthorizedKeysCacheConfig{TTL: config.YamlDuration(time.Minute)})
+	require.Nil(t, cache)
+
+	cache.add("SHA256:key", &authorizedkeys.Response{ID: 1}, nil)
+	_, ok := cache.get("SHA256:key")
+	require.False(t, ok)
+
+	cache.flush()
+}
+
+func TestAuthorizedKeysCache(t *testing.T) {
+	cache, now := newTestAuthorizedKeysCache(10)
+	response := &authorizedkeys.Response{ID: 1, Key: "key"}
+
+	initialHits := testutil.ToFloat64(metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheHit))
+	initialMisses := testutil.ToFloat64(metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheMiss))
+
+	_, ok := cache.get("SHA256:key")
+	require.False(t, ok)
+
+	cache.add("SHA256:key", response, nil)
+
+	entry, ok := cache.get("SHA256:key")
+	require.True(t, ok)
+	require.Equal(t, response, entry.response)
+	require.NoError(t, entry.err)
+
+	*now = now.Add(time.Minute)
+	_, ok = cache.get("SHA256:key")
+	require.False(t, ok)
+
+	require.InDelta(t, initialHits+1, testutil.ToFloat64(metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheHit)), 0.1)
+	require.InDelta(t, initialMisses+2, testutil.ToFloat64(metrics.SshdAuthorizedKeysCacheRequestsTotal.WithLabelValues(keyCacheMiss)), 0.1)
+}
+
+func TestAuthorizedKeysCacheErrors(t *testing.T) {
+	notFound := &client.APIError{Msg: "Not found", StatusCode: http.StatusNotFound}
+
+	testCases := []struct {
+		desc   string
+		err    error
+		cached bool
+	}{
+		{desc: "key not found", err: notFound, cached: true},
+		{desc: "system error", err: client.NewSystemAPIError("Internal API unreachable", 0)},
+		{desc: "server error", err: client.NewSystemAPIError("Internal API error", http.StatusInternalServerError)},
+		{desc: "other error", err: errors.New("invalid JSON")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache, now := newTestAuthorizedKeysCache(10)
+
+			cache.add("SHA256:key", nil, tc.err)
+
+			entry, ok := cache.get("SHA256:key")
+			require.Equal(t, tc.cached, ok)
+			if !tc.cached {
+				return
+			}
+			require.Nil(t, entry.response)
+			require.Equal(t, tc.err, entry.err)
+
+			// Negative entries expire after their own TTL
+			*now = now.Add(10 * time.Second)
+			_, ok = cache.get("SHA256:key")
+			require.False(t, ok)
+		})
+	}
+}
+
+func TestAuthorizedKeysCacheEviction(t *testing.T) {
+	cache, _ := newTestAuthorizedKeysCache(2)
+
+	cache.add("SHA256:first", &authorizedkeys.Response{ID: 1}, nil)
+	cache.add("SHA256:second", &authorizedkeys.Response{ID: 2}, nil)
+
+	// Using the first key makes the second one the least recently used
+	_, ok := cache.get("SHA256:first")
+	require.True(t, ok)
+
+	cache.add("SHA256:third", &authorizedkeys.Response{ID: 3}, nil)
+
+	_, ok = cache.get("SHA256:second")
+	require.False(t, ok)
+	for _, fingerprint := range []string{"SHA256:first", "SHA256:third"} {
+		_, ok = cache.get(fingerprint)
+		require.True(t, ok, fingerprint)
+	}
+	require.Equal(t, 2, cache.lru.Len())
+}
+
+func TestAuthorizedKeysCacheFlush(t *testing.T) {
+	cache, _ := newTestAuthorizedKeysCache(10)
+
+	cache.add("SHA256:key", &authorizedkeys.Response{ID: 1}, nil)
+	cache.flush()
+
+	_, ok := cache.get("SHA256:key")
+	require.False(t, ok)
+	require.Equal(t, 0, cache.lru.Len())
+}
+
+func TestAuthorizedKeysCacheEvict(t *testing.T) {
+	cache, _ := newTestAuthorizedKeysCache(10)
+
+	cache.add("SHA256:key", &authorizedkeys.Response{ID: 1}, nil)
+	cache.add("SHA256:other", &authorizedkeys.Response{ID: 2}, nil)
+
+	cache.evict("key")
+	_, ok := cache.get("SHA256:key")
+	require.False(t, ok)
+
+	cache.evict("SHA256:other")
+	_, ok = cache.get("SHA256:other")
+	require.False(t, ok)
+	require.Equal(t, 0, cache.lru.Len())
+}
+
+func TestSessionEvictChangedKey(t *testing.T) {
+	cache, _ := newTestAuthorizedKeysCache(10)
+	s := &session{authorizedKeysCache: cache}
+
+	testCases := []struct {
+		desc    string
+		ctx     context.Context
+		evicted bool
+	}{
+		{desc: "no changed key", ctx: context.Background()},
+		{desc: "another changed key", ctx: command.WithChangedKey(context.Background(), "SHA256:other")},
+		{desc: "changed key", ctx: command.WithChangedKey(context.Background(), "SHA256:key"), evicted: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache.add("SHA256:key", &authorizedkeys.Response{ID: 1}, nil)
+
+			s.evictChangedKey(tc.ctx)
+
+			_, ok := cache.get("SHA256:key")
+			require.Equal(t, !tc.evicted, ok)
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package sshd
+
+import (
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // SHA1 fingerprints are part of the OpenSSH KRL format
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+func krlString(data []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...) //nolint:gosec // test data is small
+}
+
+func krlSection(sectionType byte, data ...[]byte) []byte {
+	var section []byte
+	for _, d := range data {
+		section = append(section, d...)
+	}
+
+	return append([]byte{sectionType}, krlString(section)...)
+}
+
+func krlUint64(v ...uint64) []byte {
+	var data []byte
+	for _, u := range v {
+		data = binary.BigEndian.AppendUint64(data, u)
+	}
+
+	return data
+}
+
+func buildKRL(sections ...[]byte) []byte {
+	krl := []byte(krlMagic)
+	krl = binary.BigEndian.AppendUint32(krl, krlFormatVersion)
+	krl = append(krl, krlUint64(1, uint64(time.Now().Unix()), 0)...) //nolint:gosec // time is positive
+	krl = append(krl, krlString(nil)...)
+	krl = append(krl, krlString([]byte("test KRL"))...)
+
+	for _, section := range sections {
+		krl = append(krl, section...)
+	}
+
+	return krl
+}
+
+func krlCertSection(caKey ssh.PublicKey, certSections ...[]byte) []byte {
+	var caBlob []byte
+	if caKey != nil {
+		caBlob = caKey.Marshal()
+	}
+
+	data := [][]byte{krlString(caBlob), krlString(nil)}
+
+	return krlSection(krlSectionCertificates, append(data, certSections...)...)
+}
+
+func writeRevokedKeys(t *testing.T, data []byte) string {
+	t.Helper()
+
+	filename := path.Join(t.TempDir(), "revoked_keys")
+	require.NoError(t, os.WriteFile(filename, data, 0600))
+
+	return filename
+}
+
+func userCertWithSerial(t *testing.T, caSigner ssh.Signer, serial uint64) *ssh.Certificate {
+	cert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "alice")
+	cert.Serial = serial
+	require.NoError(t, cert.SignCert(rand.Reader, caSigner))
+
+	return cert
+}
+
+func TestParseRevokedKeysKRL(t *testing.T) {
+	caSigner, caPubKey := createCAKeyPair(t)
+	otherCASigner, otherCAPubKey := createCAKeyPair(t)
+
+	revokedCert := userCertWithSerial(t, caSigner, 1234)
+	sha1Hash := sha1.Sum(revokedCert.Key.Marshal()) //nolint:gosec // SHA1 fingerprints are part of the OpenSSH KRL format
+	sha256Hash := sha256.Sum256(revokedCert.Key.Marshal())
+
+	bitmap := make([]byte, 2)
+	bitmap[0] = 0x01 // bit 8
+	bitmap[1] = 0x04 // bit 2
+
+	testCases := []struct {
+		desc     string
+		sections [][]byte
+		cert     *ssh.Certificate
+		reason   string
+	}{
+		{
+			desc:     "serial list",
+			sections: [][]byte{krlCertSection(caPubKey, krlSection(krlSectionCertSerialList, krlUint64(7, 1234)))},
+			cert:     revokedCert,
+			reason:   revokedBySerial,
+		},
+		{
+			desc:     "serial range",
+			sections: [][]byte{krlCertSection(caPubKey, krlSection(krlSectionCertSerialRange, krlUint64(1000, 2000)))},
+			cert:     revokedCert,
+			reason:   revokedBySerial,
+		},
+		{
+			desc: "serial bitmap",
+			sections: [][]byte{krlCertSection(caPubKey,
+				krlSection(krlSectionCertSerialBitmap, krlUint64(1000), krlString(bitmap)))},
+			cert:   userCertWithSerial(t, caSigner, 1008),
+			reason: revokedBySerial,
+		},
+		{
+			desc: "serial bitmap, unset bit",
+			sections: [][]byte{krlCertSection(caPubKey,
+				krlSection(krlSectionCertSerialBitmap, krlUint64(1000), krlString(bitmap)))},
+			cert: userCertWithSerial(t, caSigner, 1001),
+		},
+		{
+			desc:     "serial revoked for another CA",
+			sections: [][]byte{krlCertSection(otherCAPubKey, krlSection(krlSectionCertSerialList, krlUint64(1234)))},
+			cert:     revokedCert,
+		},
+		{
+			desc:     "serial revoked for another CA, cert signed by that CA",
+			sections: [][]byte{krlCertSection(otherCAPubKey, krlSection(krlSectionCertSerialList, krlUint64(1234)))},
+			cert:     userCertWithSerial(t, otherCASigner, 1234),
+			reason:   revokedBySerial,
+		},
+		{
+			desc:     "key ID",
+			sections: [][]byte{krlCertSection(caPubKey, krlSection(krlSectionCertKeyID, krlString([]byte("alice"))))},
+			cert:     revokedCert,
+			reason:   revokedByKeyID,
+		},
+		{
+			desc:     "key ID for any CA",
+			sections: [][]byte{krlCertSection(nil, krlSection(krlSectionCertKeyID, krlString([]byte("alice"))))},
+			cert:     userCertWithSerial(t, otherCASigner, 1),
+			reason:   revokedByKeyID,
+		},
+		{
+			desc:     "explicit key",
+			sections: [][]byte{krlSection(krlSectionExplicitKey, krlString(revokedCert.Key.Marshal()))},
+			cert:     revokedCert,
+			reason:   revokedByKey,
+		},
+		{
+			desc:     "SHA1 fingerprint",
+			sections: [][]byte{krlSection(krlSectionFingerprintSHA1, krlString(sha1Hash[:]))},
+			cert:     revokedCert,
+			reason:   revokedByKey,
+		},
+		{
+			desc:     "SHA256 fingerprint",
+			sections: [][]byte{krlSection(krlSectionFingerprintSHA256, krlString(sha256Hash[:]))},
+			cert:     revokedCert,
+			reason:   revokedByKey,
+		},
+		{
+			desc:     "signing CA",
+			sections: [][]byte{krlSection(krlSectionExplicitKey, krlString(caPubKey.Marshal()))},
+			cert:     revokedCert,
+			reason:   revokedByCA,
+		},
+		{
+			desc: "signature is skipped",
+			sections: [][]byte{
+				krlSection(krlSectionExplicitKey, krlString(revokedCert.Key.Marshal())),
+				krlSection(krlSectionSignature, caPubKey.Marshal()),
+				krlString([]byte("signature")),
+			},
+			cert:   revokedCert,
+			reason: revokedByKey,
+		},
+		{
+			desc: "not revoked",
+			sections: [][]byte{
+				krlCertSection(caPubKey,
+					krlSection(krlSectionCertSerialList, krlUint64(1, 2, 3)),
+					krlSection(krlSectionCertKeyID, krlString([]byte("bob"))),
+				),
+				krlSection(krlSectionExplicitKey, krlString(otherCAPubKey.Marshal())),
+			},
+			cert: revokedCert,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			filename := writeRevokedKeys(t, buildKRL(tc.sections...))
+
+			revoked, err := parseRevokedKeys([]string{filename})
+			require.NoError(t, err)
+			require.Equal(t, tc.reason, revoked.certRevocationReason(tc.cert))
+		})
+	}
+}
+
+// The KRL of the testroot was generated by ssh-keygen from this specification,
+// with `ssh-keygen -k -f revoked.krl -s ca.pub -z 1`:
+//
+//	serial: 10-20
+//	serial: 1000-2000
+//	id: revoked-id
+//	<contents of revoked.pub>
+//
+// which ssh-keygen encodes as serial bitmap, serial range, key ID and explicit
+// key sections.
+func TestParseRevokedKeysKRLFromSSHKeygen(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+	krlDir := path.Join(testRoot, "krl")
+
+	revoked, err := parseRevokedKeys([]string{path.Join(krlDir, "revoked.krl")})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		certFile string
+		reason   string
+	}{
+		{certFile: "serial-15-cert.pub", reason: revokedBySerial},
+		{certFile: "serial-1500-cert.pub", reason: revokedBySerial},
+		{certFile: "revoked-id-cert.pub", reason: revokedByKeyID},
+		{certFile: "alice-cert.pub"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.certFile, func(t *testing.T) {
+			data, err := os.ReadFile(path.Join(krlDir, tc.certFile))
+			require.NoError(t, err)
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+			require.NoError(t, err)
+
+			require.Equal(t, tc.reason, revoked.certRevocationReason(publicKey.(*ssh.Certificate)))
+		})
+	}
+
+	data, err := os.ReadFile(path.Join(krlDir, "revoked.pub"))
+	require.NoError(t, err)
+	revokedKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	require.NoError(t, err)
+	require.True(t, revoked.isKeyRevoked(revokedKey))
+}
+
+func TestParseRevokedKeysList(t *testing.T) {
+	caSigner, _ := createCAKeyPair(t)
+	revokedCert := userCertWithSerial(t, caSigner, 1)
+	otherCert := userCertWithSerial(t, caSigner, 2)
+
+	data := []byte("# revoked after the laptop was lost\n\n" + string(ssh.MarshalAuthorizedKey(revokedCert.Key)))
+	filename := writeRevokedKeys(t, data)
+
+	revoked, err := parseRevokedKeys([]string{filename})
+	require.NoError(t, err)
+	require.Equal(t, revokedByKey, revoked.certRevocationReason(revokedCert))
+	require.Empty(t, revoked.certRevocationReason(otherCert))
+}
+
+func TestParseRevokedKeysNone(t *testing.T) {
+	caSigner, _ := createCAKeyPair(t)
+
+	revoked, err := parseRevokedKeys(nil)
+	require.NoError(t, err)
+	require.Nil(t, revoked)
+	require.Empty(t, revoked.certRevocationReason(userCertWithSerial(t, caSigner, 1)))
+}
+
+func TestParseRevokedKeysErrors(t *testing.T) {
+	_, caPubKey := createCAKeyPair(t)
+
+	truncated := buildKRL(krlCertSection(caPubKey, krlSection(krlSectionCertSerialList, krlUint64(1))))
+	unsupportedVersion := buildKRL()
+	binary.BigEndian.PutUint32(unsupportedVersion[len(krlMagic):], 2)
+
+	testCases := []struct {
+		desc        string
+		data        []byte
+		errContains string
+	}{
+		{
+			desc:        "invalid key in list",
+			data:        []byte("# comment\nnot a key\n"),
+			errContains: "line 2",
+		},
+		{
+			desc:        "truncated KRL",
+			data:        truncated[:len(truncated)-3],
+			errContains: "truncated KRL",
+		},
+		{
+			desc:        "unsupported KRL version",
+			data:        unsupportedVersion,
+			errContains: "unsupported KRL format version 2",
+		},
+		{
+			desc:        "unsupported section",
+			data:        buildKRL(krlSection(99, nil)),
+			errContains: "unsupported KRL section type 99",
+		},
+		{
+			desc:        "serials without a CA",
+			data:        buildKRL(krlCertSection(nil, krlSection(krlSectionCertSerialList, krlUint64(1)))),
+			errContains: "certificate serials can only be revoked for a specific CA",
+		},
+		{
+			desc:        "invalid fingerprint",
+			data:        buildKRL(krlSection(krlSectionFingerprintSHA256, krlString([]byte("short")))),
+			errContains: "invalid fingerprint length 5",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			filename := writeRevokedKeys(t, tc.data)
+
+			_, err := parseRevokedKeys([]string{filename})
+			require.ErrorContains(t, err, "failed to parse revoked keys file")
+			require.ErrorContains(t, err, tc.errContains)
+		})
+	}
+
+	_, err := parseRevokedKeys([]string{"/nonexistent/revoked_keys"})
+	require.ErrorContains(t, err, "failed to read revoked keys file")
+}
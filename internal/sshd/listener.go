@@ -0,0 +1,124 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	proxyproto "github.com/pires/go-proxyproto"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+// unixListenPrefix marks a listen address as a Unix socket path.
+const unixListenPrefix = "unix:"
+
+// listener is a socket gitlab-sshd accepts connections on, along with the
+// settings that apply to the connections accepted there.
+type listener struct {
+	net.Listener
+
+	cfg                 config.ListenerConfig
+	ipRateLimiter       *rateLimiter
+	identityRateLimiter *rateLimiter
+}
+
+// newListener starts listening on the address in cfg. When inherited is set,
+// it's served instead, so that connections aren't refused during a restart.
+func newListener(ctx context.Context, cfg config.ListenerConfig, inherited net.Listener) (*listener, error) {
+	sshListener := inherited
+	if sshListener == nil {
+		var err error
+		if sshListener, err = listen(cfg.Listen); err != nil {
+			return nil, fmt.Errorf("failed to listen for connection: %w", err)
+		}
+	}
+
+	ctx = log.AppendFields(ctx, log.TCPAddress(sshListener.Addr().String()))
+	if inherited != nil {
+		log.FromContext(ctx).InfoContext(ctx, "Using inherited listener")
+	}
+
+	if cfg.ProxyProtocol {
+		policy, err := proxyPolicy(cfg)
+		if err != nil {
+			_ = sshListener.Close()
+			return nil, fmt.Errorf("invalid policy configuration: %w", err)
+		}
+
+		sshListener = &proxyproto.Listener{
+			Listener:          sshListener,
+			ConnPolicy:        policy,
+			ReadHeaderTimeout: time.Duration(cfg.ProxyHeaderTimeout),
+		}
+
+		log.FromContext(ctx).InfoContext(ctx, "Proxy protocol is enabled")
+	}
+
+	log.FromContext(ctx).InfoContext(ctx, "Listening for SSH connections")
+
+	return &listener{
+		Listener:            sshListener,
+		cfg:                 cfg,
+		ipRateLimiter:       newRateLimiter(cfg.RateLimits.PerIP),
+		identityRateLimiter: newRateLimiter(cfg.RateLimits.PerIdentity),
+	}, nil
+}
+
+// listen listens on a TCP address, or on a Unix socket when address has the
+// unix: prefix. A socket left behind by a process that didn't exit cleanly is
+// replaced.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixListenPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// file returns a duplicate of the listening socket's file descriptor, to hand
+// over to another process.
+func (l *listener) file() (*os.File, error) {
+	sshListener := l.Listener
+	if proxyListener, ok := sshListener.(*proxyproto.Listener); ok {
+		sshListener = proxyListener.Listener
+	}
+
+	filer, ok := sshListener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %s can't be handed over", sshListener.Addr())
+	}
+
+	return filer.File()
+}
+
+// keepSocketFile stops a Unix socket from being removed when the listener is
+// closed, once it's been handed over to another process.
+func (l *listener) keepSocketFile() {
+	sshListener := l.Listener
+	if proxyListener, ok := sshListener.(*proxyproto.Listener); ok {
+		sshListener = proxyListener.Listener
+	}
+
+	if unixListener, ok := sshListener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+}
+
+func closeAll(listeners []net.Listener) {
+	for _, l := range listeners {
+		_ = l.Close()
+	}
+}
@@ -0,0 +1,130 @@
+package sshd
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestMultipleListeners(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "sshd.sock")
+
+	cfg := &config.Config{Server: config.ServerConfig{
+		Listeners: []config.ListenerConfig{
+			{Listen: "127.0.0.1:0"},
+			{Listen: "127.0.0.1:0", ProxyProtocol: true, ProxyPolicy: "require"},
+			{Listen: unixListenPrefix + socketPath},
+		},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	listeners := s.getListeners()
+	require.Len(t, listeners, 3)
+	require.Equal(t, listeners[0].Addr().String(), s.Addr())
+
+	client, err := ssh.Dial("tcp", listeners[0].Addr().String(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+	holdSession(t, client)
+
+	// A PROXY protocol header is required on the second listener only
+	_, err = ssh.Dial("tcp", listeners[1].Addr().String(), clientConfig(t, testRoot))
+	require.ErrorContains(t, err, "ssh: handshake failed")
+
+	unixClient, err := ssh.Dial("unix", socketPath, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer unixClient.Close()
+	holdSession(t, unixClient)
+
+	require.NoError(t, s.Shutdown())
+	verifyStatus(t, s, StatusOnShutdown)
+
+	for _, l := range listeners {
+		_, err := net.Dial(l.Addr().Network(), l.Addr().String())
+		require.Error(t, err)
+	}
+
+	client.Close()
+	unixClient.Close()
+	verifyStatus(t, s, StatusClosed)
+}
+
+func TestListenerRateLimits(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{
+		RateLimits: config.RateLimitsConfig{
+			PerIP: config.RateLimitConfig{Rate: 0.001, Burst: 1},
+		},
+		Listeners: []config.ListenerConfig{
+			{Listen: "127.0.0.1:0"},
+			{Listen: "127.0.0.1:0", RateLimits: &config.RateLimitsConfig{}},
+		},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+	listeners := s.getListeners()
+
+	for range 2 {
+		client, err := ssh.Dial("tcp", listeners[1].Addr().String(), clientConfig(t, testRoot))
+		require.NoError(t, err)
+		client.Close()
+	}
+
+	client, err := ssh.Dial("tcp", listeners[0].Addr().String(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	client.Close()
+
+	_, err = ssh.Dial("tcp", listeners[0].Addr().String(), clientConfig(t, testRoot))
+	require.Error(t, err)
+}
+
+func TestListenInheritedListenersMismatch(t *testing.T) {
+	_, fd := inheritableListener(t)
+	setListenFDsStart(t, fd)
+	t.Setenv(upgradeListenFDsEnv, "1")
+
+	s := &Server{Config: &config.Config{Server: config.ServerConfig{
+		Listeners: []config.ListenerConfig{{Listen: "127.0.0.1:0"}, {Listen: "127.0.0.1:0"}},
+	}}}
+
+	err := s.listen(context.Background())
+	require.EqualError(t, err, "failed to listen for connection: got 1 inherited listeners for 2 configured listeners")
+}
+
+func TestListenInvalidProxyPolicy(t *testing.T) {
+	s := &Server{Config: &config.Config{Server: config.ServerConfig{
+		Listeners: []config.ListenerConfig{
+			{Listen: "127.0.0.1:0"},
+			{Listen: "127.0.0.1:0", ProxyProtocol: true, ProxyAllowed: []string{"invalid"}},
+		},
+	}}}
+
+	err := s.listen(context.Background())
+	require.ErrorContains(t, err, "invalid policy configuration")
+	require.Empty(t, s.getListeners())
+}
+
+func TestListenReplacesStaleUnixSocket(t *testing.T) {
+	socketPath := path.Join(t.TempDir(), "sshd.sock")
+
+	stale, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	l, err := listen(unixListenPrefix + socketPath)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Anything other than a socket is left alone
+	filePath := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(filePath, nil, 0600))
+
+	_, err = listen(unixListenPrefix + filePath)
+	require.ErrorContains(t, err, "address already in use")
+}
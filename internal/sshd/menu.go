@@ -0,0 +1,199 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+)
+
+const (
+	menuPrompt = "gitlab> "
+
+	// menuMaxWidth is the width the menu is wrapped to on wider terminals.
+	menuMaxWidth = 80
+	menuIndent   = "     "
+)
+
+// menuItem is a command offered by the interactive shell.
+type menuItem struct {
+	command     commandargs.CommandType
+	usage       string
+	description string
+}
+
+var menuItems = []menuItem{
+	{
+		command:     commandargs.Discover,
+		description: "Show the GitLab user you're authenticated as.",
+	},
+	{
+		command:     commandargs.SSHKeys,
+		description: "List your SSH keys, with their fingerprints and expiry dates, or add, expire, or delete one.",
+	},
+	{
+		command:     commandargs.PersonalAccessToken,
+		usage:       "<name> <scope1[,scope2,...]> [ttl_days]",
+		description: "Create a token expiring in ttl_days days, 30 by default. list, revoke <id>, or rotate <id> yours.",
+	},
+	{
+		command:     commandargs.TwoFactorRecover,
+		description: "Generate new two-factor authentication recovery codes, invalidating the existing ones.",
+	},
+}
+
+// interactive reports whether the shell request of the session starts the
+// interactive shell rather than discover.
+func (s *session) interactive() bool {
+	return s.cfg.Server.InteractiveShell && s.ptyTerm != "" && s.execCmd == ""
+}
+
+// runMenu runs the interactive shell: a menu of the self-service commands,
+// run the same way as when they're passed to ssh, until the user exits.
+// syncRequests is called after each line is read, so that the window changes
+// sent before it apply to its output.
+func (s *session) runMenu(ctx context.Context, syncRequests func()) (context.Context, uint32, error) {
+	log.FromContext(ctx).InfoContext(ctx, "session: runMenu: starting interactive shell", slog.String("term", s.ptyTerm))
+
+	s.setCommand()
+	s.conn.trackSession(s)
+	defer s.conn.untrackSession(s)
+
+	term := newPTYTerminal(ctx, s.channel)
+	items := s.menuItems()
+	s.printMenu(term.out, items)
+
+	for {
+		line, err := term.readLine(menuPrompt)
+		switch {
+		case errors.Is(err, errPTYInterrupted):
+			continue
+		case errors.Is(err, io.EOF):
+			return ctx, 0, nil
+		case err != nil:
+			if sigErr := canceledBySignal(ctx); sigErr != nil {
+				return ctx, sigErr.exitStatus(), nil
+			}
+
+			return ctx, 1, err
+		}
+
+		syncRequests()
+
+		switch line = strings.TrimSpace(line); line {
+		case "":
+		case "exit", "quit":
+			return ctx, 0, nil
+		case "help", "?":
+			s.printMenu(term.out, items)
+		default:
+			s.runMenuCommand(ctx, term, items, line)
+		}
+	}
+}
+
+// menuItems returns the commands available to the user: personal access
+// tokens can be disabled.
+func (s *session) menuItems() []menuItem {
+	return slices.DeleteFunc(slices.Clone(menuItems), func(item menuItem) bool {
+		return item.command == commandargs.PersonalAccessToken && !s.cfg.PATConfig.Enabled
+	})
+}
+
+// runMenuCommand runs a command typed in the interactive shell. The command
+// can be given by its number in the menu.
+func (s *session) runMenuCommand(ctx context.Context, term *ptyTerminal, items []menuItem, line string) {
+	name, rest, _ := strings.Cut(line, " ")
+	if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(items) {
+		line = strings.TrimSpace(string(items[n-1].command) + " " + rest)
+	}
+
+	args := &commandargs.Shell{}
+	err := args.ParseCommand(line)
+	if err != nil || !slices.ContainsFunc(items, func(item menuItem) bool { return item.command == args.CommandType }) {
+		_, _ = fmt.Fprintf(term.out, "Unknown command: %s. Type help to list the commands.\n", name)
+		return
+	}
+
+	env := s.commandEnv()
+	env.OriginalCommand = line
+
+	rw := &readwriter.ReadWriter{
+		Out:    term.out,
+		In:     term,
+		ErrOut: &crlfWriter{w: s.channel.Stderr()},
+	}
+
+	cmd, err := s.getCommand(env, rw)
+	if err == nil {
+		log.FromContext(ctx).InfoContext(ctx, "session: runMenu: executing command", slog.String("command", string(args.CommandType)))
+
+		var ctxWithLogData context.Context
+		ctxWithLogData, err = cmd.Execute(ctx)
+		s.evictChangedKey(ctxWithLogData)
+	}
+
+	if err != nil && !errors.Is(err, errPTYInterrupted) {
+		_, _ = fmt.Fprintf(rw.ErrOut, "ERROR: %v\n", grpcstatus.Convert(err).Message())
+	}
+}
+
+// printMenu lists the commands of the interactive shell, wrapped to the width
+// of the terminal.
+func (s *session) printMenu(w io.Writer, items []menuItem) {
+	width := int(s.ptyColumns.Load())
+	if width <= 0 || width > menuMaxWidth {
+		width = menuMaxWidth
+	}
+
+	var b strings.Builder
+	b.WriteString("Welcome to GitLab! Type a command, or its number:\n\n")
+	for i, item := range items {
+		_, _ = fmt.Fprintf(&b, "  %d) %s", i+1, item.command)
+		if item.usage != "" {
+			b.WriteString(" " + item.usage)
+		}
+		b.WriteString("\n")
+
+		for _, descriptionLine := range wrapText(item.description, width-len(menuIndent)) {
+			b.WriteString(menuIndent + descriptionLine + "\n")
+		}
+	}
+	b.WriteString("\nType help to show this menu again, and exit or Ctrl-D to quit.\n")
+
+	_, _ = io.WriteString(w, b.String())
+}
+
+// wrapText splits text into lines of at most width characters, breaking at
+// spaces. Words longer than width get a line of their own.
+func wrapText(text string, width int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		if line != "" && len(line)+1+len(word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
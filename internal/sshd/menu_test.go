@@ -0,0 +1,180 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestInteractiveShell(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.InteractiveShell = true
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	stdin, err := session.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := session.StdoutPipe()
+	require.NoError(t, err)
+
+	require.NoError(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+	require.NoError(t, session.Shell())
+
+	menu := readUntil(t, stdout, menuPrompt)
+	require.Contains(t, menu, "  1) discover\r\n")
+	require.Contains(t, menu, "  2) ssh_keys\r\n")
+	require.NotContains(t, menu, "personal_access_token")
+
+	_, err = io.WriteString(stdin, "1\r")
+	require.NoError(t, err)
+	require.Equal(t, "1\r\nWelcome to GitLab, @test-user!\r\n"+menuPrompt, readUntil(t, stdout, menuPrompt))
+
+	_, err = io.WriteString(stdin, "personal_access_token test api\r")
+	require.NoError(t, err)
+	require.Contains(t, readUntil(t, stdout, menuPrompt), "Unknown command: personal_access_token.")
+
+	require.NoError(t, session.WindowChange(24, 40))
+	_, err = io.WriteString(stdin, "help\r")
+	require.NoError(t, err)
+	require.Contains(t, readUntil(t, stdout, menuPrompt), "     Show the GitLab user you're\r\n     authenticated as.\r\n")
+
+	_, err = io.WriteString(stdin, "exit\r")
+	require.NoError(t, err)
+	require.NoError(t, session.Wait())
+}
+
+func TestExecWithPTY(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.InteractiveShell = true
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.NoError(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+
+	output, err := session.Output(discoverCmd)
+	require.NoError(t, err)
+	require.Equal(t, "Welcome to GitLab, @test-user!\r\n", string(output))
+}
+
+func TestInteractiveShellDisabled(t *testing.T) {
+	s, testRoot := setupServerWithConfig(t, nil)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	require.NoError(t, err)
+	defer session.Close()
+
+	require.Error(t, session.RequestPty("xterm", 24, 80, ssh.TerminalModes{}))
+
+	// Without a PTY, a shell runs discover as before
+	output, err := session.Output("")
+	require.NoError(t, err)
+	require.Equal(t, "Welcome to GitLab, @test-user!\n", string(output))
+}
+
+func TestRunMenu(t *testing.T) {
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	testCases := []struct {
+		desc             string
+		input            string
+		patEnabled       bool
+		expectedOutput   []string
+		expectedExitCode uint32
+	}{
+		{
+			desc:             "command by name",
+			input:            "discover\r",
+			expectedOutput:   []string{"gitlab> discover\r\nWelcome to GitLab, @test-user!\r\ngitlab> "},
+			expectedExitCode: 0,
+		},
+		{
+			desc:             "unknown commands",
+			input:            "5\rgit-upload-pack group/repo\r\r",
+			expectedOutput:   []string{"Unknown command: 5.", "Unknown command: git-upload-pack."},
+			expectedExitCode: 0,
+		},
+		{
+			desc:             "personal access tokens enabled",
+			input:            "quit\r",
+			patEnabled:       true,
+			expectedOutput:   []string{"  3) personal_access_token <name> <scope1[,scope2,...]> [ttl_days]\r\n"},
+			expectedExitCode: 0,
+		},
+		{
+			desc:             "interrupted",
+			input:            "disc\x03exit\r",
+			expectedOutput:   []string{"gitlab> disc^C\r\ngitlab> exit\r\n"},
+			expectedExitCode: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			channel := newInputChannel(tc.input)
+			s := &session{
+				gitlabKeyID: rootUser,
+				channel:     channel,
+				cfg:         &config.Config{GitlabURL: url},
+				ptyTerm:     "xterm",
+			}
+			s.cfg.PATConfig.Enabled = tc.patEnabled
+
+			_, exitCode, err := s.runMenu(context.Background(), func() {})
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedExitCode, exitCode)
+
+			for _, expected := range tc.expectedOutput {
+				require.Contains(t, channel.stdOut.(*bytes.Buffer).String(), expected)
+			}
+		})
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	text := "List your SSH keys, with their fingerprints and expiry dates."
+
+	require.Equal(t, []string{text}, wrapText(text, 80))
+	require.Equal(t, []string{"List your SSH keys,", "with their", "fingerprints and", "expiry dates."}, wrapText(text, 19))
+	require.Equal(t, []string{"List", "your", "SSH", "keys,", "with", "their", "fingerprints", "and", "expiry", "dates."}, wrapText(text, 3))
+}
+
+// readUntil reads r until what has been read ends with suffix.
+func readUntil(t *testing.T, r io.Reader, suffix string) string {
+	t.Helper()
+
+	var out strings.Builder
+	buf := make([]byte, 1024)
+	for !strings.HasSuffix(out.String(), suffix) {
+		n, err := r.Read(buf)
+		require.NoError(t, err)
+		out.Write(buf[:n])
+	}
+
+	return out.String()
+}
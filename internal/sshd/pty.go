@@ -0,0 +1,289 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
+)
+
+const (
+	// maxPTYLineLength caps how many bytes of a line are read from the
+	// terminal. Anything typed past it is dropped.
+	maxPTYLineLength = 4096
+
+	keyCtrlC     = 0x03
+	keyCtrlD     = 0x04
+	keyBackspace = 0x08
+	keyCtrlU     = 0x15
+	keyEscape    = 0x1b
+	keyDelete    = 0x7f
+)
+
+// errPTYInterrupted is returned when the user presses Ctrl-C at a prompt.
+var errPTYInterrupted = errors.New("interrupted")
+
+// ptyRequest is the payload of a pty-req request, as defined in RFC 4254.
+type ptyRequest struct {
+	Term     string
+	Columns  uint32
+	Rows     uint32
+	Width    uint32
+	Height   uint32
+	Modelist string
+}
+
+// windowChangeRequest is the payload of a window-change request.
+type windowChangeRequest struct {
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+}
+
+// handlePTYRequest accepts a pseudo-terminal for the interactive shell, if
+// it's enabled. Otherwise, the client is told that none could be allocated.
+func (s *session) handlePTYRequest(ctx context.Context, req *ssh.Request) error {
+	var ptyReq ptyRequest
+	if err := ssh.Unmarshal(req.Payload, &ptyReq); err != nil {
+		return err
+	}
+
+	// Certificates without the permit-pty extension don't allow PTYs
+	accepted := s.cfg.Server.InteractiveShell && !s.certPolicy.noPTY
+	if accepted {
+		s.ptyTerm = ptyReq.Term
+		s.ptyColumns.Store(ptyReq.Columns)
+	}
+
+	log.FromContext(ctx).DebugContext(ctx, "session: handlePTYRequest: processed",
+		slog.Bool("accepted", accepted),
+		slog.String("term", ptyReq.Term),
+		slog.Int("columns", int(ptyReq.Columns)),
+	)
+
+	if req.WantReply {
+		if err := req.Reply(accepted, []byte{}); err != nil {
+			log.FromContext(ctx).DebugContext(ctx, "session: handlePTYRequest: Failed to reply", log.ErrorMessage(err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// handleWindowChange records the new width of the terminal. The client
+// doesn't expect a reply.
+func (s *session) handleWindowChange(ctx context.Context, req *ssh.Request) {
+	var change windowChangeRequest
+	if err := ssh.Unmarshal(req.Payload, &change); err != nil {
+		log.FromContext(ctx).DebugContext(ctx, "session: handleWindowChange: failed to unmarshal request", log.ErrorMessage(err.Error()))
+		return
+	}
+
+	s.ptyColumns.Store(change.Columns)
+
+	if req.WantReply {
+		_ = req.Reply(true, []byte{})
+	}
+}
+
+// ptyTerminal reads lines typed on the client's terminal. The terminal is in
+// raw mode when a PTY is allocated, so the server echoes what's typed and
+// handles line editing, while output needs CRLF line endings.
+type ptyTerminal struct {
+	ctx   context.Context
+	out   io.Writer
+	input <-chan []byte
+
+	// buffered holds the input received past the end of the last line, and
+	// pending the part of the last line not read yet through Read.
+	buffered []byte
+	pending  []byte
+	escape   escapeState
+	lastCR   bool
+}
+
+// escapeState tracks the escape sequences sent by keys such as the arrows,
+// which the terminal ignores.
+type escapeState int
+
+const (
+	escapeNone escapeState = iota
+	escapeStarted
+	escapeSequence
+)
+
+// newPTYTerminal starts reading the input of channel. Reading stops once ctx
+// is done or the channel is closed.
+func newPTYTerminal(ctx context.Context, channel ssh.Channel) *ptyTerminal {
+	input := make(chan []byte)
+
+	go func() {
+		defer close(input)
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := channel.Read(buf)
+			if n > 0 {
+				select {
+				case input <- bytes.Clone(buf[:n]):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return &ptyTerminal{ctx: ctx, out: &crlfWriter{w: channel}, input: input}
+}
+
+// readLine writes prompt, then reads a line, echoing it as it's typed. It
+// returns io.EOF if the user presses Ctrl-D on an empty line, and
+// errPTYInterrupted if they press Ctrl-C.
+func (t *ptyTerminal) readLine(prompt string) (string, error) {
+	_, _ = io.WriteString(t.out, prompt)
+
+	var line []byte
+	for {
+		if len(t.buffered) == 0 {
+			select {
+			case <-t.ctx.Done():
+				return "", t.ctx.Err()
+			case data, ok := <-t.input:
+				if !ok {
+					return "", io.EOF
+				}
+				t.buffered = data
+			}
+		}
+
+		for len(t.buffered) > 0 {
+			key := t.buffered[0]
+			t.buffered = t.buffered[1:]
+
+			done, err := t.handleKey(key, &line)
+			if done || err != nil {
+				return string(line), err
+			}
+		}
+	}
+}
+
+// handleKey applies a key typed on the terminal to line, and reports whether
+// the line is complete.
+func (t *ptyTerminal) handleKey(key byte, line *[]byte) (bool, error) {
+	lastCR := t.lastCR
+	t.lastCR = false
+
+	switch t.escape {
+	case escapeStarted:
+		// CSI and SS3 sequences go on, anything else is a single key
+		t.escape = escapeNone
+		if key == '[' || key == 'O' {
+			t.escape = escapeSequence
+		}
+
+		return false, nil
+	case escapeSequence:
+		// Sequences end with a byte between @ and ~
+		if key >= '@' && key <= '~' {
+			t.escape = escapeNone
+		}
+
+		return false, nil
+	}
+
+	switch key {
+	case '\r', '\n':
+		if key == '\n' && lastCR {
+			return false, nil
+		}
+		t.lastCR = key == '\r'
+		_, _ = io.WriteString(t.out, "\n")
+
+		return true, nil
+	case keyBackspace, keyDelete:
+		if len(*line) > 0 {
+			_, size := utf8.DecodeLastRune(*line)
+			*line = (*line)[:len(*line)-size]
+			_, _ = io.WriteString(t.out, "\b \b")
+		}
+	case keyCtrlU:
+		for range utf8.RuneCount(*line) {
+			_, _ = io.WriteString(t.out, "\b \b")
+		}
+		*line = (*line)[:0]
+	case keyCtrlC:
+		*line = (*line)[:0]
+		_, _ = io.WriteString(t.out, "^C\n")
+
+		return true, errPTYInterrupted
+	case keyCtrlD:
+		if len(*line) == 0 {
+			_, _ = io.WriteString(t.out, "\n")
+			return true, io.EOF
+		}
+	case keyEscape:
+		t.escape = escapeStarted
+	default:
+		if key >= ' ' && len(*line) < maxPTYLineLength {
+			*line = append(*line, key)
+			_, _ = t.out.Write([]byte{key})
+		}
+	}
+
+	return false, nil
+}
+
+// Read lets commands read the lines typed on the terminal.
+func (t *ptyTerminal) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		line, err := t.readLine("")
+		if err != nil {
+			return 0, err
+		}
+		t.pending = []byte(line + "\n")
+	}
+
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+
+	return n, nil
+}
+
+// newPTYReadWriter adapts rw to the PTY of channel, for the commands run with
+// one, like a terminal driver would: the input is echoed and read line by line,
+// and the line endings of the output are translated.
+func newPTYReadWriter(ctx context.Context, channel ssh.Channel, rw *readwriter.ReadWriter) *readwriter.ReadWriter {
+	return &readwriter.ReadWriter{
+		Out:    &crlfWriter{w: rw.Out},
+		In:     newPTYTerminal(ctx, channel),
+		ErrOut: &crlfWriter{w: rw.ErrOut},
+	}
+}
+
+// crlfWriter translates the line endings written to w to CRLF, as a terminal
+// in raw mode expects.
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	if _, err := c.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
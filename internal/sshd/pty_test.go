@@ -0,0 +1,214 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+// inputChannel is a channel the input of which is read from in.
+type inputChannel struct {
+	fakeChannel
+	in io.Reader
+}
+
+func (c *inputChannel) Read(data []byte) (int, error) {
+	return c.in.Read(data)
+}
+
+func newInputChannel(input string) *inputChannel {
+	return &inputChannel{
+		fakeChannel: fakeChannel{stdErr: &bytes.Buffer{}, stdOut: &bytes.Buffer{}},
+		in:          strings.NewReader(input),
+	}
+}
+
+func TestPTYTerminalReadLine(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		input          string
+		expectedLines  []string
+		expectedErr    error
+		expectedOutput string
+	}{
+		{
+			desc:           "carriage returns",
+			input:          "discover\rexit\r",
+			expectedLines:  []string{"discover", "exit"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discover\r\n> exit\r\n> ",
+		},
+		{
+			desc:           "CRLF line endings",
+			input:          "discover\r\nexit\n",
+			expectedLines:  []string{"discover", "exit"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discover\r\n> exit\r\n> ",
+		},
+		{
+			desc:           "backspace and delete",
+			input:          "discox\x7f\bover\r",
+			expectedLines:  []string{"discover"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discox\b \b\b \bover\r\n> ",
+		},
+		{
+			desc:           "multibyte runes are erased whole",
+			input:          "né\x7f\r",
+			expectedLines:  []string{"n"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> né\b \b\r\n> ",
+		},
+		{
+			desc:           "erased line",
+			input:          "ab\x15discover\r",
+			expectedLines:  []string{"discover"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> ab\b \b\b \bdiscover\r\n> ",
+		},
+		{
+			desc:           "escape sequences are ignored",
+			input:          "dis\x1b[A\x1b[1;5Dcover\x1bOB\x1bx\r",
+			expectedLines:  []string{"discover"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discover\r\n> ",
+		},
+		{
+			desc:           "control characters are ignored",
+			input:          "dis\x01\x02cover\t\r",
+			expectedLines:  []string{"discover"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discover\r\n> ",
+		},
+		{
+			desc:           "Ctrl-C",
+			input:          "disc\x03",
+			expectedLines:  []string{""},
+			expectedErr:    errPTYInterrupted,
+			expectedOutput: "> disc^C\r\n",
+		},
+		{
+			desc:           "Ctrl-D on an empty line",
+			input:          "\x04discover\r",
+			expectedLines:  []string{""},
+			expectedErr:    io.EOF,
+			expectedOutput: "> \r\n",
+		},
+		{
+			desc:           "Ctrl-D within a line",
+			input:          "disc\x04over\r",
+			expectedLines:  []string{"discover"},
+			expectedErr:    io.EOF,
+			expectedOutput: "> discover\r\n> ",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			channel := newInputChannel(tc.input)
+			term := newPTYTerminal(context.Background(), channel)
+
+			var lines []string
+			var err error
+			for {
+				var line string
+				line, err = term.readLine("> ")
+				if err != nil {
+					if line != "" || len(lines) == 0 {
+						lines = append(lines, line)
+					}
+					break
+				}
+				lines = append(lines, line)
+			}
+
+			require.Equal(t, tc.expectedLines, lines)
+			require.ErrorIs(t, err, tc.expectedErr)
+			require.Equal(t, tc.expectedOutput, channel.stdOut.(*bytes.Buffer).String())
+		})
+	}
+}
+
+func TestPTYTerminalReadLineCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	channel := &inputChannel{fakeChannel: fakeChannel{stdOut: &bytes.Buffer{}}, in: reader}
+	term := newPTYTerminal(ctx, channel)
+	cancel()
+
+	_, err := term.readLine("> ")
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPTYTerminalRead(t *testing.T) {
+	channel := newInputChannel("first\rsecond\r")
+	term := newPTYTerminal(context.Background(), channel)
+
+	data, err := io.ReadAll(term)
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", string(data))
+}
+
+func TestCRLFWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := &crlfWriter{w: out}
+
+	n, err := w.Write([]byte("one\ntwo\n"))
+	require.NoError(t, err)
+	require.Equal(t, 8, n)
+	require.Equal(t, "one\r\ntwo\r\n", out.String())
+}
+
+func TestHandlePTYRequest(t *testing.T) {
+	payload := ssh.Marshal(ptyRequest{Term: "xterm-256color", Columns: 120, Rows: 40})
+
+	for _, enabled := range []bool{true, false} {
+		s := &session{cfg: &config.Config{}}
+		s.cfg.Server.InteractiveShell = enabled
+
+		err := s.handlePTYRequest(context.Background(), &ssh.Request{Type: "pty-req", Payload: payload})
+		require.NoError(t, err)
+
+		if enabled {
+			require.Equal(t, "xterm-256color", s.ptyTerm)
+			require.Equal(t, uint32(120), s.ptyColumns.Load())
+		} else {
+			require.Empty(t, s.ptyTerm)
+			require.Zero(t, s.ptyColumns.Load())
+		}
+	}
+
+	// Certificates without the permit-pty extension don't allow PTYs
+	s := &session{cfg: &config.Config{}, certPolicy: certPolicy{noPTY: true}}
+	s.cfg.Server.InteractiveShell = true
+	err := s.handlePTYRequest(context.Background(), &ssh.Request{Type: "pty-req", Payload: payload})
+	require.NoError(t, err)
+	require.Empty(t, s.ptyTerm)
+
+	s = &session{cfg: &config.Config{}}
+	err = s.handlePTYRequest(context.Background(), &ssh.Request{Type: "pty-req", Payload: []byte("invalid")})
+	require.Error(t, err)
+}
+
+func TestHandleWindowChange(t *testing.T) {
+	s := &session{cfg: &config.Config{}}
+	s.ptyColumns.Store(80)
+
+	s.handleWindowChange(context.Background(), &ssh.Request{
+		Type:    "window-change",
+		Payload: ssh.Marshal(windowChangeRequest{Columns: 132, Rows: 50}),
+	})
+	require.Equal(t, uint32(132), s.ptyColumns.Load())
+
+	s.handleWindowChange(context.Background(), &ssh.Request{Type: "window-change", Payload: []byte("invalid")})
+	require.Equal(t, uint32(132), s.ptyColumns.Load())
+}
@@ -0,0 +1,228 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/fields"
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	rateLimitIP       = "ip"
+	rateLimitIdentity = "identity"
+
+	rateLimitedMessage = "Too many connections, please try again later.\n"
+
+	// rateLimiterPruneInterval is how often buckets that have refilled
+	// completely are dropped, so that the set of tracked keys stays bounded by
+	// the number of recently active clients.
+	rateLimiterPruneInterval = time.Minute
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// rateLimiter is a set of token buckets keyed by an arbitrary string such as
+// an IP address. A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns a limiter for cfg, or nil if cfg doesn't set a rate.
+// When no burst is configured, one second worth of tokens is allowed.
+func newRateLimiter(cfg config.RateLimitConfig) *rateLimiter {
+	if cfg.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(cfg.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(cfg.Rate))
+	}
+
+	return &rateLimiter{
+		rate:      cfg.Rate,
+		burst:     burst,
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket for key and reports whether there was
+// one to take.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = l.refill(bucket, now)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// exhausted reports whether the bucket for key is out of tokens, without
+// taking one.
+func (l *rateLimiter) exhausted(key string) bool {
+	if l == nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+
+	return ok && l.refill(bucket, l.now()) < 1
+}
+
+func (l *rateLimiter) refill(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated).Seconds()
+
+	return math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+}
+
+// prune drops the buckets that are full again: they behave exactly like a
+// bucket that was never created.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimiterPruneInterval {
+		return
+	}
+
+	for key, bucket := range l.buckets {
+		if l.refill(bucket, now) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastPrune = now
+}
+
+// rateLimitIdentityKey returns the identity an authentication attempt that
+// resolved to the permissions extensions is limited by: the username of a
+// certificate, the Kerberos principal, or else the GitLab key ID.
+func rateLimitIdentityKey(extensions map[string]string) string {
+	switch {
+	case extensions[certPermUsername] != "":
+		return "user:" + extensions[certPermUsername]
+	case extensions["krb5principal"] != "":
+		return "krb5:" + extensions["krb5principal"]
+	default:
+		return "key:" + extensions["key-id"]
+	}
+}
+
+// limitIdentities makes sshCfg reject the authentication attempts of the
+// identities over limiter's rate. Keys and certificates only resolve to an
+// identity once they're looked up, so the attempts that resolve to none are
+// limited per client address instead, and a client over that rate isn't looked
+// up anymore. Kerberos principals are limited before they're accepted.
+func limitIdentities(ctx context.Context, sshCfg *ssh.ServerConfig, limiter *rateLimiter, outcome *connOutcome, ip string) {
+	if limiter == nil {
+		return
+	}
+
+	reject := func(attr slog.Attr) error {
+		metrics.SshdRateLimitedTotal.WithLabelValues(rateLimitIdentity).Inc()
+		log.FromContext(ctx).WarnContext(ctx, "authentication rejected: rate limit exceeded", attr)
+
+		err := &ssh.BannerError{Err: errRateLimited, Message: rateLimitedMessage}
+		if outcome != nil {
+			outcome.observeAuth(ctx, err)
+		}
+
+		return err
+	}
+
+	unresolved := "unresolved:" + ip
+	callback := sshCfg.PublicKeyCallback
+	sshCfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		fingerprint := slog.String("public_key_fingerprint", ssh.FingerprintSHA256(key))
+		if limiter.exhausted(unresolved) {
+			return nil, reject(fingerprint)
+		}
+
+		perms, err := callback(conn, key)
+		if err != nil {
+			limiter.allow(unresolved)
+			return nil, err
+		}
+
+		if !limiter.allow(rateLimitIdentityKey(perms.Extensions)) {
+			return nil, reject(fingerprint)
+		}
+
+		return perms, nil
+	}
+
+	if gssapiCfg := sshCfg.GSSAPIWithMICConfig; gssapiCfg != nil {
+		allowLogin := gssapiCfg.AllowLogin
+		sshCfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+			Server: gssapiCfg.Server,
+			AllowLogin: func(conn ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+				if !limiter.allow(rateLimitIdentityKey(map[string]string{"krb5principal": srcName})) {
+					return nil, reject(slog.String("krb5principal", srcName))
+				}
+
+				return allowLogin(conn, srcName)
+			},
+		}
+	}
+}
+
+// rejectRateLimited makes every authentication attempt made with sshCfg fail.
+// The client is sent a banner explaining why, and is then disconnected by the
+// SSH library after its first attempt, instead of seeing a bare connection
+// reset.
+func rejectRateLimited(ctx context.Context, sshCfg *ssh.ServerConfig, ip string) {
+	metrics.SshdRateLimitedTotal.WithLabelValues(rateLimitIP).Inc()
+	log.FromContext(ctx).WarnContext(ctx, "connection rejected: rate limit exceeded", slog.String(fields.RemoteIP, ip))
+
+	sshCfg.PreAuthConnCallback = func(conn ssh.ServerPreAuthConn) {
+		_ = conn.SendAuthBanner(rateLimitedMessage)
+	}
+	sshCfg.PublicKeyCallback = func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+		return nil, errRateLimited
+	}
+	sshCfg.GSSAPIWithMICConfig = nil
+	sshCfg.MaxAuthTries = 1
+}
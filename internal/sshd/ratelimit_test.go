@@ -0,0 +1,212 @@
+package sshd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+func newTestRateLimiter(cfg config.RateLimitConfig) (*rateLimiter, *time.Time) {
+	now := time.Now()
+	limiter := newRateLimiter(cfg)
+	limiter.now = func() time.Time { return now }
+	limiter.lastPrune = now
+
+	return limiter, &now
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(config.RateLimitConfig{})
+	require.Nil(t, limiter)
+
+	for range 100 {
+		require.True(t, limiter.allow("127.0.0.1"))
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	limiter, now := newTestRateLimiter(config.RateLimitConfig{Rate: 2, Burst: 3})
+
+	for range 3 {
+		require.True(t, limiter.allow("127.0.0.1"))
+	}
+	require.False(t, limiter.allow("127.0.0.1"))
+
+	// Buckets are independent of each other
+	require.True(t, limiter.allow("127.0.0.2"))
+
+	// Two tokens are added per second
+	*now = now.Add(500 * time.Millisecond)
+	require.True(t, limiter.allow("127.0.0.1"))
+	require.False(t, limiter.allow("127.0.0.1"))
+
+	// The bucket never holds more than the burst
+	*now = now.Add(time.Hour)
+	for range 3 {
+		require.True(t, limiter.allow("127.0.0.1"))
+	}
+	require.False(t, limiter.allow("127.0.0.1"))
+}
+
+func TestRateLimiterDefaultBurst(t *testing.T) {
+	testCases := []struct {
+		rate          float64
+		expectedBurst float64
+	}{
+		{rate: 0.1, expectedBurst: 1},
+		{rate: 1, expectedBurst: 1},
+		{rate: 2.5, expectedBurst: 3},
+	}
+
+	for _, tc := range testCases {
+		limiter := newRateLimiter(config.RateLimitConfig{Rate: tc.rate})
+		require.InDelta(t, tc.expectedBurst, limiter.burst, 0.001)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	limiter, now := newTestRateLimiter(config.RateLimitConfig{Rate: 1, Burst: 10})
+
+	require.True(t, limiter.allow("full-again"))
+	*now = now.Add(rateLimiterPruneInterval - time.Second)
+	for range 10 {
+		require.True(t, limiter.allow("still-draining"))
+	}
+	require.Len(t, limiter.buckets, 2)
+
+	*now = now.Add(time.Second)
+	require.True(t, limiter.allow("new"))
+
+	require.Len(t, limiter.buckets, 2)
+	require.Contains(t, limiter.buckets, "still-draining")
+	require.Contains(t, limiter.buckets, "new")
+}
+
+func TestRateLimiterExhausted(t *testing.T) {
+	limiter, now := newTestRateLimiter(config.RateLimitConfig{Rate: 1, Burst: 2})
+	require.False(t, limiter.exhausted("127.0.0.1"))
+
+	require.True(t, limiter.allow("127.0.0.1"))
+	require.False(t, limiter.exhausted("127.0.0.1"))
+	require.True(t, limiter.allow("127.0.0.1"))
+	require.True(t, limiter.exhausted("127.0.0.1"))
+
+	// Checking doesn't take a token
+	*now = now.Add(time.Second)
+	require.False(t, limiter.exhausted("127.0.0.1"))
+	require.False(t, limiter.exhausted("127.0.0.1"))
+	require.True(t, limiter.allow("127.0.0.1"))
+
+	require.False(t, (*rateLimiter)(nil).exhausted("127.0.0.1"))
+}
+
+func TestRateLimitIdentityKey(t *testing.T) {
+	require.Equal(t, "key:1", rateLimitIdentityKey(map[string]string{"key-id": "1"}))
+	require.Equal(t, "user:alice", rateLimitIdentityKey(map[string]string{certPermUsername: "alice", certPermNamespace: "group"}))
+	require.Equal(t, "krb5:alice@EXAMPLE.COM", rateLimitIdentityKey(map[string]string{"krb5principal": "alice@EXAMPLE.COM"}))
+}
+
+func TestLimitIdentities(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caSigner, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	knownKey := rsaPublicKey(t)
+	var lookups atomic.Int32
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				lookups.Add(1)
+				if r.URL.Query().Get("key") != base64.RawStdEncoding.EncodeToString(knownKey.Marshal()) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+
+				fmt.Fprint(w, `{"id": 1, "key": "key"}`)
+			},
+		},
+	}
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile}},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: testserver.StartSocketHTTPServer(t, requests), User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	sshCfg := cfg.get(context.Background(), nil)
+	var krb5Logins int
+	sshCfg.GSSAPIWithMICConfig = &ssh.GSSAPIWithMICConfig{
+		AllowLogin: func(_ ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+			krb5Logins++
+			return &ssh.Permissions{Extensions: map[string]string{"krb5principal": srcName}}, nil
+		},
+	}
+	limitIdentities(context.Background(), sshCfg, newRateLimiter(config.RateLimitConfig{Rate: 0.001, Burst: 1}), nil, "127.0.0.1")
+	conn := fakeConnMetadata{user: testUser}
+
+	initialLimited := testutil.ToFloat64(metrics.SshdRateLimitedTotal.WithLabelValues(rateLimitIdentity))
+
+	// Certificates are limited by username, however often they're reissued
+	_, err = sshCfg.PublicKeyCallback(conn, userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "alice"))
+	require.NoError(t, err)
+
+	_, err = sshCfg.PublicKeyCallback(conn, userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "alice"))
+	require.ErrorIs(t, err, errRateLimited)
+
+	var bannerErr *ssh.BannerError
+	require.ErrorAs(t, err, &bannerErr)
+	require.Equal(t, rateLimitedMessage, bannerErr.Message)
+
+	// Another identity isn't affected
+	_, err = sshCfg.PublicKeyCallback(conn, userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "bob"))
+	require.NoError(t, err)
+
+	// Keys are limited by the key ID GitLab resolves them to
+	_, err = sshCfg.PublicKeyCallback(conn, knownKey)
+	require.NoError(t, err)
+	_, err = sshCfg.PublicKeyCallback(conn, knownKey)
+	require.ErrorIs(t, err, errRateLimited)
+	require.Equal(t, int32(2), lookups.Load())
+
+	// Keys that don't resolve to any identity are limited by client address,
+	// and aren't looked up once over the limit
+	_, err = sshCfg.PublicKeyCallback(conn, rsaPublicKey(t))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, errRateLimited)
+	_, err = sshCfg.PublicKeyCallback(conn, rsaPublicKey(t))
+	require.ErrorIs(t, err, errRateLimited)
+	require.Equal(t, int32(3), lookups.Load())
+
+	// Kerberos principals are limited before they're accepted
+	_, err = sshCfg.GSSAPIWithMICConfig.AllowLogin(conn, "alice@EXAMPLE.COM")
+	require.NoError(t, err)
+	_, err = sshCfg.GSSAPIWithMICConfig.AllowLogin(conn, "alice@EXAMPLE.COM")
+	require.ErrorIs(t, err, errRateLimited)
+	require.Equal(t, 1, krb5Logins)
+
+	require.InDelta(t, initialLimited+4, testutil.ToFloat64(metrics.SshdRateLimitedTotal.WithLabelValues(rateLimitIdentity)), 0.1)
+}
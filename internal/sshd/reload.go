@@ -0,0 +1,114 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+// keyFileState is the part of a file's metadata used to detect that it
+// changed on disk.
+type keyFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// ReloadKeys re-reads the host keys, host certificates, trusted user CA keys,
+// revoked keys, IP filter files and admin token from disk. Handshakes that
+// start after a successful reload use the new keys, while established
+// connections keep the ones they were authenticated with.
+// If the new files can't be loaded the current keys stay in place and an error
+// is returned, so a bad reload never takes down the listener.
+func (s *Server) ReloadKeys(ctx context.Context) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	reloaded, err := s.serverConfig.Load().reload()
+	if err != nil {
+		metrics.SshdKeyReloadsTotal.WithLabelValues("fail").Inc()
+		log.FromContext(ctx).ErrorContext(ctx, "Failed to reload keys, keeping the current ones", log.ErrorMessage(err.Error()))
+
+		return fmt.Errorf("failed to reload keys: %w", err)
+	}
+
+	s.serverConfig.Store(reloaded)
+
+	metrics.SshdKeyReloadsTotal.WithLabelValues("ok").Inc()
+	log.FromContext(ctx).InfoContext(ctx, "Reloaded keys",
+		slog.Int("host_keys", len(reloaded.hostKeys)),
+		slog.Int("host_certs", len(reloaded.hostKeyToCertMap)),
+		slog.Int("trusted_user_ca_keys", len(reloaded.trustedUserCAKeys)),
+	)
+
+	return nil
+}
+
+// watchKeyFiles polls the configured key files every interval and reloads the
+// keys when any of them has changed. Polling is used instead of inotify because
+// Kubernetes secrets are updated by swapping symlinks, which file watchers on
+// the original path don't observe.
+func (s *Server) watchKeyFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := s.keyFilesState()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := s.keyFilesState()
+			if maps.Equal(last, current) {
+				continue
+			}
+
+			log.FromContext(ctx).InfoContext(ctx, "Key files changed on disk, reloading")
+
+			// Remember the new state even if the reload fails, so a broken file is
+			// reported once rather than on every tick until it's fixed.
+			last = current
+			_ = s.ReloadKeys(ctx)
+		}
+	}
+}
+
+func (s *Server) keyFilesState() map[string]keyFileState {
+	state := make(map[string]keyFileState)
+
+	for _, files := range [][]string{
+		s.Config.Server.HostKeyFiles,
+		s.Config.Server.HostCertFiles,
+		s.Config.Server.TrustedUserCAKeyFiles(),
+		s.Config.Server.RevokedKeys,
+		s.Config.Server.IPFilter.AllowFiles,
+		s.Config.Server.IPFilter.DenyFiles,
+		{s.Config.Server.AdminTokenFile},
+	} {
+		for _, filename := range files {
+			if filename == "" {
+				continue
+			}
+
+			info, err := os.Stat(filepath.Clean(filename))
+			if err != nil {
+				// A missing file is recorded as the zero state so that its
+				// (re)appearance is detected as a change.
+				state[filename] = keyFileState{}
+				continue
+			}
+
+			state[filename] = keyFileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+
+	return state
+}
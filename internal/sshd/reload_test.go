@@ -0,0 +1,171 @@
+package sshd
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+func setupReloadableServer(t *testing.T, caPubKey ssh.PublicKey) (*Server, string) {
+	t.Helper()
+
+	testRoot := testhelper.PrepareTestRootDir(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	s, err := NewServer(&config.Config{
+		GitlabURL: localhostURL,
+		User:      testUser,
+		Server: config.ServerConfig{
+			HostKeyFiles:      []string{path.Join(testRoot, "certs/valid/server.key")},
+			TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile}},
+		},
+	})
+	require.NoError(t, err)
+
+	return s, caKeyFile
+}
+
+func TestReloadKeys(t *testing.T) {
+	_, oldCA := createCAKeyPair(t)
+	_, newCA := createCAKeyPair(t)
+
+	s, caKeyFile := setupReloadableServer(t, oldCA)
+	inFlight := s.serverConfig.Load()
+
+	initialOK := testutil.ToFloat64(metrics.SshdKeyReloadsTotal.WithLabelValues("ok"))
+
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(newCA), 0600))
+	require.NoError(t, s.ReloadKeys(context.Background()))
+
+	reloaded := s.serverConfig.Load()
+	require.True(t, reloaded.isLocallyTrustedCA(newCA))
+	require.False(t, reloaded.isLocallyTrustedCA(oldCA))
+	require.Len(t, reloaded.hostKeys, 1)
+
+	// A connection that captured the config before the reload keeps it
+	require.True(t, inFlight.isLocallyTrustedCA(oldCA))
+	require.False(t, inFlight.isLocallyTrustedCA(newCA))
+
+	require.InDelta(t, initialOK+1, testutil.ToFloat64(metrics.SshdKeyReloadsTotal.WithLabelValues("ok")), 0.1)
+}
+
+func TestReloadKeysPicksUpRevokedKeys(t *testing.T) {
+	caSigner, caPubKey := createCAKeyPair(t)
+	cert := userCertWithSerial(t, caSigner, 7)
+
+	s, _ := setupReloadableServer(t, caPubKey)
+	_, err := s.serverConfig.Load().handleUserCertificate(context.Background(), testUser, cert)
+	require.NoError(t, err)
+
+	s.Config.Server.RevokedKeys = []string{writeRevokedKeys(t, ssh.MarshalAuthorizedKey(cert.Key))}
+	require.NoError(t, s.ReloadKeys(context.Background()))
+
+	_, err = s.serverConfig.Load().handleUserCertificate(context.Background(), testUser, cert)
+	require.EqualError(t, err, "handleUserCertificate: certificate is revoked")
+}
+
+func TestReloadKeysRejectsBadFiles(t *testing.T) {
+	_, caPubKey := createCAKeyPair(t)
+
+	testCases := []struct {
+		desc        string
+		setup       func(t *testing.T, s *Server, caKeyFile string)
+		errContains string
+	}{
+		{
+			desc: "invalid CA key file",
+			setup: func(t *testing.T, _ *Server, caKeyFile string) {
+				require.NoError(t, os.WriteFile(caKeyFile, []byte("not a valid ssh key"), 0600))
+			},
+			errContains: "failed to load trusted user CA keys",
+		},
+		{
+			desc: "removed CA key file",
+			setup: func(t *testing.T, _ *Server, caKeyFile string) {
+				require.NoError(t, os.Remove(caKeyFile))
+			},
+			errContains: "failed to read trusted user CA key file",
+		},
+		{
+			desc: "no loadable host keys",
+			setup: func(_ *testing.T, s *Server, _ string) {
+				s.Config.Server.HostKeyFiles = []string{"/nonexistent/host.key"}
+			},
+			errContains: "failed to load host keys",
+		},
+		{
+			desc: "one unreadable host key",
+			setup: func(_ *testing.T, s *Server, _ string) {
+				s.Config.Server.HostKeyFiles = append(s.Config.Server.HostKeyFiles, "/nonexistent/host.key")
+			},
+			errContains: `failed to read host key "/nonexistent/host.key"`,
+		},
+		{
+			desc: "one corrupt host certificate",
+			setup: func(_ *testing.T, s *Server, _ string) {
+				certDir := path.Dir(s.Config.Server.HostKeyFiles[0])
+				s.Config.Server.HostCertFiles = []string{
+					path.Join(certDir, "server-cert.pub"),
+					path.Join(certDir, "../invalid/server-cert.pub"),
+				}
+			},
+			errContains: "failed to load host certificates",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			s, caKeyFile := setupReloadableServer(t, caPubKey)
+			current := s.serverConfig.Load()
+
+			initialFail := testutil.ToFloat64(metrics.SshdKeyReloadsTotal.WithLabelValues("fail"))
+
+			tc.setup(t, s, caKeyFile)
+
+			err := s.ReloadKeys(context.Background())
+			require.ErrorContains(t, err, "failed to reload keys")
+			require.ErrorContains(t, err, tc.errContains)
+
+			require.Same(t, current, s.serverConfig.Load())
+			require.Len(t, s.serverConfig.Load().hostKeys, 1)
+			require.True(t, s.serverConfig.Load().isLocallyTrustedCA(caPubKey))
+			require.InDelta(t, initialFail+1, testutil.ToFloat64(metrics.SshdKeyReloadsTotal.WithLabelValues("fail")), 0.1)
+		})
+	}
+}
+
+func TestWatchKeyFiles(t *testing.T) {
+	_, oldCA := createCAKeyPair(t)
+	_, newCA := createCAKeyPair(t)
+
+	s, caKeyFile := setupReloadableServer(t, oldCA)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go s.watchKeyFiles(ctx, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(newCA), 0600))
+
+	modTime := time.Now()
+	require.Eventually(t, func() bool {
+		// Keep bumping the modification time: the watcher may take its initial
+		// snapshot after the write above, and coarse-grained filesystems may not
+		// record a different time for it anyway.
+		modTime = modTime.Add(time.Second)
+		_ = os.Chtimes(caKeyFile, modTime, modTime)
+
+		return s.serverConfig.Load().isLocallyTrustedCA(newCA)
+	}, 2*time.Second, 20*time.Millisecond)
+}
@@ -0,0 +1,43 @@
+package sshd
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// permUserPresence is the permissions extension recording that the
+	// connection is authenticated with a security key the user touched.
+	permUserPresence = "user-presence"
+
+	// noTouchRequiredExtension lets the signatures of the security key a
+	// certificate is issued for skip asserting user presence.
+	noTouchRequiredExtension = "no-touch-required"
+)
+
+// assertsUserPresence reports whether authenticating with key proves that the
+// user touched their security key. crypto/ssh rejects the signatures of
+// security keys that don't assert user presence, unless the certificate of
+// the key carries the no-touch-required extension. The user verification flag,
+// set when the user entered their PIN, isn't exposed by crypto/ssh.
+func assertsUserPresence(key ssh.PublicKey) bool {
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if _, waived := cert.Extensions[noTouchRequiredExtension]; waived {
+			return false
+		}
+		key = cert.Key
+	}
+
+	switch key.Type() {
+	case ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519:
+		return true
+	default:
+		return false
+	}
+}
+
+// userPresenceFromExtensions reports whether the permissions extensions of a
+// connection record that the user touched their security key.
+func userPresenceFromExtensions(extensions map[string]string) bool {
+	_, ok := extensions[permUserPresence]
+	return ok
+}
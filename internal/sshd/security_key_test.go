@@ -0,0 +1,110 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+// skEd25519PublicKey returns the public key of an sk-ssh-ed25519 security key.
+func skEd25519PublicKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	key, err := ssh.ParsePublicKey(ssh.Marshal(struct {
+		Name        string
+		KeyBytes    []byte
+		Application string
+	}{ssh.KeyAlgoSKED25519, pub, "ssh:"}))
+	require.NoError(t, err)
+
+	return key
+}
+
+func TestAssertsUserPresence(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed25519Key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+
+	skKey := skEd25519PublicKey(t)
+
+	testCases := []struct {
+		desc     string
+		key      ssh.PublicKey
+		expected bool
+	}{
+		{
+			desc: "regular key",
+			key:  ed25519Key,
+		},
+		{
+			desc:     "security key",
+			key:      skKey,
+			expected: true,
+		},
+		{
+			desc: "certificate of a regular key",
+			key:  &ssh.Certificate{Key: ed25519Key},
+		},
+		{
+			desc:     "certificate of a security key",
+			key:      &ssh.Certificate{Key: skKey, Permissions: ssh.Permissions{Extensions: map[string]string{"permit-pty": ""}}},
+			expected: true,
+		},
+		{
+			desc: "certificate of a security key not requiring touch",
+			key:  &ssh.Certificate{Key: skKey, Permissions: ssh.Permissions{Extensions: map[string]string{noTouchRequiredExtension: ""}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expected, assertsUserPresence(tc.key))
+		})
+	}
+}
+
+func TestPublicKeyCallbackUserPresence(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.Write([]byte(`{ "id": 1, "key": "key" }`))
+			},
+		},
+	}
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: testserver.StartSocketHTTPServer(t, requests), User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	callback := cfg.publicKeyCallback(context.Background(), nil)
+
+	perms, err := callback(fakeConnMetadata{user: testUser}, skEd25519PublicKey(t))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"key-id": "1", permUserPresence: ""}, perms.Extensions)
+	require.True(t, userPresenceFromExtensions(perms.Extensions))
+
+	perms, err = callback(fakeConnMetadata{user: testUser}, rsaPublicKey(t))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"key-id": "1"}, perms.Extensions)
+	require.False(t, userPresenceFromExtensions(perms.Extensions))
+}
@@ -4,6 +4,7 @@ package sshd
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -18,6 +19,8 @@ import (
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedcerts"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/authorizedkeys"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/discover"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/twofactorverify"
 
 	"gitlab.com/gitlab-org/labkit/fips"
 	"gitlab.com/gitlab-org/labkit/v2/log"
@@ -32,34 +35,48 @@ type serverConfig struct {
 	cfg                   *config.Config
 	hostKeys              []ssh.Signer
 	hostKeyToCertMap      map[string]*ssh.Certificate
-	trustedUserCAKeySet   map[string]struct{}
+	trustedUserCAKeys     map[string]certIdentityMapping
+	revokedKeys           *revocationList
+	ipFilter              *ipFilter
+	adminToken            []byte
 	authorizedKeysClient  *authorizedkeys.Client
 	authorizedCertsClient *authorizedcerts.Client
+	authorizedKeysCache   *authorizedKeysCache
+	twoFactorClient       *twofactorverify.Client
+	discoverClient        *discover.Client
 }
 
-func parseHostKeys(keyFiles []string) []ssh.Signer {
+// parseHostKeys loads the host keys that can be read, and returns the errors of
+// the others.
+func parseHostKeys(keyFiles []string) ([]ssh.Signer, error) {
 	var hostKeys []ssh.Signer
+	var errs []error
 
 	for _, filename := range keyFiles {
 		keyRaw, err := os.ReadFile(filepath.Clean(filename))
 		if err != nil {
 			slog.Default().Error("Failed to read host key", slog.String("filename", filename), log.ErrorMessage(err.Error()))
+			errs = append(errs, fmt.Errorf("failed to read host key %q: %w", filename, err))
 			continue
 		}
 		key, err := ssh.ParsePrivateKey(keyRaw)
 		if err != nil {
 			slog.Default().Error("Failed to parse host key", slog.String("filename", filename), log.ErrorMessage(err.Error()))
+			errs = append(errs, fmt.Errorf("failed to parse host key %q: %w", filename, err))
 			continue
 		}
 
 		hostKeys = append(hostKeys, key)
 	}
 
-	return hostKeys
+	return hostKeys, errors.Join(errs...)
 }
 
-func parseHostCerts(hostKeys []ssh.Signer, certFiles []string) map[string]*ssh.Certificate {
+// parseHostCerts attaches the host certificates that can be loaded to their
+// host keys, and returns the errors of the others.
+func parseHostCerts(hostKeys []ssh.Signer, certFiles []string) (map[string]*ssh.Certificate, error) {
 	keyToCertMap := map[string]*ssh.Certificate{}
+	var errs []error
 	hostKeyIndex := make(map[string]int)
 
 	for index, hostKey := range hostKeys {
@@ -72,17 +89,20 @@ func parseHostCerts(hostKeys []ssh.Signer, certFiles []string) map[string]*ssh.C
 		ctx = log.WithLogger(ctx, slog.Default().With(slog.String("filename", filename)))
 		if err != nil {
 			log.FromContext(ctx).ErrorContext(ctx, "failed to read host certificate", log.ErrorMessage(err.Error()))
+			errs = append(errs, fmt.Errorf("failed to read host certificate %q: %w", filename, err))
 			continue
 		}
 		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(keyRaw)
 		if err != nil {
 			log.FromContext(ctx).ErrorContext(ctx, "failed to parse host certificate", log.ErrorMessage(err.Error()))
+			errs = append(errs, fmt.Errorf("failed to parse host certificate %q: %w", filename, err))
 			continue
 		}
 
 		cert, ok := publicKey.(*ssh.Certificate)
 		if !ok {
 			log.FromContext(ctx).ErrorContext(ctx, "failed to decode host certificate")
+			errs = append(errs, fmt.Errorf("host certificate %q isn't a certificate", filename))
 			continue
 		}
 
@@ -94,26 +114,36 @@ func parseHostCerts(hostKeys []ssh.Signer, certFiles []string) map[string]*ssh.C
 			certSigner, err := ssh.NewCertSigner(cert, hostKeys[index])
 			if err != nil {
 				log.FromContext(ctx).ErrorContext(ctx, "the host certificate doesn't match the host private key", log.ErrorMessage(err.Error()))
+				errs = append(errs, fmt.Errorf("host certificate %q doesn't match its host key: %w", filename, err))
 				continue
 			}
 
 			hostKeys[index] = certSigner
 		} else {
 			log.FromContext(ctx).ErrorContext(ctx, "no matching private key for certificate")
+			errs = append(errs, fmt.Errorf("no host key matches host certificate %q", filename))
 		}
 	}
 
-	return keyToCertMap
+	return keyToCertMap, errors.Join(errs...)
 }
 
-// parseTrustedUserCAKeys loads trusted user CA public key files.
+// parseTrustedUserCAKeys loads trusted user CA public key files, along with
+// the identity mapping of each file.
 // Unlike parseHostKeys, this fails on any error because trusted CA keys are a
 // security trust boundary: a partially loaded set could silently authenticate
-// the wrong users or fail to authenticate expected users.
-func parseTrustedUserCAKeys(caKeyFiles []string) (map[string]struct{}, error) {
-	result := make(map[string]struct{})
+// the wrong users or fail to authenticate expected users. For the same reason,
+// a CA key listed in several files must have the same mapping in all of them.
+func parseTrustedUserCAKeys(caKeys []config.TrustedUserCAKeyConfig) (map[string]certIdentityMapping, error) {
+	result := make(map[string]certIdentityMapping)
+
+	for _, caKey := range caKeys {
+		filename := caKey.File
+		mapping, err := newCertIdentityMapping(caKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity mapping of trusted user CA key file %q: %w", filename, err)
+		}
 
-	for _, filename := range caKeyFiles {
 		keyRaw, err := os.ReadFile(filepath.Clean(filename))
 		if err != nil {
 			return nil, fmt.Errorf("failed to read trusted user CA key file %q: %w", filename, err)
@@ -126,7 +156,11 @@ func parseTrustedUserCAKeys(caKeyFiles []string) (map[string]struct{}, error) {
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse trusted user CA key in file %q after %d valid key(s): %w", filename, keysFromFile, err)
 			}
-			result[string(publicKey.Marshal())] = struct{}{}
+			marshaled := string(publicKey.Marshal())
+			if existing, ok := result[marshaled]; ok && !existing.equal(mapping) {
+				return nil, fmt.Errorf("trusted user CA key in file %q is already trusted with a different identity mapping", filename)
+			}
+			result[marshaled] = mapping
 			keysFromFile++
 			rest = remaining
 		}
@@ -146,46 +180,121 @@ func newServerConfig(cfg *config.Config) (*serverConfig, error) {
 		return nil, fmt.Errorf("failed to initialize authorized certs client: %w", err)
 	}
 
-	hostKeys := parseHostKeys(cfg.Server.HostKeyFiles)
+	twoFactorClient, err := twofactorverify.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize two-factor verification client: %w", err)
+	}
+
+	discoverClient, err := discover.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize discover client: %w", err)
+	}
+
+	s := &serverConfig{
+		cfg:                   cfg,
+		authorizedKeysClient:  authorizedKeysClient,
+		authorizedCertsClient: authorizedCertsClient,
+		authorizedKeysCache:   newAuthorizedKeysCache(cfg.Server.AuthorizedKeysCache),
+		twoFactorClient:       twoFactorClient,
+		discoverClient:        discoverClient,
+	}
+
+	if err := s.loadKeys(false); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// loadKeys reads the host keys, host certificates, trusted user CA keys,
+// revoked keys, IP filter and admin token from the files listed in the config.
+// At startup the host keys and certificates that can't be loaded are skipped,
+// as long as one host key is. When strict, as on reload, any of them failing
+// fails the load: the server keeps presenting its current keys rather than
+// dropping one its clients already know.
+func (s *serverConfig) loadKeys(strict bool) error {
+	hostKeys, err := parseHostKeys(s.cfg.Server.HostKeyFiles)
+	if err != nil && strict {
+		return fmt.Errorf("failed to load host keys: %w", err)
+	}
 	if len(hostKeys) == 0 {
-		return nil, fmt.Errorf("no host keys could be loaded, aborting")
+		return fmt.Errorf("no host keys could be loaded, aborting")
 	}
 
-	hostKeyToCertMap := parseHostCerts(hostKeys, cfg.Server.HostCertFiles)
+	hostKeyToCertMap, err := parseHostCerts(hostKeys, s.cfg.Server.HostCertFiles)
+	if err != nil && strict {
+		return fmt.Errorf("failed to load host certificates: %w", err)
+	}
 
-	trustedUserCAKeySet, err := parseTrustedUserCAKeys(cfg.Server.TrustedUserCAKeys)
+	trustedUserCAKeys, err := parseTrustedUserCAKeys(s.cfg.Server.TrustedUserCAKeys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to load trusted user CA keys: %w", err)
+		return fmt.Errorf("failed to load trusted user CA keys: %w", err)
 	}
-	if len(cfg.Server.TrustedUserCAKeys) > 0 && len(trustedUserCAKeySet) == 0 {
-		return nil, fmt.Errorf("trusted_user_ca_keys configured but no valid CA keys were loaded, aborting")
+	if len(s.cfg.Server.TrustedUserCAKeys) > 0 && len(trustedUserCAKeys) == 0 {
+		return fmt.Errorf("trusted_user_ca_keys configured but no valid CA keys were loaded, aborting")
 	}
-	if len(trustedUserCAKeySet) > 0 {
+	if len(trustedUserCAKeys) > 0 {
 		slog.Default().Info("Loaded trusted user CA keys for instance-level SSH certificates",
-			slog.Int("count", len(trustedUserCAKeySet)))
+			slog.Int("count", len(trustedUserCAKeys)))
 	}
 
-	return &serverConfig{
-		cfg:                   cfg,
-		authorizedKeysClient:  authorizedKeysClient,
-		authorizedCertsClient: authorizedCertsClient,
-		hostKeys:              hostKeys,
-		hostKeyToCertMap:      hostKeyToCertMap,
-		trustedUserCAKeySet:   trustedUserCAKeySet,
-	}, nil
+	revokedKeys, err := parseRevokedKeys(s.cfg.Server.RevokedKeys)
+	if err != nil {
+		return fmt.Errorf("failed to load revoked keys: %w", err)
+	}
+
+	ipFilter, err := parseIPFilter(s.cfg.Server.IPFilter)
+	if err != nil {
+		return fmt.Errorf("failed to load IP filter: %w", err)
+	}
+
+	adminToken, err := readAdminToken(s.cfg.Server.AdminTokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to load admin token: %w", err)
+	}
+
+	s.hostKeys = hostKeys
+	s.hostKeyToCertMap = hostKeyToCertMap
+	s.trustedUserCAKeys = trustedUserCAKeys
+	s.revokedKeys = revokedKeys
+	s.ipFilter = ipFilter
+	s.adminToken = adminToken
+
+	return nil
+}
+
+// reload returns a copy of s with its keys re-read from disk. s itself is left
+// untouched, so connections that already captured it keep using the previous
+// keys, and a failed reload leaves nothing half-applied.
+func (s *serverConfig) reload() (*serverConfig, error) {
+	reloaded := *s
+
+	if err := reloaded.loadKeys(true); err != nil {
+		return nil, err
+	}
+
+	return &reloaded, nil
 }
 
 func (s *serverConfig) isLocallyTrustedCA(signingKey ssh.PublicKey) bool {
-	_, ok := s.trustedUserCAKeySet[string(signingKey.Marshal())]
+	_, ok := s.trustedCAMapping(signingKey)
 	return ok
 }
 
+// trustedCAMapping returns the identity mapping of signingKey, if it's a
+// locally trusted CA.
+func (s *serverConfig) trustedCAMapping(signingKey ssh.PublicKey) (certIdentityMapping, bool) {
+	mapping, ok := s.trustedUserCAKeys[string(signingKey.Marshal())]
+	return mapping, ok
+}
+
 var (
 	validKeyIDPattern       = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,253}[a-zA-Z0-9]$`)
 	consecutiveSpecialChars = regexp.MustCompile(`[._-]{2,}`)
 )
 
-// validateKeyID checks that the certificate KeyId conforms to GitLab's username
+// validateKeyID checks that the username taken from an instance-level
+// certificate, its KeyId unless mapped otherwise, conforms to GitLab's username
 // rules, since it is used directly as the username in API calls and logging.
 func validateKeyID(keyID string) error {
 	if keyID == "" {
@@ -212,23 +321,56 @@ func (s *serverConfig) handleUserKey(ctx context.Context, user string, key ssh.P
 		return nil, fmt.Errorf("DSA is prohibited")
 	}
 
-	res, err := s.authorizedKeysClient.GetByKey(ctx, base64.RawStdEncoding.EncodeToString(key.Marshal()))
+	res, err := s.getAuthorizedKey(ctx, key)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ssh.Permissions{
+	perms := &ssh.Permissions{
 		// Record the public key used for authentication.
 		Extensions: map[string]string{
 			"key-id": strconv.FormatInt(res.ID, 10),
 		},
-	}, nil
+	}
+	if res.TwoFactorRequired && s.cfg.Server.TwoFactor.Enabled {
+		perms.Extensions[permTwoFactorRequired] = ""
+	}
+
+	return perms, nil
+}
+
+// getAuthorizedKey looks key up in GitLab, going through the cache when it's
+// enabled.
+func (s *serverConfig) getAuthorizedKey(ctx context.Context, key ssh.PublicKey) (*authorizedkeys.Response, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	if entry, ok := s.authorizedKeysCache.get(fingerprint); ok {
+		return entry.response, entry.err
+	}
+
+	res, err := s.authorizedKeysClient.GetByKey(ctx, base64.RawStdEncoding.EncodeToString(key.Marshal()))
+	s.authorizedKeysCache.add(fingerprint, res, err)
+
+	return res, err
+}
+
+// certNamespaces returns the namespaces recorded in the permissions extensions
+// of a certificate, separated by commas.
+func certNamespaces(extensions map[string]string) []string {
+	namespace := extensions[certPermNamespace]
+	if namespace == "" {
+		return nil
+	}
+
+	return strings.Split(namespace, ",")
 }
 
 // buildCertPermissions constructs ssh.Permissions for an authenticated certificate.
 // It propagates cert.CriticalOptions so that crypto/ssh can enforce restrictions
-// such as source-address, and rejects connections with unknown critical options.
-func buildCertPermissions(cert *ssh.Certificate, extensions map[string]string) *ssh.Permissions {
+// such as source-address, and records the policy of the certificate for the
+// sessions to enforce.
+func buildCertPermissions(cert *ssh.Certificate, policy certPolicy, extensions map[string]string) *ssh.Permissions {
+	policy.addTo(extensions)
+
 	return &ssh.Permissions{
 		CriticalOptions: cert.CriticalOptions,
 		Extensions:      extensions,
@@ -252,21 +394,60 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 		return nil, fmt.Errorf("handleUserCertificate: cert has type %d", cert.CertType)
 	}
 
-	certChecker := &ssh.CertChecker{}
-	if err := certChecker.CheckCert(user, cert); err != nil {
+	mapping, locallyTrusted := s.trustedCAMapping(cert.SignatureKey)
+
+	// Certificates whose username is taken from a principal are checked
+	// against that principal instead of the SSH user
+	principal := user
+	if locallyTrusted && mapping.fromPrincipals {
+		if user != s.cfg.User {
+			return nil, fmt.Errorf("handleUserCertificate: unknown user")
+		}
+
+		var err error
+		if principal, err = mapping.principal(cert); err != nil {
+			log.FromContext(ctx).WarnContext(ctx, "instance-level certificate rejected: no principal to map",
+				log.ErrorMessage(err.Error()))
+			return nil, fmt.Errorf("handleUserCertificate: %w", err)
+		}
+	}
+
+	// Unknown critical options are rejected
+	certChecker := &ssh.CertChecker{SupportedCriticalOptions: supportedCriticalOptions}
+	if err := certChecker.CheckCert(principal, cert); err != nil {
 		log.FromContext(ctx).WarnContext(ctx, "certificate rejected: validity check failed",
 			log.ErrorMessage(err.Error()))
 		return nil, err
 	}
 
-	if s.isLocallyTrustedCA(cert.SignatureKey) {
-		if err := validateKeyID(cert.KeyId); err != nil {
-			log.FromContext(ctx).WarnContext(ctx, "instance-level certificate rejected: invalid KeyId",
+	policy, err := parseCertPolicy(cert)
+	if err != nil {
+		log.FromContext(ctx).WarnContext(ctx, "certificate rejected: invalid policy", log.ErrorMessage(err.Error()))
+		return nil, fmt.Errorf("handleUserCertificate: %w", err)
+	}
+
+	if reason := s.revokedKeys.certRevocationReason(cert); reason != "" {
+		log.FromContext(ctx).WarnContext(ctx, "certificate rejected: revoked",
+			slog.String("revocation_reason", reason),
+			slog.Uint64("certificate_serial", cert.Serial))
+		return nil, fmt.Errorf("handleUserCertificate: certificate is revoked")
+	}
+
+	if locallyTrusted {
+		username, err := mapping.username(cert)
+		if err == nil {
+			err = validateKeyID(username)
+		}
+		if err != nil {
+			log.FromContext(ctx).WarnContext(ctx, "instance-level certificate rejected: invalid username",
 				log.ErrorMessage(err.Error()))
 			return nil, fmt.Errorf("handleUserCertificate: %w", err)
 		}
 
-		ctx = log.AppendFields(ctx, slog.String("certificate_username", cert.KeyId))
+		ctx = log.AppendFields(ctx,
+			slog.String("certificate_username", username),
+			slog.String("certificate_namespace", strings.Join(mapping.namespaces, ",")),
+		)
 		log.FromContext(ctx).InfoContext(ctx, "user certificate is signed by a locally trusted CA (instance-level)")
 
 		if addr, ok := cert.CriticalOptions["source-address"]; ok {
@@ -274,10 +455,13 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 				slog.String("source_address", addr))
 		}
 
+		extensions := map[string]string{certPermUsername: username}
 		// No namespace key = instance-wide access (no namespace restriction)
-		return buildCertPermissions(cert, map[string]string{
-			certPermUsername: cert.KeyId,
-		}), nil
+		if len(mapping.namespaces) > 0 {
+			extensions[certPermNamespace] = strings.Join(mapping.namespaces, ",")
+		}
+
+		return buildCertPermissions(cert, policy, extensions), nil
 	}
 
 	// Fall back to group-level certificate check via Rails API
@@ -303,7 +487,7 @@ func (s *serverConfig) handleUserCertificate(ctx context.Context, user string, c
 			slog.String("source_address", addr))
 	}
 
-	return buildCertPermissions(cert, map[string]string{
+	return buildCertPermissions(cert, policy, map[string]string{
 		certPermUsername:  res.Username,
 		certPermNamespace: res.Namespace,
 	}), nil
@@ -326,14 +510,65 @@ func (s *serverConfig) publicKeyCallback(parentCtx context.Context, outcome *con
 			perms, err = s.handleUserKey(ctx, conn.User(), key)
 		}
 
+		if err != nil {
+			perms = nil
+		} else if assertsUserPresence(key) {
+			perms.Extensions[permUserPresence] = ""
+		}
+
 		if outcome != nil {
-			outcome.observeAuth(err)
+			outcome.observeAuth(ctx, err)
 		}
 
 		return perms, err
 	}
 }
 
+// gssapiAllowLogin returns the GSSAPI AllowLogin callback, which accepts the
+// Kerberos principal authenticated by GSSAPI and, when two-factor
+// authentication is enabled, asks for the second factor of the users that
+// must pass it.
+func (s *serverConfig) gssapiAllowLogin(parentCtx context.Context, outcome *connOutcome) func(ssh.ConnMetadata, string) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
+		ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+		defer cancel()
+
+		// GSSAPI auth is a genuine auth attempt; record it via observeAuth so
+		// it counts toward the connection SLI consistently with public-key
+		// auth. On success observeAuth(nil) also clears any server-side error
+		// left by an earlier public-key attempt, since the connection
+		// ultimately authenticated.
+		if conn.User() != s.cfg.User {
+			err := fmt.Errorf("unknown user")
+			if outcome != nil {
+				outcome.observeAuth(ctx, err)
+			}
+
+			return nil, err
+		}
+
+		perms := &ssh.Permissions{
+			// Record the Kerberos principal used for authentication.
+			Extensions: map[string]string{
+				"krb5principal": srcName,
+			},
+		}
+
+		// The principal is only looked up once the GSSAPI exchange and the
+		// user have been accepted.
+		err := s.lookUpTwoFactor(ctx, perms)
+		if outcome != nil {
+			outcome.observeAuth(ctx, err)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return s.requireSecondFactor(parentCtx, outcome, perms)
+	}
+}
+
 func (s *serverConfig) get(parentCtx context.Context, outcome *connOutcome) *ssh.ServerConfig {
 	var gssapiWithMICConfig *ssh.GSSAPIWithMICConfig
 	if s.cfg.Server.GSSAPI.Enabled {
@@ -341,34 +576,8 @@ func (s *serverConfig) get(parentCtx context.Context, outcome *connOutcome) *ssh
 
 		if gssAPIServer != nil {
 			gssapiWithMICConfig = &ssh.GSSAPIWithMICConfig{
-				AllowLogin: func(conn ssh.ConnMetadata, srcName string) (*ssh.Permissions, error) {
-					// GSSAPI auth is a genuine auth attempt; record it via
-					// observeAuth so it counts toward the connection SLI
-					// consistently with public-key auth. GSSAPI makes no internal
-					// API call, so a failure here is always client-side; on success
-					// observeAuth(nil) also clears any server-side error left by an
-					// earlier public-key attempt, since the connection ultimately
-					// authenticated.
-					var perms *ssh.Permissions
-					var err error
-					if conn.User() == s.cfg.User {
-						perms = &ssh.Permissions{
-							// Record the Kerberos principal used for authentication.
-							Extensions: map[string]string{
-								"krb5principal": srcName,
-							},
-						}
-					} else {
-						err = fmt.Errorf("unknown user")
-					}
-
-					if outcome != nil {
-						outcome.observeAuth(err)
-					}
-
-					return perms, err
-				},
-				Server: gssAPIServer,
+				AllowLogin: s.gssapiAllowLogin(parentCtx, outcome),
+				Server:     gssAPIServer,
 			}
 		}
 	}
@@ -378,6 +587,9 @@ func (s *serverConfig) get(parentCtx context.Context, outcome *connOutcome) *ssh
 		GSSAPIWithMICConfig: gssapiWithMICConfig,
 		ServerVersion:       "SSH-2.0-GitLab-SSHD",
 	}
+	if s.cfg.Server.TwoFactor.Enabled {
+		sshCfg.VerifiedPublicKeyCallback = s.verifiedPublicKeyCallback(parentCtx, outcome)
+	}
 
 	// Only set this for FIPS because by default to preserve backwards compatibility
 	// for previous versions that support both secure and insecure defaults.
@@ -7,10 +7,12 @@ import (
 	"crypto/rsa"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -99,7 +101,7 @@ func TestNewServerConfigLoadsTrustedCAKeys(t *testing.T) {
 		HostKeyFiles: []string{
 			path.Join(testRoot, "certs/valid/server.key"),
 		},
-		TrustedUserCAKeys: []string{caKeyFile},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile}},
 	}
 
 	cfg, err := newServerConfig(
@@ -108,7 +110,7 @@ func TestNewServerConfigLoadsTrustedCAKeys(t *testing.T) {
 	require.NoError(t, err)
 
 	// Smoke test: verify CA keys were loaded via newServerConfig wiring
-	require.Len(t, cfg.trustedUserCAKeySet, 1)
+	require.Len(t, cfg.trustedUserCAKeys, 1)
 }
 
 func TestNewServerConfig_FailsOnBadCAKeyFile(t *testing.T) {
@@ -120,7 +122,7 @@ func TestNewServerConfig_FailsOnBadCAKeyFile(t *testing.T) {
 		HostKeyFiles: []string{
 			path.Join(testRoot, "certs/valid/server.key"),
 		},
-		TrustedUserCAKeys: []string{"/nonexistent/ca.pub"},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: "/nonexistent/ca.pub"}},
 	}
 
 	_, err := newServerConfig(
@@ -282,6 +284,7 @@ func TestUserCertificateHandling(t *testing.T) {
 				Extensions: map[string]string{
 					certPermUsername:  rootUser,
 					certPermNamespace: testNamespaceValue,
+					certPermNoPTY:     "",
 				},
 			},
 		}, {
@@ -304,6 +307,7 @@ func TestUserCertificateHandling(t *testing.T) {
 				Extensions: map[string]string{
 					certPermUsername:  rootUser,
 					certPermNamespace: testNamespaceValue,
+					certPermNoPTY:     "",
 				},
 			},
 		},
@@ -607,7 +611,12 @@ func TestParseTrustedUserCAKeys(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.desc, func(t *testing.T) {
-			keySet, err := parseTrustedUserCAKeys(tc.files)
+			caKeys := make([]config.TrustedUserCAKeyConfig, 0, len(tc.files))
+			for _, file := range tc.files {
+				caKeys = append(caKeys, config.TrustedUserCAKeyConfig{File: file})
+			}
+
+			keySet, err := parseTrustedUserCAKeys(caKeys)
 			if tc.expectErr {
 				require.Error(t, err)
 				require.Contains(t, err.Error(), tc.errContains)
@@ -619,12 +628,41 @@ func TestParseTrustedUserCAKeys(t *testing.T) {
 	}
 }
 
+func TestParseTrustedUserCAKeysMappings(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	_, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+	sameCAKeyFile := path.Join(testRoot, "same_ca.pub")
+	require.NoError(t, os.WriteFile(sameCAKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	keySet, err := parseTrustedUserCAKeys([]config.TrustedUserCAKeyConfig{
+		{File: caKeyFile, UsernameFrom: "first_principal"},
+		{File: sameCAKeyFile, UsernameFrom: "first_principal"},
+	})
+	require.NoError(t, err)
+	require.Len(t, keySet, 1)
+	require.True(t, keySet[string(caPubKey.Marshal())].fromPrincipals)
+
+	_, err = parseTrustedUserCAKeys([]config.TrustedUserCAKeyConfig{
+		{File: caKeyFile},
+		{File: sameCAKeyFile, UsernameFrom: "first_principal"},
+	})
+	require.EqualError(t, err, fmt.Sprintf("trusted user CA key in file %q is already trusted with a different identity mapping", sameCAKeyFile))
+
+	_, err = parseTrustedUserCAKeys([]config.TrustedUserCAKeyConfig{
+		{File: caKeyFile, UsernameFrom: "email"},
+	})
+	require.EqualError(t, err, fmt.Sprintf("invalid identity mapping of trusted user CA key file %q: unknown username_from \"email\"", caKeyFile))
+}
+
 func TestIsLocallyTrustedCA(t *testing.T) {
 	_, caPubKey := createCAKeyPair(t)
 	_, otherPubKey := createCAKeyPair(t)
 
 	cfg := &serverConfig{
-		trustedUserCAKeySet: map[string]struct{}{
+		trustedUserCAKeys: map[string]certIdentityMapping{
 			string(caPubKey.Marshal()): {},
 		},
 	}
@@ -634,7 +672,7 @@ func TestIsLocallyTrustedCA(t *testing.T) {
 
 	// Test with empty trusted keys
 	emptyCfg := &serverConfig{
-		trustedUserCAKeySet: map[string]struct{}{},
+		trustedUserCAKeys: map[string]certIdentityMapping{},
 	}
 	require.False(t, emptyCfg.isLocallyTrustedCA(caPubKey))
 
@@ -708,7 +746,9 @@ func TestUserCertificateHandling_InstanceLevel(t *testing.T) {
 	dottedKeyIDCert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "jane.doe")
 	consecutiveSpecialsCert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "user..name")
 	sourceAddrCert := userCertSignedByCAWithOptions(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2, map[string]string{sourceAddressExt: "10.0.0.0/8,192.168.1.0/24"})
-	multiOptionsCert := userCertSignedByCAWithOptions(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2, map[string]string{sourceAddressExt: "10.0.0.1", "force-command": "/usr/bin/git"})
+	forceCommandCert := userCertSignedByCAWithOptions(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2, map[string]string{"force-command": "git-upload-pack"})
+	emptyForceCommandCert := userCertSignedByCAWithOptions(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2, map[string]string{"force-command": ""})
+	multiOptionsCert := userCertSignedByCAWithOptions(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2, map[string]string{sourceAddressExt: "10.0.0.1", "restrict-to@example.com": "ci"})
 
 	srvCfg := config.ServerConfig{
 		Listen:                  localhostIP,
@@ -724,7 +764,7 @@ func TestUserCertificateHandling_InstanceLevel(t *testing.T) {
 	require.NoError(t, err)
 
 	// Add the trusted CA
-	cfg.trustedUserCAKeySet = map[string]struct{}{
+	cfg.trustedUserCAKeys = map[string]certIdentityMapping{
 		string(caPubKey.Marshal()): {},
 	}
 
@@ -740,6 +780,7 @@ func TestUserCertificateHandling_InstanceLevel(t *testing.T) {
 			expectedPermissions: &ssh.Permissions{
 				Extensions: map[string]string{
 					certPermUsername: testUser2,
+					certPermNoPTY:    "",
 				},
 			},
 		},
@@ -749,6 +790,7 @@ func TestUserCertificateHandling_InstanceLevel(t *testing.T) {
 			expectedPermissions: &ssh.Permissions{
 				Extensions: map[string]string{
 					certPermUsername: "jane.doe",
+					certPermNoPTY:    "",
 				},
 			},
 		},
@@ -799,13 +841,31 @@ func TestUserCertificateHandling_InstanceLevel(t *testing.T) {
 				CriticalOptions: map[string]string{sourceAddressExt: "10.0.0.0/8,192.168.1.0/24"},
 				Extensions: map[string]string{
 					certPermUsername: testUser2,
+					certPermNoPTY:    "",
+				},
+			},
+		},
+		{
+			desc: "valid instance-level certificate with force-command",
+			cert: forceCommandCert,
+			expectedPermissions: &ssh.Permissions{
+				CriticalOptions: map[string]string{"force-command": "git-upload-pack"},
+				Extensions: map[string]string{
+					certPermUsername: testUser2,
+					certPermCommands: "git-upload-pack",
+					certPermNoPTY:    "",
 				},
 			},
 		},
+		{
+			desc:        "instance-level certificate with an empty force-command is rejected",
+			cert:        emptyForceCommandCert,
+			expectedErr: "handleUserCertificate: certificate has an empty force-command",
+		},
 		{
 			desc:        "instance-level certificate with unsupported critical option is rejected",
 			cert:        multiOptionsCert,
-			expectedErr: `ssh: unsupported critical option "force-command" in certificate`,
+			expectedErr: `ssh: unsupported critical option "restrict-to@example.com" in certificate`,
 		},
 	}
 
@@ -847,7 +907,7 @@ func TestUserCertificateHandling_InstanceLevelWithMultipleCAs(t *testing.T) {
 	require.NoError(t, err)
 
 	// Add both trusted CAs
-	cfg.trustedUserCAKeySet = map[string]struct{}{
+	cfg.trustedUserCAKeys = map[string]certIdentityMapping{
 		string(caPubKey1.Marshal()): {},
 		string(caPubKey2.Marshal()): {},
 	}
@@ -856,12 +916,270 @@ func TestUserCertificateHandling_InstanceLevelWithMultipleCAs(t *testing.T) {
 	permissions1, err := cfg.handleUserCertificate(context.Background(), testUser, certFromCA1)
 	require.NoError(t, err)
 	require.Equal(t, &ssh.Permissions{
-		Extensions: map[string]string{certPermUsername: "user1"},
+		Extensions: map[string]string{certPermUsername: "user1", certPermNoPTY: ""},
 	}, permissions1)
 
 	permissions2, err := cfg.handleUserCertificate(context.Background(), testUser, certFromCA2)
 	require.NoError(t, err)
 	require.Equal(t, &ssh.Permissions{
-		Extensions: map[string]string{certPermUsername: "user2"},
+		Extensions: map[string]string{certPermUsername: "user2", certPermNoPTY: ""},
 	}, permissions2)
 }
+
+func TestUserCertificateHandling_PrincipalMapping(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caSigner, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	srvCfg := config.ServerConfig{
+		Listen:                  localhostIP,
+		ConcurrentSessionsLimit: 1,
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{
+			File:              caKeyFile,
+			UsernameFrom:      "principal",
+			PrincipalTemplate: "{username}@corp.example.com",
+			Rewrite:           &config.UsernameRewriteConfig{Pattern: `^(.+)\.admin$`, Replacement: "$1"},
+		}},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: localhostURL, User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	certWithPrincipals := func(keyID string, principals ...string) *ssh.Certificate {
+		cert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), keyID)
+		cert.ValidPrincipals = principals
+		require.NoError(t, cert.SignCert(rand.Reader, caSigner))
+
+		return cert
+	}
+
+	testCases := []struct {
+		desc             string
+		user             string
+		cert             *ssh.Certificate
+		expectedUsername string
+		expectedErr      string
+	}{
+		{
+			desc:             "principal matching the template",
+			user:             testUser,
+			cert:             certWithPrincipals("ticket-1234", "ops", "jane.admin@corp.example.com"),
+			expectedUsername: "jane",
+		},
+		{
+			desc:        "no principal matching the template",
+			user:        testUser,
+			cert:        certWithPrincipals("jane", "jane", testUser),
+			expectedErr: `handleUserCertificate: certificate has no principal matching "{username}@corp.example.com"`,
+		},
+		{
+			desc:        "principal not matching the rewrite pattern",
+			user:        testUser,
+			cert:        certWithPrincipals("jane", "jane@corp.example.com"),
+			expectedErr: `handleUserCertificate: certificate username "jane" doesn't match the rewrite pattern`,
+		},
+		{
+			desc:        "invalid username",
+			user:        testUser,
+			cert:        certWithPrincipals("jane", "-jane.admin@corp.example.com"),
+			expectedErr: "handleUserCertificate: " + keyIDFormatErr,
+		},
+		{
+			desc:        "other SSH user",
+			user:        "jane.admin@corp.example.com",
+			cert:        certWithPrincipals("jane", "jane.admin@corp.example.com"),
+			expectedErr: "handleUserCertificate: unknown user",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			permissions, err := cfg.handleUserCertificate(context.Background(), tc.user, tc.cert)
+			if tc.expectedErr != "" {
+				require.EqualError(t, err, tc.expectedErr)
+				require.Nil(t, permissions)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, &ssh.Permissions{
+				Extensions: map[string]string{certPermUsername: tc.expectedUsername, certPermNoPTY: ""},
+			}, permissions)
+		})
+	}
+}
+
+func TestUserCertificateHandling_PinnedNamespaces(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caSigner, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	srvCfg := config.ServerConfig{
+		Listen:                  localhostIP,
+		ConcurrentSessionsLimit: 1,
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile, Namespaces: []string{"payments", "shared/tools"}}},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: localhostURL, User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	cert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), testUser2)
+	permissions, err := cfg.handleUserCertificate(context.Background(), testUser, cert)
+	require.NoError(t, err)
+	require.Equal(t, &ssh.Permissions{
+		Extensions: map[string]string{
+			certPermUsername:  testUser2,
+			certPermNamespace: "payments,shared/tools",
+			certPermNoPTY:     "",
+		},
+	}, permissions)
+	require.Equal(t, []string{"payments", "shared/tools"}, certNamespaces(permissions.Extensions))
+}
+
+func TestCertNamespaces(t *testing.T) {
+	require.Nil(t, certNamespaces(map[string]string{certPermUsername: testUser2}))
+	require.Equal(t, []string{"group"}, certNamespaces(map[string]string{certPermNamespace: "group"}))
+}
+
+func TestUserCertificateHandling_Revoked(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caSigner, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	revokedCert := userCertWithSerial(t, caSigner, 42)
+	validCert := userCertWithSerial(t, caSigner, 43)
+
+	revokedKeysFile := writeRevokedKeys(t, buildKRL(
+		krlCertSection(caPubKey, krlSection(krlSectionCertSerialList, krlUint64(42))),
+	))
+
+	srvCfg := config.ServerConfig{
+		Listen:                  localhostIP,
+		ConcurrentSessionsLimit: 1,
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile}},
+		RevokedKeys:       []string{revokedKeysFile},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: localhostURL, User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	permissions, err := cfg.handleUserCertificate(context.Background(), testUser, revokedCert)
+	require.EqualError(t, err, "handleUserCertificate: certificate is revoked")
+	require.Nil(t, permissions)
+
+	permissions, err = cfg.handleUserCertificate(context.Background(), testUser, validCert)
+	require.NoError(t, err)
+	require.Equal(t, &ssh.Permissions{
+		Extensions: map[string]string{certPermUsername: "alice", certPermNoPTY: ""},
+	}, permissions)
+}
+
+func TestNewServerConfig_FailsOnBadRevokedKeysFile(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	srvCfg := config.ServerConfig{
+		Listen:                  localhostIP,
+		ConcurrentSessionsLimit: 1,
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		RevokedKeys: []string{"/nonexistent/revoked_keys"},
+	}
+
+	_, err := newServerConfig(
+		&config.Config{GitlabURL: localhostURL, User: testUser, Server: srvCfg},
+	)
+	require.ErrorContains(t, err, "failed to load revoked keys")
+}
+
+type fakeConnMetadata struct {
+	ssh.ConnMetadata
+
+	user string
+}
+
+func (f fakeConnMetadata) User() string {
+	return f.user
+}
+
+func TestUserKeyHandlingWithCache(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	validRSAKey := rsaPublicKey(t)
+	unknownRSAKey := rsaPublicKey(t)
+
+	var requestCount atomic.Int32
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				requestCount.Add(1)
+
+				key := base64.RawStdEncoding.EncodeToString(validRSAKey.Marshal())
+				if key == r.URL.Query().Get("key") {
+					w.Write([]byte(`{ "id": 1, "key": "key" }`))
+				} else {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			},
+		},
+	}
+
+	url := testserver.StartSocketHTTPServer(t, requests)
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{
+			path.Join(testRoot, "certs/valid/server.key"),
+		},
+		AuthorizedKeysCache: config.AuthorizedKeysCacheConfig{
+			Size:        10,
+			TTL:         config.YamlDuration(time.Minute),
+			NegativeTTL: config.YamlDuration(time.Minute),
+		},
+	}
+
+	cfg, err := newServerConfig(
+		&config.Config{GitlabURL: url, User: testUser, Server: srvCfg},
+	)
+	require.NoError(t, err)
+
+	for range 3 {
+		permissions, err := cfg.handleUserKey(context.Background(), testUser, validRSAKey)
+		require.NoError(t, err)
+		require.Equal(t, &ssh.Permissions{Extensions: map[string]string{"key-id": "1"}}, permissions)
+
+		_, err = cfg.handleUserKey(context.Background(), testUser, unknownRSAKey)
+		var apiErr *client.APIError
+		require.ErrorAs(t, err, &apiErr)
+		require.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+
+	require.Equal(t, int32(2), requestCount.Load())
+
+	cfg.authorizedKeysCache.flush()
+
+	_, err = cfg.handleUserKey(context.Background(), testUser, validRSAKey)
+	require.NoError(t, err)
+	require.Equal(t, int32(3), requestCount.Load())
+}
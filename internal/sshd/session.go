@@ -5,8 +5,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"gitlab.com/gitlab-org/labkit/v2/log"
@@ -16,6 +20,7 @@ import (
 
 	shellCmd "gitlab.com/gitlab-org/gitlab-shell/v14/cmd/gitlab-shell/command"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/readwriter"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/shared/disallowedcommand"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
@@ -31,13 +36,33 @@ type session struct {
 	gitlabKeyID         string
 	gitlabKrb5Principal string
 	gitlabUsername      string
-	namespace           string
+	namespaces          []string
+	certPolicy          certPolicy
+	userPresence        bool
 	remoteAddr          string
+	conn                *connection
+	userBandwidth       *userBandwidthLimiters
+	envAllowlist        *envAllowlist
+	authorizedKeysCache *authorizedKeysCache
 
 	// State managed by the session
 	execCmd            string
 	gitProtocolVersion string
+	outputFormat       string
+	envVariables       []sshenv.Variable
 	started            time.Time
+
+	// The pseudo-terminal of the interactive shell. ptyColumns changes while
+	// the shell runs.
+	ptyTerm    string
+	ptyColumns atomic.Uint32
+
+	// The command being run, reported on the admin endpoints. Only
+	// writtenBytes changes once the session is tracked by its connection.
+	commandType    commandargs.CommandType
+	repository     string
+	commandStarted time.Time
+	writtenBytes   atomic.Int64
 }
 
 type execRequest struct {
@@ -76,23 +101,17 @@ func (s *session) handle(ctx context.Context, requests <-chan *ssh.Request) (con
 			// The command has been executed as `ssh user@host command` or `exec` channel has been used
 			// in the app implementation
 			shouldContinue = false
-			ctxWithLogData, err = s.handleExec(ctx, req)
+			ctxWithLogData, err = s.handleExec(ctx, req, requests)
 		case "shell":
 			// The command has been entered into the shell or `shell` channel has been used
 			// in the app implementation
 			shouldContinue = false
 			var status uint32
-			ctxWithLogData, status, err = s.handleShell(ctx, req)
+			ctxWithLogData, status, err = s.handleShell(ctx, req, requests)
 			s.exit(ctx, status)
 		default:
-			// Ignore unknown requests but don't terminate the session
 			shouldContinue = true
-
-			if req.WantReply {
-				if err = req.Reply(false, []byte{}); err != nil {
-					log.FromContext(ctx).DebugContext(ctx, "session: handle: Failed to reply", log.ErrorMessage(err.Error()))
-				}
-			}
+			err = s.handleOtherRequest(ctx, req)
 		}
 
 		log.FromContext(ctx).DebugContext(ctx, "session: handle: request processed", slog.Bool("should_continue", shouldContinue))
@@ -108,6 +127,27 @@ func (s *session) handle(ctx context.Context, requests <-chan *ssh.Request) (con
 	return ctxWithLogData, err
 }
 
+// handleOtherRequest handles the requests that don't start a command. None of
+// them terminates the session.
+func (s *session) handleOtherRequest(ctx context.Context, req *ssh.Request) error {
+	switch req.Type {
+	case "pty-req":
+		return s.handlePTYRequest(ctx, req)
+	case "window-change":
+		s.handleWindowChange(ctx, req)
+	default:
+		// Ignore unknown requests
+		if req.WantReply {
+			if err := req.Reply(false, []byte{}); err != nil {
+				log.FromContext(ctx).DebugContext(ctx, "session: handle: Failed to reply", log.ErrorMessage(err.Error()))
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
 func (s *session) handleEnv(ctx context.Context, req *ssh.Request) (bool, error) {
 	var accepted bool
 	var envReq envRequest
@@ -121,8 +161,11 @@ func (s *session) handleEnv(ctx context.Context, req *ssh.Request) (bool, error)
 	case sshenv.GitProtocolEnv:
 		s.gitProtocolVersion = envReq.Value
 		accepted = true
+	case sshenv.OutputFormatEnv:
+		s.outputFormat = envReq.Value
+		accepted = true
 	default:
-		// Client requested a forbidden envvar, nothing to do
+		accepted = s.acceptEnv(ctx, envReq)
 	}
 
 	if req.WantReply {
@@ -139,7 +182,7 @@ func (s *session) handleEnv(ctx context.Context, req *ssh.Request) (bool, error)
 	return true, nil
 }
 
-func (s *session) handleExec(ctx context.Context, req *ssh.Request) (context.Context, error) {
+func (s *session) handleExec(ctx context.Context, req *ssh.Request, requests <-chan *ssh.Request) (context.Context, error) {
 	var execReq execRequest
 
 	if err := ssh.Unmarshal(req.Payload, &execReq); err != nil {
@@ -148,34 +191,134 @@ func (s *session) handleExec(ctx context.Context, req *ssh.Request) (context.Con
 
 	s.execCmd = execReq.Command
 
-	ctxWithLogData, status, err := s.handleShell(ctx, req)
+	ctxWithLogData, status, err := s.handleShell(ctx, req, requests)
 	s.exit(ctxWithLogData, status)
 
 	return ctxWithLogData, err
 }
 
-func (s *session) handleShell(ctx context.Context, req *ssh.Request) (context.Context, uint32, error) {
+// handleShell runs the command of the session, or the interactive shell when
+// the client asked for a PTY. The requests that follow, which may cancel it,
+// are handled while it runs.
+func (s *session) handleShell(ctx context.Context, req *ssh.Request, requests <-chan *ssh.Request) (context.Context, uint32, error) {
 	if req.WantReply {
 		if err := req.Reply(true, []byte{}); err != nil {
 			slog.DebugContext(ctx, "session: handleShell: Failed to reply", log.ErrorMessage(err.Error()))
 		}
 	}
 
-	env := sshenv.Env{
-		IsSSHConnection:    true,
-		OriginalCommand:    s.execCmd,
-		GitProtocolVersion: s.gitProtocolVersion,
-		RemoteAddr:         s.remoteAddr,
-		NamespacePath:      s.namespace,
+	ctx, syncRequests, stop := s.watchSignals(ctx, requests)
+	defer stop()
+
+	if s.interactive() {
+		return s.runMenu(ctx, syncRequests)
 	}
 
-	countingWriter := &readwriter.CountingWriter{W: s.channel}
+	return s.runCommand(ctx)
+}
+
+// gitChannelCommands are the commands gitlab-git@gitlab.com channels run: the
+// ones transferring pack data or archives.
+var gitChannelCommands = []commandargs.CommandType{
+	commandargs.UploadPack,
+	commandargs.ReceivePack,
+	commandargs.UploadArchive,
+}
+
+// handleGitChannel runs the command carried by a gitlab-git@gitlab.com channel
+// open request. There are no env or exec requests on such a channel: the Git
+// protocol version is part of the open request too. Commands other than the Git
+// ones are refused, like unknown commands are.
+func (s *session) handleGitChannel(ctx context.Context, req gitChannelRequest) (context.Context, error) {
+	s.execCmd = req.Command
+	s.gitProtocolVersion = req.GitProtocolVersion
+
+	var ctxWithLogData context.Context
+	var status uint32
+	var err error
+	if err = checkGitChannelCommand(req.Command); err != nil {
+		ctxWithLogData, status, err = s.handleCommandError(ctx, err)
+	} else {
+		ctxWithLogData, status, err = s.runCommand(ctx)
+	}
+	s.exit(ctxWithLogData, status)
+	_ = s.channel.Close()
+
+	return ctxWithLogData, err
+}
+
+// checkGitChannelCommand returns an error unless command is one of the
+// gitChannelCommands.
+func checkGitChannelCommand(command string) error {
+	args := &commandargs.Shell{}
+	if err := args.ParseCommand(command); err != nil {
+		return fmt.Errorf("Invalid SSH command: %w", err) //nolint:staticcheck // message is customer facing
+	}
+
+	if !slices.Contains(gitChannelCommands, args.CommandType) {
+		return disallowedcommand.Error
+	}
+
+	return nil
+}
+
+// commandEnv returns the environment the command of the session runs in.
+func (s *session) commandEnv() sshenv.Env {
+	return sshenv.Env{
+		IsSSHConnection:          true,
+		OriginalCommand:          s.execCmd,
+		GitProtocolVersion:       s.gitProtocolVersion,
+		RemoteAddr:               s.remoteAddr,
+		NamespacePath:            s.namespacePath(),
+		OutputFormat:             s.outputFormat,
+		AllowedCommands:          s.certPolicy.commands,
+		ReadOnly:                 s.certPolicy.readOnly,
+		AllowedProjects:          s.certPolicy.projects,
+		SecurityKeyUserPresence:  s.userPresence,
+		PushRequiresUserPresence: s.cfg != nil && s.cfg.Server.SecurityKeys.RequireUserPresenceForPush,
+		Variables:                s.envVariables,
+	}
+}
+
+// namespacePath returns the namespace the command of the session is restricted
+// to, if any. When the certificate is pinned to several namespaces, it's the
+// one containing the repository the command accesses, or the first one if none
+// does, which GitLab then denies.
+func (s *session) namespacePath() string {
+	if len(s.namespaces) == 0 {
+		return ""
+	}
+
+	args := &commandargs.Shell{}
+	if len(s.namespaces) > 1 && args.ParseCommand(s.execCmd) == nil && len(args.SSHArgs) > 1 {
+		repo := strings.TrimPrefix(args.SSHArgs[1], "/")
+		for _, namespace := range s.namespaces {
+			if len(repo) > len(namespace) && strings.EqualFold(repo[:len(namespace)+1], namespace+"/") {
+				return namespace
+			}
+		}
+	}
+
+	return s.namespaces[0]
+}
+
+func (s *session) runCommand(ctx context.Context) (context.Context, uint32, error) {
+	env := s.commandEnv()
+
+	s.setCommand()
+	throttled, releaseThrottle := s.throttle(ctx)
+	defer releaseThrottle()
+
+	countingWriter := &readwriter.CountingWriter{W: &liveCountingWriter{w: throttled, n: &s.writtenBytes}}
 
 	rw := &readwriter.ReadWriter{
 		Out:    countingWriter,
 		In:     s.channel,
 		ErrOut: s.channel.Stderr(),
 	}
+	if s.ptyTerm != "" {
+		rw = newPTYReadWriter(ctx, s.channel, rw)
+	}
 
 	cmd, err := s.getCommand(env, rw)
 
@@ -193,20 +336,17 @@ func (s *session) handleShell(ctx context.Context, req *ssh.Request) (context.Co
 	)
 	metrics.SshdSessionEstablishedDuration.Observe(establishSessionDuration)
 
-	ctxWithLogData, err := cmd.Execute(ctx)
+	s.conn.trackSession(s)
+	defer s.conn.untrackSession(s)
 
-	logData := extractLogDataFromContext(ctxWithLogData)
-	logData.WrittenBytes = countingWriter.N
+	ctxWithLogData, err := cmd.Execute(ctx)
+	s.evictChangedKey(ctxWithLogData)
 
+	logData := s.commandLogData(ctxWithLogData, countingWriter.N, throttled.throttled)
 	ctxWithLogData = context.WithValue(ctx, logInfo{}, logData)
 
 	if err != nil {
-		grpcStatus := grpcstatus.Convert(err)
-		if grpcStatus.Code() != grpccodes.Internal {
-			s.toStderr(ctx, "ERROR: %v\n", grpcStatus.Message())
-		}
-
-		return ctx, 1, err
+		return s.handleExecuteError(ctx, ctxWithLogData, err)
 	}
 
 	log.FromContext(ctx).InfoContext(ctx, "session: handleShell: command executed successfully")
@@ -214,6 +354,95 @@ func (s *session) handleShell(ctx context.Context, req *ssh.Request) (context.Co
 	return ctxWithLogData, 0, nil
 }
 
+// setCommand records the type of the command being run, and the repository it
+// runs on for Git commands.
+func (s *session) setCommand() {
+	s.commandStarted = time.Now()
+
+	args := &commandargs.Shell{}
+	if err := args.ParseCommand(s.execCmd); err != nil {
+		return
+	}
+
+	s.commandType = args.CommandType
+
+	if len(args.SSHArgs) > 1 && (slices.Contains(commandargs.GitCommands, args.CommandType) || args.CommandType == commandargs.LfsTransfer) {
+		s.repository = args.SSHArgs[1]
+	}
+}
+
+// throttle returns a writer to the channel that applies the bandwidth limits
+// of the command being run, and a function that releases the per-user limit
+// once the command is done.
+func (s *session) throttle(ctx context.Context) (*throttledWriter, func()) {
+	perSession, perUser, ownPerUser := s.cfg.Server.BandwidthLimits.ForCommand(string(s.commandType))
+
+	// The sessions of a user share a limit, unless the command type has a
+	// per-user limit of its own.
+	key := s.userKey()
+	if ownPerUser {
+		key += " " + string(s.commandType)
+	}
+
+	userLimiter := s.userBandwidth.acquire(key, perUser)
+	release := func() {
+		if userLimiter != nil {
+			s.userBandwidth.release(key)
+		}
+	}
+
+	return newThrottledWriter(ctx, s.channel, newByteLimiter(perSession), userLimiter), release
+}
+
+// userKey identifies the user the session authenticated as. Users who
+// authenticated with a key are told apart by key, since their username is only
+// known once the command has been checked by GitLab.
+func (s *session) userKey() string {
+	switch {
+	case s.gitlabKrb5Principal != "":
+		return "krb5principal:" + s.gitlabKrb5Principal
+	case s.gitlabUsername != "":
+		return "username:" + s.gitlabUsername
+	default:
+		return "key:" + s.gitlabKeyID
+	}
+}
+
+// commandLogData completes the log data of a command that ran, and records
+// how it went.
+func (s *session) commandLogData(ctxWithLogData context.Context, written int64, throttled time.Duration) command.LogData {
+	logData := extractLogDataFromContext(ctxWithLogData)
+	logData.WrittenBytes = written
+	logData.ThrottledDuration = throttled
+
+	s.conn.setUsername(logData.Username)
+
+	if throttled > 0 {
+		metrics.SshdBandwidthThrottledSessionsTotal.WithLabelValues(string(s.commandType)).Inc()
+		metrics.SshdBandwidthThrottledSecondsTotal.WithLabelValues(string(s.commandType)).Add(throttled.Seconds())
+	}
+
+	return logData
+}
+
+// handleExecuteError reports a command that failed. A command canceled by a
+// signal from the client isn't an error: it exits with the status of the
+// signal.
+func (s *session) handleExecuteError(ctx, ctxWithLogData context.Context, err error) (context.Context, uint32, error) {
+	if sigErr := canceledBySignal(ctx); sigErr != nil {
+		log.FromContext(ctx).InfoContext(ctx, "session: handleShell: command canceled", slog.String("signal", sigErr.signal))
+
+		return ctxWithLogData, sigErr.exitStatus(), nil
+	}
+
+	grpcStatus := grpcstatus.Convert(err)
+	if grpcStatus.Code() != grpccodes.Internal {
+		s.toStderr(ctx, "ERROR: %v\n", grpcStatus.Message())
+	}
+
+	return ctx, 1, err
+}
+
 func (s *session) handleCommandError(ctx context.Context, err error) (context.Context, uint32, error) {
 	if errors.Is(err, disallowedcommand.Error) {
 		s.toStderr(ctx, "ERROR: Unknown command: %v\n", s.execCmd)
@@ -253,3 +482,17 @@ func (s *session) exit(ctx context.Context, status uint32) {
 	_ = s.channel.CloseWrite()
 	_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(req))
 }
+
+// liveCountingWriter counts the bytes written to w, like
+// readwriter.CountingWriter, but can be read while the command is running.
+type liveCountingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw *liveCountingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+
+	return n, err
+}
@@ -7,13 +7,16 @@ import (
 	"io"
 	"net/http"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 
 	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
 	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
 )
 
 const discoverCmd = "discover"
@@ -67,6 +70,7 @@ func TestHandleEnv(t *testing.T) {
 		payload                 []byte
 		expectedErr             error
 		expectedProtocolVersion string
+		expectedOutputFormat    string
 		expectedResult          bool
 	}{
 		{
@@ -87,6 +91,13 @@ func TestHandleEnv(t *testing.T) {
 			expectedErr:             nil,
 			expectedProtocolVersion: "1",
 			expectedResult:          true,
+		}, {
+			desc:                    "valid payload with output format",
+			payload:                 ssh.Marshal(envRequest{Name: "GL_OUTPUT_FORMAT", Value: "json"}),
+			expectedErr:             nil,
+			expectedProtocolVersion: "1",
+			expectedOutputFormat:    "json",
+			expectedResult:          true,
 		},
 	}
 
@@ -100,6 +111,7 @@ func TestHandleEnv(t *testing.T) {
 			require.Equal(t, tc.expectedErr, err)
 			require.Equal(t, tc.expectedResult, shouldContinue)
 			require.Equal(t, tc.expectedProtocolVersion, s.gitProtocolVersion)
+			require.Equal(t, tc.expectedOutputFormat, s.outputFormat)
 		})
 	}
 }
@@ -155,7 +167,7 @@ func TestHandleExec(t *testing.T) {
 
 				s.channel = f
 				shouldContinue := false
-				_, err := s.handleExec(context.Background(), r)
+				_, err := s.handleExec(context.Background(), r, nil)
 
 				require.Equal(t, tc.expectedErr, err)
 				require.False(t, shouldContinue)
@@ -227,7 +239,7 @@ func TestHandleShell(t *testing.T) {
 			}
 			r := &ssh.Request{}
 
-			ctxWithLogData, exitCode, err := s.handleShell(context.Background(), r)
+			ctxWithLogData, exitCode, err := s.handleShell(context.Background(), r, nil)
 
 			logInfo := extractLogDataFromContext(ctxWithLogData)
 
@@ -252,3 +264,201 @@ func TestHandleShell(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleGitChannelRefusesOtherCommands(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		cmd    string
+		errMsg string
+	}{
+		{desc: "discover", cmd: discoverCmd, errMsg: "ERROR: Unknown command: discover\n"},
+		{desc: "empty command", cmd: "", errMsg: "ERROR: Unknown command: \n"},
+		{desc: "personal_access_token", cmd: "personal_access_token test api", errMsg: "ERROR: Unknown command: personal_access_token test api\n"},
+		{desc: "2fa_recovery_codes", cmd: "2fa_recovery_codes", errMsg: "ERROR: Unknown command: 2fa_recovery_codes\n"},
+		{desc: "2fa_verify", cmd: "2fa_verify", errMsg: "ERROR: Unknown command: 2fa_verify\n"},
+		{desc: "ssh_keys add", cmd: "ssh_keys add laptop", errMsg: "ERROR: Unknown command: ssh_keys add laptop\n"},
+		{desc: "ssh_keys delete", cmd: "ssh_keys delete SHA256:abc", errMsg: "ERROR: Unknown command: ssh_keys delete SHA256:abc\n"},
+		{desc: "verify_signature", cmd: "verify_signature", errMsg: "ERROR: Unknown command: verify_signature\n"},
+		{desc: "git-lfs-authenticate", cmd: "git-lfs-authenticate group/project download", errMsg: "ERROR: Unknown command: git-lfs-authenticate group/project download\n"},
+		{desc: "unparsable command", cmd: `\`, errMsg: "ERROR: Failed to parse command: Invalid SSH command: invalid command line string\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			stdErr := &bytes.Buffer{}
+			channel := &fakeChannel{stdErr: stdErr, stdOut: &bytes.Buffer{}}
+			// No GitLab URL: the command must be refused before reaching it
+			s := &session{gitlabKeyID: rootUser, channel: channel, cfg: &config.Config{}}
+
+			_, err := s.handleGitChannel(context.Background(), gitChannelRequest{Command: tc.cmd})
+			require.Error(t, err)
+
+			formattedErr := &bytes.Buffer{}
+			console.DisplayWarningMessage(tc.errMsg, formattedErr)
+			require.Equal(t, formattedErr.String(), stdErr.String())
+
+			require.Equal(t, "exit-status", channel.sentRequestName)
+			require.Equal(t, ssh.Marshal(exitStatusReq{ExitStatus: 128}), channel.sentRequestPayload)
+		})
+	}
+}
+
+func TestHandleShellBandwidthLimits(t *testing.T) {
+	url := testserver.StartHTTPServer(t, requests)
+
+	cfg := &config.Config{GitlabURL: url}
+	cfg.Server.BandwidthLimits = config.BandwidthLimitsConfig{
+		PerUser: config.BandwidthLimitConfig{Rate: 1000, Burst: 10},
+	}
+
+	initialThrottled := testutil.ToFloat64(metrics.SshdBandwidthThrottledSessionsTotal.WithLabelValues(discoverCmd))
+
+	stdOut := &bytes.Buffer{}
+	userBandwidth := &userBandwidthLimiters{}
+	s := &session{
+		gitlabKeyID:   rootUser,
+		execCmd:       discoverCmd,
+		channel:       &fakeChannel{stdErr: &bytes.Buffer{}, stdOut: stdOut},
+		cfg:           cfg,
+		userBandwidth: userBandwidth,
+	}
+
+	ctxWithLogData, exitCode, err := s.handleShell(context.Background(), &ssh.Request{}, nil)
+	require.NoError(t, err)
+	require.Zero(t, exitCode)
+	require.Equal(t, "Welcome to GitLab, @test-user!\n", stdOut.String())
+
+	// 31 bytes at 1000 bytes per second, of which 10 are sent at once
+	logInfo := extractLogDataFromContext(ctxWithLogData)
+	require.Equal(t, int64(31), logInfo.WrittenBytes)
+	require.Positive(t, logInfo.ThrottledDuration)
+	require.LessOrEqual(t, logInfo.ThrottledDuration, 21*time.Millisecond)
+	require.InDelta(t, initialThrottled+1, testutil.ToFloat64(metrics.SshdBandwidthThrottledSessionsTotal.WithLabelValues(discoverCmd)), 0.1)
+
+	// The per-user limit is released with the session
+	require.Empty(t, userBandwidth.limiters)
+}
+
+func TestSessionThrottle(t *testing.T) {
+	perUser := config.BandwidthLimitConfig{Rate: 1000}
+	cfg := &config.Config{}
+	cfg.Server.BandwidthLimits = config.BandwidthLimitsConfig{
+		PerSession: config.BandwidthLimitConfig{Rate: 2000},
+		PerUser:    perUser,
+		Commands: map[string]config.CommandBandwidthLimitsConfig{
+			"git-upload-archive": {PerUser: &perUser},
+		},
+	}
+	userBandwidth := &userBandwidthLimiters{}
+
+	newSession := func(execCmd string) *session {
+		s := &session{cfg: cfg, gitlabKeyID: "1", execCmd: execCmd, userBandwidth: userBandwidth}
+		s.setCommand()
+
+		return s
+	}
+
+	fetch, releaseFetch := newSession("git-upload-pack group/project.git").throttle(context.Background())
+	clone, releaseClone := newSession("git-upload-pack group/other.git").throttle(context.Background())
+	archive, releaseArchive := newSession("git-upload-archive group/project.git").throttle(context.Background())
+
+	// Each session has a limit of its own, and shares the per-user one with the
+	// other sessions of the same command type
+	require.Len(t, fetch.limiters, 2)
+	require.NotSame(t, fetch.limiters[0], clone.limiters[0])
+	require.Same(t, fetch.limiters[1], clone.limiters[1])
+	require.NotSame(t, fetch.limiters[1], archive.limiters[1])
+	require.Len(t, userBandwidth.limiters, 2)
+
+	releaseFetch()
+	require.Len(t, userBandwidth.limiters, 2)
+
+	releaseClone()
+	releaseArchive()
+	require.Empty(t, userBandwidth.limiters)
+}
+
+func TestCommandEnvWithCertPolicy(t *testing.T) {
+	s := &session{
+		execCmd:    "git-upload-pack group/project",
+		namespaces: []string{"group"},
+		certPolicy: certPolicy{
+			commands: []string{"git-upload-pack"},
+			readOnly: true,
+			projects: []string{"group/project"},
+		},
+	}
+
+	env := s.commandEnv()
+	require.Equal(t, []string{"git-upload-pack"}, env.AllowedCommands)
+	require.True(t, env.ReadOnly)
+	require.Equal(t, []string{"group/project"}, env.AllowedProjects)
+	require.Equal(t, "group", env.NamespacePath)
+}
+
+func TestCommandEnvSecurityKeyUserPresence(t *testing.T) {
+	s := &session{execCmd: "git-receive-pack group/project"}
+	env := s.commandEnv()
+	require.False(t, env.SecurityKeyUserPresence)
+	require.False(t, env.PushRequiresUserPresence)
+
+	s.userPresence = true
+	s.cfg = &config.Config{Server: config.ServerConfig{
+		SecurityKeys: config.SecurityKeysConfig{RequireUserPresenceForPush: true},
+	}}
+	env = s.commandEnv()
+	require.True(t, env.SecurityKeyUserPresence)
+	require.True(t, env.PushRequiresUserPresence)
+}
+
+func TestCommandEnvNamespacePath(t *testing.T) {
+	testCases := []struct {
+		desc                  string
+		namespaces            []string
+		execCmd               string
+		expectedNamespacePath string
+	}{
+		{
+			desc:    "no namespace",
+			execCmd: "git-upload-pack group/project",
+		},
+		{
+			desc:                  "one namespace",
+			namespaces:            []string{"group"},
+			execCmd:               "git-upload-pack other/project",
+			expectedNamespacePath: "group",
+		},
+		{
+			desc:                  "namespace containing the repository",
+			namespaces:            []string{"group", "other/sub"},
+			execCmd:               "git upload-pack '/Other/Sub/project.git'",
+			expectedNamespacePath: "other/sub",
+		},
+		{
+			desc:                  "no namespace containing the repository",
+			namespaces:            []string{"group", "other/sub"},
+			execCmd:               "git-receive-pack other/project",
+			expectedNamespacePath: "group",
+		},
+		{
+			desc:                  "namespace prefixing the name of another one",
+			namespaces:            []string{"group", "other"},
+			execCmd:               "git-upload-pack other-group/project",
+			expectedNamespacePath: "group",
+		},
+		{
+			desc:                  "command without a repository",
+			namespaces:            []string{"group", "other"},
+			execCmd:               "discover",
+			expectedNamespacePath: "group",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			s := &session{execCmd: tc.execCmd, namespaces: tc.namespaces}
+
+			require.Equal(t, tc.expectedNamespacePath, s.commandEnv().NamespacePath)
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+// breakSignal is the signal a break request is treated as, like a break on a
+// serial console interrupts the program attached to it.
+const breakSignal = "INT"
+
+// signalNumbers are the numbers of the signals, named as in RFC 4254, that
+// cancel a running command. The command then exits with 128 plus the number,
+// like a process killed by the signal does in a shell.
+var signalNumbers = map[string]uint32{
+	"HUP":  1,
+	"INT":  2,
+	"QUIT": 3,
+	"KILL": 9,
+	"TERM": 15,
+}
+
+type signalRequest struct {
+	Signal string
+}
+
+// signalError is the cause of the cancellation of a command by a signal.
+type signalError struct {
+	signal string
+}
+
+func (e *signalError) Error() string {
+	return fmt.Sprintf("command canceled by signal %s", e.signal)
+}
+
+func (e *signalError) exitStatus() uint32 {
+	return 128 + signalNumbers[e.signal]
+}
+
+// canceledBySignal returns the signal that canceled ctx, if any.
+func canceledBySignal(ctx context.Context) *signalError {
+	var sigErr *signalError
+	if errors.As(context.Cause(ctx), &sigErr) {
+		return sigErr
+	}
+
+	return nil
+}
+
+// watchSignals handles the requests sent while the command of the session is
+// running. The signal and break requests cancel the context it returns, which
+// the command runs with, window-change requests resize the interactive shell,
+// and the other requests are refused. The first returned function returns
+// once the requests received so far are handled: crypto/ssh queues the
+// requests of a channel before the data sent after them is readable, so
+// calling it after reading input applies the window changes sent before that
+// input. Watching stops once the second returned function is called.
+func (s *session) watchSignals(ctx context.Context, requests <-chan *ssh.Request) (context.Context, func(), func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	syncs := make(chan chan struct{})
+
+	handle := func(req *ssh.Request) {
+		if req.Type == "window-change" {
+			s.handleWindowChange(ctx, req)
+			return
+		}
+
+		s.handleSignal(ctx, req, cancel)
+	}
+
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+			case synced := <-syncs:
+				drainRequests(requests, handle)
+				close(synced)
+			case req, ok := <-requests:
+				if !ok {
+					return
+				}
+
+				handle(req)
+			}
+		}
+	}()
+
+	sync := func() {
+		synced := make(chan struct{})
+		select {
+		case syncs <- synced:
+			<-synced
+		case <-stopped:
+		}
+	}
+
+	return ctx, sync, func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+}
+
+// drainRequests handles the requests already queued in requests, without
+// waiting for more.
+func drainRequests(requests <-chan *ssh.Request, handle func(*ssh.Request)) {
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				return
+			}
+
+			handle(req)
+		default:
+			return
+		}
+	}
+}
+
+func (s *session) handleSignal(ctx context.Context, req *ssh.Request, cancel context.CancelCauseFunc) {
+	var signal string
+	switch req.Type {
+	case "signal":
+		var sigReq signalRequest
+		if err := ssh.Unmarshal(req.Payload, &sigReq); err == nil {
+			signal = sigReq.Signal
+		}
+	case "break":
+		signal = breakSignal
+	}
+
+	_, ok := signalNumbers[signal]
+	if ok {
+		log.FromContext(ctx).InfoContext(ctx, "session: handleSignal: canceling command",
+			slog.String("type", req.Type),
+			slog.String("signal", signal),
+		)
+
+		cancel(&signalError{signal: signal})
+	}
+
+	if req.WantReply {
+		if err := req.Reply(ok, []byte{}); err != nil {
+			log.FromContext(ctx).DebugContext(ctx, "session: handleSignal: Failed to reply", log.ErrorMessage(err.Error()))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+func TestHandleShellCanceledBySignal(t *testing.T) {
+	testCases := []struct {
+		desc             string
+		req              *ssh.Request
+		expectedExitCode uint32
+	}{
+		{
+			desc:             "INT",
+			req:              &ssh.Request{Type: "signal", Payload: ssh.Marshal(signalRequest{Signal: "INT"})},
+			expectedExitCode: 130,
+		},
+		{
+			desc:             "TERM",
+			req:              &ssh.Request{Type: "signal", Payload: ssh.Marshal(signalRequest{Signal: "TERM"})},
+			expectedExitCode: 143,
+		},
+		{
+			desc:             "break",
+			req:              &ssh.Request{Type: "break", Payload: ssh.Marshal(struct{ Length uint32 }{Length: 500})},
+			expectedExitCode: 130,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			started := make(chan struct{})
+			canceled := make(chan struct{})
+
+			url := testserver.StartHTTPServer(t, []testserver.TestRequestHandler{
+				{
+					Path: "/api/v4/internal/discover",
+					Handler: func(_ http.ResponseWriter, r *http.Request) {
+						close(started)
+						<-r.Context().Done()
+						close(canceled)
+					},
+				},
+			})
+
+			stdErr := &bytes.Buffer{}
+			s := &session{
+				gitlabKeyID: rootUser,
+				execCmd:     discoverCmd,
+				channel:     &fakeChannel{stdErr: stdErr, stdOut: &bytes.Buffer{}},
+				cfg:         &config.Config{GitlabURL: url},
+			}
+
+			requests := make(chan *ssh.Request)
+			go func() {
+				<-started
+				requests <- tc.req
+			}()
+
+			_, exitCode, err := s.handleShell(context.Background(), &ssh.Request{}, requests)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedExitCode, exitCode)
+			require.Empty(t, stdErr.String())
+
+			// The request to GitLab is canceled with the command
+			select {
+			case <-canceled:
+			case <-time.After(2 * time.Second):
+				require.FailNow(t, "the request to GitLab wasn't canceled")
+			}
+		})
+	}
+}
+
+func TestWatchSignalsIgnoresOtherRequests(t *testing.T) {
+	s := &session{}
+	requests := make(chan *ssh.Request)
+
+	ctx, _, stop := s.watchSignals(context.Background(), requests)
+
+	requests <- &ssh.Request{Type: "signal", Payload: ssh.Marshal(signalRequest{Signal: "USR1"})}
+	requests <- &ssh.Request{Type: "signal", Payload: []byte("invalid")}
+	requests <- &ssh.Request{Type: "env", Payload: ssh.Marshal(envRequest{Name: "LANG", Value: "C"})}
+	require.NoError(t, ctx.Err())
+
+	stop()
+	require.Error(t, ctx.Err())
+	require.Nil(t, canceledBySignal(ctx))
+}
+
+func TestWatchSignalsStopsWhenRequestsClose(t *testing.T) {
+	s := &session{}
+	requests := make(chan *ssh.Request)
+
+	ctx, _, stop := s.watchSignals(context.Background(), requests)
+	close(requests)
+
+	// stop doesn't wait forever once the requests are done
+	stop()
+	require.Error(t, ctx.Err())
+}
+
+func TestWatchSignalsSync(t *testing.T) {
+	s := &session{}
+	requests := make(chan *ssh.Request, 2)
+
+	_, sync, stop := s.watchSignals(context.Background(), requests)
+
+	// The requests queued before sync are handled by the time it returns
+	requests <- &ssh.Request{Type: "window-change", Payload: ssh.Marshal(windowChangeRequest{Columns: 40})}
+	requests <- &ssh.Request{Type: "window-change", Payload: ssh.Marshal(windowChangeRequest{Columns: 60})}
+	sync()
+	require.Equal(t, uint32(60), s.ptyColumns.Load())
+
+	// sync doesn't wait forever once watching stopped
+	stop()
+	sync()
+}
+
+func TestSignalErrorExitStatus(t *testing.T) {
+	for signal, number := range signalNumbers {
+		sigErr := &signalError{signal: signal}
+		require.Equal(t, 128+number, sigErr.exitStatus())
+		require.Equal(t, "command canceled by signal "+signal, sigErr.Error())
+	}
+}
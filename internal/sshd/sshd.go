@@ -3,12 +3,14 @@ package sshd
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	proxyproto "github.com/pires/go-proxyproto"
@@ -54,20 +56,42 @@ type Server struct {
 	status       status
 	statusMu     sync.RWMutex
 	wg           sync.WaitGroup
-	listener     net.Listener
-	serverConfig *serverConfig
+	listeners    []*listener
+	webListener  net.Listener
+	serverConfig atomic.Pointer[serverConfig]
+	reloadMu     sync.Mutex
+	conns        map[*connection]struct{}
+	connsMu      sync.Mutex
+	authBans     *authBanList
+	envAllowlist *envAllowlist
+	nextConnID   atomic.Uint64
+
+	inheritOnce        sync.Once
+	inherited          []net.Listener
+	inheritedWeb       net.Listener
+	inheritedListenErr error
+
+	userBandwidth userBandwidthLimiters
 }
 
 type logInfo struct{}
 
 // NewServer creates a new instance of Server
 func NewServer(cfg *config.Config) (*Server, error) {
+	envAllowlist, err := newEnvAllowlist(cfg.Server.AcceptEnv)
+	if err != nil {
+		return nil, err
+	}
+
 	serverConfig, err := newServerConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Server{Config: cfg, serverConfig: serverConfig}, nil
+	s := &Server{Config: cfg, authBans: newAuthBanList(cfg.Server.AuthBans), envAllowlist: envAllowlist}
+	s.serverConfig.Store(serverConfig)
+
+	return s, nil
 }
 
 // ListenAndServe starts listening for SSH connections and serves them
@@ -75,33 +99,113 @@ func (s *Server) ListenAndServe(ctx context.Context) error {
 	if err := s.listen(ctx); err != nil {
 		return err
 	}
-	defer func() { _ = s.listener.Close() }()
+	defer func() { _ = s.closeListeners() }()
+
+	if interval := time.Duration(s.Config.Server.KeyReloadInterval); interval > 0 {
+		go s.watchKeyFiles(ctx, interval)
+	}
 
 	s.serve(ctx)
 
 	return nil
 }
 
-// Shutdown gracefully shuts down the SSH server
+// Shutdown gracefully shuts down the SSH server. New connections are refused,
+// and new channels on open connections are sent a notice instead of being
+// served, while the commands that are already running are left to complete.
 func (s *Server) Shutdown() error {
-	if s.listener == nil {
+	if len(s.getListeners()) == 0 {
 		return nil
 	}
 
 	s.changeStatus(StatusOnShutdown)
 
-	return s.listener.Close()
+	return s.closeListeners()
 }
 
-// Addr returns the listener's network address, or an empty string if not yet listening.
+// Addr returns the first listener's network address, or an empty string if not yet listening.
 func (s *Server) Addr() string {
+	listeners := s.getListeners()
+	if len(listeners) == 0 {
+		return ""
+	}
+
+	return listeners[0].Addr().String()
+}
+
+func (s *Server) getListeners() []*listener {
 	s.statusMu.RLock()
 	defer s.statusMu.RUnlock()
 
-	if s.listener == nil {
-		return ""
+	return s.listeners
+}
+
+func (s *Server) closeListeners() error {
+	var errs []error
+	for _, l := range s.getListeners() {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// MonitoringListener returns the listening socket of the monitoring endpoint
+// on web_listen. It's the one handed over by the previous process on upgrade
+// if there's one, so that the new process doesn't fail to bind the address the
+// previous process still listens on, and it's handed over in turn by Upgrade.
+func (s *Server) MonitoringListener(ctx context.Context) (net.Listener, error) {
+	_, webListener, err := s.inheritedListeners()
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for monitoring: %w", err)
+	}
+
+	if webListener != nil {
+		log.FromContext(ctx).InfoContext(ctx, "Using inherited monitoring listener", log.TCPAddress(webListener.Addr().String()))
+	} else if webListener, err = net.Listen("tcp", s.Config.Server.WebListen); err != nil {
+		return nil, fmt.Errorf("failed to listen for monitoring: %w", err)
+	}
+
+	s.statusMu.Lock()
+	s.webListener = webListener
+	s.statusMu.Unlock()
+
+	return webListener, nil
+}
+
+func (s *Server) getMonitoringListener() net.Listener {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+
+	return s.webListener
+}
+
+// closeMonitoringListener stops serving the monitoring endpoint once its
+// listening socket has been handed over to a new process.
+func (s *Server) closeMonitoringListener() {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	if s.webListener != nil {
+		_ = s.webListener.Close()
+		s.webListener = nil
 	}
-	return s.listener.Addr().String()
+}
+
+// inheritedListeners reads the listening sockets inherited by the process
+// once, for listen and MonitoringListener to share. The monitoring endpoint's
+// socket is closed if web_listen is no longer set.
+func (s *Server) inheritedListeners() ([]net.Listener, net.Listener, error) {
+	s.inheritOnce.Do(func() {
+		s.inherited, s.inheritedWeb, s.inheritedListenErr = inheritedListeners()
+		if s.inheritedWeb != nil && s.Config.Server.WebListen == "" {
+			_ = s.inheritedWeb.Close()
+			s.inheritedWeb = nil
+		}
+	})
+
+	return s.inherited, s.inheritedWeb, s.inheritedListenErr
 }
 
 // MonitoringServeMux returns the ServeMux for monitoring endpoints
@@ -120,50 +224,79 @@ func (s *Server) MonitoringServeMux() *http.ServeMux {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	mux.HandleFunc(flushAuthorizedKeysCachePath, s.requireAdminToken(s.serveFlushAuthorizedKeysCache))
+	mux.HandleFunc(authBansPath, s.requireAdminToken(s.serveAuthBans))
+	mux.HandleFunc(adminConnectionsPath, s.requireAdminToken(s.serveAdminConnections))
+	mux.HandleFunc(adminTerminatePath, s.requireAdminToken(s.serveAdminTerminate))
+
 	return mux
 }
 
 func (s *Server) listen(ctx context.Context) error {
-	sshListener, err := net.Listen("tcp", s.Config.Server.Listen)
+	listenerConfigs := s.Config.Server.ListenerConfigs()
+
+	inherited, _, err := s.inheritedListeners()
 	if err != nil {
 		return fmt.Errorf("failed to listen for connection: %w", err)
 	}
+	if len(inherited) > 0 && len(inherited) != len(listenerConfigs) {
+		closeAll(inherited)
+		return fmt.Errorf("failed to listen for connection: got %d inherited listeners for %d configured listeners",
+			len(inherited), len(listenerConfigs))
+	}
 
-	if s.Config.Server.ProxyProtocol {
-		policy, err := s.proxyPolicy()
-		if err != nil {
-			return fmt.Errorf("invalid policy configuration: %w", err)
-		}
+	if len(s.Config.Server.PublicKeyAlgorithms) > 0 {
+		ctx = log.AppendFields(ctx, slog.Any("supported_public_key_algorithms", s.Config.Server.PublicKeyAlgorithms))
+	}
 
-		sshListener = &proxyproto.Listener{
-			Listener:          sshListener,
-			ConnPolicy:        policy,
-			ReadHeaderTimeout: time.Duration(s.Config.Server.ProxyHeaderTimeout),
+	listeners := make([]*listener, 0, len(listenerConfigs))
+	for i, listenerConfig := range listenerConfigs {
+		var inheritedListener net.Listener
+		if len(inherited) > 0 {
+			inheritedListener = inherited[i]
 		}
 
-		ctx = log.AppendFields(ctx, log.TCPAddress(sshListener.Addr().String()))
-		log.FromContext(ctx).InfoContext(ctx, "Proxy protocol is enabled")
-	}
+		l, err := newListener(ctx, listenerConfig, inheritedListener)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			closeAll(inherited[min(i+1, len(inherited)):])
 
-	if len(s.serverConfig.cfg.Server.PublicKeyAlgorithms) > 0 {
-		ctx = log.AppendFields(ctx, slog.Any("supported_public_key_algorithms", s.serverConfig.cfg.Server.PublicKeyAlgorithms))
-	}
+			return err
+		}
 
-	log.FromContext(ctx).InfoContext(ctx, "Listening for SSH connections")
+		listeners = append(listeners, l)
+	}
 
-	s.listener = sshListener
+	s.statusMu.Lock()
+	s.listeners = listeners
+	s.statusMu.Unlock()
 
 	return nil
 }
 
 func (s *Server) serve(ctx context.Context) {
 	s.changeStatus(StatusReady)
+	notifyReady(ctx)
+
+	var accepting sync.WaitGroup
+	for _, l := range s.getListeners() {
+		accepting.Go(func() { s.acceptConnections(ctx, l) })
+	}
+	accepting.Wait()
 
+	s.wg.Wait()
+
+	s.changeStatus(StatusClosed)
+}
+
+func (s *Server) acceptConnections(ctx context.Context, l *listener) {
 	for {
-		nconn, err := s.listener.Accept()
+		nconn, err := l.Accept()
 		if err != nil {
 			if s.getStatus() == StatusOnShutdown {
-				break
+				return
 			}
 
 			log.FromContext(ctx).WarnContext(ctx, "Failed to accept connection", log.ErrorMessage(err.Error()))
@@ -171,12 +304,8 @@ func (s *Server) serve(ctx context.Context) {
 		}
 
 		s.wg.Add(1)
-		go s.handleConn(ctx, nconn)
+		go s.handleConn(ctx, l, nconn)
 	}
-
-	s.wg.Wait()
-
-	s.changeStatus(StatusClosed)
 }
 
 func (s *Server) changeStatus(st status) {
@@ -211,7 +340,7 @@ func contextWithValues(parent context.Context, nconn net.Conn) context.Context {
 	return ctx
 }
 
-func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
+func (s *Server) handleConn(ctx context.Context, l *listener, nconn net.Conn) {
 	defer s.wg.Done()
 
 	metrics.SshdConnectionsInFlight.Inc()
@@ -235,25 +364,30 @@ func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
 		}
 	}()
 
+	if !s.acceptsConn(ctx, remoteAddr) {
+		return
+	}
+
 	started := time.Now()
-	conn := newConnection(s.Config, nconn)
+	conn := s.newConnection(l, nconn)
+
+	s.trackConn(conn)
+	defer s.untrackConn(conn)
 
 	var ctxWithLogData context.Context
 
-	conn.handle(ctx, s.serverConfig.get(ctx, &conn.outcome), func(ctx context.Context, sconn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
-		session := &session{
-			cfg:                 s.Config,
-			channel:             channel,
-			gitlabKeyID:         sconn.Permissions.Extensions["key-id"],
-			gitlabKrb5Principal: sconn.Permissions.Extensions["krb5principal"],
-			gitlabUsername:      sconn.Permissions.Extensions[certPermUsername],
-			namespace:           sconn.Permissions.Extensions[certPermNamespace],
-			remoteAddr:          remoteAddr,
-			started:             time.Now(),
+	if s.Config.Server.GitChannel.Enabled {
+		conn.gitChannelHandler = func(ctx context.Context, sconn *ssh.ServerConn, channel ssh.Channel, req gitChannelRequest) error {
+			var err error
+			ctxWithLogData, err = s.newSession(conn, sconn, channel).handleGitChannel(ctx, req)
+
+			return err
 		}
+	}
 
+	conn.handle(ctx, s.connServerConfig(ctx, l, conn), func(ctx context.Context, sconn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) error {
 		var err error
-		ctxWithLogData, err = session.handle(ctx, requests)
+		ctxWithLogData, err = s.newSession(conn, sconn, channel).handle(ctx, requests)
 
 		return err
 	})
@@ -262,18 +396,77 @@ func (s *Server) handleConn(ctx context.Context, nconn net.Conn) {
 	log.FromContext(ctx).InfoContext(ctx, "access: finish",
 		log.DurationS(time.Since(started)),
 		slog.Int64("written_bytes", logData.WrittenBytes),
+		slog.Float64("throttled_s", logData.ThrottledDuration.Seconds()),
 		slog.Any("meta", logData.Meta),
 	)
 }
 
-func (s *Server) proxyPolicy() (proxyproto.ConnPolicyFunc, error) {
-	if len(s.Config.Server.ProxyAllowed) > 0 {
-		return proxyproto.ConnStrictWhiteListPolicy(s.Config.Server.ProxyAllowed)
+// acceptsConn reports whether a connection from remoteAddr passes the IP
+// filter and isn't from a banned address.
+func (s *Server) acceptsConn(ctx context.Context, remoteAddr string) bool {
+	return s.serverConfig.Load().ipFilter.acceptsConn(ctx, remoteAddr) && s.authBans.acceptsConn(ctx, remoteAddr)
+}
+
+// newConnection returns a connection accepted on l, with the settings of that
+// listener.
+func (s *Server) newConnection(l *listener, nconn net.Conn) *connection {
+	conn := newConnection(s.Config, nconn)
+	conn.id = s.nextConnID.Add(1)
+	conn.loginGraceTime = time.Duration(l.cfg.LoginGraceTime)
+	conn.draining = func() bool { return s.getStatus() == StatusOnShutdown }
+	// With PROXY protocol, the remote address is the one from the header.
+	conn.outcome.authBans = s.authBans
+	conn.outcome.ip = gitlabnet.ParseIP(conn.remoteAddr)
+	conn.outcome.disconnect = func() { _ = nconn.Close() }
+
+	return conn
+}
+
+// connServerConfig returns the SSH server config for a new connection, with
+// the rate limits of the listener it was accepted on. The server config is
+// captured once per connection, so a key reload only affects handshakes that
+// start after it.
+func (s *Server) connServerConfig(ctx context.Context, l *listener, conn *connection) *ssh.ServerConfig {
+	// With PROXY protocol, the remote address is the one from the header.
+	ip := gitlabnet.ParseIP(conn.remoteAddr)
+
+	sshCfg := s.serverConfig.Load().get(ctx, &conn.outcome)
+	limitIdentities(ctx, sshCfg, l.identityRateLimiter, &conn.outcome, ip)
+
+	if !l.ipRateLimiter.allow(ip) {
+		rejectRateLimited(ctx, sshCfg, ip)
+	}
+
+	return sshCfg
+}
+
+func (s *Server) newSession(conn *connection, sconn *ssh.ServerConn, channel ssh.Channel) *session {
+	return &session{
+		cfg:                 s.Config,
+		channel:             channel,
+		gitlabKeyID:         sconn.Permissions.Extensions["key-id"],
+		gitlabKrb5Principal: sconn.Permissions.Extensions["krb5principal"],
+		gitlabUsername:      sconn.Permissions.Extensions[certPermUsername],
+		namespaces:          certNamespaces(sconn.Permissions.Extensions),
+		certPolicy:          certPolicyFromExtensions(sconn.Permissions.Extensions),
+		userPresence:        userPresenceFromExtensions(sconn.Permissions.Extensions),
+		authorizedKeysCache: s.serverConfig.Load().authorizedKeysCache,
+		remoteAddr:          conn.remoteAddr,
+		conn:                conn,
+		userBandwidth:       &s.userBandwidth,
+		envAllowlist:        s.envAllowlist,
+		started:             time.Now(),
+	}
+}
+
+func proxyPolicy(cfg config.ListenerConfig) (proxyproto.ConnPolicyFunc, error) {
+	if len(cfg.ProxyAllowed) > 0 {
+		return proxyproto.ConnStrictWhiteListPolicy(cfg.ProxyAllowed)
 	}
 
 	// Set the Policy value based on config
 	// Values are taken from https://github.com/pires/go-proxyproto/blob/195fedcfbfc1be163f3a0d507fac1709e9d81fed/policy.go#L20
-	switch strings.ToLower(s.Config.Server.ProxyPolicy) {
+	switch strings.ToLower(cfg.ProxyPolicy) {
 	case proxyPolicyRequire:
 		return staticProxyPolicy(proxyproto.REQUIRE), nil
 	case proxyPolicyIgnore:
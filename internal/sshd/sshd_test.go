@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -48,7 +49,7 @@ func TestListenAndServe(t *testing.T) {
 	require.NoError(t, s.Shutdown())
 	verifyStatus(t, s, StatusOnShutdown)
 
-	holdSession(t, client)
+	requireDrainingNotice(t, client)
 
 	_, err = ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
 	require.Error(t, err)
@@ -334,6 +335,78 @@ func findJSONLogByMessage(t *testing.T, output []byte, msg string) map[string]an
 	return nil
 }
 
+func TestGitChannelSession(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{
+		GitChannel: config.GitChannelConfig{Enabled: true, ConcurrentChannelsLimit: 1},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	// The command is checked with GitLab like over a session
+	channel, requests, err := client.OpenChannel(gitChannelType, ssh.Marshal(gitChannelRequest{Command: "git-upload-pack group/project.git"}))
+	require.NoError(t, err)
+	defer channel.Close()
+
+	output, err := io.ReadAll(channel)
+	require.NoError(t, err)
+	require.Empty(t, output)
+
+	stderr, err := io.ReadAll(channel.Stderr())
+	require.NoError(t, err)
+	require.Contains(t, string(stderr), "Access denied")
+
+	req := <-requests
+	require.Equal(t, "exit-status", req.Type)
+	require.Equal(t, ssh.Marshal(exitStatusReq{ExitStatus: 1}), req.Payload)
+
+	// Sessions are accounted separately, so they're still available
+	holdSession(t, client)
+}
+
+func TestGitChannelDisabled(t *testing.T) {
+	s, testRoot := setupServer(t)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	_, _, err = client.OpenChannel(gitChannelType, ssh.Marshal(gitChannelRequest{Command: "git-upload-pack group/project.git"}))
+
+	var openErr *ssh.OpenChannelError
+	require.ErrorAs(t, err, &openErr)
+	require.Equal(t, ssh.UnknownChannelType, openErr.Reason)
+}
+
+func TestIPRateLimit(t *testing.T) {
+	cfg := &config.Config{Server: config.ServerConfig{
+		RateLimits: config.RateLimitsConfig{
+			PerIP: config.RateLimitConfig{Rate: 0.001, Burst: 1},
+		},
+	}}
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	var banner string
+	limitedConfig := clientConfig(t, testRoot)
+	limitedConfig.BannerCallback = func(message string) error {
+		banner = message
+		return nil
+	}
+
+	_, err = ssh.Dial("tcp", s.Addr(), limitedConfig)
+	require.Error(t, err)
+	require.Equal(t, rateLimitedMessage, banner)
+
+	// The connection established before the limit was hit is unaffected
+	holdSession(t, client)
+}
+
 func TestReadinessProbe(t *testing.T) {
 	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
 
@@ -366,6 +439,34 @@ func TestReadinessProbe(t *testing.T) {
 	res.Body.Close()
 }
 
+func TestFlushAuthorizedKeysCacheEndpoint(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "admin_token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(testAdminToken), 0600))
+
+	cfg := &config.Config{Server: config.DefaultServerConfig}
+	cfg.Server.AuthorizedKeysCache.Size = 10
+	cfg.Server.AdminTokenFile = tokenFile
+	s, _ := setupServerWithConfig(t, cfg)
+
+	cache := s.serverConfig.Load().authorizedKeysCache
+	cache.add("SHA256:key", nil, nil)
+
+	r := adminRequest(t, s, http.MethodPost, flushAuthorizedKeysCachePath, "")
+	require.Equal(t, http.StatusUnauthorized, r.Code)
+
+	r = adminRequest(t, s, http.MethodGet, flushAuthorizedKeysCachePath, testAdminToken)
+	require.Equal(t, http.StatusMethodNotAllowed, r.Code)
+
+	_, ok := cache.get("SHA256:key")
+	require.True(t, ok)
+
+	r = adminRequest(t, s, http.MethodPost, flushAuthorizedKeysCachePath, testAdminToken)
+	require.Equal(t, http.StatusNoContent, r.Code)
+
+	_, ok = cache.get("SHA256:key")
+	require.False(t, ok)
+}
+
 func TestLivenessProbe(t *testing.T) {
 	s := &Server{Config: &config.Config{Server: config.DefaultServerConfig}}
 	mux := s.MonitoringServeMux()
@@ -522,6 +623,12 @@ func setupServerWithContext(ctx context.Context, t *testing.T, cfg *config.Confi
 
 				fmt.Fprint(w, `{"id": 1000, "name": "Test User", "username": "test-user"}`)
 			},
+		}, {
+			Path: "/api/v4/internal/allowed",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, `{"message": "Access denied"}`)
+			},
 		},
 	}
 
@@ -0,0 +1,193 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/console"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	sessionTimeoutIdle        = "idle"
+	sessionTimeoutMaxDuration = "max_duration"
+
+	// sessionTimeoutExitStatus is reported for a command that was stopped by a
+	// session timeout. It's the status timeout(1) exits with.
+	sessionTimeoutExitStatus = 124
+)
+
+var errSessionTimeout = errors.New("session timed out")
+
+// timedChannel is a channel that stops once it has been idle, with no data
+// read or written, for longer than idleTimeout, or once it has been open for
+// longer than maxDuration. A zero duration disables the matching timeout.
+type timedChannel struct {
+	ssh.Channel
+
+	idleTimeout  time.Duration
+	maxDuration  time.Duration
+	started      time.Time
+	lastActivity atomic.Int64
+
+	// exited is set once an exit status has been sent, by the command or by a
+	// timeout, so that the client is sent only one.
+	exited   atomic.Bool
+	timedOut atomic.Bool
+}
+
+func newTimedChannel(channel ssh.Channel, idleTimeout, maxDuration time.Duration) *timedChannel {
+	t := &timedChannel{
+		Channel:     channel,
+		idleTimeout: idleTimeout,
+		maxDuration: maxDuration,
+		started:     time.Now(),
+	}
+	t.touch()
+
+	return t
+}
+
+func (t *timedChannel) touch() {
+	t.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (t *timedChannel) Read(data []byte) (int, error) {
+	n, err := t.Channel.Read(data)
+	if n > 0 {
+		t.touch()
+	}
+
+	return n, err
+}
+
+func (t *timedChannel) Write(data []byte) (int, error) {
+	n, err := t.Channel.Write(data)
+	if n > 0 {
+		t.touch()
+	}
+
+	return n, err
+}
+
+func (t *timedChannel) Stderr() io.ReadWriter {
+	return &timedStderr{ReadWriter: t.Channel.Stderr(), channel: t}
+}
+
+// SendRequest sends the exit status of the command, unless the channel has
+// already timed out and reported its own.
+func (t *timedChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
+	if (name == "exit-status" || name == "exit-signal") && !t.exited.CompareAndSwap(false, true) {
+		return false, nil
+	}
+
+	return t.Channel.SendRequest(name, wantReply, payload)
+}
+
+// expired returns why the channel has timed out, if it has, and otherwise
+// how long until it could.
+func (t *timedChannel) expired(now time.Time) (string, time.Duration) {
+	wait := time.Duration(-1)
+
+	if t.maxDuration > 0 {
+		remaining := t.started.Add(t.maxDuration).Sub(now)
+		if remaining <= 0 {
+			return sessionTimeoutMaxDuration, 0
+		}
+		wait = remaining
+	}
+
+	if t.idleTimeout > 0 {
+		remaining := time.Unix(0, t.lastActivity.Load()).Add(t.idleTimeout).Sub(now)
+		if remaining <= 0 {
+			return sessionTimeoutIdle, 0
+		}
+		if wait < 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+
+	return "", wait
+}
+
+// watch stops the channel once it times out, and then calls cancel so that
+// the command running on it stops too. It returns once ctx is done.
+func (t *timedChannel) watch(ctx context.Context, cancel context.CancelCauseFunc) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-timer.C:
+			reason, wait := t.expired(now)
+			if reason == "" {
+				timer.Reset(wait)
+				continue
+			}
+
+			if t.timeOut(ctx, reason) {
+				cancel(errSessionTimeout)
+			}
+
+			return
+		}
+	}
+}
+
+// timeOut tells the client why its session is being stopped, reports the
+// timeout exit status, and closes the channel. It returns false if the command
+// has already exited.
+func (t *timedChannel) timeOut(ctx context.Context, reason string) bool {
+	if !t.exited.CompareAndSwap(false, true) {
+		return false
+	}
+	t.timedOut.Store(true)
+
+	var message string
+	if reason == sessionTimeoutIdle {
+		message = fmt.Sprintf("Session timed out after %s without activity.", t.idleTimeout)
+	} else {
+		message = fmt.Sprintf("Session exceeded the maximum duration of %s.", t.maxDuration)
+	}
+
+	metrics.SshdSessionTimeoutsTotal.WithLabelValues(reason).Inc()
+	log.FromContext(ctx).InfoContext(ctx, "connection: serveChannel: session timed out",
+		slog.String("timeout", reason),
+		log.DurationS(time.Since(t.started)),
+	)
+
+	console.DisplayWarningMessage(message, t.Channel.Stderr())
+
+	_ = t.Channel.CloseWrite()
+	_, _ = t.Channel.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{ExitStatus: sessionTimeoutExitStatus}))
+	_ = t.Channel.Close()
+
+	return true
+}
+
+// timedStderr is the stderr stream of a timedChannel, which counts as
+// activity too.
+type timedStderr struct {
+	io.ReadWriter
+	channel *timedChannel
+}
+
+func (s *timedStderr) Write(data []byte) (int, error) {
+	n, err := s.ReadWriter.Write(data)
+	if n > 0 {
+		s.channel.touch()
+	}
+
+	return n, err
+}
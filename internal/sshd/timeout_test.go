@@ -0,0 +1,221 @@
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/metrics"
+)
+
+func TestTimedChannelExpired(t *testing.T) {
+	testCases := []struct {
+		desc           string
+		idleTimeout    time.Duration
+		maxDuration    time.Duration
+		idle           time.Duration
+		open           time.Duration
+		expectedReason string
+		expectedWait   time.Duration
+	}{
+		{desc: "active", idleTimeout: time.Minute, idle: 20 * time.Second, open: time.Hour, expectedWait: 40 * time.Second},
+		{desc: "idle", idleTimeout: time.Minute, idle: time.Minute, open: time.Hour, expectedReason: sessionTimeoutIdle},
+		{desc: "within max duration", maxDuration: time.Hour, open: 50 * time.Minute, expectedWait: 10 * time.Minute},
+		{desc: "over max duration", maxDuration: time.Hour, open: time.Hour, expectedReason: sessionTimeoutMaxDuration},
+		{desc: "both, idle first", idleTimeout: time.Minute, maxDuration: time.Hour, open: 30 * time.Minute, expectedWait: time.Minute},
+		{desc: "both, max duration first", idleTimeout: time.Minute, maxDuration: time.Hour, open: 59*time.Minute + 30*time.Second, expectedWait: 30 * time.Second},
+		{desc: "both, over max duration", idleTimeout: time.Minute, maxDuration: time.Hour, idle: 2 * time.Minute, open: 2 * time.Hour, expectedReason: sessionTimeoutMaxDuration},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			now := time.Now()
+
+			timed := newTimedChannel(&fakeChannel{}, tc.idleTimeout, tc.maxDuration)
+			timed.started = now.Add(-tc.open)
+			timed.lastActivity.Store(now.Add(-tc.idle).UnixNano())
+
+			reason, wait := timed.expired(now)
+			require.Equal(t, tc.expectedReason, reason)
+			require.Equal(t, tc.expectedWait, wait)
+		})
+	}
+}
+
+func TestTimedChannelActivity(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	timed := newTimedChannel(&fakeChannel{stdOut: stdout, stdErr: stderr}, time.Minute, 0)
+
+	timed.lastActivity.Store(0)
+	_, err := timed.Write([]byte("output"))
+	require.NoError(t, err)
+	require.NotZero(t, timed.lastActivity.Load())
+
+	timed.lastActivity.Store(0)
+	_, err = timed.Stderr().Write([]byte("error"))
+	require.NoError(t, err)
+	require.NotZero(t, timed.lastActivity.Load())
+
+	// Reading nothing isn't activity
+	timed.lastActivity.Store(0)
+	_, err = timed.Read(make([]byte, 1))
+	require.NoError(t, err)
+	require.Zero(t, timed.lastActivity.Load())
+
+	require.Equal(t, "output", stdout.String())
+	require.Equal(t, "error", stderr.String())
+}
+
+func TestTimedChannelTimeOut(t *testing.T) {
+	stderr := &bytes.Buffer{}
+	channel := &fakeChannel{stdErr: stderr}
+	timed := newTimedChannel(channel, time.Minute, 0)
+
+	before := testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(sessionTimeoutIdle))
+
+	require.True(t, timed.timeOut(context.Background(), sessionTimeoutIdle))
+	require.True(t, timed.timedOut.Load())
+	require.Equal(t, "remote: \nremote: ========================================================================\nremote: \n"+
+		"remote: Session timed out after 1m0s without activity.\nremote: \n"+
+		"remote: ========================================================================\nremote: \n", stderr.String())
+	require.Equal(t, "exit-status", channel.sentRequestName)
+	require.Equal(t, ssh.Marshal(exitStatusReq{ExitStatus: sessionTimeoutExitStatus}), channel.sentRequestPayload)
+	require.InDelta(t, before+1, testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(sessionTimeoutIdle)), 0.1)
+
+	// The exit status of the command that was stopped isn't sent
+	channel.sentRequestName = ""
+	sent, err := timed.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{ExitStatus: 1}))
+	require.NoError(t, err)
+	require.False(t, sent)
+	require.Empty(t, channel.sentRequestName)
+
+	// Other requests are
+	_, err = timed.SendRequest("keepalive@openssh.com", false, nil)
+	require.NoError(t, err)
+	require.Equal(t, "keepalive@openssh.com", channel.sentRequestName)
+}
+
+func TestTimedChannelTimeOutAfterExit(t *testing.T) {
+	channel := &fakeChannel{stdErr: &bytes.Buffer{}}
+	timed := newTimedChannel(channel, time.Minute, 0)
+
+	sent, err := timed.SendRequest("exit-status", false, ssh.Marshal(exitStatusReq{}))
+	require.NoError(t, err)
+	require.True(t, sent)
+
+	require.False(t, timed.timeOut(context.Background(), sessionTimeoutIdle))
+	require.False(t, timed.timedOut.Load())
+}
+
+func TestTimedChannelWatch(t *testing.T) {
+	timed := newTimedChannel(&fakeChannel{stdErr: &bytes.Buffer{}}, 0, 10*time.Millisecond)
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	timed.watch(ctx, cancel)
+
+	require.True(t, timed.timedOut.Load())
+	require.ErrorIs(t, context.Cause(ctx), errSessionTimeout)
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		idleTimeout     time.Duration
+		maxDuration     time.Duration
+		reason          string
+		expectedMessage string
+	}{
+		{
+			desc:            "idle",
+			idleTimeout:     100 * time.Millisecond,
+			reason:          sessionTimeoutIdle,
+			expectedMessage: "Session timed out after 100ms without activity.",
+		},
+		{
+			desc:            "max duration",
+			maxDuration:     100 * time.Millisecond,
+			reason:          sessionTimeoutMaxDuration,
+			expectedMessage: "Session exceeded the maximum duration of 100ms.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := &config.Config{}
+			cfg.Server.SessionIdleTimeout = config.YamlDuration(tc.idleTimeout)
+			cfg.Server.MaxSessionDuration = config.YamlDuration(tc.maxDuration)
+			s, testRoot := setupServerWithConfig(t, cfg)
+
+			client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+			require.NoError(t, err)
+			defer client.Close()
+
+			timeoutsBefore := testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(tc.reason))
+			errorsBefore := testutil.ToFloat64(metrics.SliSshdSessionsErrorsTotal)
+
+			// The session is opened, but no command is ever sent
+			channel, requests, err := client.OpenChannel(sessionChannelType, nil)
+			require.NoError(t, err)
+			defer channel.Close()
+
+			stderr, err := io.ReadAll(channel.Stderr())
+			require.NoError(t, err)
+			require.Contains(t, string(stderr), "remote: "+tc.expectedMessage+"\n")
+
+			req := <-requests
+			require.Equal(t, "exit-status", req.Type)
+			require.Equal(t, uint32(sessionTimeoutExitStatus), binary.BigEndian.Uint32(req.Payload))
+
+			_, err = channel.Read(make([]byte, 1))
+			require.ErrorIs(t, err, io.EOF)
+
+			require.Eventually(t, func() bool {
+				return testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(tc.reason)) == timeoutsBefore+1
+			}, 2*time.Second, time.Millisecond)
+			require.InDelta(t, errorsBefore, testutil.ToFloat64(metrics.SliSshdSessionsErrorsTotal), 0.1)
+
+			// The connection stays open for other sessions, once the slot of the
+			// session that timed out is released
+			require.Eventually(t, func() bool {
+				session, err := client.NewSession()
+				if err != nil {
+					return false
+				}
+				defer session.Close()
+
+				output, err := session.Output(discoverCmd)
+
+				return err == nil && string(output) == "Welcome to GitLab, @test-user!\n"
+			}, 2*time.Second, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestSessionIdleTimeoutWithActivity(t *testing.T) {
+	cfg := &config.Config{}
+	cfg.Server.SessionIdleTimeout = config.YamlDuration(time.Second)
+	s, testRoot := setupServerWithConfig(t, cfg)
+
+	client, err := ssh.Dial("tcp", s.Addr(), clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	timeoutsBefore := testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(sessionTimeoutIdle))
+
+	// Commands that complete within the timeout aren't affected
+	holdSession(t, client)
+	holdSession(t, client)
+
+	require.InDelta(t, timeoutsBefore, testutil.ToFloat64(metrics.SshdSessionTimeoutsTotal.WithLabelValues(sessionTimeoutIdle)), 0.1)
+}
@@ -0,0 +1,164 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/command/commandargs"
+)
+
+const (
+	// permTwoFactorRequired is the permissions extension recording that the
+	// user must pass two-factor authentication after their public key.
+	permTwoFactorRequired = "two-factor-required"
+
+	twoFactorInstruction = "Two-factor authentication is required."
+	twoFactorQuestion    = "OTP (leave blank to approve a push notification): "
+)
+
+var errTwoFactorAnswers = errors.New("expected one answer to the two-factor authentication prompt")
+
+// verifiedPublicKeyCallback returns the SSH VerifiedPublicKeyCallback. Once the
+// client has proven it holds a key whose owner must pass two-factor
+// authentication, it asks for the second factor with keyboard-interactive
+// authentication instead of completing authentication. The owner of a
+// certificate is only looked up then. Keys and certificates merely offered by
+// the client never trigger a lookup or a push notification.
+func (s *serverConfig) verifiedPublicKeyCallback(parentCtx context.Context, outcome *connOutcome) func(ssh.ConnMetadata, ssh.PublicKey, *ssh.Permissions, string) (*ssh.Permissions, error) {
+	return func(_ ssh.ConnMetadata, _ ssh.PublicKey, perms *ssh.Permissions, _ string) (*ssh.Permissions, error) {
+		if perms == nil {
+			return nil, nil
+		}
+
+		if _, ok := perms.Extensions[certPermUsername]; ok {
+			ctx, cancel := context.WithTimeout(parentCtx, 10*time.Second)
+			defer cancel()
+
+			// The permissions the certificate was accepted with are cached
+			// for the connection, so they're left untouched
+			perms = &ssh.Permissions{
+				CriticalOptions: perms.CriticalOptions,
+				Extensions:      maps.Clone(perms.Extensions),
+			}
+			if err := s.lookUpTwoFactor(ctx, perms); err != nil {
+				if outcome != nil {
+					outcome.observeAuth(ctx, err)
+				}
+
+				return nil, err
+			}
+		}
+
+		return s.requireSecondFactor(parentCtx, outcome, perms)
+	}
+}
+
+// requireSecondFactor returns perms if they don't record that the user must
+// pass two-factor authentication. Otherwise, it returns the partial success
+// asking for the second factor.
+func (s *serverConfig) requireSecondFactor(parentCtx context.Context, outcome *connOutcome, perms *ssh.Permissions) (*ssh.Permissions, error) {
+	if _, ok := perms.Extensions[permTwoFactorRequired]; !ok {
+		return perms, nil
+	}
+
+	verified := &ssh.Permissions{
+		CriticalOptions: perms.CriticalOptions,
+		Extensions:      maps.Clone(perms.Extensions),
+	}
+	delete(verified.Extensions, permTwoFactorRequired)
+
+	return nil, &ssh.PartialSuccessError{
+		Next: ssh.ServerAuthCallbacks{
+			KeyboardInteractiveCallback: s.twoFactorCallback(parentCtx, outcome, verified),
+		},
+	}
+}
+
+// lookUpTwoFactor records in perms whether the user authenticated with a
+// certificate or Kerberos must pass two-factor authentication. Unlike keys,
+// GitLab isn't asked about these when they're checked, so the user is looked
+// up with /discover, once the client has proven who they are. A failed lookup
+// fails authentication.
+func (s *serverConfig) lookUpTwoFactor(ctx context.Context, perms *ssh.Permissions) error {
+	if !s.cfg.Server.TwoFactor.Enabled {
+		return nil
+	}
+
+	res, err := s.discoverClient.GetByCommandArgs(ctx, twoFactorArgs(perms.Extensions))
+	if err != nil {
+		return fmt.Errorf("failed to look up two-factor authentication requirement: %w", err)
+	}
+	if res.TwoFactorRequired {
+		perms.Extensions[permTwoFactorRequired] = ""
+	}
+
+	return nil
+}
+
+// twoFactorArgs identifies the user authenticated with the permissions
+// extensions: by key, certificate username or Kerberos principal.
+func twoFactorArgs(extensions map[string]string) *commandargs.Shell {
+	return &commandargs.Shell{
+		GitlabKeyID:         extensions["key-id"],
+		GitlabUsername:      extensions[certPermUsername],
+		GitlabKrb5Principal: extensions["krb5principal"],
+	}
+}
+
+// twoFactorCallback returns the keyboard-interactive callback asking for the
+// second factor of the user authenticated with perms. An OTP is verified, and
+// a blank answer waits for the user to approve a push notification.
+func (s *serverConfig) twoFactorCallback(parentCtx context.Context, outcome *connOutcome, perms *ssh.Permissions) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	return func(_ ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+		ctx, cancel := context.WithTimeout(parentCtx, time.Duration(s.cfg.Server.TwoFactor.Timeout))
+		defer cancel()
+
+		err := s.verifySecondFactor(ctx, perms, challenge)
+		if err != nil {
+			log.FromContext(ctx).WarnContext(ctx, "two-factor authentication failed", log.ErrorMessage(err.Error()))
+		} else {
+			log.FromContext(ctx).InfoContext(ctx, "two-factor authentication succeeded")
+		}
+
+		if outcome != nil {
+			outcome.observeAuth(ctx, err)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return perms, nil
+	}
+}
+
+func (s *serverConfig) verifySecondFactor(ctx context.Context, perms *ssh.Permissions, challenge ssh.KeyboardInteractiveChallenge) error {
+	answers, err := challenge("", twoFactorInstruction, []string{twoFactorQuestion}, []bool{false})
+	if err != nil {
+		return err
+	}
+	if len(answers) != 1 {
+		return errTwoFactorAnswers
+	}
+
+	args := twoFactorArgs(perms.Extensions)
+
+	if otp := strings.TrimSpace(answers[0]); otp != "" {
+		log.FromContext(ctx).InfoContext(ctx, "verifying two-factor OTP")
+		return s.twoFactorClient.VerifyOTP(ctx, args, otp)
+	}
+
+	log.FromContext(ctx).InfoContext(ctx, "waiting for two-factor push approval",
+		slog.Duration("timeout", time.Duration(s.cfg.Server.TwoFactor.Timeout)))
+
+	return s.twoFactorClient.PushAuth(ctx, args)
+}
@@ -0,0 +1,366 @@
+package sshd
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/client/testserver"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/gitlabnet/twofactorverify"
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/testhelper"
+)
+
+const testOTP = "123456"
+
+func setupTwoFactor(t *testing.T, enabled, required bool) *serverConfig {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	readBody := func(r *http.Request) *twofactorverify.RequestBody {
+		b, err := io.ReadAll(r.Body)
+		defer r.Body.Close()
+		assert.NoError(t, err)
+
+		var requestBody *twofactorverify.RequestBody
+		assert.NoError(t, json.Unmarshal(b, &requestBody))
+		assert.Equal(t, "1", requestBody.KeyID)
+
+		return requestBody
+	}
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/authorized_keys",
+			Handler: func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprintf(w, `{"id": 1, "key": "key", "two_factor_required": %t}`, required)
+			},
+		},
+		{
+			Path: "/api/v4/internal/two_factor_manual_otp_check",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				if readBody(r).OTPAttempt == testOTP {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+				} else {
+					json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "message": "Invalid OTP"})
+				}
+			},
+		},
+		{
+			Path: "/api/v4/internal/two_factor_push_otp_check",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				readBody(r)
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+			},
+		},
+	}
+
+	srvCfg := config.ServerConfig{
+		HostKeyFiles: []string{path.Join(testRoot, "certs/valid/server.key")},
+		TwoFactor:    config.TwoFactorConfig{Enabled: enabled, Timeout: config.YamlDuration(time.Second)},
+	}
+
+	cfg, err := newServerConfig(&config.Config{
+		GitlabURL: testserver.StartSocketHTTPServer(t, requests),
+		User:      testUser,
+		Server:    srvCfg,
+	})
+	require.NoError(t, err)
+
+	return cfg
+}
+
+// authenticate runs the SSH authentication of a client answering the
+// keyboard-interactive prompts with answer, and returns the permissions of the
+// connection and the number of prompts.
+func authenticate(t *testing.T, cfg *serverConfig, answer string) (*ssh.Permissions, int, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	require.NoError(t, err)
+
+	prompts := 0
+	clientCfg := &ssh.ClientConfig{
+		User: testUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+			ssh.KeyboardInteractive(func(_, instruction string, questions []string, echos []bool) ([]string, error) {
+				prompts++
+				assert.Equal(t, twoFactorInstruction, instruction)
+				assert.Equal(t, []string{twoFactorQuestion}, questions)
+				assert.Equal(t, []bool{false}, echos)
+
+				return []string{answer}, nil
+			}),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint:gosec // the host key doesn't matter here
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	type result struct {
+		perms *ssh.Permissions
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		defer serverConn.Close()
+
+		sconn, _, _, err := ssh.NewServerConn(serverConn, cfg.get(context.Background(), nil))
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		resultCh <- result{perms: sconn.Permissions}
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer clientConn.Close()
+
+	_, _, _, clientErr := ssh.NewClientConn(clientConn, listener.Addr().String(), clientCfg)
+	if clientErr != nil {
+		clientConn.Close()
+	}
+
+	res := <-resultCh
+	if clientErr != nil {
+		return nil, prompts, clientErr
+	}
+
+	return res.perms, prompts, res.err
+}
+
+func TestTwoFactorAuthentication(t *testing.T) {
+	testCases := []struct {
+		desc            string
+		enabled         bool
+		required        bool
+		answer          string
+		expectedPrompts int
+		expectedErr     bool
+	}{
+		{
+			desc:            "OTP",
+			enabled:         true,
+			required:        true,
+			answer:          testOTP,
+			expectedPrompts: 1,
+		},
+		{
+			desc:            "OTP with surrounding spaces",
+			enabled:         true,
+			required:        true,
+			answer:          " " + testOTP + "\n",
+			expectedPrompts: 1,
+		},
+		{
+			desc:            "invalid OTP",
+			enabled:         true,
+			required:        true,
+			answer:          "654321",
+			expectedPrompts: 1,
+			expectedErr:     true,
+		},
+		{
+			desc:            "push approval",
+			enabled:         true,
+			required:        true,
+			expectedPrompts: 1,
+		},
+		{
+			desc:    "not required",
+			enabled: true,
+		},
+		{
+			desc:     "disabled",
+			required: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			cfg := setupTwoFactor(t, tc.enabled, tc.required)
+
+			perms, prompts, err := authenticate(t, cfg, tc.answer)
+			require.Equal(t, tc.expectedPrompts, prompts)
+
+			if tc.expectedErr {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, map[string]string{"key-id": "1"}, perms.Extensions)
+		})
+	}
+}
+
+func TestVerifiedPublicKeyCallback(t *testing.T) {
+	cfg := &serverConfig{}
+	callback := cfg.verifiedPublicKeyCallback(context.Background(), nil)
+
+	perms := &ssh.Permissions{Extensions: map[string]string{"key-id": "1"}}
+	verified, err := callback(nil, nil, perms, "")
+	require.NoError(t, err)
+	require.Same(t, perms, verified)
+
+	perms = &ssh.Permissions{Extensions: map[string]string{"key-id": "1", permTwoFactorRequired: ""}}
+	verified, err = callback(nil, nil, perms, "")
+	require.Nil(t, verified)
+
+	var partialSuccess *ssh.PartialSuccessError
+	require.ErrorAs(t, err, &partialSuccess)
+	require.NotNil(t, partialSuccess.Next.KeyboardInteractiveCallback)
+	require.Nil(t, partialSuccess.Next.PublicKeyCallback)
+	// The permissions the public key was accepted with are left untouched
+	require.Contains(t, perms.Extensions, permTwoFactorRequired)
+}
+
+func TestTwoFactorWithCertificateAndKerberos(t *testing.T) {
+	testRoot := testhelper.PrepareTestRootDir(t)
+
+	caSigner, caPubKey := createCAKeyPair(t)
+	caKeyFile := path.Join(testRoot, "ca.pub")
+	require.NoError(t, os.WriteFile(caKeyFile, ssh.MarshalAuthorizedKey(caPubKey), 0600))
+
+	requiredUsers := map[string]bool{"jane": true, "jane@EXAMPLE.COM": true}
+	var discoverCalls atomic.Int32
+
+	requests := []testserver.TestRequestHandler{
+		{
+			Path: "/api/v4/internal/discover",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				discoverCalls.Add(1)
+
+				user := r.URL.Query().Get("username") + r.URL.Query().Get("krb5principal")
+				if user == "broken" || user == "broken@EXAMPLE.COM" {
+					w.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+
+				fmt.Fprintf(w, `{"id": 2, "username": %q, "two_factor_required": %t}`, user, requiredUsers[user])
+			},
+		},
+		{
+			Path: "/api/v4/internal/two_factor_manual_otp_check",
+			Handler: func(w http.ResponseWriter, r *http.Request) {
+				var requestBody *twofactorverify.RequestBody
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&requestBody))
+				assert.Equal(t, int64(2), requestBody.UserID)
+
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": requestBody.OTPAttempt == testOTP})
+			},
+		},
+	}
+
+	cfg, err := newServerConfig(&config.Config{
+		GitlabURL: testserver.StartSocketHTTPServer(t, requests),
+		User:      testUser,
+		Server: config.ServerConfig{
+			HostKeyFiles:      []string{path.Join(testRoot, "certs/valid/server.key")},
+			TrustedUserCAKeys: []config.TrustedUserCAKeyConfig{{File: caKeyFile}},
+			TwoFactor:         config.TwoFactorConfig{Enabled: true, Timeout: config.YamlDuration(time.Second)},
+		},
+	})
+	require.NoError(t, err)
+
+	certLogin := func(username string) (*ssh.Permissions, error) {
+		cert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), username)
+		perms, err := cfg.publicKeyCallback(context.Background(), nil)(fakeConnMetadata{user: testUser}, cert)
+		if err != nil {
+			return nil, err
+		}
+
+		return cfg.verifiedPublicKeyCallback(context.Background(), nil)(nil, cert, perms, "")
+	}
+
+	// Certificates merely offered by the client, without a signature, aren't
+	// looked up
+	cert := userCertSignedByCA(t, caSigner, ssh.UserCert, time.Now().Add(time.Hour), "jane")
+	perms, err := cfg.publicKeyCallback(context.Background(), nil)(fakeConnMetadata{user: testUser}, cert)
+	require.NoError(t, err)
+	require.NotContains(t, perms.Extensions, permTwoFactorRequired)
+	require.Zero(t, discoverCalls.Load())
+
+	_, err = cfg.verifiedPublicKeyCallback(context.Background(), nil)(nil, cert, perms, "")
+	require.Error(t, err)
+	require.Equal(t, int32(1), discoverCalls.Load())
+	// The permissions the certificate was accepted with are left untouched
+	require.NotContains(t, perms.Extensions, permTwoFactorRequired)
+
+	kerberosLogin := func(username string) (*ssh.Permissions, error) {
+		return cfg.gssapiAllowLogin(context.Background(), nil)(fakeConnMetadata{user: testUser}, username+"@EXAMPLE.COM")
+	}
+
+	testCases := []struct {
+		desc               string
+		login              func(string) (*ssh.Permissions, error)
+		expectedExtensions map[string]string
+	}{
+		{
+			desc:               "certificate",
+			login:              certLogin,
+			expectedExtensions: map[string]string{certPermUsername: "jane", certPermNoPTY: ""},
+		},
+		{
+			desc:               "Kerberos",
+			login:              kerberosLogin,
+			expectedExtensions: map[string]string{"krb5principal": "jane@EXAMPLE.COM"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Users that must pass two-factor authentication are asked for it
+			_, err := tc.login("jane")
+
+			var partialSuccess *ssh.PartialSuccessError
+			require.ErrorAs(t, err, &partialSuccess)
+
+			callback := partialSuccess.Next.KeyboardInteractiveCallback
+			require.NotNil(t, callback)
+
+			_, err = callback(nil, func(_, _ string, _ []string, _ []bool) ([]string, error) {
+				return []string{"654321"}, nil
+			})
+			require.Error(t, err)
+
+			perms, err := callback(nil, func(_, _ string, _ []string, _ []bool) ([]string, error) {
+				return []string{testOTP}, nil
+			})
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedExtensions, perms.Extensions)
+
+			// Other users aren't
+			perms, err = tc.login("john")
+			require.NoError(t, err)
+			require.NotContains(t, perms.Extensions, permTwoFactorRequired)
+
+			// A failed lookup fails authentication
+			perms, err = tc.login("broken")
+			require.ErrorContains(t, err, "failed to look up two-factor authentication requirement")
+			require.Nil(t, perms)
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package sshd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"gitlab.com/gitlab-org/labkit/v2/log"
+)
+
+const (
+	// The systemd socket activation protocol, see sd_listen_fds(3)
+	systemdListenFDsEnv   = "LISTEN_FDS"
+	systemdListenPIDEnv   = "LISTEN_PID"
+	systemdListenNamesEnv = "LISTEN_FDNAMES"
+
+	// upgradeListenFDsEnv is set instead of LISTEN_FDS when the listening socket
+	// is handed over by a previous gitlab-sshd process: that process can't know
+	// the PID to put in LISTEN_PID before starting the new one.
+	upgradeListenFDsEnv = "GITLAB_SSHD_LISTEN_FDS"
+
+	// upgradeWebListenFDEnv is the file descriptor, among the ones counted in
+	// GITLAB_SSHD_LISTEN_FDS, of the monitoring endpoint's listening socket.
+	upgradeWebListenFDEnv = "GITLAB_SSHD_WEB_LISTEN_FD"
+
+	// upgradeReadyFDEnv is the file descriptor the new process writes to once it
+	// serves connections, so that the previous process knows it can stop.
+	upgradeReadyFDEnv = "GITLAB_SSHD_READY_FD"
+)
+
+// listenFDsStart is the first inherited file descriptor, after stdin, stdout
+// and stderr.
+var listenFDsStart = 3
+
+// UpgradeTimeout is how long a new process started by Upgrade is given to
+// start serving connections before it's killed.
+var UpgradeTimeout = time.Minute
+
+// inheritedListeners returns the listening sockets passed by systemd socket
+// activation or by a previous gitlab-sshd process, if any: the ones for SSH
+// connections, and the one for the monitoring endpoint, which only a previous
+// gitlab-sshd process passes. The environment variables are cleared so that
+// they don't leak into processes started later.
+func inheritedListeners() ([]net.Listener, net.Listener, error) {
+	count, err := inheritedFDCount()
+	webFD := os.Getenv(upgradeWebListenFDEnv)
+	defer func() {
+		for _, env := range []string{systemdListenFDsEnv, systemdListenPIDEnv, systemdListenNamesEnv, upgradeListenFDsEnv, upgradeWebListenFDEnv} {
+			_ = os.Unsetenv(env)
+		}
+	}()
+	if err != nil || count == 0 {
+		return nil, nil, err
+	}
+
+	webListenerFD := -1
+	if webFD != "" && os.Getenv(upgradeListenFDsEnv) != "" {
+		webListenerFD, err = strconv.Atoi(webFD)
+		if err != nil || webListenerFD < listenFDsStart || webListenerFD >= listenFDsStart+count {
+			return nil, nil, fmt.Errorf("invalid %s value %q", upgradeWebListenFDEnv, webFD)
+		}
+	}
+
+	var listeners []net.Listener
+	var webListener net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+count; fd++ {
+		file := os.NewFile(uintptr(fd), "listener-"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		_ = file.Close()
+		if err != nil {
+			closeAll(listeners)
+			if webListener != nil {
+				_ = webListener.Close()
+			}
+			return nil, nil, fmt.Errorf("inherited file descriptor %d is not a listening socket: %w", fd, err)
+		}
+
+		if fd == webListenerFD {
+			webListener = listener
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	return listeners, webListener, nil
+}
+
+func inheritedFDCount() (int, error) {
+	if fds := os.Getenv(upgradeListenFDsEnv); fds != "" {
+		return parseFDCount(upgradeListenFDsEnv, fds)
+	}
+
+	fds := os.Getenv(systemdListenFDsEnv)
+	if fds == "" {
+		return 0, nil
+	}
+
+	// The sockets were passed to another process, which started this one
+	if os.Getenv(systemdListenPIDEnv) != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+
+	return parseFDCount(systemdListenFDsEnv, fds)
+}
+
+func parseFDCount(env, value string) (int, error) {
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid %s value %q", env, value)
+	}
+
+	return count, nil
+}
+
+// notifyReady tells the process that handed the listening socket over that
+// this one is serving connections.
+func notifyReady(ctx context.Context) {
+	fdValue := os.Getenv(upgradeReadyFDEnv)
+	if fdValue == "" {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyFDEnv)
+
+	fd, err := strconv.Atoi(fdValue)
+	if err != nil {
+		log.FromContext(ctx).WarnContext(ctx, "Invalid upgrade readiness file descriptor", slog.String("fd", fdValue))
+		return
+	}
+
+	ready := os.NewFile(uintptr(fd), "ready")
+	defer func() { _ = ready.Close() }()
+
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.FromContext(ctx).WarnContext(ctx, "Failed to notify the previous process", log.ErrorMessage(err.Error()))
+	}
+}
+
+// Upgrade starts a new gitlab-sshd process with the same executable and
+// arguments, hands the listening sockets over to it, including the monitoring
+// endpoint's one, and waits until it serves connections. The sockets are never
+// closed in the meantime, so connections are queued rather than refused while
+// the new process starts. Once the new process is ready, the monitoring
+// endpoint's socket is closed, so that it's served by the new process alone.
+// Once Upgrade succeeds, this process should be shut down; if it fails, it
+// keeps serving.
+func (s *Server) Upgrade(ctx context.Context) error {
+	listeners := s.getListeners()
+	if len(listeners) == 0 {
+		return errors.New("server isn't listening")
+	}
+
+	listenerFiles, env, err := s.upgradeFiles(listeners)
+	defer func() {
+		for _, file := range listenerFiles {
+			_ = file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer func() { _ = ready.Close() }()
+
+	executable, err := os.Executable()
+	if err != nil {
+		_ = readyWriter.Close()
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...) //nolint:gosec // re-executes the running binary with its own arguments
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(listenerFiles, readyWriter)
+	cmd.Env = append(append(os.Environ(), env...),
+		upgradeReadyFDEnv+"="+strconv.Itoa(listenFDsStart+len(listenerFiles)),
+	)
+
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	ctx = log.AppendFields(ctx, slog.Int("pid", cmd.Process.Pid))
+	log.FromContext(ctx).InfoContext(ctx, "Started new process, waiting for it to be ready")
+
+	// Reap the new process if it exits before this one
+	go func() { _ = cmd.Wait() }()
+
+	if err := waitReady(ctx, ready); err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process failed to start: %w", err)
+	}
+
+	for _, l := range listeners {
+		l.keepSocketFile()
+	}
+	s.closeMonitoringListener()
+
+	log.FromContext(ctx).InfoContext(ctx, "New process is ready")
+
+	return nil
+}
+
+// upgradeFiles returns duplicates of the listening sockets to hand over to a
+// new process, in the order they're inherited in, and the environment
+// variables that describe them.
+func (s *Server) upgradeFiles(listeners []*listener) ([]*os.File, []string, error) {
+	files := make([]*os.File, 0, len(listeners)+1)
+	for _, l := range listeners {
+		file, err := l.file()
+		if err != nil {
+			return files, nil, err
+		}
+
+		files = append(files, file)
+	}
+
+	var env []string
+	if webListener := s.getMonitoringListener(); webListener != nil {
+		filer, ok := webListener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return files, nil, fmt.Errorf("monitoring listener %s can't be handed over", webListener.Addr())
+		}
+
+		file, err := filer.File()
+		if err != nil {
+			return files, nil, err
+		}
+
+		env = append(env, upgradeWebListenFDEnv+"="+strconv.Itoa(listenFDsStart+len(files)))
+		files = append(files, file)
+	}
+
+	return files, append(env, upgradeListenFDsEnv+"="+strconv.Itoa(len(files))), nil
+}
+
+// waitReady waits for the new process to write to the readiness pipe. If it
+// exits first, the pipe is closed without anything written to it.
+func waitReady(ctx context.Context, ready *os.File) error {
+	readyErr := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		readyErr <- err
+	}()
+
+	select {
+	case err := <-readyErr:
+		if errors.Is(err, io.EOF) {
+			return errors.New("exited before serving connections")
+		}
+		return err
+	case <-time.After(UpgradeTimeout):
+		return errors.New("timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,238 @@
+package sshd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"gitlab.com/gitlab-org/gitlab-shell/v14/internal/config"
+)
+
+// inheritableListener returns the address of a new listening socket, and a
+// duplicate of its file descriptor for inheritedListeners to take over.
+func inheritableListener(t *testing.T) (string, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	file, err := listener.(*net.TCPListener).File()
+	require.NoError(t, err)
+	defer file.Close()
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+
+	return listener.Addr().String(), fd
+}
+
+func setListenFDsStart(t *testing.T, fd int) {
+	t.Helper()
+
+	start := listenFDsStart
+	t.Cleanup(func() { listenFDsStart = start })
+	listenFDsStart = fd
+}
+
+func TestInheritedListeners(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		env      map[string]string
+		expected bool
+	}{
+		{
+			desc:     "systemd socket activation",
+			env:      map[string]string{systemdListenFDsEnv: "1", systemdListenPIDEnv: strconv.Itoa(os.Getpid())},
+			expected: true,
+		},
+		{
+			desc: "systemd socket activation for another process",
+			env:  map[string]string{systemdListenFDsEnv: "1", systemdListenPIDEnv: "1"},
+		},
+		{
+			desc:     "handoff from a previous process",
+			env:      map[string]string{upgradeListenFDsEnv: "1"},
+			expected: true,
+		},
+		{
+			desc: "no inherited sockets",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			addr, fd := inheritableListener(t)
+			setListenFDsStart(t, fd)
+
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+
+			listeners, webListener, err := inheritedListeners()
+			require.NoError(t, err)
+			require.Nil(t, webListener)
+
+			if tc.expected {
+				require.Len(t, listeners, 1)
+				require.Equal(t, addr, listeners[0].Addr().String())
+				require.NoError(t, listeners[0].Close())
+			} else {
+				require.Empty(t, listeners)
+				require.NoError(t, syscall.Close(fd))
+			}
+
+			for name := range tc.env {
+				require.Empty(t, os.Getenv(name))
+			}
+		})
+	}
+}
+
+func TestInheritedListenersErrors(t *testing.T) {
+	t.Setenv(upgradeListenFDsEnv, "one")
+
+	_, _, err := inheritedListeners()
+	require.EqualError(t, err, `invalid GITLAB_SSHD_LISTEN_FDS value "one"`)
+
+	setListenFDsStart(t, 3)
+	t.Setenv(upgradeListenFDsEnv, "1")
+	t.Setenv(upgradeWebListenFDEnv, "4")
+
+	_, _, err = inheritedListeners()
+	require.EqualError(t, err, `invalid GITLAB_SSHD_WEB_LISTEN_FD value "4"`)
+
+	file, err := os.CreateTemp(t.TempDir(), "not-a-socket")
+	require.NoError(t, err)
+	defer file.Close()
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	require.NoError(t, err)
+	setListenFDsStart(t, fd)
+	t.Setenv(upgradeListenFDsEnv, "1")
+
+	_, _, err = inheritedListeners()
+	require.ErrorContains(t, err, "inherited file descriptor "+strconv.Itoa(fd)+" is not a listening socket")
+}
+
+func TestListenAndServeWithInheritedListener(t *testing.T) {
+	addr, fd := inheritableListener(t)
+	setListenFDsStart(t, fd)
+	t.Setenv(upgradeListenFDsEnv, "1")
+
+	s, testRoot := setupServer(t)
+	require.Equal(t, addr, s.Addr())
+
+	client, err := ssh.Dial("tcp", addr, clientConfig(t, testRoot))
+	require.NoError(t, err)
+	defer client.Close()
+
+	holdSession(t, client)
+}
+
+func TestNotifyReady(t *testing.T) {
+	ready, readyWriter, err := os.Pipe()
+	require.NoError(t, err)
+	defer ready.Close()
+
+	fd, err := syscall.Dup(int(readyWriter.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, readyWriter.Close())
+
+	t.Setenv(upgradeReadyFDEnv, strconv.Itoa(fd))
+	notifyReady(context.Background())
+	require.Empty(t, os.Getenv(upgradeReadyFDEnv))
+
+	require.NoError(t, waitReady(context.Background(), ready))
+}
+
+func TestWaitReadyProcessExited(t *testing.T) {
+	ready, readyWriter, err := os.Pipe()
+	require.NoError(t, err)
+	defer ready.Close()
+
+	require.NoError(t, readyWriter.Close())
+
+	require.EqualError(t, waitReady(context.Background(), ready), "exited before serving connections")
+}
+
+func TestUpgradeNotListening(t *testing.T) {
+	s := &Server{}
+
+	require.EqualError(t, s.Upgrade(context.Background()), "server isn't listening")
+}
+
+// dupFDFrom duplicates fd onto the lowest free file descriptor from minFD.
+func dupFDFrom(t *testing.T, fd uintptr, minFD int) int {
+	t.Helper()
+
+	newFD, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, syscall.F_DUPFD, uintptr(minFD))
+	require.Zero(t, errno)
+
+	return int(newFD)
+}
+
+func TestUpgradeHandsMonitoringListenerOver(t *testing.T) {
+	s, _ := setupServerWithConfig(t, &config.Config{Server: config.ServerConfig{WebListen: "127.0.0.1:0"}})
+
+	webListener, err := s.MonitoringListener(context.Background())
+	require.NoError(t, err)
+
+	// The new process inherits the sockets from the file descriptor 1000
+	setListenFDsStart(t, 1000)
+
+	files, env, err := s.upgradeFiles(s.getListeners())
+	require.NoError(t, err)
+	require.Equal(t, []string{upgradeWebListenFDEnv + "=1001", upgradeListenFDsEnv + "=2"}, env)
+
+	for i, file := range files {
+		require.Equal(t, 1000+i, dupFDFrom(t, file.Fd(), 1000+i))
+		require.NoError(t, file.Close())
+	}
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		t.Setenv(name, value)
+	}
+
+	// The new process serves the monitoring endpoint on the same address
+	// while the previous one still listens on it
+	newServer, err := NewServer(s.Config)
+	require.NoError(t, err)
+
+	newWebListener, err := newServer.MonitoringListener(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, webListener.Addr().String(), newWebListener.Addr().String())
+
+	go func() {
+		_ = http.Serve(newWebListener, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { //nolint:gosec // test server
+			_, _ = w.Write([]byte("new process"))
+		}))
+	}()
+	defer newServer.closeMonitoringListener()
+
+	go func() { _ = newServer.ListenAndServe(context.Background()) }()
+	defer func() { _ = newServer.Shutdown() }()
+	verifyStatus(t, newServer, StatusReady)
+	require.Equal(t, s.Addr(), newServer.Addr())
+
+	// Once the new process is ready, only it serves the monitoring endpoint
+	s.closeMonitoringListener()
+	require.Nil(t, s.getMonitoringListener())
+
+	resp, err := http.Get("http://" + webListener.Addr().String()) //nolint:noctx // test request
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "new process", string(body))
+}
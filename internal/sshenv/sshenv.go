@@ -3,6 +3,7 @@ package sshenv
 
 import (
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -13,8 +14,15 @@ const (
 	SSHConnectionEnv = "SSH_CONNECTION"
 	// SSHOriginalCommandEnv defines the ENV containing the original SSH command
 	SSHOriginalCommandEnv = "SSH_ORIGINAL_COMMAND"
+	// OutputFormatEnv defines the ENV selecting the output format of the
+	// informational commands
+	OutputFormatEnv = "GL_OUTPUT_FORMAT"
 )
 
+// gitalyMetadataPrefix prefixes the Gitaly metadata keys of the variables
+// forwarded to Gitaly.
+const gitalyMetadataPrefix = "ssh-env-"
+
 // Env represents the SSH environment variables
 type Env struct {
 	GitProtocolVersion string
@@ -22,6 +30,82 @@ type Env struct {
 	OriginalCommand    string
 	RemoteAddr         string
 	NamespacePath      string
+	OutputFormat       string
+	// AllowedCommands, ReadOnly, and AllowedProjects narrow what the SSH
+	// certificate the connection is authenticated with allows: the commands
+	// run, read access only, and the projects accessed. No commands or
+	// projects allows them all.
+	AllowedCommands []string
+	ReadOnly        bool
+	AllowedProjects []string
+	// SecurityKeyUserPresence is set when the connection is authenticated
+	// with a security key whose signature asserted that the user touched it,
+	// and PushRequiresUserPresence refuses pushes otherwise.
+	SecurityKeyUserPresence  bool
+	PushRequiresUserPresence bool
+	// Variables are the other environment variables sent by the client that
+	// gitlab-sshd accepts.
+	Variables []Variable
+}
+
+// Variable is an environment variable sent by an SSH client. Gitaly and API
+// tell whether it's passed on as Gitaly metadata and to the internal API.
+type Variable struct {
+	Name   string
+	Value  string
+	Gitaly bool
+	API    bool
+}
+
+// GitalyMetadata returns the variables passed on to Gitaly, keyed by their
+// metadata key: the lowercase name prefixed with ssh-env-.
+func (e Env) GitalyMetadata() map[string]string {
+	md := make(map[string]string)
+	for _, v := range e.Variables {
+		if v.Gitaly {
+			md[gitalyMetadataPrefix+strings.ToLower(v.Name)] = v.Value
+		}
+	}
+
+	return md
+}
+
+// APIVariables returns the variables passed on to the internal API, keyed by
+// name, or nil if there are none.
+func (e Env) APIVariables() map[string]string {
+	var vars map[string]string
+	for _, v := range e.Variables {
+		if !v.API {
+			continue
+		}
+
+		if vars == nil {
+			vars = make(map[string]string)
+		}
+		vars[v.Name] = v.Value
+	}
+
+	return vars
+}
+
+// AllowsCommand reports whether command can be run.
+func (e Env) AllowsCommand(command string) bool {
+	return len(e.AllowedCommands) == 0 || slices.Contains(e.AllowedCommands, command)
+}
+
+// AllowsProject reports whether the project at repo, as passed to the Git
+// commands, can be accessed. Paths are compared case-insensitively, without
+// their leading slash and .git suffix.
+func (e Env) AllowsProject(repo string) bool {
+	if len(e.AllowedProjects) == 0 {
+		return true
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(repo, "/"), ".git")
+
+	return slices.ContainsFunc(e.AllowedProjects, func(project string) bool {
+		return strings.EqualFold(project, path)
+	})
 }
 
 // NewFromEnv creates a new Env instance based on the current environment variables
@@ -36,6 +120,7 @@ func NewFromEnv() Env {
 		IsSSHConnection:    isSSHConnection,
 		RemoteAddr:         remoteAddrFromEnv(),
 		OriginalCommand:    os.Getenv(SSHOriginalCommandEnv),
+		OutputFormat:       os.Getenv(OutputFormatEnv),
 	}
 }
 
@@ -48,3 +48,46 @@ func TestRemoteAddrFromEnv(t *testing.T) {
 func TestEmptyRemoteAddrFromEnv(t *testing.T) {
 	require.Empty(t, remoteAddrFromEnv())
 }
+
+func TestForwardedVariables(t *testing.T) {
+	env := Env{
+		Variables: []Variable{
+			{Name: "GIT_TRACE2_PARENT_SID", Value: "sid", Gitaly: true},
+			{Name: "GL_OPTION_CI_SKIP", Value: "true", API: true},
+			{Name: "CORRELATION_ID", Value: "abc", Gitaly: true, API: true},
+			{Name: "DEBUG", Value: "1"},
+		},
+	}
+
+	require.Equal(t, map[string]string{
+		"ssh-env-git_trace2_parent_sid": "sid",
+		"ssh-env-correlation_id":        "abc",
+	}, env.GitalyMetadata())
+	require.Equal(t, map[string]string{
+		"GL_OPTION_CI_SKIP": "true",
+		"CORRELATION_ID":    "abc",
+	}, env.APIVariables())
+
+	require.Empty(t, Env{}.GitalyMetadata())
+	require.Nil(t, Env{}.APIVariables())
+}
+
+func TestAllowsCommand(t *testing.T) {
+	require.True(t, Env{}.AllowsCommand("git-receive-pack"))
+
+	env := Env{AllowedCommands: []string{"git-upload-pack", "git-upload-archive"}}
+	require.True(t, env.AllowsCommand("git-upload-pack"))
+	require.False(t, env.AllowsCommand("git-receive-pack"))
+}
+
+func TestAllowsProject(t *testing.T) {
+	require.True(t, Env{}.AllowsProject("group/project"))
+
+	env := Env{AllowedProjects: []string{"group/project", "group/sub/other"}}
+	for _, repo := range []string{"group/project", "/group/project.git", "Group/Project", "group/sub/other.git"} {
+		require.True(t, env.AllowsProject(repo), repo)
+	}
+	for _, repo := range []string{"group/project2", "group", "other/project", "group/sub/other.wiki"} {
+		require.False(t, env.AllowsProject(repo), repo)
+	}
+}